@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Anchoring the chain to an external blockchain or transparency log, for tamper-evidence which
+ * doesn't depend on the signatories: even if all of them collude to rewrite the chain, the old
+ * tip hashes stay published elsewhere. With anchor_backend, the node publishes its tip hash
+ * every anchor_interval, if the chain has grown, and gets back a reference to the anchor, e.g.
+ * a transaction ID or a log entry's URL. The backends are:
+ *
+ *   http    - POSTs {"chain": <genesis hash>, "height": <height>, "hash": <block hash>} to the
+ *             anchor_target URL, e.g. a transparency log's submission endpoint or an adapter
+ *             for it, which responds with {"ref": <reference>}
+ *   command - runs the anchor_target command with the block hash, the height and the genesis
+ *             hash as the arguments, e.g. a script which puts the hash into a Bitcoin OP_RETURN
+ *             output; its output is the reference
+ *
+ * The anchors are kept in the anchors table of the main database, and the pending ones are
+ * recorded in the Anchors _meta of the next block the node signs, so the references become
+ * part of the chain. The nodes check that the anchored hashes are the hashes of the earlier
+ * blocks in their chain, but not the external anchors themselves, which are for the auditors.
+ */
+
+// The _meta key of the anchor references recorded in a block
+const blockMetaAnchors = "Anchors"
+
+// The maximum size of the Anchors _meta
+const anchorsMaxMetaSize = 4096
+
+// The maximum length of an anchor reference
+const anchorMaxRefLength = 512
+
+// The time between the anchors, if anchor_interval isn't configured
+const anchorDefaultInterval = 24 * time.Hour
+
+// How long to wait for the backend
+const anchorTimeout = 60 * time.Second
+
+const anchorsTableCreate = `
+CREATE TABLE anchors (
+	backend			VARCHAR NOT NULL,
+	ref			VARCHAR NOT NULL, -- Returned by the backend
+	height			INTEGER NOT NULL, -- The anchored block
+	hash			VARCHAR NOT NULL,
+	time_published		INTEGER NOT NULL,
+	block_height		INTEGER, -- The block recording the anchor, NULL while it's pending
+	PRIMARY KEY (backend, ref)
+);
+`
+
+// blockAnchor is a reference to an anchor of a block's hash in an external chain or log
+type blockAnchor struct {
+	Backend string `json:"backend"`
+	Height  int    `json:"height"`
+	Hash    string `json:"hash"`
+	Ref     string `json:"ref"`
+}
+
+// anchorBackend publishes block hashes to an external chain or log
+type anchorBackend interface {
+	name() string
+	publish(height int, hash string) (string, error) // Returns the reference to the anchor
+}
+
+// The anchor backends, by name, created with the anchor_target
+var anchorBackends = map[string]func(node *Node, target string) anchorBackend{
+	"http": func(node *Node, target string) anchorBackend { return anchorBackendHTTP{node: node, url: target} },
+	"command": func(node *Node, target string) anchorBackend {
+		return anchorBackendCommand{node: node, command: target}
+	},
+}
+
+type anchorBackendHTTP struct {
+	url  string
+	node *Node
+}
+
+func (anchorBackendHTTP) name() string { return "http" }
+
+func (a anchorBackendHTTP) publish(height int, hash string) (string, error) {
+	body := jsonifyWhateverToBytes(StrIfMap{"chain": a.node.chainParams.GenesisBlockHash, "height": height, "hash": hash})
+	client := http.Client{Timeout: anchorTimeout}
+	resp, err := client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("HTTP status %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var result struct {
+		Ref string `json:"ref"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	return result.Ref, nil
+}
+
+type anchorBackendCommand struct {
+	command string
+	node    *Node
+}
+
+func (anchorBackendCommand) name() string { return "command" }
+
+func (a anchorBackendCommand) publish(height int, hash string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), anchorTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.command, hash, strconv.Itoa(height), a.node.chainParams.GenesisBlockHash)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", a.command, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Returns the configured anchor backend, or nil if anchoring isn't configured
+func (node *Node) anchorGetBackend() (anchorBackend, error) {
+	if node.cfg.AnchorBackend == "" {
+		return nil, nil
+	}
+	newBackend, ok := anchorBackends[node.cfg.AnchorBackend]
+	if !ok {
+		return nil, fmt.Errorf("unknown anchor backend %s", strconv.Quote(node.cfg.AnchorBackend))
+	}
+	if node.cfg.AnchorTarget == "" {
+		return nil, fmt.Errorf("the %s anchor backend needs anchor_target", node.cfg.AnchorBackend)
+	}
+	return newBackend(node, node.cfg.AnchorTarget), nil
+}
+
+// Returns the time between the anchors
+func (node *Node) anchorGetInterval() (time.Duration, error) {
+	if node.cfg.AnchorInterval == "" {
+		return anchorDefaultInterval, nil
+	}
+	interval, err := time.ParseDuration(node.cfg.AnchorInterval)
+	if err != nil {
+		return 0, err
+	}
+	if interval < time.Minute {
+		return 0, fmt.Errorf("must be at least a minute")
+	}
+	return interval, nil
+}
+
+// Records a published anchor
+func (node *Node) dbInsertAnchor(a *blockAnchor) error {
+	_, err := node.mainDb.Exec("INSERT INTO anchors(backend, ref, height, hash, time_published) VALUES (?, ?, ?, ?, ?)",
+		a.Backend, a.Ref, a.Height, a.Hash, time.Now().Unix())
+	return err
+}
+
+// Returns true if the block hash has already been anchored with the backend
+func (node *Node) dbIsAnchored(backend string, hash string) (bool, error) {
+	var count int
+	err := node.mainDb.QueryRow("SELECT COUNT(*) FROM anchors WHERE backend=? AND hash=?", backend, hash).Scan(&count)
+	return count > 0, err
+}
+
+// Returns the anchors which haven't been recorded in a block yet, of the blocks which are still
+// in the chain
+func (node *Node) dbGetPendingAnchors() ([]blockAnchor, error) {
+	rows, err := node.mainDb.Query(`SELECT a.backend, a.height, a.hash, a.ref FROM anchors a JOIN blockchain b ON b.height=a.height AND b.hash=a.hash
+		WHERE a.block_height IS NULL ORDER BY a.height, a.backend`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var anchors []blockAnchor
+	for rows.Next() {
+		var a blockAnchor
+		if err = rows.Scan(&a.Backend, &a.Height, &a.Hash, &a.Ref); err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, a)
+	}
+	return anchors, rows.Err()
+}
+
+// Marks the anchor as recorded in the block at the given height
+func (node *Node) dbSetAnchorRecorded(a *blockAnchor, blockHeight int) error {
+	_, err := node.mainDb.Exec("UPDATE anchors SET block_height=? WHERE backend=? AND ref=? AND hash=?", blockHeight, a.Backend, a.Ref, a.Hash)
+	return err
+}
+
+// Marks the anchors recorded in the blocks above the height as pending again, after a rollback
+func (node *Node) dbAnchorsRollback(height int) error {
+	_, err := node.mainDb.Exec("UPDATE anchors SET block_height=NULL WHERE block_height>?", height)
+	return err
+}
+
+// Publishes the tip hash with the backend, unless it has already been anchored
+func (node *Node) anchorTip(backend anchorBackend) (*blockAnchor, error) {
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	if anchored, err := node.dbIsAnchored(backend.name(), hash); err != nil || anchored {
+		return nil, err
+	}
+	ref, err := backend.publish(height, hash)
+	if err != nil {
+		return nil, err
+	}
+	if ref == "" || len(ref) > anchorMaxRefLength {
+		return nil, fmt.Errorf("the %s anchor backend has returned an invalid reference %s", backend.name(), strconv.Quote(ref))
+	}
+	a := &blockAnchor{Backend: backend.name(), Height: height, Hash: hash, Ref: ref}
+	if err = node.dbInsertAnchor(a); err != nil {
+		return nil, err
+	}
+	chainLog.Info("Anchored block", hash, "at height", height, "with", a.Backend, "as", ref)
+	node.nodeEvents.Publish(eventBlockAnchored, StrIfMap{"backend": a.Backend, "height": height, "hash": hash, "ref": ref})
+	return a, nil
+}
+
+// Anchors the tip periodically, if anchor_backend is configured
+func (node *Node) anchorScheduler() {
+	backend, err := node.anchorGetBackend()
+	if err != nil {
+		chainLog.Error("Anchoring is disabled:", err)
+		return
+	}
+	if backend == nil {
+		return
+	}
+	interval, err := node.anchorGetInterval()
+	if err != nil {
+		chainLog.Error("Invalid anchor interval, anchoring is disabled:", node.cfg.AnchorInterval)
+		return
+	}
+	chainLog.Info("Anchoring the chain with", backend.name(), "every", interval)
+	for range time.Tick(interval) {
+		if _, err = node.anchorTip(backend); err != nil {
+			chainLog.Error("Cannot anchor the chain:", err)
+		}
+	}
+}
+
+// Adds the pending anchors into the _meta of a block being signed
+func (node *Node) blockAddPendingAnchors(db *sql.DB) error {
+	anchors, err := node.dbGetPendingAnchors()
+	if err != nil || len(anchors) == 0 {
+		return err
+	}
+	// Leave the rest for the next block if they don't fit
+	for len(anchors) > 0 && len(jsonifyWhateverToBytes(anchors)) > anchorsMaxMetaSize {
+		anchors = anchors[:len(anchors)-1]
+	}
+	if len(anchors) == 0 {
+		return nil
+	}
+	return dbSetMetaString(db, blockMetaAnchors, string(jsonifyWhateverToBytes(anchors)))
+}
+
+// Parses the Anchors _meta value
+func parseBlockAnchors(value string) ([]blockAnchor, error) {
+	var anchors []blockAnchor
+	if err := json.Unmarshal([]byte(value), &anchors); err != nil {
+		return nil, err
+	}
+	for _, a := range anchors {
+		if _, ok := anchorBackends[a.Backend]; !ok {
+			return nil, fmt.Errorf("unknown anchor backend %s", strconv.Quote(a.Backend))
+		}
+		if a.Height < 0 || !blockHashRegexp.MatchString(a.Hash) {
+			return nil, fmt.Errorf("invalid anchored block %d %s", a.Height, a.Hash)
+		}
+		if a.Ref == "" || len(a.Ref) > anchorMaxRefLength {
+			return nil, fmt.Errorf("invalid anchor reference %s", strconv.Quote(a.Ref))
+		}
+	}
+	return anchors, nil
+}
+
+func validateBlockMetaAnchors(value string) error {
+	_, err := parseBlockAnchors(value)
+	return err
+}
+
+// Returns the anchors recorded in the block
+func (b *Block) dbGetAnchors() ([]blockAnchor, error) {
+	var count int
+	if err := b.queryRow("SELECT COUNT(*) FROM _meta WHERE key=?", blockMetaAnchors).Scan(&count); err != nil || count == 0 {
+		return nil, err
+	}
+	value, err := b.dbGetMetaString(blockMetaAnchors)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlockAnchors(value)
+}
+
+// Checks that the anchors recorded in the block at the given height are of the earlier blocks
+// in the chain
+func (b *Block) anchorVerifyRecords(node *Node, height int) error {
+	anchors, err := b.dbGetAnchors()
+	if err != nil {
+		return err
+	}
+	for _, a := range anchors {
+		if a.Height >= height {
+			return fmt.Errorf("the block records an anchor of block %d, which isn't before it", a.Height)
+		}
+		hash, err := node.dbGetBlockHashByHeight(a.Height)
+		if err != nil {
+			return err
+		}
+		if hash != a.Hash {
+			return fmt.Errorf("the block records an anchor of %s at height %d, which isn't in the chain", a.Hash, a.Height)
+		}
+	}
+	return nil
+}
+
+// Marks the anchors recorded in an accepted block, so they aren't recorded again
+func (node *Node) anchorMarkRecorded(blk *Block, height int) {
+	anchors, err := blk.dbGetAnchors()
+	if err != nil {
+		chainLog.Warn("Cannot read the anchors from block", blk.Hash, err)
+		return
+	}
+	for i := range anchors {
+		if err = node.dbSetAnchorRecorded(&anchors[i], height); err != nil {
+			chainLog.Warn("Cannot mark the anchor", anchors[i].Ref, "as recorded:", err)
+		}
+	}
+}
+
+// Anchors the tip now with the configured backend
+func (node *Node) actionAnchor() {
+	backend, err := node.anchorGetBackend()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if backend == nil {
+		log.Fatalln("anchor_backend isn't configured")
+	}
+	a, err := node.anchorTip(backend)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if a == nil {
+		fmt.Println("The tip has already been anchored")
+		return
+	}
+	fmt.Println(jsonifyWhatever(a))
+}
+
+// Prints the anchors published by this node
+func (node *Node) actionAnchors() {
+	rows, err := node.mainDb.Query("SELECT backend, ref, height, hash, time_published, block_height FROM anchors ORDER BY height, backend")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var a blockAnchor
+		var timePublished int
+		var blockHeight sql.NullInt64
+		if err = rows.Scan(&a.Backend, &a.Ref, &a.Height, &a.Hash, &timePublished, &blockHeight); err != nil {
+			log.Fatalln(err)
+		}
+		recorded := "pending"
+		if blockHeight.Valid {
+			recorded = fmt.Sprintf("recorded in block %d", blockHeight.Int64)
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\tpublished %s\t%s\n", a.Height, a.Hash, a.Backend, a.Ref,
+			unixTimeStampToUTCTime(timePublished).Format(time.RFC3339), recorded)
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	if n == 0 {
+		fmt.Println("No anchors have been published")
+	}
+}
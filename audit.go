@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const auditLogFileName = "audit.log"
+
+// Audit events
+const (
+	auditBlockAccepted = "block_accepted"
+	auditBlockVetoed   = "block_vetoed"
+	auditBlockRejected = "block_rejected_by_peer"
+	auditBlockRollback = "block_rolled_back"
+	auditChainDesync   = "chain_desync"
+	auditChainResynced = "chain_resynced"
+
+	auditKeyEquivocation = "key_equivocation"
+)
+
+// Appends an event to the audit log in the data directory. Every event is written as a single
+// line of JSON, containing the event name, the time and the given fields.
+func (node *Node) auditLog(event string, fields StrIfMap) {
+	entry := StrIfMap{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["event"] = event
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	line := append(jsonifyWhateverToBytes(entry), '\n')
+
+	node.auditLock.With(func() {
+		f, err := os.OpenFile(fmt.Sprintf("%s/%s", node.cfg.DataDir, auditLogFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Println("Cannot open audit log:", err)
+			return
+		}
+		defer f.Close()
+		if _, err = f.Write(line); err != nil {
+			log.Println("Cannot write audit log:", err)
+		}
+	})
+}
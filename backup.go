@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Backups of the node's state: the system databases (copied with SQLite's online backup API,
+ * so the node can keep running) and chainparams.json. Each backup is a directory named
+ * daisy-YYYYMMDD-HHMMSS, with a manifest.json describing it. The blocks aren't included, as
+ * they can always be fetched from peers.
+ *
+ * With backup_interval set in the config file, the node makes backups periodically, keeps the
+ * newest backup_keep of them, and runs backup_hook with each new backup directory as the
+ * argument, e.g. to upload it to S3.
+ */
+
+const backupNamePrefix = "daisy-"
+const backupManifestName = "manifest.json"
+const backupDefaultKeep = 7
+
+// The files a backup can contain, in the data directory
+var backupFileNames = []string{mainDbFileName, privateDbFilename, chainParamsBaseName}
+
+// backupManifest describes a backup
+type backupManifest struct {
+	Created     time.Time `json:"created"`
+	Height      int       `json:"height"`
+	TipHash     string    `json:"tip_hash"`
+	GenesisHash string    `json:"genesis_hash"`
+	Files       []string  `json:"files"`
+	Encrypted   bool      `json:"encrypted"`
+}
+
+// Returns the directory the backups are kept in
+func (node *Node) backupGetDir() string {
+	if node.cfg.BackupDir != "" {
+		return node.cfg.BackupDir
+	}
+	return filepath.Join(node.cfg.DataDir, "backups")
+}
+
+// Copies a system database into the given file, with the same passphrase
+func (node *Node) backupDb(db *dbHandle, destFileName string) error {
+	dest, err := sql.Open("sqlite3", node.dbSystemDSN(destFileName))
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			return dbBackupConns(d, s)
+		})
+	})
+}
+
+// Makes a backup in a new directory in dir, and returns its path
+func (node *Node) backupCreate(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := backupNamePrefix + time.Now().UTC().Format("20060102-150405")
+	path := filepath.Join(dir, name)
+	partial := path + ".partial"
+	if err := os.Mkdir(partial, 0700); err != nil {
+		return "", err
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+	tipHash, err := node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+	m := backupManifest{
+		Created:     time.Now().UTC(),
+		Height:      height,
+		TipHash:     tipHash,
+		GenesisHash: node.chainParams.GenesisBlockHash,
+		Encrypted:   node.dbGetPassphrase() != "",
+	}
+	dbs := map[string]*dbHandle{privateDbFilename: node.privateDb}
+	if node.cfg.MainDbURL == "" {
+		dbs[mainDbFileName] = node.mainDb
+	} else {
+		log.Println("The main database is in PostgreSQL, and must be backed up with its own tools")
+	}
+	for name, db := range dbs {
+		if err = node.backupDb(db, filepath.Join(partial, name)); err != nil {
+			os.RemoveAll(partial)
+			return "", fmt.Errorf("backing up %s: %v", name, err)
+		}
+		m.Files = append(m.Files, name)
+	}
+	cpFilename := filepath.Join(node.cfg.DataDir, chainParamsBaseName)
+	if fileExists(cpFilename) {
+		if err = copyFile(cpFilename, filepath.Join(partial, chainParamsBaseName)); err != nil {
+			os.RemoveAll(partial)
+			return "", err
+		}
+		m.Files = append(m.Files, chainParamsBaseName)
+	}
+	if err = ioutil.WriteFile(filepath.Join(partial, backupManifestName), jsonifyWhateverToBytes(m), 0600); err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+	if err = os.Rename(partial, path); err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+	return path, nil
+}
+
+// Deletes the oldest backups in dir, keeping the newest keep of them
+func backupPrune(dir string, keep int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), backupNamePrefix) && !strings.HasSuffix(e.Name(), ".partial") {
+			names = append(names, e.Name())
+		}
+	}
+	// The names sort by time
+	sort.Strings(names)
+	for len(names) > keep {
+		log.Println("Deleting old backup", names[0])
+		if err = os.RemoveAll(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Makes a backup, deletes the old ones and runs the backup hook
+func (node *Node) backupRun() (string, error) {
+	dir := node.backupGetDir()
+	path, err := node.backupCreate(dir)
+	if err != nil {
+		return "", err
+	}
+	keep := node.cfg.BackupKeep
+	if keep <= 0 {
+		keep = backupDefaultKeep
+	}
+	if err = backupPrune(dir, keep); err != nil {
+		log.Println("Error deleting old backups:", err)
+	}
+	if node.cfg.BackupHook != "" {
+		out, err := exec.Command(node.cfg.BackupHook, path).CombinedOutput()
+		if err != nil {
+			return path, fmt.Errorf("backup hook: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return path, nil
+}
+
+// Makes backups periodically, if backup_interval is configured
+func (node *Node) backupScheduler() {
+	if node.cfg.BackupInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(node.cfg.BackupInterval)
+	if err != nil || interval < time.Minute {
+		log.Println("Invalid backup interval, backups are disabled:", node.cfg.BackupInterval)
+		return
+	}
+	log.Println("Backing up to", node.backupGetDir(), "every", interval)
+	for range time.Tick(interval) {
+		path, err := node.backupRun()
+		if err != nil {
+			log.Println("Backup failed:", err)
+			continue
+		}
+		log.Println("Backed up to", path)
+	}
+}
+
+// Makes a backup now
+func (node *Node) actionBackup() {
+	node.dbInit()
+	node.blockchainLoad(false)
+	path, err := node.backupRun()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Backed up to", path)
+}
+
+// Restores the system databases and chainparams.json from a backup directory. The current
+// files are kept with the .before-restore suffix.
+func (node *Node) actionRestore(path string) {
+	var st nodeStatus
+	if err := node.controlRequest(http.MethodGet, "/status", &st); err == nil {
+		log.Fatalln("The node is running; stop it before restoring")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, backupManifestName))
+	if err != nil {
+		log.Fatalln("Not a backup directory:", err)
+	}
+	var m backupManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		log.Fatalln("Cannot parse the backup manifest:", err)
+	}
+	if m.Encrypted && node.dbGetPassphrase() == "" {
+		log.Println("Warning: the backup is encrypted, and the database passphrase isn't configured")
+	}
+	// The manifest decides which files in the data directory are replaced, so only the files
+	// a backup contains are accepted, checked before any of them is restored
+	for _, name := range m.Files {
+		if filepath.Base(name) != name || !inStrings(name, backupFileNames) {
+			log.Fatalln("The backup manifest lists an unexpected file:", name)
+		}
+	}
+	for _, name := range m.Files {
+		if name == mainDbFileName && node.cfg.MainDbURL != "" {
+			log.Println("Not restoring", name, "as the main database is in PostgreSQL")
+			continue
+		}
+		dest := filepath.Join(node.cfg.DataDir, name)
+		if fileExists(dest) {
+			if err = os.Rename(dest, dest+".before-restore"); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if err = copyFile(filepath.Join(path, name), dest); err != nil {
+			log.Fatalln(err)
+		}
+		if name == privateDbFilename {
+			if err = os.Chmod(dest, 0600); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	fmt.Printf("Restored the backup made at %v, at the block height %d\n", m.Created, m.Height)
+}
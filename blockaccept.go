@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+ * New blocks, whether received from peers or created locally, pass through a pipeline of
+ * acceptance stages before they are stored into the blockchain. The order of the stages is
+ * configurable, and any stage can veto the block. Vetoes are recorded in the audit log and
+ * reported back to the peer which has sent the block.
+ */
+
+// BlockVetoReason classifies the reason a block has been vetoed
+type BlockVetoReason string
+
+// Block veto reasons
+const (
+	BlockVetoInvalid     BlockVetoReason = "invalid"     // The block violates consensus rules
+	BlockVetoUnconnected BlockVetoReason = "unconnected" // The block doesn't extend the local chain: its parent is unknown, or its height is taken
+	BlockVetoPolicy      BlockVetoReason = "policy"      // The block content is not allowed by the local policy
+	BlockVetoApplication BlockVetoReason = "application" // The application hook has refused the block
+	BlockVetoUnanchored  BlockVetoReason = "unanchored"  // The block cannot be anchored in time
+	BlockVetoInternal    BlockVetoReason = "internal"    // A local error has prevented checking the block
+)
+
+// BlockVetoError is returned when a stage of the acceptance pipeline vetoes a block
+type BlockVetoError struct {
+	Stage   string
+	Reason  BlockVetoReason
+	Message string
+}
+
+func (e *BlockVetoError) Error() string {
+	return fmt.Sprintf("block vetoed by %s (%s): %s", e.Stage, e.Reason, e.Message)
+}
+
+// Creates a new BlockVetoError with a formatted message
+func newBlockVeto(stage string, reason BlockVetoReason, format string, args ...interface{}) *BlockVetoError {
+	return &BlockVetoError{Stage: stage, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// blockAcceptanceRequest holds a block travelling through the acceptance pipeline
+type blockAcceptanceRequest struct {
+	blk      *Block
+	fileName string
+	height   int    // Filled in by the consensus stage
+	source   string // The address of the peer which has sent the block, or "local"
+
+	// With policy_require_identity, the result of verifying the creator's identity, filled in
+	// before the acceptance lock is taken, as it can take DNS lookups
+	creatorIdentityErr error
+	// With chain_refs, the result of verifying the block's references to the other chains,
+	// filled in before the acceptance lock is taken, as it asks the other chains' nodes
+	chainRefsErr error
+}
+
+// A stage of the acceptance pipeline. Returns nil if the block passes.
+type blockAcceptanceStage func(node *Node, req *blockAcceptanceRequest) *BlockVetoError
+
+// Blocks can be dated at most this far in the future
+const blockMaxFutureDrift = 2 * time.Hour
+
+var blockAcceptanceStages = map[string]blockAcceptanceStage{
+	"consensus": (*Node).blockStageConsensus,
+	"policy":    (*Node).blockStagePolicy,
+	"hook":      (*Node).blockStageHook,
+	"anchoring": (*Node).blockStageAnchoring,
+}
+
+var defaultBlockAcceptanceStages = []string{"consensus", "policy", "hook", "anchoring"}
+
+// Validates the configured stage order and sets up the pipeline
+func (node *Node) blockAcceptanceInit() error {
+	stages := node.cfg.BlockAcceptanceStages
+	if len(stages) == 0 {
+		stages = defaultBlockAcceptanceStages
+	}
+	seen := map[string]bool{}
+	for _, name := range stages {
+		if _, ok := blockAcceptanceStages[name]; !ok {
+			return fmt.Errorf("Unknown block acceptance stage: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Duplicate block acceptance stage: %s", name)
+		}
+		seen[name] = true
+	}
+	if !seen["consensus"] {
+		return fmt.Errorf("The consensus block acceptance stage cannot be omitted")
+	}
+	node.blockAcceptancePipeline = stages
+	return nil
+}
+
+// Runs the block through the acceptance pipeline and, if no stage vetoes it, stores it into
+// the blockchain. The returned error is a *BlockVetoError if the block has been vetoed.
+func (node *Node) blockchainAcceptBlock(req *blockAcceptanceRequest) (err error) {
+	if node.cfg.PolicyRequireIdentity {
+		req.verifyCreatorIdentity(node)
+	}
+	if len(node.cfg.ChainRefs) > 0 {
+		req.chainRefsErr = req.blk.verifyChainRefs(node)
+	}
+	node.blockAcceptLock.With(func() {
+		err = node.blockchainAcceptBlockLocked(req)
+	})
+	return
+}
+
+func (node *Node) blockchainAcceptBlockLocked(req *blockAcceptanceRequest) error {
+	for _, name := range node.blockAcceptancePipeline {
+		if veto := blockAcceptanceStages[name](node, req); veto != nil {
+			veto.Stage = name
+			node.auditLog(auditBlockVetoed, StrIfMap{"hash": req.blk.Hash, "source": req.source, "stage": veto.Stage,
+				"reason": string(veto.Reason), "message": veto.Message})
+			node.nodeEvents.Publish(eventBlockRejected, StrIfMap{"hash": req.blk.Hash, "source": req.source, "stage": veto.Stage,
+				"reason": string(veto.Reason), "message": veto.Message})
+			return veto
+		}
+	}
+	// The file is stored first: without its record in the main database it's only an unused
+	// file, which is stored again if the block is accepted later
+	if _, err := node.blockStore.Put(req.fileName); err != nil {
+		return err
+	}
+	req.blk.Height = req.height
+	req.blk.TimeAccepted = time.Now()
+	tx, err := node.mainDb.Begin()
+	if err != nil {
+		return err
+	}
+	if err = node.blockchainInsertBlock(tx, req); err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		// The chain param updates are also kept in memory
+		if err := node.chainParamsLoadUpdates(); err != nil {
+			chainLog.Error("Cannot reload the chain param updates", err)
+		}
+		return err
+	}
+	if err = node.blockchainClearPendingKeyMetadata(req.blk); err != nil {
+		chainLog.Warn("Cannot clear the published key metadata of block", req.blk.Hash, err)
+	}
+	node.auditLog(auditBlockAccepted, StrIfMap{"hash": req.blk.Hash, "height": req.height, "source": req.source})
+	node.nodeEvents.Publish(eventBlockAccepted, StrIfMap{"hash": req.blk.Hash, "height": req.height, "source": req.source})
+	node.publishKeyOpEvents(req.blk, req.height)
+	node.anchorMarkRecorded(req.blk, req.height)
+	node.notaryIndexBlock(req.blk, req.height)
+	return nil
+}
+
+// Applies the key ops and the chain param updates of the accepted block, and inserts it, in a
+// single transaction, so that the signatories never change without the block which changes them
+func (node *Node) blockchainInsertBlock(tx *dbTx, req *blockAcceptanceRequest) error {
+	if err := blockchainApplyKeyOps(tx, req.blk, req.height); err != nil {
+		return err
+	}
+	if err := node.blockchainApplyParamOps(tx, req.blk, req.height); err != nil {
+		return err
+	}
+	return dbInsertBlockTx(tx, req.blk.DbBlockchainBlock)
+}
+
+// Checks the blockchain consensus rules: signatures, key ops, chain param updates, the block
+// size and the block's place in the chain
+func (node *Node) blockStageConsensus(req *blockAcceptanceRequest) *BlockVetoError {
+	height, err := node.checkAcceptBlock(req.blk)
+	if _, ok := err.(blockUnconnectedError); ok {
+		return newBlockVeto("", BlockVetoUnconnected, "%v", err)
+	}
+	if err != nil {
+		return newBlockVeto("", BlockVetoInvalid, "%v", err)
+	}
+	// The references' format is checked with the block's metadata, the chain they are to here
+	if _, err = req.blk.dbGetChainRefs(node); err != nil {
+		return newBlockVeto("", BlockVetoInvalid, "%v", err)
+	}
+	powHashName, err := req.blk.dbGetPoWHashName()
+	if err != nil {
+		return newBlockVeto("", BlockVetoInvalid, "%v", err)
+	}
+	if err = node.powCheckBlock(req.fileName, req.blk.Hash, powHashName, height); err != nil {
+		return newBlockVeto("", BlockVetoInvalid, "%v", err)
+	}
+	if err = node.checkBlockSize(req.fileName, height); err != nil {
+		return newBlockVeto("", BlockVetoInvalid, "%v", err)
+	}
+	req.height = height
+	return nil
+}
+
+// Verifies the identity of the block's creator, for the policy stage
+func (req *blockAcceptanceRequest) verifyCreatorIdentity(node *Node) {
+	dbpk, err := node.dbGetPublicKey(req.blk.SignaturePublicKeyHash)
+	if err != nil {
+		req.creatorIdentityErr = fmt.Errorf("unknown creator key %s", req.blk.SignaturePublicKeyHash)
+		return
+	}
+	if _, err = node.cachedKeyIdentity(dbpk); err != nil {
+		req.creatorIdentityErr = fmt.Errorf("the creator's identity can't be verified: %v", err)
+	}
+}
+
+// Checks the block against the locally configured content policy
+func (node *Node) blockStagePolicy(req *blockAcceptanceRequest) *BlockVetoError {
+	if node.cfg.PolicyMaxBlockSize > 0 {
+		st, err := os.Stat(req.fileName)
+		if err != nil {
+			return newBlockVeto("", BlockVetoInternal, "%v", err)
+		}
+		if st.Size() > node.cfg.PolicyMaxBlockSize {
+			return newBlockVeto("", BlockVetoPolicy, "block size %d exceeds the maximum of %d", st.Size(), node.cfg.PolicyMaxBlockSize)
+		}
+	}
+	if node.cfg.PolicyRequireIdentity && req.creatorIdentityErr != nil {
+		return newBlockVeto("", BlockVetoPolicy, "%v", req.creatorIdentityErr)
+	}
+	if height, err := node.dbGetEquivocationHeight(req.blk.SignaturePublicKeyHash); err == nil && height != 0 {
+		chainLog.Warn("Block", req.blk.Hash, "is signed by", req.blk.SignaturePublicKeyHash, "which has signed two different blocks at height", height, "and should be revoked")
+	}
+	if node.cfg.TSARoots != "" {
+		if err := req.blk.tsaCheckPreviousBlockRoots(node); err != nil {
+			return newBlockVeto("", BlockVetoPolicy, "%v", err)
+		}
+	}
+	if len(node.cfg.ChainRefs) > 0 && req.chainRefsErr != nil {
+		return newBlockVeto("", BlockVetoPolicy, "%v", req.chainRefsErr)
+	}
+	if len(node.cfg.PolicyDenyTables) > 0 {
+		tables, err := req.blk.dbGetTableNames()
+		if err != nil {
+			return newBlockVeto("", BlockVetoInternal, "%v", err)
+		}
+		for _, name := range tables {
+			if inStrings(name, node.cfg.PolicyDenyTables) {
+				return newBlockVeto("", BlockVetoPolicy, "table %s is not allowed", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Executes the application hook, if it's configured. The hook is given the block's file name
+// and hash as arguments, and a non-zero exit status vetoes the block, with the hook's output
+// used as the message.
+func (node *Node) blockStageHook(req *blockAcceptanceRequest) *BlockVetoError {
+	if node.cfg.BlockAcceptHook == "" {
+		return nil
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(node.cfg.BlockAcceptHook, req.fileName, req.blk.Hash)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			log.Println("Error running block acceptance hook:", err)
+			return newBlockVeto("", BlockVetoInternal, "%v", err)
+		}
+		return newBlockVeto("", BlockVetoApplication, "%s", strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// Checks that the block is anchored in time: it must not be dated before the genesis block,
+// nor too far in the future.
+func (node *Node) blockStageAnchoring(req *blockAcceptanceRequest) *BlockVetoError {
+	genesisTime, err := time.Parse(time.RFC3339, node.chainParams.GenesisBlockTimestamp)
+	if err == nil && req.blk.TimeAccepted.Before(genesisTime) {
+		return newBlockVeto("", BlockVetoUnanchored, "block is dated %v, before the genesis block", req.blk.TimeAccepted)
+	}
+	if req.blk.TimeAccepted.After(time.Now().Add(blockMaxFutureDrift)) {
+		return newBlockVeto("", BlockVetoUnanchored, "block is dated %v, in the future", req.blk.TimeAccepted)
+	}
+	return nil
+}
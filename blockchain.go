@@ -1,16 +1,16 @@
 package main
 
 import (
+	"crypto/ecdsa"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"math"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -28,18 +28,12 @@ var defaultChainParams = ChainParams{
 	GenesisBlockTimestamp:     "2017-05-06T10:38:50+02:00",
 }
 
-var chainParams = defaultChainParams
-
 const chainParamsBaseName = "chainparams.json"
 
 // Blocks (SQLite databases) are stored as flat files in a directory
 const blockchainSubdirectoryBaseName = "blocks"
-const rawBlockFilenameFormat = "%s/%04x/block_%08x.db"
-const rawBlockDirnameFormat = "%s/%04x"
 const genesisBlockHeight = 0
 
-var blockchainSubdirectory string
-
 /*
  * Block metadata fields:
  *
@@ -56,7 +50,8 @@ var blockchainSubdirectory string
 // Block is the working representation of a blockchain block
 type Block struct {
 	*DbBlockchainBlock
-	db *sql.DB
+	db  *sql.DB
+	bdb *BlockDB // The shared handle, for blocks opened from the blockchain
 }
 
 // BlockKeyOp is the representation of a key op record from the blocks' _keys table.
@@ -67,28 +62,37 @@ type BlockKeyOp struct {
 	signatureKeyHash string
 	signature        []byte
 	metadata         map[string]string
+	metadataJSON     string // As stored in the block, for verifying metadata op signatures
 }
 
-func ensureBlockchainSubdirectoryExists() {
-	blockchainSubdirectory = fmt.Sprintf("%s/%s", cfg.DataDir, blockchainSubdirectoryBaseName)
-	if _, err := os.Stat(blockchainSubdirectory); err != nil {
+func (node *Node) ensureBlockchainSubdirectoryExists() {
+	node.blockchainSubdirectory = fmt.Sprintf("%s/%s", node.cfg.DataDir, blockchainSubdirectoryBaseName)
+	if _, err := os.Stat(node.blockchainSubdirectory); err != nil {
 		// Probably doesn't exist, create it
-		log.Println("Creating directory", blockchainSubdirectory)
-		err := os.Mkdir(blockchainSubdirectory, 0700)
+		chainLog.Info("Creating directory", node.blockchainSubdirectory)
+		err := os.Mkdir(node.blockchainSubdirectory, 0700)
 		if err != nil {
-			log.Fatalln(err)
+			chainLog.Fatal(err)
 		}
 	}
+	node.blockStore = node.NewBlockStore(node.blockchainSubdirectory)
 }
 
 // Initializes the blockchain: creates database entries and the genesis block file
-func blockchainInit(createDefault bool) {
-	ensureBlockchainSubdirectoryExists()
-	if dbGetBlockchainHeight() == -1 && createDefault {
-		log.Println("Writing down the default Genesis block. Let there be light.")
+func (node *Node) blockchainLoad(createDefault bool) {
+	node.ensureBlockchainSubdirectoryExists()
+	if err := node.blockStore.migrateLegacyFiles(); err != nil {
+		chainLog.Fatal("Error migrating block files:", err)
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		chainLog.Fatal(err)
+	}
+	if height == -1 && createDefault {
+		chainLog.Info("Writing down the default Genesis block. Let there be light.")
 
 		// This is basically testing the crypto code, no real purpose.
-		keypair, publicKeyHash, err := cryptoGetAPrivateKey()
+		keypair, publicKeyHash, err := node.cryptoGetAPrivateKey()
 		if err != nil {
 			log.Panicln(err)
 		}
@@ -110,13 +114,13 @@ func blockchainInit(createDefault bool) {
 			if err != nil {
 				log.Panicln(err)
 			}
-			log.Println(GenesisBlockPreviousBlockHash)
-			log.Println(hex.EncodeToString(signature))
+			chainLog.Debug(GenesisBlockPreviousBlockHash)
+			chainLog.Debug(hex.EncodeToString(signature))
 		*/
 
 		// Bring the genesis block into existence
 		genesisBlock := MustAsset("bindata/genesis.db")
-		if hashBytesToHexString(genesisBlock) != chainParams.GenesisBlockHash {
+		if hashBytesToHexString(genesisBlock) != node.chainParams.GenesisBlockHash {
 			log.Panicln("Genesis block hash unexpected:", hashBytesToHexString(genesisBlock))
 		}
 
@@ -130,27 +134,24 @@ func blockchainInit(createDefault bool) {
 			if err != nil {
 				log.Panicln(err)
 			}
-			log.Println(hex.EncodeToString(signature))
+			chainLog.Debug(hex.EncodeToString(signature))
 		*/
 
-		if err := blockchainEnsureBlockDir(genesisBlockHeight); err != nil {
-			log.Panicln(err)
-		}
-		genesisBlockFilename := blockchainGetFilename(genesisBlockHeight)
-		err = ioutil.WriteFile(genesisBlockFilename, genesisBlock, 0644)
+		genesisBlockHash, err := node.blockStore.PutBytes(genesisBlock)
 		if err != nil {
 			log.Panic(err)
 		}
+		genesisBlockFilename := node.blockStore.Filename(genesisBlockHash)
 		b, err := OpenBlockFile(genesisBlockFilename)
 		if err != nil {
 			log.Panicln(err)
 		}
 		b.Height = 0
-		b.TimeAccepted, err = time.Parse(time.RFC3339, chainParams.GenesisBlockTimestamp)
+		b.TimeAccepted, err = time.Parse(time.RFC3339, node.chainParams.GenesisBlockTimestamp)
 		if err != nil {
 			log.Panicln("Error parsing genesis block timestamp", err)
 		}
-		b.HashSignature, err = hex.DecodeString(chainParams.GenesisBlockHashSignature)
+		b.HashSignature, err = hex.DecodeString(node.chainParams.GenesisBlockHashSignature)
 		if err != nil {
 			log.Panicln(err)
 		}
@@ -160,169 +161,466 @@ func blockchainInit(createDefault bool) {
 		}
 		for _, keyOps := range blockKeyOps {
 			for _, keyOp := range keyOps {
-				if dbPublicKeyExists(keyOp.publicKeyHash) {
+				exists, err := node.dbPublicKeyExists(keyOp.publicKeyHash)
+				if err != nil {
+					log.Panicln(err)
+				}
+				if exists {
 					continue
 				}
-				dbWritePublicKey(keyOp.publicKeyBytes, keyOp.publicKeyHash, 0)
+				if err = dbWritePublicKey(node.mainDb, keyOp.publicKeyBytes, keyOp.publicKeyHash, 0); err != nil {
+					log.Panicln(err)
+				}
 			}
 		}
-		err = dbInsertBlock(b.DbBlockchainBlock)
+		err = node.dbInsertBlock(b.DbBlockchainBlock)
 		if err != nil {
 			log.Panicln(err)
 		}
 	} else {
 		// The chainparams file will only exist for non-default blockchains
-		cpFilename := fmt.Sprintf("%s/%s", cfg.DataDir, chainParamsBaseName)
+		cpFilename := fmt.Sprintf("%s/%s", node.cfg.DataDir, chainParamsBaseName)
 		if fileExists(cpFilename) {
-			log.Println("Loading custom blockchain params from", cpFilename)
+			chainLog.Info("Loading custom blockchain params from", cpFilename)
 			cpJSON, err := ioutil.ReadFile(cpFilename)
 			if err != nil {
-				log.Fatal("Error reading chainparams file", cpFilename, err)
+				chainLog.Fatal("Error reading chainparams file", cpFilename, err)
+			}
+			err = json.Unmarshal(cpJSON, &node.chainParams)
+			if err != nil {
+				chainLog.Fatal("Error decoding chainparams file", cpFilename, err)
+			}
+			if err = node.chainParams.quorumPolicy().validate(); err != nil {
+				chainLog.Fatal("Invalid chainparams file", cpFilename, err)
+			}
+			if err = node.chainParams.validateSoftForks(); err != nil {
+				chainLog.Fatal("Invalid chainparams file", cpFilename, err)
 			}
-			err = json.Unmarshal(cpJSON, &chainParams)
+			peers, err := node.dbGetSavedPeers()
 			if err != nil {
-				log.Fatal("Error decoding chainparams file", cpFilename, err)
+				chainLog.Fatal(err)
 			}
-			peers := dbGetSavedPeers()
-			for _, peer := range chainParams.BootstrapPeers {
+			for _, peer := range node.chainParams.BootstrapPeers {
 				_, ok := peers[peer]
 				if !ok {
-					dbSavePeer(peer)
+					if err = node.dbSavePeer(peer); err != nil {
+						chainLog.Fatal(err)
+					}
 				}
 			}
 		} else {
-			log.Println("Using default blockchain params")
+			chainLog.Info("Using default blockchain params")
+		}
+		peers, err := node.dbGetSavedPeers()
+		if err != nil {
+			chainLog.Fatal(err)
+		}
+		// The configured bootstrap peers are added to the existing databases too
+		for _, peer := range node.cfg.BootstrapPeers {
+			if _, ok := peers[peer]; !ok {
+				if err = node.dbSavePeer(peer); err != nil {
+					chainLog.Fatal(err)
+				}
+				peers[peer] = time.Now()
+			}
 		}
-		log.Println("P2P peers:", dbGetSavedPeers())
+		chainLog.Info("P2P peers:", peers)
 	}
-	err := blockchainVerifyEverything()
+}
+
+// Loads the blockchain and verifies it
+func (node *Node) blockchainInit(createDefault bool) {
+	node.blockchainLoad(createDefault)
+	if err := node.chainParamsLoadUpdates(); err != nil {
+		chainLog.Fatal("Cannot load the chain param updates:", err)
+	}
+	err := node.blockchainVerifyEverything()
 	if err != nil {
-		log.Fatalf("blockchainVerifyEverything: %v", err)
+		chainLog.Fatalf("blockchainVerifyEverything: %v", err)
+	}
+	if node.cfg.faster {
+		node.blockchainVerificationState = "skipped"
+	} else {
+		node.blockchainVerificationState = "verified"
+	}
+	if err = node.softForksUpdate(); err != nil {
+		chainLog.Fatal("Cannot update the soft fork states:", err)
+	}
+}
+
+// blockchainKeyState is the state of one signatory key at a certain point in the blockchain
+type blockchainKeyState struct {
+	publicKeyBytes []byte
+	addHeight      int
+	isRevoked      bool
+	revokeHeight   int
+	metadata       map[string]string // The weight and the role, see keyweights.go
+}
+
+// blockchainKeySet is the set of signatory keys, as they are added and revoked by key ops
+// while the blockchain is replayed block by block. Map keys are public key hashes.
+type blockchainKeySet map[string]*blockchainKeyState
+
+// Returns the key if it is a valid signatory at the current replay height.
+func (ks blockchainKeySet) getValid(publicKeyHash string) (*blockchainKeyState, error) {
+	k, ok := ks[publicKeyHash]
+	if !ok {
+		return nil, fmt.Errorf("key %s has not been added as a signatory", publicKeyHash)
+	}
+	if k.isRevoked {
+		return nil, fmt.Errorf("key %s has been revoked at height %d", publicKeyHash, k.revokeHeight)
+	}
+	return k, nil
+}
+
+// Returns the total weight of the valid keys which can sign key ops at the given height
+func (ks blockchainKeySet) keyOpWeight(height int) int {
+	total := 0
+	for _, k := range ks {
+		if !k.isRevoked && keyCanSignKeyOps(k.metadata) && keyCheckActive(k.addHeight, k.metadata, height) == nil {
+			total += keyWeight(k.metadata)
+		}
 	}
+	return total
+}
+
+// Applies the key ops from a block at the given height to the set.
+func (ks blockchainKeySet) apply(height int, blockKeyOps map[string][]BlockKeyOp) error {
+	for keyOpKeyHash, keyOps := range blockKeyOps {
+		switch keyOps[0].op {
+		case "A":
+			if _, ok := ks[keyOpKeyHash]; ok {
+				return fmt.Errorf("attempt to add an already existing key %s", keyOpKeyHash)
+			}
+			ks[keyOpKeyHash] = &blockchainKeyState{publicKeyBytes: keyOps[0].publicKeyBytes, addHeight: height, metadata: keyOps[0].metadata}
+		case "R":
+			k, err := ks.getValid(keyOpKeyHash)
+			if err != nil {
+				return fmt.Errorf("cannot revoke: %v", err)
+			}
+			k.isRevoked = true
+			k.revokeHeight = height
+		case "M":
+			k, err := ks.getValid(keyOpKeyHash)
+			if err != nil {
+				return fmt.Errorf("cannot set metadata: %v", err)
+			}
+			k.metadata = keyOps[0].metadata
+		default:
+			return fmt.Errorf("invalid key op %s for %s", keyOps[0].op, keyOpKeyHash)
+		}
+	}
+	return nil
+}
+
+// blockVerifyError is an error found in a block by blockchainVerifyBlocks
+type blockVerifyError struct {
+	Height int    `json:"height"`
+	Error  string `json:"error"`
 }
 
 // Verifies the entire blockchain to see if there are errors.
-// TODO: Dynamic adding and revoking of key is not yet checked
-func blockchainVerifyEverything() error {
-	if cfg.faster {
-		log.Println("Skipping blockchain consistency checks")
+func (node *Node) blockchainVerifyEverything() error {
+	if node.cfg.faster {
+		chainLog.Info("Skipping blockchain consistency checks")
+		return nil
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	// The blocks up to the verified height have been verified before, see syncstate.go
+	verifiedHeight, err := node.dbGetVerifiedHeight()
+	if err != nil {
+		return err
+	}
+	if verifiedHeight < 0 {
+		chainLog.Info("Verifying all the blocks (use --faster to skip)...")
+	} else if verifiedHeight < height {
+		chainLog.Info("Verifying the blocks from", verifiedHeight+1, "(use --faster to skip, and the verify command to verify all of them)...")
+	}
+	errs := node.blockchainVerifyBlocks(verifiedHeight+1, height)
+	if len(errs) == 0 {
+		if err = node.dbSetVerifiedHeight(height); err != nil {
+			return err
+		}
 		return nil
 	}
-	log.Println("Verifying all the blocks (use --faster to skip)...")
-	maxHeight := dbGetBlockchainHeight()
+	for _, e := range errs[1:] {
+		chainLog.Errorf("block %d: %s", e.Height, e.Error)
+	}
+	if len(errs) > 1 {
+		return fmt.Errorf("block %d: %s (and %d more errors)", errs[0].Height, errs[0].Error, len(errs)-1)
+	}
+	return fmt.Errorf("block %d: %s", errs[0].Height, errs[0].Error)
+}
+
+// Verifies the blocks in the given height range, and returns all the errors found.
+// Key ops are replayed block by block from the genesis block, so that each block and each
+// key op is checked against the set of signatories which were valid at that block's height.
+// Blocks below minHeight only contribute their key ops.
+func (node *Node) blockchainVerifyBlocks(minHeight, maxHeight int) []blockVerifyError {
+	var errs []blockVerifyError
+	keys := blockchainKeySet{}
 	for height := 0; height <= maxHeight; height++ {
 		if height > 0 && height%1000 == 0 {
-			log.Println("Verifying block", height)
+			chainLog.Debug("Verifying block", height)
 		}
-		if err := blockchainEnsureBlockDir(height); err != nil {
-			return err
-		}
-		blockFilename := blockchainGetFilename(height)
-		fileHash, err := hashFileToHexString(blockFilename)
-		if err != nil {
-			return fmt.Errorf("block %d: %v", height, err)
+		for _, err := range node.blockchainVerifyBlock(height, height >= minHeight, keys) {
+			errs = append(errs, blockVerifyError{Height: height, Error: err.Error()})
 		}
-		dbb, err := dbGetBlockByHeight(height)
-		if err != nil {
-			return fmt.Errorf("block %d: %v", height, err)
+	}
+	return errs
+}
+
+// Verifies a single block against the current key set and applies its key ops to the set.
+// If check is false, only the key ops are applied.
+func (node *Node) blockchainVerifyBlock(height int, check bool, keys blockchainKeySet) (errs []error) {
+	dbb, err := node.dbGetBlockByHeight(height)
+	if err != nil {
+		return []error{err}
+	}
+	b, err := node.OpenBlockByHeight(height)
+	if err != nil {
+		return []error{fmt.Errorf("cannot open block db file: %v", err)}
+	}
+	blockKeyOps, err := b.dbGetKeyOps()
+	paramOps, paramErr := b.dbGetParamOps()
+	powHashName, powErr := b.dbGetPoWHashName()
+	tsaErr := b.tsaVerifyPreviousBlock()
+	anchorErr := b.anchorVerifyRecords(node, height)
+	if err := b.Close(); err != nil {
+		panic(err)
+	}
+	if err != nil {
+		return []error{fmt.Errorf("cannot get key ops: %v", err)}
+	}
+	if height == 0 {
+		// The genesis block introduces the initial, self-signed keys which also sign the
+		// genesis block itself.
+		if err = keys.apply(height, blockKeyOps); err != nil {
+			return []error{err}
 		}
-		if fileHash != dbb.Hash {
-			return fmt.Errorf("block %d: file hash %s doesn't match db hash %s", height, fileHash, dbb.Hash)
+	} else {
+		defer func() {
+			if err := keys.apply(height, blockKeyOps); err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	if !check {
+		return nil
+	}
+
+	fileHash, err := hashFileToHexString(node.blockStore.Filename(dbb.Hash))
+	if err != nil {
+		errs = append(errs, err)
+	} else if fileHash != dbb.Hash {
+		errs = append(errs, fmt.Errorf("file hash %s doesn't match db hash %s", fileHash, dbb.Hash))
+	}
+	if height > 0 {
+		if powErr != nil {
+			errs = append(errs, powErr)
+		} else if err = node.powCheckBlock(node.blockStore.Filename(dbb.Hash), dbb.Hash, powHashName, height); err != nil {
+			errs = append(errs, err)
 		}
-		if height == 0 && fileHash != chainParams.GenesisBlockHash {
-			return fmt.Errorf("block %d: it's supposed to be the genesis block but its hash doesn't match %s",
-				height, chainParams.GenesisBlockHash)
+		if err = node.checkBlockSize(node.blockStore.Filename(dbb.Hash), height); err != nil {
+			errs = append(errs, err)
 		}
-		dbpk, err := dbGetPublicKey(dbb.SignaturePublicKeyHash)
-		if err != nil {
-			return fmt.Errorf("block %d: error getting public key %s", height, dbb.SignaturePublicKeyHash)
+		if tsaErr != nil {
+			errs = append(errs, tsaErr)
 		}
-		creatorPublicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot decode public key %s", height, dbb.SignaturePublicKeyHash)
+		if anchorErr != nil {
+			errs = append(errs, anchorErr)
 		}
-		hashBytes, err := hex.DecodeString(dbb.Hash)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot decode hash %s", height, dbb.Hash)
+	}
+	if height == 0 && dbb.Hash != node.chainParams.GenesisBlockHash {
+		errs = append(errs, fmt.Errorf("it's supposed to be the genesis block but its hash doesn't match %s", node.chainParams.GenesisBlockHash))
+	}
+	errs = append(errs, node.blockchainVerifyBlockSignatures(height, dbb, keys)...)
+
+	Q := node.KeyOpThreshold(height, keys.keyOpWeight(height))
+	if height == 0 {
+		// The initial keys only need to be signed by the genesis block's creator
+		Q = 0
+	}
+	for keyOpKeyHash, keyOps := range blockKeyOps {
+		if keyOps[0].op == "M" {
+			k, err := keys.getValid(keyOpKeyHash)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("metadata op for an invalid key: %v", err))
+			} else if err = blockchainVerifyKeyMetadataOp(k.publicKeyBytes, keyOps, height); err != nil {
+				errs = append(errs, err)
+			} else if err = checkKeyGovernanceUnchanged(k.metadata, keyOps[0].metadata); err != nil {
+				errs = append(errs, fmt.Errorf("metadata op for %s: %v", keyOpKeyHash, err))
+			}
+			continue
 		}
-		err = cryptoVerifyBytes(creatorPublicKey, hashBytes, dbb.HashSignature)
-		if err != nil {
-			log.Println(creatorPublicKey, hashBytes, dbb.HashSignature)
-			return fmt.Errorf("block %d: block hash signature is invalid (%v)", height, err)
+		op := keyOps[0].op
+		weight := 0
+		signers := map[string]bool{}
+		for _, kop := range keyOps {
+			if kop.op != op || kop.metadataJSON != keyOps[0].metadataJSON {
+				errs = append(errs, fmt.Errorf("key ops for %s don't match: %s vs %s", keyOpKeyHash, kop.op, op))
+				continue
+			}
+			signingKeyState, err := keys.getValid(kop.signatureKeyHash)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("key op for %s not signed by a valid signatory: %v", keyOpKeyHash, err))
+				continue
+			}
+			if height == 0 && kop.signatureKeyHash != dbb.SignaturePublicKeyHash {
+				errs = append(errs, fmt.Errorf("genesis key op for %s not signed by the genesis block's creator", keyOpKeyHash))
+				continue
+			}
+			if !keyCanSignKeyOps(signingKeyState.metadata) {
+				errs = append(errs, fmt.Errorf("key op for %s signed by %s, whose role doesn't allow signing key ops", keyOpKeyHash, kop.signatureKeyHash))
+				continue
+			}
+			if err = keyCheckActive(signingKeyState.addHeight, signingKeyState.metadata, height); err != nil {
+				errs = append(errs, fmt.Errorf("key op for %s signed by %s: %v", keyOpKeyHash, kop.signatureKeyHash, err))
+				continue
+			}
+			signingKey, err := cryptoDecodePublicKeyBytes(signingKeyState.publicKeyBytes)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot decode public key %s", kop.signatureKeyHash))
+				continue
+			}
+			if err = cryptoVerifyKeyOpSignature(signingKey, &kop); err != nil {
+				errs = append(errs, fmt.Errorf("key op signature invalid for signer %s: %v", kop.signatureKeyHash, err))
+				continue
+			}
+			if !signers[kop.signatureKeyHash] {
+				signers[kop.signatureKeyHash] = true
+				weight += keyWeight(signingKeyState.metadata)
+			}
 		}
-		previousHashBytes, err := hex.DecodeString(dbb.PreviousBlockHash)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot decode previous block hash %s", height, dbb.PreviousBlockHash)
+		if weight < Q {
+			errs = append(errs, fmt.Errorf("key ops for %s don't have quorum: weight %d vs Q=%d", keyOpKeyHash, weight, Q))
 		}
-		err = cryptoVerifyBytes(creatorPublicKey, previousHashBytes, dbb.PreviousBlockHashSignature)
+	}
+
+	if paramErr != nil {
+		return append(errs, fmt.Errorf("cannot get chain param updates: %v", paramErr))
+	}
+	err = node.blockchainVerifyParamOps(height, paramOps, node.KeyOpThreshold(height, keys.keyOpWeight(height)), func(publicKeyHash string) (*ecdsa.PublicKey, map[string]string, error) {
+		k, err := keys.getValid(publicKeyHash)
 		if err != nil {
-			return fmt.Errorf("block %d: previous block hash signature is invalid (%v)", height, err)
+			return nil, nil, err
 		}
-		b, err := OpenBlockByHeight(height)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot open block db file: %v", height, err)
+		if err = keyCheckActive(k.addHeight, k.metadata, height); err != nil {
+			return nil, nil, err
 		}
-		blockKeyOps, err := b.dbGetKeyOps()
+		publicKey, err := cryptoDecodePublicKeyBytes(k.publicKeyBytes)
+		return publicKey, k.metadata, err
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Verifies the creator's signatures of the block hash and the previous block hash, and the
+// cosignatures.
+func (node *Node) blockchainVerifyBlockSignatures(height int, dbb *DbBlockchainBlock, keys blockchainKeySet) (errs []error) {
+	creatorKey, err := keys.getValid(dbb.SignaturePublicKeyHash)
+	if err != nil {
+		return []error{fmt.Errorf("not signed by a valid signatory: %v", err)}
+	}
+	if !keyCanSignBlocks(creatorKey.metadata) {
+		return []error{fmt.Errorf("signed by %s, whose role doesn't allow signing blocks", dbb.SignaturePublicKeyHash)}
+	}
+	if err = keyCheckActive(creatorKey.addHeight, creatorKey.metadata, height); err != nil {
+		return []error{fmt.Errorf("signed by %s: %v", dbb.SignaturePublicKeyHash, err)}
+	}
+	creatorPublicKey, err := cryptoDecodePublicKeyBytes(creatorKey.publicKeyBytes)
+	if err != nil {
+		return []error{fmt.Errorf("cannot decode public key %s", dbb.SignaturePublicKeyHash)}
+	}
+	if hashBytes, err := hex.DecodeString(dbb.Hash); err != nil {
+		errs = append(errs, fmt.Errorf("cannot decode hash %s", dbb.Hash))
+	} else if err = cryptoVerifyBytes(creatorPublicKey, hashBytes, dbb.HashSignature); err != nil {
+		errs = append(errs, fmt.Errorf("block hash signature is invalid (%v)", err))
+	}
+	if previousHashBytes, err := hex.DecodeString(dbb.PreviousBlockHash); err != nil {
+		errs = append(errs, fmt.Errorf("cannot decode previous block hash %s", dbb.PreviousBlockHash))
+	} else if err = cryptoVerifyBytes(creatorPublicKey, previousHashBytes, dbb.PreviousBlockHashSignature); err != nil {
+		errs = append(errs, fmt.Errorf("previous block hash signature is invalid (%v)", err))
+	}
+	err = blockchainVerifyCosignatures(dbb, node.SignatureQuorumForHeight(height), func(publicKeyHash string) (*ecdsa.PublicKey, error) {
+		k, err := keys.getValid(publicKeyHash)
 		if err != nil {
-			if err := b.Close(); err != nil {
-				panic(err)
-			}
-			return fmt.Errorf("block %d: cannot get key ops: %v", height, err)
+			return nil, err
 		}
-		if err = b.Close(); err != nil {
-			panic(err)
+		if !keyCanSignBlocks(k.metadata) {
+			return nil, fmt.Errorf("the role of %s doesn't allow signing blocks", publicKeyHash)
 		}
-		Q := QuorumForHeight(height)
-		for keyOpKeyHash, keyOps := range blockKeyOps {
-			if len(keyOps) != Q {
-				return fmt.Errorf("block %d: key ops for %s don't have quorum: %d vs Q=%d",
-					height, keyOpKeyHash, len(keyOps), Q)
-			}
-			op := keyOps[0].op
-			for _, kop := range keyOps {
-				if kop.op != op {
-					return fmt.Errorf("block %d: key ops for %s don't match: %s vs %s",
-						height, keyOpKeyHash, kop.op, op)
-				}
-				dbSigningKey, err := dbGetPublicKey(kop.signatureKeyHash)
-				if err != nil {
-					return fmt.Errorf("block %d: cannot get public key %s from main db", height, kop.signatureKeyHash)
-				}
-				signingKey, err := cryptoDecodePublicKeyBytes(dbSigningKey.publicKeyBytes)
-				if err != nil {
-					return fmt.Errorf("block %d: cannot decode public key %s", height, dbSigningKey.publicKeyHash)
-				}
-				if err = cryptoVerifyPublicKeyHashSignature(signingKey, kop.publicKeyHash, kop.signature); err != nil {
-					return fmt.Errorf("block %d: key op signature invalid for signer %s: %v", height, kop.signatureKeyHash, err)
-				}
-			}
+		if err = keyCheckActive(k.addHeight, k.metadata, height); err != nil {
+			return nil, fmt.Errorf("%s: %v", publicKeyHash, err)
 		}
+		return cryptoDecodePublicKeyBytes(k.publicKeyBytes)
+	})
+	if err != nil {
+		errs = append(errs, err)
 	}
-	return nil
+	return errs
 }
 
-// Checks if a new block can be accepted to extend the blockchain
-func checkAcceptBlock(blk *Block) (int, error) {
+// blockUnconnectedError is the error of a block which doesn't extend the local chain, because
+// its previous block isn't in it, or is followed by another block. Such a block can be valid
+// on another branch of the chain, or the node can be behind, so it's not the sender's fault.
+type blockUnconnectedError struct {
+	err error
+}
+
+func (e blockUnconnectedError) Error() string {
+	return e.err.Error()
+}
+
+// Checks if a new block can be accepted to extend the blockchain. Returns a
+// blockUnconnectedError if the block doesn't extend the chain.
+func (node *Node) checkAcceptBlock(blk *Block) (int, error) {
+	if err := dbValidateBlockKeys(blk.db); err != nil {
+		return 0, err
+	}
+	if err := dbValidateBlockParams(blk.db); err != nil {
+		return 0, err
+	}
+	if err := dbValidateBlockNotary(blk.db); err != nil {
+		return 0, err
+	}
+	if err := blk.tsaVerifyPreviousBlock(); err != nil {
+		return 0, err
+	}
 	// Step 1: Does the block fit, i.e. does it extend the chain?
-	if blk.Version != CurrentBlockVersion {
+	if blockVersionFormat(blk.Version) != CurrentBlockVersion {
 		return 0, fmt.Errorf("Unsupported block version: %d", blk.Version)
 	}
-	prevBlk, err := dbGetBlock(blk.PreviousBlockHash)
+	prevBlk, err := node.dbGetBlock(blk.PreviousBlockHash)
 	if err != nil {
-		return 0, fmt.Errorf("Cannot find previous block %s: %v", blk.PreviousBlockHash, err)
+		return 0, blockUnconnectedError{fmt.Errorf("Cannot find previous block %s: %v", blk.PreviousBlockHash, err)}
 	}
 	thisBlockHeight := prevBlk.Height + 1
-	if _, err = dbGetBlockByHeight(thisBlockHeight); err == nil {
-		return 0, fmt.Errorf("The block to accept would replace an existing block, and this is not supported yet (height=%d)", prevBlk.Height+1)
+	if _, err = node.dbGetBlockByHeight(thisBlockHeight); err == nil {
+		return 0, blockUnconnectedError{fmt.Errorf("The block to accept would replace an existing block, and this is not supported yet (height=%d)", prevBlk.Height+1)}
+	}
+	if err = blk.anchorVerifyRecords(node, thisBlockHeight); err != nil {
+		return 0, err
 	}
 	// Step 2: Is the block signed by a valid signatory?
-	signatoryPubKey, err := dbGetPublicKey(blk.SignaturePublicKeyHash)
+	signatoryPubKey, err := node.dbGetPublicKey(blk.SignaturePublicKeyHash)
 	if err != nil {
 		return 0, fmt.Errorf("Cannot find an accepted public key %s signing the block", blk.SignaturePublicKeyHash)
 	}
 	if signatoryPubKey.isRevoked {
 		return 0, fmt.Errorf("The public key %s signing the block is revoked on %v", blk.SignaturePublicKeyHash, signatoryPubKey.timeRevoked)
 	}
+	if !keyCanSignBlocks(signatoryPubKey.metadata) {
+		return 0, fmt.Errorf("The role of the public key %s signing the block doesn't allow signing blocks", blk.SignaturePublicKeyHash)
+	}
+	if err = keyCheckActive(signatoryPubKey.addBlockHeight, signatoryPubKey.metadata, thisBlockHeight); err != nil {
+		return 0, fmt.Errorf("The public key %s signing the block can't sign it yet: %v", blk.SignaturePublicKeyHash, err)
+	}
 	sigPubKey, err := cryptoDecodePublicKeyBytes(signatoryPubKey.publicKeyBytes)
 	if err != nil {
 		return 0, fmt.Errorf("Cannot decode public key %s: %v", blk.SignaturePublicKeyHash, err)
@@ -335,96 +633,266 @@ func checkAcceptBlock(blk *Block) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("Verification of block hash has failed: %v", err)
 	}
+	if err = blk.notaryVerifyRoot(sigPubKey); err != nil {
+		return 0, err
+	}
+	err = blockchainVerifyCosignatures(blk.DbBlockchainBlock, node.SignatureQuorumForHeight(thisBlockHeight), func(publicKeyHash string) (*ecdsa.PublicKey, error) {
+		dbpk, err := node.dbGetPublicKey(publicKeyHash)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find an accepted public key %s", publicKeyHash)
+		}
+		if dbpk.isRevoked {
+			return nil, fmt.Errorf("the public key %s is revoked on %v", publicKeyHash, dbpk.timeRevoked)
+		}
+		if !keyCanSignBlocks(dbpk.metadata) {
+			return nil, fmt.Errorf("the role of the public key %s doesn't allow signing blocks", publicKeyHash)
+		}
+		if err = keyCheckActive(dbpk.addBlockHeight, dbpk.metadata, thisBlockHeight); err != nil {
+			return nil, fmt.Errorf("the public key %s can't sign the block yet: %v", publicKeyHash, err)
+		}
+		return cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	})
+	if err != nil {
+		return 0, err
+	}
 	allKeyOps, err := blk.dbGetKeyOps()
 	if err != nil {
 		return 0, err
 	}
-	targetQuorum := QuorumForHeight(thisBlockHeight)
+	keyOpWeight, err := node.dbGetKeyOpWeight(thisBlockHeight)
+	if err != nil {
+		return 0, err
+	}
+	targetQuorum := node.KeyOpThreshold(thisBlockHeight, keyOpWeight)
 	for key, keyOps := range allKeyOps {
-		if len(keyOps) < targetQuorum {
-			return 0, fmt.Errorf("Quorum of %d not met for key ops on key %s", targetQuorum, key)
+		if keyOps[0].op == "M" {
+			// Metadata is set by the key itself, so there's no quorum
+			dbpk, err := node.dbGetPublicKey(key)
+			if err != nil || dbpk.isRevoked {
+				return 0, fmt.Errorf("Metadata op for a key which isn't a valid signatory: %s", key)
+			}
+			if err = blockchainVerifyKeyMetadataOp(dbpk.publicKeyBytes, keyOps, thisBlockHeight); err != nil {
+				return 0, err
+			}
+			if err = checkKeyGovernanceUnchanged(dbpk.metadata, keyOps[0].metadata); err != nil {
+				return 0, fmt.Errorf("Metadata op for %s: %v", key, err)
+			}
+			continue
 		}
+		weight := 0
+		signers := map[string]bool{}
 		for _, keyOp := range keyOps {
-			signatoryPubKey, err = dbGetPublicKey(keyOp.signatureKeyHash)
+			if keyOp.op != keyOps[0].op || keyOp.metadataJSON != keyOps[0].metadataJSON {
+				return 0, fmt.Errorf("Key ops for %s don't match", key)
+			}
+			signatoryPubKey, err = node.dbGetPublicKey(keyOp.signatureKeyHash)
 			if err != nil {
 				return 0, fmt.Errorf("Error retrieving supposedly key op signatory %s", keyOp.signatureKeyHash)
 			}
+			if signatoryPubKey.isRevoked || !keyCanSignKeyOps(signatoryPubKey.metadata) {
+				return 0, fmt.Errorf("Key op for %s signed by %s, which can't sign key ops", key, keyOp.signatureKeyHash)
+			}
+			if err = keyCheckActive(signatoryPubKey.addBlockHeight, signatoryPubKey.metadata, thisBlockHeight); err != nil {
+				return 0, fmt.Errorf("Key op for %s signed by %s: %v", key, keyOp.signatureKeyHash, err)
+			}
 			sigPubKey, err := cryptoDecodePublicKeyBytes(signatoryPubKey.publicKeyBytes)
 			if err != nil {
 				return 0, fmt.Errorf("Cannot decode public key %s: %v", signatoryPubKey.publicKeyHash, err)
 			}
-			err = cryptoVerifyPublicKeyHashSignature(sigPubKey, key, keyOp.signature)
+			err = cryptoVerifyKeyOpSignature(sigPubKey, &keyOp)
 			if err != nil {
 				return 0, fmt.Errorf("Failed verification of key op for %s by %s", key, keyOp.signatureKeyHash)
 			}
+			if !signers[keyOp.signatureKeyHash] {
+				signers[keyOp.signatureKeyHash] = true
+				weight += keyWeight(signatoryPubKey.metadata)
+			}
+		}
+		if weight < targetQuorum {
+			return 0, fmt.Errorf("Quorum of %d not met for key ops on key %s: the signatures have the weight of %d", targetQuorum, key, weight)
 		}
 		// At this point, all required signatures have been verified
 		if keyOps[0].op == "A" {
-			// Add the key to the list of valid signatories. But first, check if it already exists.
-			_, err := dbGetPublicKey(key)
+			// The key will be added to the list of valid signatories. But first, check if it already exists.
+			_, err := node.dbGetPublicKey(key)
 			if err == nil {
 				return 0, fmt.Errorf("Attempt to add an already existing key to the list of signatores")
 			}
-			dbWritePublicKey(keyOps[0].publicKeyBytes, key, thisBlockHeight)
 		} else if keyOps[0].op == "R" {
-			// Revoke the key. But first, check if it's already revoked.
-			dbpk, err := dbGetPublicKey(key)
+			// The key will be revoked. But first, check if it's already revoked.
+			dbpk, err := node.dbGetPublicKey(key)
 			if err != nil {
 				return 0, fmt.Errorf("Cannot retrieve key to revoke: %s", key)
 			}
 			if dbpk.isRevoked {
 				return 0, fmt.Errorf("Attempt to revoke a key which is already revoked: %s", key)
 			}
-			dbRevokePublicKey(key)
 		} else {
 			return 0, fmt.Errorf("Invalid key op: %s", keyOps[0].op)
 		}
 	}
+	paramOps, err := blk.dbGetParamOps()
+	if err != nil {
+		return 0, err
+	}
+	err = node.blockchainVerifyParamOps(thisBlockHeight, paramOps, targetQuorum, func(publicKeyHash string) (*ecdsa.PublicKey, map[string]string, error) {
+		dbpk, err := node.dbGetPublicKey(publicKeyHash)
+		if err != nil || dbpk.isRevoked {
+			return nil, nil, fmt.Errorf("not a valid signatory")
+		}
+		if err = keyCheckActive(dbpk.addBlockHeight, dbpk.metadata, thisBlockHeight); err != nil {
+			return nil, nil, err
+		}
+		publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+		return publicKey, dbpk.metadata, err
+	})
+	if err != nil {
+		return 0, err
+	}
 	// Everything's ok, the block is ok to import.
 	return thisBlockHeight, nil
 }
 
-// QuorumForHeight calculates the required key op quorum for the given block height
-func QuorumForHeight(h int) int {
-	if h < 149 {
-		return 1
+// Applies the key ops from an accepted block to the list of signatories, in the transaction
+// on the main database which inserts the block. The key ops must have been verified by
+// checkAcceptBlock().
+func blockchainApplyKeyOps(tx *dbTx, blk *Block, height int) error {
+	allKeyOps, err := blk.dbGetKeyOps()
+	if err != nil {
+		return err
+	}
+	for key, keyOps := range allKeyOps {
+		switch keyOps[0].op {
+		case "A":
+			if err = dbWritePublicKey(tx, keyOps[0].publicKeyBytes, key, height); err != nil {
+				return err
+			}
+			if len(keyOps[0].metadata) > 0 {
+				if err = dbSetPublicKeyMetadata(tx, key, keyOps[0].metadata); err != nil {
+					return err
+				}
+			}
+		case "R":
+			if err = dbRevokePublicKey(tx, key); err != nil {
+				return err
+			}
+		case "M":
+			if err = dbSetPublicKeyMetadata(tx, key, keyOps[0].metadata); err != nil {
+				return err
+			}
+		}
 	}
-	return int(math.Log(float64(h)) * 2)
+	return nil
 }
 
-// Formats the block height into a blockchain file (SQLite database) filename
-func blockchainGetFilename(h int) string {
-	return fmt.Sprintf(rawBlockFilenameFormat, blockchainSubdirectory, h/65536, h)
+// Removes the metadata of my keys published by an accepted block from the metadata waiting
+// to be published, in the private database
+func (node *Node) blockchainClearPendingKeyMetadata(blk *Block) error {
+	allKeyOps, err := blk.dbGetKeyOps()
+	if err != nil {
+		return err
+	}
+	for key, keyOps := range allKeyOps {
+		if keyOps[0].op != "M" {
+			continue
+		}
+		if err = node.dbClearPendingKeyMetadata(key, keyOps[0].metadataJSON); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func blockchainEnsureBlockDir(h int) error {
-	dirName := fmt.Sprintf(rawBlockDirnameFormat, blockchainSubdirectory, h/65536)
-	return os.MkdirAll(dirName, 0755)
+// Publishes the key_added and key_revoked events for the key ops of an accepted block
+func (node *Node) publishKeyOpEvents(blk *Block, height int) {
+	allKeyOps, err := blk.dbGetKeyOps()
+	if err != nil {
+		chainLog.Error("Cannot read key ops from block", blk.Hash, err)
+		return
+	}
+	for key, keyOps := range allKeyOps {
+		switch keyOps[0].op {
+		case "A":
+			node.nodeEvents.Publish(eventKeyAdded, StrIfMap{"pubkey_hash": key, "hash": blk.Hash, "height": height})
+		case "R":
+			node.nodeEvents.Publish(eventKeyRevoked, StrIfMap{"pubkey_hash": key, "hash": blk.Hash, "height": height})
+		}
+	}
 }
 
-// OpenBlockByHeight opens a block stored in the blockchain at the given height
-func OpenBlockByHeight(height int) (*Block, error) {
-	b := Block{DbBlockchainBlock: &DbBlockchainBlock{Height: height}}
-	if err := blockchainEnsureBlockDir(height); err != nil {
-		return nil, err
+// Verifies a key metadata op in the block at the given height, which must be signed by the key
+// itself
+func blockchainVerifyKeyMetadataOp(publicKeyBytes []byte, keyOps []BlockKeyOp, height int) error {
+	kop := keyOps[0]
+	if len(keyOps) != 1 || kop.signatureKeyHash != kop.publicKeyHash {
+		return fmt.Errorf("metadata op for %s must be signed only by the key itself", kop.publicKeyHash)
 	}
-	blockFilename := blockchainGetFilename(height)
-	hash, err := hashFileToHexString(blockFilename)
+	publicKey, err := cryptoDecodePublicKeyBytes(publicKeyBytes)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("cannot decode public key %s", kop.publicKeyHash)
 	}
-	dbb, err := dbGetBlockByHeight(height)
+	if err = cryptoVerifyBytes(publicKey, cryptoKeyMetadataOpHash(kop.publicKeyHash, kop.metadataJSON, height), kop.signature); err != nil {
+		return fmt.Errorf("metadata op signature invalid for %s: %v", kop.publicKeyHash, err)
+	}
+	return nil
+}
+
+// QuorumForHeight calculates the required key op quorum for the given block height, with the
+// chain's quorum policy in effect at that height
+func (node *Node) QuorumForHeight(h int) int {
+	return node.chainParamsAt(h).quorumPolicy().quorum(h)
+}
+
+// SignatureQuorumForHeight returns the number of distinct signatories which must sign the block
+// at the given height. The genesis block is only signed by its creator.
+func (node *Node) SignatureQuorumForHeight(h int) int {
+	if q := node.networkSignatureQuorum(); h > 0 && q > 1 {
+		return q
+	}
+	return 1
+}
+
+// Verifies the cosignatures of the block hash and checks that, together with the creator,
+// the block is signed by at least quorum distinct signatories. The creator's signature must
+// be verified separately. getKey returns the public key of a valid signatory.
+func blockchainVerifyCosignatures(dbb *DbBlockchainBlock, quorum int, getKey func(publicKeyHash string) (*ecdsa.PublicKey, error)) error {
+	hashBytes, err := hex.DecodeString(dbb.Hash)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("cannot decode hash %s", dbb.Hash)
+	}
+	signatories := map[string]bool{dbb.SignaturePublicKeyHash: true}
+	for _, sig := range dbb.Cosignatures {
+		if signatories[sig.PublicKeyHash] {
+			return fmt.Errorf("duplicate signature by %s", sig.PublicKeyHash)
+		}
+		publicKey, err := getKey(sig.PublicKeyHash)
+		if err != nil {
+			return fmt.Errorf("cosignature not by a valid signatory: %v", err)
+		}
+		if err = cryptoVerifyBytes(publicKey, hashBytes, sig.Signature); err != nil {
+			return fmt.Errorf("cosignature by %s is invalid: %v", sig.PublicKeyHash, err)
+		}
+		signatories[sig.PublicKeyHash] = true
 	}
-	if hash != dbb.Hash {
-		return nil, fmt.Errorf("Recorded block hash doesn't match actual: %s vs %s", dbb.Hash, hash)
+	if len(signatories) < quorum {
+		return fmt.Errorf("the block is signed by %d signatories, %d are required", len(signatories), quorum)
 	}
-	b.DbBlockchainBlock = dbb
-	b.db, err = dbOpen(blockFilename, true)
+	return nil
+}
+
+// OpenBlockByHeight opens a block stored in the blockchain at the given height
+func (node *Node) OpenBlockByHeight(height int) (*Block, error) {
+	b := Block{DbBlockchainBlock: &DbBlockchainBlock{Height: height}}
+	dbb, err := node.dbGetBlockByHeight(height)
 	if err != nil {
 		return nil, err
 	}
+	b.DbBlockchainBlock = dbb
+	// The block file's hash is checked when it's first opened
+	if b.bdb, err = node.blockDBs.Get(dbb.Hash); err != nil {
+		return nil, err
+	}
+	b.db = b.bdb.db
 	return &b, nil
 }
 
@@ -439,6 +907,10 @@ func OpenBlockFile(fileName string) (*Block, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = dbValidateBlockMeta(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	b := Block{DbBlockchainBlock: &DbBlockchainBlock{Hash: hash}, db: db}
 	if b.Version, err = b.dbGetMetaInt("Version"); err != nil {
 		return nil, err
@@ -462,14 +934,37 @@ func OpenBlockFile(fileName string) (*Block, error) {
 	return &b, nil
 }
 
+// Closes the block database, or gives back the shared handle
 func (b *Block) Close() error {
+	if b.bdb != nil {
+		b.bdb.cache.Release(b.bdb)
+		b.bdb = nil
+		return nil
+	}
 	return b.db.Close()
 }
 
+// Runs a query on the block database, with a cached prepared statement if possible
+func (b *Block) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if b.bdb != nil {
+		return b.bdb.Query(query, args...)
+	}
+	return b.db.Query(query, args...)
+}
+
+// Runs a query returning at most one row on the block database, with a cached prepared
+// statement if possible
+func (b *Block) queryRow(query string, args ...interface{}) *sql.Row {
+	if b.bdb != nil {
+		return b.bdb.QueryRow(query, args...)
+	}
+	return b.db.QueryRow(query, args...)
+}
+
 // Returns an integer value from the _meta table within the block
 func (b *Block) dbGetMetaInt(key string) (int, error) {
 	var value string
-	if err := b.db.QueryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
+	if err := b.queryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
 		return -1, err
 	}
 	return strconv.Atoi(value)
@@ -478,7 +973,7 @@ func (b *Block) dbGetMetaInt(key string) (int, error) {
 // Returns a timestamp value from the _meta table within the block
 func (b *Block) dbGetMetaTime(key string) (time.Time, error) {
 	var value string
-	if err := b.db.QueryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
+	if err := b.queryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
 		return time.Time{}, err
 	}
 	t, err := time.Parse(time.RFC3339, value)
@@ -488,7 +983,7 @@ func (b *Block) dbGetMetaTime(key string) (time.Time, error) {
 // Returns a string value from the _meta table within the block
 func (b *Block) dbGetMetaString(key string) (string, error) {
 	var value string
-	if err := b.db.QueryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
+	if err := b.queryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
 		return "", err
 	}
 	return value, nil
@@ -497,21 +992,67 @@ func (b *Block) dbGetMetaString(key string) (string, error) {
 // Returns a byte blob value from the _meta table within the block (stored in the db as a hex string)
 func (b *Block) dbGetMetaHexBytes(key string) ([]byte, error) {
 	var value string
-	if err := b.db.QueryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
+	if err := b.queryRow("SELECT value FROM _meta WHERE key=?", key).Scan(&value); err != nil {
 		return nil, err
 	}
 	return hex.DecodeString(value)
 }
 
+// Returns the names of user tables in the block, i.e. excluding the SQLite and the blockchain
+// metadata tables.
+func (b *Block) dbGetTableNames() ([]string, error) {
+	rows, err := b.query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name NOT IN ('_meta', '_keys', '_params') ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Returns the column definitions of the given table in the block, as "name TYPE" strings.
+func (b *Block) dbGetTableColumns(table string) ([]string, error) {
+	rows, err := b.query(fmt.Sprintf("PRAGMA table_info(%s)", dbQuoteIdentifier(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue interface{}
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, strings.TrimSpace(name+" "+colType))
+	}
+	return columns, rows.Err()
+}
+
+// Returns the number of rows in the given table in the block
+func (b *Block) dbGetTableRowCount(table string) (int, error) {
+	var count int
+	err := b.queryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", dbQuoteIdentifier(table))).Scan(&count)
+	return count, err
+}
+
 // Returns a map of key operations stored in the block. Map keys are public key hashes, values are lists of ops.
 func (b *Block) dbGetKeyOps() (map[string][]BlockKeyOp, error) {
 	var count int
-	if err := b.db.QueryRow("SELECT COUNT(*) FROM _keys").Scan(&count); err != nil {
-		log.Println("Error reading db _keys")
+	if err := b.queryRow("SELECT COUNT(*) FROM _keys").Scan(&count); err != nil {
+		chainLog.Error("Error reading db _keys")
 		return nil, err
 	}
 	keyOps := make(map[string][]BlockKeyOp)
-	rows, err := b.db.Query("SELECT op, pubkey_hash, pubkey, sigkey_hash, signature, COALESCE(metadata, '') FROM _keys")
+	rows, err := b.query("SELECT op, pubkey_hash, pubkey, sigkey_hash, signature, COALESCE(metadata, '') FROM _keys")
 	if err != nil {
 		return nil, err
 	}
@@ -537,6 +1078,7 @@ func (b *Block) dbGetKeyOps() (map[string][]BlockKeyOp, error) {
 		if keyOp.signature, err = hex.DecodeString(signatureHex); err != nil {
 			return nil, err
 		}
+		keyOp.metadataJSON = metadataJSON
 		if metadataJSON != "" {
 			if err = json.Unmarshal([]byte(metadataJSON), &keyOp.metadata); err != nil {
 				return nil, err
@@ -561,16 +1103,19 @@ func (b *Block) dbGetKeyOps() (map[string][]BlockKeyOp, error) {
 
 // Ensures special metadata tables exist in a SQLite database
 func dbEnsureBlockchainTables(db *sql.DB) {
-	if !dbTableExists(db, "_meta") {
-		_, err := db.Exec(metaTableCreate)
+	for _, t := range []struct{ name, create string }{
+		{"_meta", metaTableCreate},
+		{"_keys", keysTableCreate},
+	} {
+		exists, err := dbTableExists(db, t.name)
 		if err != nil {
-			log.Fatal(err)
+			chainLog.Fatal(err)
 		}
-	}
-	if !dbTableExists(db, "_keys") {
-		_, err := db.Exec(keysTableCreate)
-		if err != nil {
-			log.Fatal(err)
+		if exists {
+			continue
+		}
+		if _, err = db.Exec(t.create); err != nil {
+			chainLog.Fatal(err)
 		}
 	}
 }
@@ -586,30 +1131,3 @@ func dbSetMetaInt(db *sql.DB, key string, value int) error {
 	_, err := db.Exec("INSERT OR REPLACE INTO _meta(key, value) VALUES (?, ?)", key, value)
 	return err
 }
-
-// Copies a given file to the blockchain directory and names it as a block with the given height
-func blockchainCopyFile(fn string, height int) error {
-	if err := blockchainEnsureBlockDir(height); err != nil {
-		return err
-	}
-	blockFilename := blockchainGetFilename(height)
-	in, err := os.Open(fn)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = in.Close()
-		if err != nil {
-			log.Printf("blockchainCopyFile in.Close: %v", err)
-		}
-	}()
-	out, err := os.Create(blockFilename)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(out, in)
-	if err != nil {
-		return err
-	}
-	return out.Close()
-}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The createblock command creates a new block file from data files, one table per file, so that
+ * data can be added to the blockchain without using SQLite tools. The table name is the file
+ * name without the extension, and the format is detected from the extension:
+ *   .csv        - the first row contains the column names
+ *   .json       - an array of objects, or one object per line (JSON lines)
+ *   .jsonl      - one object per line
+ *   .sql        - SQL statements, executed as they are
+ * Column types of CSV and JSON tables are inferred from the values.
+ */
+
+// Creates a block file from the given data files, ready for signimportblock
+func actionCreateBlock(fn string, inputFiles []string) {
+	if fileExists(fn) {
+		log.Fatalln(fn, "already exists")
+	}
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, inputFile := range inputFiles {
+		if err = blockCreateAddFile(db, inputFile); err != nil {
+			db.Close()
+			os.Remove(fn)
+			log.Fatalln(inputFile+":", err)
+		}
+	}
+	dbEnsureBlockchainTables(db)
+	if err = db.Close(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Created", fn, "- sign and import it with: daisy signimportblock", fn)
+}
+
+// Adds the data from one input file to the block
+func blockCreateAddFile(db *sql.DB, inputFile string) error {
+	ext := strings.ToLower(filepath.Ext(inputFile))
+	table := strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile))
+	if ext != ".sql" && !blockCreateValidTableName(table) {
+		return fmt.Errorf("%s is not a valid table name", table)
+	}
+	data, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	var rows [][]interface{}
+	switch ext {
+	case ".sql":
+		_, err = db.Exec(string(data))
+		return err
+	case ".csv":
+		columns, rows, err = blockCreateReadCSV(data)
+	case ".json", ".jsonl":
+		columns, rows, err = blockCreateReadJSON(data)
+	default:
+		return fmt.Errorf("unknown file type %s, expecting .csv, .json, .jsonl or .sql", ext)
+	}
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("no columns found")
+	}
+	log.Println("Creating table", table, "with", len(columns), "columns and", len(rows), "rows")
+	return blockCreateTable(db, table, columns, rows)
+}
+
+// Returns true if the table name can be used for user data, i.e. it isn't a blockchain
+// metadata or an SQLite table name
+func blockCreateValidTableName(table string) bool {
+	return table != "" && !strings.HasPrefix(table, "_") && !strings.HasPrefix(strings.ToLower(table), "sqlite_")
+}
+
+// Reads a CSV file with the column names in the first row
+func blockCreateReadCSV(data []byte) ([]string, [][]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, nil
+	}
+	rows := make([][]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make([]interface{}, len(record))
+		for i, s := range record {
+			row[i] = blockCreateParseCSVValue(s)
+		}
+		rows = append(rows, row)
+	}
+	return records[0], rows, nil
+}
+
+// Converts a CSV field into a number if it is one, and empty fields into NULL
+func blockCreateParseCSVValue(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	// Only convert values which can be converted back exactly, keeping e.g. "007" as text
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(i, 10) == s {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == s {
+		return f
+	}
+	return s
+}
+
+// Reads a JSON array of objects, or JSON objects one per line. Columns are collected from the
+// keys in the order they first appear.
+func blockCreateReadJSON(data []byte) ([]string, [][]interface{}, error) {
+	var objects []map[string]interface{}
+	var columns []string
+	known := map[string]bool{}
+	addObject := func(dec *json.Decoder) error {
+		obj, keys, err := blockCreateDecodeObject(dec)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !known[key] {
+				known[key] = true
+				columns = append(columns, key)
+			}
+		}
+		objects = append(objects, obj)
+		return nil
+	}
+
+	data = bytes.TrimSpace(data)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if len(data) > 0 && data[0] == '[' {
+		if _, err := dec.Token(); err != nil {
+			return nil, nil, err
+		}
+	}
+	for dec.More() {
+		if err := addObject(dec); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rows := make([][]interface{}, len(objects))
+	for i, obj := range objects {
+		row := make([]interface{}, len(columns))
+		for j, column := range columns {
+			row[j] = blockCreateJSONValue(obj[column])
+		}
+		rows[i] = row
+	}
+	return columns, rows, nil
+}
+
+// Decodes the next JSON object from the decoder, also returning its keys in the order they
+// appear, which maps don't keep
+func blockCreateDecodeObject(dec *json.Decoder) (map[string]interface{}, []string, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return nil, nil, fmt.Errorf("expecting a JSON object, found %v", t)
+	}
+	obj := map[string]interface{}{}
+	var keys []string
+	for dec.More() {
+		t, err = dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := t.(string)
+		var value interface{}
+		if err = dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := obj[key]; !ok {
+			keys = append(keys, key)
+		}
+		obj[key] = value
+	}
+	// The closing brace
+	if _, err = dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	return obj, keys, nil
+}
+
+// Converts a decoded JSON value into a value for SQLite. Nested objects and arrays are
+// stored as JSON text.
+func blockCreateJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string:
+		return v
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	default:
+		return string(jsonifyWhateverToBytes(v))
+	}
+}
+
+// Returns the column type for the values: INTEGER or REAL if all the values are numbers,
+// TEXT otherwise. NULLs are ignored.
+func blockCreateColumnType(rows [][]interface{}, column int) string {
+	colType := ""
+	for _, row := range rows {
+		if column >= len(row) {
+			continue
+		}
+		switch row[column].(type) {
+		case nil:
+		case int64:
+			if colType == "" {
+				colType = "INTEGER"
+			}
+		case float64:
+			if colType == "" || colType == "INTEGER" {
+				colType = "REAL"
+			}
+		default:
+			return "TEXT"
+		}
+	}
+	if colType == "" {
+		return "TEXT"
+	}
+	return colType
+}
+
+// Creates the table and inserts the rows
+func blockCreateTable(db *sql.DB, table string, columns []string, rows [][]interface{}) error {
+	_, err := blockCreateTableRows(db, table, columns, rows, false)
+	return err
+}
+
+// Creates the table and inserts the rows. If skipBadRows is true, the rows which can't be
+// inserted are skipped, and their indexes returned, instead of failing.
+func blockCreateTableRows(db *sql.DB, table string, columns []string, rows [][]interface{}, skipBadRows bool) ([]int, error) {
+	defs := make([]string, len(columns))
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = dbQuoteIdentifier(c)
+		defs[i] = quoted[i] + " " + blockCreateColumnType(rows, i)
+		placeholders[i] = "?"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", dbQuoteIdentifier(table), strings.Join(defs, ", "))); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", dbQuoteIdentifier(table), strings.Join(quoted, ", "), strings.Join(placeholders, ", ")))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer stmt.Close()
+	var skipped []int
+	for n, row := range rows {
+		if len(row) != len(columns) {
+			err = fmt.Errorf("row %d has %d values, expecting %d", n+1, len(row), len(columns))
+		} else {
+			// A failed statement is rolled back by SQLite without the rest of the transaction
+			_, err = stmt.Exec(row...)
+		}
+		if err != nil {
+			if !skipBadRows {
+				tx.Rollback()
+				return nil, err
+			}
+			skipped = append(skipped, n)
+		}
+	}
+	return skipped, tx.Commit()
+}
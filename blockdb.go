@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+)
+
+/*
+ * Block databases never change once they're in the blockchain, so read-only handles to them
+ * can be kept open and shared. blockDBs keeps the recently used handles, with their prepared
+ * statements, in a bounded LRU. Handles which are in use are never closed; if the cache is
+ * over its size when a handle is released, the least recently used unused handles are closed.
+ */
+
+// The number of block database handles kept open
+const blockDBCacheSize = 64
+
+// BlockDB is a shared read-only handle to a block database
+type BlockDB struct {
+	hash     string
+	db       *sql.DB
+	stmts    map[string]*sql.Stmt
+	stmtLock WithMutex
+	refs     int
+	elem     *list.Element // The position in the LRU list, nil while in use
+	cache    *blockDBCache // The cache the handle is released to
+}
+
+type blockDBCache struct {
+	lock     WithMutex
+	capacity int
+	byHash   map[string]*BlockDB
+	lru      *list.List // Unused handles, the most recently used at the front
+	node     *Node
+}
+
+// Returns a handle to the block database with the given hash, opening it if needed. The
+// handle must be given back with Release.
+func (c *blockDBCache) Get(hash string) (*BlockDB, error) {
+	var bdb *BlockDB
+	c.lock.With(func() {
+		if bdb = c.byHash[hash]; bdb != nil {
+			c.acquire(bdb)
+		}
+	})
+	if bdb != nil {
+		return bdb, nil
+	}
+
+	// Open the file without holding the lock, as hashing it takes a while
+	fileName := c.node.blockStore.Filename(hash)
+	fileHash, err := hashFileToHexString(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if fileHash != hash {
+		return nil, fmt.Errorf("Recorded block hash doesn't match actual: %s vs %s", hash, fileHash)
+	}
+	db, err := dbOpen(fileName, true)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.With(func() {
+		if bdb = c.byHash[hash]; bdb != nil {
+			// Opened by someone else in the meantime
+			c.acquire(bdb)
+			return
+		}
+		bdb = &BlockDB{hash: hash, db: db, stmts: map[string]*sql.Stmt{}, refs: 1, cache: c}
+		c.byHash[hash] = bdb
+		db = nil
+	})
+	if db != nil {
+		db.Close()
+	}
+	return bdb, nil
+}
+
+// Marks the handle as used. Must be called with the lock held.
+func (c *blockDBCache) acquire(bdb *BlockDB) {
+	if bdb.elem != nil {
+		c.lru.Remove(bdb.elem)
+		bdb.elem = nil
+	}
+	bdb.refs++
+}
+
+// Gives back a handle returned by Get
+func (c *blockDBCache) Release(bdb *BlockDB) {
+	var evicted []*BlockDB
+	c.lock.With(func() {
+		bdb.refs--
+		if bdb.refs > 0 {
+			return
+		}
+		bdb.elem = c.lru.PushFront(bdb)
+		for len(c.byHash) > c.capacity && c.lru.Len() > 0 {
+			old := c.lru.Remove(c.lru.Back()).(*BlockDB)
+			old.elem = nil
+			delete(c.byHash, old.hash)
+			evicted = append(evicted, old)
+		}
+	})
+	for _, old := range evicted {
+		old.close()
+	}
+}
+
+// Closes the handles which aren't in use
+func (c *blockDBCache) Flush() {
+	var evicted []*BlockDB
+	c.lock.With(func() {
+		for c.lru.Len() > 0 {
+			old := c.lru.Remove(c.lru.Back()).(*BlockDB)
+			old.elem = nil
+			delete(c.byHash, old.hash)
+			evicted = append(evicted, old)
+		}
+	})
+	for _, old := range evicted {
+		old.close()
+	}
+}
+
+// Closes the statements and the database
+func (bdb *BlockDB) close() {
+	for _, stmt := range bdb.stmts {
+		stmt.Close()
+	}
+	bdb.db.Close()
+}
+
+// Returns a prepared statement for the query, preparing it on the first use
+func (bdb *BlockDB) stmt(query string) (stmt *sql.Stmt, err error) {
+	bdb.stmtLock.With(func() {
+		if stmt = bdb.stmts[query]; stmt != nil {
+			return
+		}
+		if stmt, err = bdb.db.Prepare(query); err == nil {
+			bdb.stmts[query] = stmt
+		}
+	})
+	return
+}
+
+// Runs a query with a cached prepared statement
+func (bdb *BlockDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := bdb.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+// Runs a query returning at most one row with a cached prepared statement
+func (bdb *BlockDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := bdb.stmt(query)
+	if err != nil {
+		// The error will be reported by Scan
+		return bdb.db.QueryRow(query, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+// Returns the names of user tables in the block, i.e. excluding the SQLite and the blockchain
+// metadata tables.
+func (bdb *BlockDB) TableNames() ([]string, error) {
+	return dbQueryStrings(bdb, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name NOT IN ('_meta', '_keys', '_params') ORDER BY name")
+}
+
+// Returns the column names of the given table in the block
+func (bdb *BlockDB) ColumnNames(table string) ([]string, error) {
+	return dbQueryStrings(bdb, "SELECT name FROM pragma_table_info(?)", table)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+ * Comparing the user tables of two blocks, for the registry-style chains in which every block
+ * is a new snapshot of mostly the same data. Both blocks are attached to an in-memory database,
+ * and the differences are printed as JSON lines: the tables and the columns which were added or
+ * removed, and the rows. The rows of the tables with a primary key (the same in both blocks) are
+ * matched by it, so a row whose other columns differ is "changed", with the old and the new
+ * values; in the other tables, rows are compared whole, so a change is a removed and an added row
+ * (and duplicate rows are only reported once). The rows are compared on the columns both
+ * versions of the table have.
+ */
+
+// The differences in one table
+type blockDiffTable struct {
+	name    string
+	out     *bufio.Writer
+	db      *sql.DB
+	columns []string // The columns in both blocks
+	key     []string // The primary key, if it's the same in both blocks
+}
+
+// Compares the user tables of the two blocks, and prints the differences
+func (node *Node) actionDiffBlocks(blockArg1, blockArg2 string) {
+	hash1, err := node.resolveBlockArg(blockArg1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hash2, err := node.resolveBlockArg(blockArg2)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = node.blockDiff(os.Stdout, hash1, hash2); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Writes the differences between the blocks as JSON lines
+func (node *Node) blockDiff(w io.Writer, hash1, hash2 string) error {
+	db, err := dbOpen(":memory:", false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// ATTACH is per-connection
+	db.SetMaxOpenConns(1)
+	for schema, hash := range map[string]string{"old": hash1, "new": hash2} {
+		// The block file's hash is checked when it's first opened
+		bdb, err := node.blockDBs.Get(hash)
+		if err != nil {
+			return err
+		}
+		node.blockDBs.Release(bdb)
+		if _, err = db.Exec(fmt.Sprintf("ATTACH DATABASE ? AS %s", schema), "file:"+node.blockStore.Filename(hash)+"?mode=ro"); err != nil {
+			return err
+		}
+	}
+	tablesQuery := "SELECT name FROM %s.sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%%' AND name NOT IN ('_meta', '_keys', '_params') ORDER BY name"
+	oldTables, err := dbQueryStrings(db, fmt.Sprintf(tablesQuery, "old"))
+	if err != nil {
+		return err
+	}
+	newTables, err := dbQueryStrings(db, fmt.Sprintf(tablesQuery, "new"))
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	for _, table := range oldTables {
+		if !inStrings(table, newTables) {
+			blockDiffWrite(out, table, "table_removed", nil)
+		}
+	}
+	for _, table := range newTables {
+		if !inStrings(table, oldTables) {
+			blockDiffWrite(out, table, "table_added", nil)
+			continue
+		}
+		t := blockDiffTable{name: table, out: out, db: db}
+		if err = t.diffSchema(); err != nil {
+			return fmt.Errorf("cannot compare table %s: %v", table, err)
+		}
+		if err = t.diffRows(); err != nil {
+			return fmt.Errorf("cannot compare table %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// Returns the columns and the primary key of the table in the attached block
+func blockDiffTableInfo(db *sql.DB, schema, table string) (columns, types, key []string, err error) {
+	rows, err := db.Query("SELECT name, type, pk FROM pragma_table_info(?, ?) ORDER BY cid", table, schema)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	pk := map[int]string{}
+	for rows.Next() {
+		var name, colType string
+		var pkIndex int
+		if err = rows.Scan(&name, &colType, &pkIndex); err != nil {
+			return
+		}
+		columns = append(columns, name)
+		types = append(types, colType)
+		if pkIndex > 0 {
+			pk[pkIndex] = name
+		}
+	}
+	for i := 1; i <= len(pk); i++ {
+		key = append(key, pk[i])
+	}
+	err = rows.Err()
+	return
+}
+
+// Reports the added and removed columns, and the changed column types
+func (t *blockDiffTable) diffSchema() error {
+	oldColumns, oldTypes, oldKey, err := blockDiffTableInfo(t.db, "old", t.name)
+	if err != nil {
+		return err
+	}
+	newColumns, newTypes, newKey, err := blockDiffTableInfo(t.db, "new", t.name)
+	if err != nil {
+		return err
+	}
+	for i, c := range oldColumns {
+		if !inStrings(c, newColumns) {
+			blockDiffWrite(t.out, t.name, "column_removed", map[string]string{"column": c, "type": oldTypes[i]})
+		}
+	}
+	for i, c := range newColumns {
+		j := len(oldColumns) - 1
+		for j >= 0 && oldColumns[j] != c {
+			j--
+		}
+		if j < 0 {
+			blockDiffWrite(t.out, t.name, "column_added", map[string]string{"column": c, "type": newTypes[i]})
+			continue
+		}
+		if !strings.EqualFold(oldTypes[j], newTypes[i]) {
+			blockDiffWrite(t.out, t.name, "column_type_changed", map[string]string{"column": c, "old_type": oldTypes[j], "new_type": newTypes[i]})
+		}
+		t.columns = append(t.columns, c)
+	}
+	if len(oldKey) > 0 && strings.Join(oldKey, "\x00") == strings.Join(newKey, "\x00") {
+		t.key = newKey
+		for _, c := range t.key {
+			if !inStrings(c, t.columns) {
+				t.key = nil
+			}
+		}
+	}
+	return nil
+}
+
+// Reports the added, removed and changed rows
+func (t *blockDiffTable) diffRows() error {
+	if len(t.columns) == 0 {
+		return nil
+	}
+	table := dbQuoteIdentifier(t.name)
+	quoted := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		quoted[i] = dbQuoteIdentifier(c)
+	}
+	cols := strings.Join(quoted, ", ")
+	if len(t.key) == 0 {
+		if err := t.writeRows("row_removed", fmt.Sprintf("SELECT %s FROM old.%s EXCEPT SELECT %s FROM new.%s", cols, table, cols, table)); err != nil {
+			return err
+		}
+		return t.writeRows("row_added", fmt.Sprintf("SELECT %s FROM new.%s EXCEPT SELECT %s FROM old.%s", cols, table, cols, table))
+	}
+	var keyEq, keyNull, changed []string
+	for _, c := range t.key {
+		q := dbQuoteIdentifier(c)
+		keyEq = append(keyEq, fmt.Sprintf("o.%s = n.%s", q, q))
+		keyNull = append(keyNull, fmt.Sprintf("n.%s IS NULL", q))
+	}
+	oldCols := make([]string, len(quoted))
+	newCols := make([]string, len(quoted))
+	for i, q := range quoted {
+		oldCols[i] = "o." + q
+		newCols[i] = "n." + q
+		if !inStrings(t.columns[i], t.key) {
+			changed = append(changed, fmt.Sprintf("o.%s IS NOT n.%s", q, q))
+		}
+	}
+	on := strings.Join(keyEq, " AND ")
+	if err := t.writeRows("row_removed", fmt.Sprintf("SELECT %s FROM old.%s o LEFT JOIN new.%s n ON %s WHERE %s", strings.Join(oldCols, ", "), table, table, on, strings.Join(keyNull, " AND "))); err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		err := t.writeRows("row_changed", fmt.Sprintf("SELECT %s, %s FROM old.%s o JOIN new.%s n ON %s WHERE %s",
+			strings.Join(oldCols, ", "), strings.Join(newCols, ", "), table, table, on, strings.Join(changed, " OR ")))
+		if err != nil {
+			return err
+		}
+	}
+	keyNull = keyNull[:0]
+	for _, c := range t.key {
+		keyNull = append(keyNull, fmt.Sprintf("o.%s IS NULL", dbQuoteIdentifier(c)))
+	}
+	return t.writeRows("row_added", fmt.Sprintf("SELECT %s FROM new.%s n LEFT JOIN old.%s o ON %s WHERE %s", strings.Join(newCols, ", "), table, table, on, strings.Join(keyNull, " AND ")))
+}
+
+// Writes the rows of the query as changes. The rows of the changed rows have the old and the new
+// values of the columns.
+func (t *blockDiffTable) writeRows(change, query string) error {
+	rows, err := t.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	n := len(t.columns)
+	values := make([]interface{}, n)
+	if change == "row_changed" {
+		values = make([]interface{}, 2*n)
+	}
+	valuePtrs := make([]interface{}, len(values))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	var line []byte
+	for rows.Next() {
+		if err = rows.Scan(valuePtrs...); err != nil {
+			return err
+		}
+		line = append(appendQueryJSONString(append(line[:0], `{"table":`...), t.name), `,"change":`...)
+		line = appendQueryJSONString(line, change)
+		if change == "row_changed" {
+			line = blockDiffAppendRow(append(line, `,"old":`...), t.columns, values[:n])
+			line = blockDiffAppendRow(append(line, `,"new":`...), t.columns, values[n:])
+		} else {
+			line = blockDiffAppendRow(append(line, `,"row":`...), t.columns, values)
+		}
+		if _, err = t.out.Write(append(line, '}', '\n')); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Appends the row as a JSON object
+func blockDiffAppendRow(buf []byte, columns []string, values []interface{}) []byte {
+	buf = append(buf, '{')
+	for i, c := range columns {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendQueryJSONValue(append(appendQueryJSONString(buf, c), ':'), values[i])
+	}
+	return append(buf, '}')
+}
+
+// Writes a change of a table or its schema
+func blockDiffWrite(out io.Writer, table, change string, fields map[string]string) {
+	entry := StrIfMap{"table": table, "change": change}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	fmt.Fprintln(out, jsonifyWhatever(entry))
+}
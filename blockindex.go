@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The default and the maximum number of blocks returned by /api/blocks
+const (
+	blockIndexDefaultLimit = 100
+	blockIndexMaxLimit     = 1000
+)
+
+// blockIndexRecord is the header of a block, as returned by /api/blocks
+type blockIndexRecord struct {
+	Height                     int                 `json:"height"`
+	Hash                       string              `json:"hash"`
+	PreviousBlockHash          string              `json:"prev_hash"`
+	SignaturePublicKeyHash     string              `json:"sigkey_hash"`
+	HashSignature              string              `json:"hash_signature"`
+	PreviousBlockHashSignature string              `json:"prev_hash_signature"`
+	Cosignatures               []p2pBlockSignature `json:"cosignatures,omitempty"`
+	TimeAccepted               time.Time           `json:"time_accepted"`
+	Version                    int                 `json:"version"`
+}
+
+// blockIndexPage is a page of block headers. The next page is requested with after=NextAfter.
+type blockIndexPage struct {
+	Blocks    []blockIndexRecord `json:"blocks"`
+	NextAfter int                `json:"next_after"`
+	More      bool               `json:"more"`
+}
+
+// Sends the headers of the blocks above the height given by after (or from the genesis block),
+// optionally only those signed by the key given by signer, as JSON.
+func (node *Node) blockWebSendBlockIndex(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	after := -1
+	limit := blockIndexDefaultLimit
+	var err error
+	if s := q.Get("after"); s != "" {
+		if after, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid after height", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > blockIndexMaxLimit {
+			limit = blockIndexMaxLimit
+		}
+	}
+	// One more block is fetched to find out if there are more
+	blocks, err := node.dbGetBlocksAfter(after, limit+1, q.Get("signer"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Cannot read blocks", http.StatusInternalServerError)
+		return
+	}
+	page := blockIndexPage{Blocks: []blockIndexRecord{}, NextAfter: after}
+	if len(blocks) > limit {
+		page.More = true
+		blocks = blocks[:limit]
+	}
+	for _, dbb := range blocks {
+		page.Blocks = append(page.Blocks, blockIndexRecord{
+			Height:                     dbb.Height,
+			Hash:                       dbb.Hash,
+			PreviousBlockHash:          dbb.PreviousBlockHash,
+			SignaturePublicKeyHash:     dbb.SignaturePublicKeyHash,
+			HashSignature:              hex.EncodeToString(dbb.HashSignature),
+			PreviousBlockHashSignature: hex.EncodeToString(dbb.PreviousBlockHashSignature),
+			Cosignatures:               p2pEncodeCosignatures(dbb.Cosignatures),
+			TimeAccepted:               dbb.TimeAccepted,
+			Version:                    dbb.Version,
+		})
+		page.NextAfter = dbb.Height
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonifyWhateverToBytes(page)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Returns the hash of the block given by its height or hash
+func (node *Node) resolveBlockArg(arg string) (string, error) {
+	if height, err := strconv.Atoi(arg); err == nil {
+		hash, err := node.dbGetBlockHashByHeight(height)
+		if err != nil {
+			return "", err
+		}
+		if hash == "" {
+			return "", fmt.Errorf("No block at height %d", height)
+		}
+		return hash, nil
+	}
+	exists, err := node.dbBlockHashExists(arg)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("No block with the hash %s", arg)
+	}
+	return arg, nil
+}
+
+// Copies the block file out of the block store
+func (node *Node) actionExportBlock(blockArg string, destFileName string) {
+	hash, err := node.resolveBlockArg(blockArg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = copyFile(node.blockStore.Filename(hash), destFileName); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Exported block", hash, "to", destFileName)
+}
+
+// blockInspection is the description of a block printed by inspectblock
+type blockInspection struct {
+	Hash          string                 `json:"hash"`
+	Height        int                    `json:"height"`
+	FileName      string                 `json:"file_name"`
+	Creator       string                 `json:"creator,omitempty"`
+	HashSignature string                 `json:"hash_signature,omitempty"`
+	Cosignatures  []p2pBlockSignature    `json:"cosignatures,omitempty"`
+	Meta          map[string]string      `json:"meta"`
+	KeyOps        []blockInspectionKeyOp `json:"key_ops"`
+	Tables        []blockInspectionTable `json:"tables"`
+}
+
+type blockInspectionKeyOp struct {
+	Op            string            `json:"op"`
+	PublicKeyHash string            `json:"pubkey_hash"`
+	SignerKeyHash string            `json:"sigkey_hash"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+type blockInspectionTable struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+}
+
+// Prints the block's metadata, key ops and tables as JSON. The block is given by its height
+// or hash, or as the name of a block file which isn't (yet) in the blockchain.
+func (node *Node) actionInspectBlock(blockArg string) {
+	var bi blockInspection
+	var b *Block
+	var err error
+	if fileExists(blockArg) {
+		bi.FileName = blockArg
+		bi.Height = -1
+		b, err = OpenBlockFile(blockArg)
+	} else {
+		var hash string
+		var dbb *DbBlockchainBlock
+		if hash, err = node.resolveBlockArg(blockArg); err != nil {
+			log.Fatalln(err)
+		}
+		if dbb, err = node.dbGetBlock(hash); err != nil {
+			log.Fatalln(err)
+		}
+		bi.FileName = node.blockStore.Filename(hash)
+		bi.Height = dbb.Height
+		bi.HashSignature = hex.EncodeToString(dbb.HashSignature)
+		bi.Cosignatures = p2pEncodeCosignatures(dbb.Cosignatures)
+		b, err = OpenBlockFile(bi.FileName)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer b.Close()
+	bi.Hash = b.Hash
+	bi.Creator = b.SignaturePublicKeyHash
+
+	bi.Meta = map[string]string{}
+	rows, err := b.query("SELECT key, COALESCE(value, '') FROM _meta ORDER BY key")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			log.Fatalln(err)
+		}
+		bi.Meta[key] = value
+	}
+	rows.Close()
+
+	bi.KeyOps = []blockInspectionKeyOp{}
+	keyOps, err := b.dbGetKeyOps()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, ops := range keyOps {
+		for _, kop := range ops {
+			bi.KeyOps = append(bi.KeyOps, blockInspectionKeyOp{Op: kop.op, PublicKeyHash: kop.publicKeyHash, SignerKeyHash: kop.signatureKeyHash, Metadata: kop.metadata})
+		}
+	}
+
+	bi.Tables = []blockInspectionTable{}
+	names, err := b.dbGetTableNames()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, name := range names {
+		t := blockInspectionTable{Name: name}
+		if t.Columns, err = b.dbGetTableColumns(name); err != nil {
+			log.Fatalln(err)
+		}
+		if t.Rows, err = b.dbGetTableRowCount(name); err != nil {
+			log.Fatalln(err)
+		}
+		bi.Tables = append(bi.Tables, t)
+	}
+
+	data, err := json.MarshalIndent(bi, "", "\t")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Automatic block production. With block_producer_dir set, the node watches that directory
+ * for data files (.csv, .json, .jsonl and .sql, as for createblock) and assembles them into
+ * a block every block_producer_interval, or as soon as they add up to block_producer_max_size
+ * bytes. The block is mined if the chain uses PoW, signed with the signing key and accepted
+ * into the blockchain, from where it's announced to the peers.
+ *
+ * The records pending in the mempool (see mempool.go) and the digests submitted for
+ * notarization (see notary.go) also go into the block, and count towards
+ * block_producer_max_size.
+ *
+ * Files whose names start with a dot are ignored, so the files should be written under such a
+ * name and renamed when complete. The files which have gone into a block are moved into the
+ * done/<block hash> subdirectory, and a file which can't be added to a block into failed,
+ * with the block assembled again from the rest of the files on the next check. If the chain
+ * needs more than one signature per block, the signed block and its signatures file are moved
+ * into the signed subdirectory instead of being accepted, for cosignblock and importblock.
+ */
+
+// How often the pending directory is checked
+const blockProducerCheckInterval = 30 * time.Second
+
+// The name of the block file being produced, in the pending directory
+const blockProducerBlockName = ".block.db"
+
+// Returns the directory with the pending data files, relative to the data directory
+func (node *Node) blockProducerDir() string {
+	if node.cfg.BlockProducerDir == "" || filepath.IsAbs(node.cfg.BlockProducerDir) {
+		return node.cfg.BlockProducerDir
+	}
+	return filepath.Join(node.cfg.DataDir, node.cfg.BlockProducerDir)
+}
+
+// Watches the pending directory and produces blocks from its files
+func (node *Node) blockProducer() {
+	dir := node.blockProducerDir()
+	if dir == "" {
+		return
+	}
+	var interval time.Duration
+	if node.cfg.BlockProducerInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(node.cfg.BlockProducerInterval); err != nil || interval < time.Minute {
+			chainLog.Error("Invalid block producer interval, block production is disabled:", node.cfg.BlockProducerInterval)
+			return
+		}
+	}
+	for _, sub := range []string{"", "done", "failed", "signed"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			chainLog.Error("Block production is disabled:", err)
+			return
+		}
+	}
+	chainLog.Info("Producing blocks from the files in", dir)
+	lastBlockTime := time.Now()
+	for range time.Tick(blockProducerCheckInterval) {
+		files, size, err := blockProducerPendingFiles(dir)
+		if err != nil {
+			chainLog.Error("Cannot read the pending files:", err)
+			continue
+		}
+		records, recordsSize := node.mempool.List()
+		size += recordsSize
+		if err = node.blockProducerReleaseNotarizations(dir); err != nil {
+			chainLog.Error("Cannot release the notarizations:", err)
+			continue
+		}
+		notarizations, notarySize, err := node.dbGetPendingNotarizations(node.cfg.BlockProducerMaxSize)
+		if err != nil {
+			chainLog.Error("Cannot read the pending notarizations:", err)
+			continue
+		}
+		size += notarySize
+		if len(files) == 0 && len(records) == 0 && len(notarizations) == 0 {
+			continue
+		}
+		due := interval > 0 && time.Since(lastBlockTime) >= interval
+		full := node.cfg.BlockProducerMaxSize > 0 && size >= node.cfg.BlockProducerMaxSize
+		if !due && !full {
+			continue
+		}
+		if err = node.blockProduce(context.Background(), dir, files, records, notarizations); err != nil {
+			chainLog.Error("Cannot produce a block:", err)
+			continue
+		}
+		lastBlockTime = time.Now()
+	}
+}
+
+// Makes the notarizations put into the blocks which were waiting for signatures pending again,
+// if the blocks have been removed from the signed directory without being accepted
+func (node *Node) blockProducerReleaseNotarizations(dir string) error {
+	hashes, err := node.dbGetUnacceptedNotarizationBlocks()
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if fileExists(filepath.Join(dir, "signed", hash+".db")) {
+			continue
+		}
+		chainLog.Info("Block", hash, "hasn't been accepted, its notarizations are pending again")
+		if err = node.dbResetNotarizationsBlock(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the data files waiting in the pending directory, sorted by name, and their total size
+func blockProducerPendingFiles(dir string) ([]string, int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []string
+	var size int64
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".csv", ".json", ".jsonl", ".sql":
+			files = append(files, filepath.Join(dir, e.Name()))
+			size += e.Size()
+		}
+	}
+	sort.Strings(files)
+	return files, size, nil
+}
+
+// Assembles the files and the pending records into a block, then mines, signs and accepts it
+func (node *Node) blockProduce(ctx context.Context, dir string, files []string, records []*mempoolRecord, notarizations []notarization) error {
+	fn := filepath.Join(dir, blockProducerBlockName)
+	os.Remove(fn)
+	defer os.Remove(fn)
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err = blockCreateAddFile(db, f); err != nil {
+			// The file may have been partially added, so the block is assembled again
+			// without it on the next try
+			db.Close()
+			if err2 := os.Rename(f, filepath.Join(dir, "failed", filepath.Base(f))); err2 != nil {
+				return err2
+			}
+			return fmt.Errorf("cannot add %s to the block, moved it to failed: %v", f, err)
+		}
+	}
+	if records, err = node.blockCreateAddRecords(db, records); err != nil {
+		db.Close()
+		return err
+	}
+	if err = blockCreateAddNotarizations(db, notarizations); err != nil {
+		db.Close()
+		return err
+	}
+	if err = db.Close(); err != nil {
+		return err
+	}
+	sigs, err := node.blockSign(ctx, fn)
+	if err != nil {
+		return err
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	if q := node.SignatureQuorumForHeight(height + 1); q > 1 {
+		signed := filepath.Join(dir, "signed", sigs.Hash+".db")
+		if err = sigs.write(signed); err != nil {
+			return err
+		}
+		if err = os.Rename(fn, signed); err != nil {
+			return err
+		}
+		chainLog.Info("Produced block", sigs.Hash, "which needs", q-1, "more signatures:", signed)
+		return node.blockProducerArchive(dir, sigs.Hash, files, records, notarizations)
+	}
+	blk, err := node.blockImport(fn, sigs)
+	if err != nil {
+		return err
+	}
+	chainLog.Info("Produced block", blk.Hash, "at height", blk.Height, "from", len(files), "files,", len(records), "records and",
+		len(notarizations), "notarizations")
+	return node.blockProducerArchive(dir, blk.Hash, files, records, notarizations)
+}
+
+// Moves the files which have gone into the block into the done/<block hash> directory, and
+// removes the records from the mempool, keeping them in records.jsonl there. The notarizations
+// are marked as included in the block.
+func (node *Node) blockProducerArchive(dir, hash string, files []string, records []*mempoolRecord, notarizations []notarization) error {
+	done := filepath.Join(dir, "done", hash)
+	if err := os.MkdirAll(done, 0700); err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		var buf bytes.Buffer
+		ids := make([]string, len(records))
+		for i, rec := range records {
+			buf.Write(jsonifyWhateverToBytes(rec))
+			buf.WriteByte('\n')
+			ids[i] = rec.ID
+		}
+		node.mempool.Remove(ids)
+		if err := ioutil.WriteFile(filepath.Join(done, "records.jsonl"), buf.Bytes(), 0600); err != nil {
+			return err
+		}
+	}
+	if err := node.dbSetNotarizationsBlock(notarizations, hash); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Rename(f, filepath.Join(done, filepath.Base(f))); err != nil {
+			return fmt.Errorf("cannot archive %s: %v", f, err)
+		}
+	}
+	return nil
+}
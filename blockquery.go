@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Queries over the whole blockchain are executed on a temporary database combining the blocks.
+ * Block databases are ATTACHed to it in batches (SQLite limits the number of attached databases),
+ * and the rows of each block's tables are appended to tables of the same name in the temporary
+ * database, with an additional _block_height column. Queries can then JOIN rows from different
+ * blocks and aggregate over the whole chain. The block files have been verified when they were
+ * accepted, so they are attached without hashing them again, and their schemas are read through
+ * the attachment, without going through blockDBs, whose recently used handles a scan over the
+ * whole chain would only push out.
+ */
+
+// queryRequest describes a query, from the CLI or the HTTP API
+type queryRequest struct {
+	SQL     string        `json:"sql"`
+	Params  []interface{} `json:"params"`
+	From    int           `json:"from"`
+	To      int           `json:"to"` // 0 for the last block
+	Reverse bool          `json:"reverse"`
+	Limit   int           `json:"limit"` // 0 for no limit
+	Format  string        `json:"format"`
+}
+
+// Checks the query and fills in the defaults
+func (qr *queryRequest) normalize(node *Node) error {
+	if strings.TrimSpace(qr.SQL) == "" {
+		return fmt.Errorf("The query is empty")
+	}
+	if qr.From < 1 {
+		qr.From = 1
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	if qr.To <= 0 || qr.To > height {
+		qr.To = height
+	}
+	if qr.From > qr.To {
+		return fmt.Errorf("No blocks between the heights %d and %d", qr.From, qr.To)
+	}
+	if err := queryCheckStatement(qr.SQL); err != nil {
+		return err
+	}
+	if qr.Format == "" {
+		qr.Format = "jsonl"
+	}
+	if !inStrings(qr.Format, queryOutputFormats) {
+		return fmt.Errorf("Unknown output format %s - must be one of: %s", qr.Format, strings.Join(queryOutputFormats, ", "))
+	}
+	return nil
+}
+
+// Combines the blocks and runs the query in the sandbox, read-only (see querysandbox.go).
+// The context should have the query's timeout, it also cancels reading the rows. The caller
+// must close both the rows and the combined database.
+func (qr *queryRequest) run(node *Node, ctx context.Context) (*queryCombinedDb, *sql.Rows, error) {
+	qdb, err := node.queryCombineBlocks(ctx, qr.From, qr.To, qr.Reverse)
+	if err != nil {
+		return nil, nil, err
+	}
+	if qdb.conn, err = node.querySandboxConn(ctx, qdb.db); err != nil {
+		qdb.Close()
+		return nil, nil, err
+	}
+	log.Println("Running query:", qr.SQL)
+	rows, err := qdb.conn.QueryContext(ctx, qr.SQL, qr.Params...)
+	if err != nil {
+		qdb.Close()
+		return nil, nil, err
+	}
+	return qdb, rows, nil
+}
+
+// The number of block databases attached at the same time, SQLite's default SQLITE_MAX_ATTACHED
+const queryAttachBatchSize = 10
+
+// The name of the column holding the height of the block a row comes from
+const queryBlockHeightColumn = "_block_height"
+
+// The name of the column holding the hash of the block a row comes from, in combined.db
+const queryBlockHashColumn = "_block_hash"
+
+// queryCombinedDb is a temporary database with the rows of the blocks' tables, or combined.db
+type queryCombinedDb struct {
+	db       *sql.DB
+	conn     *sql.Conn                  // The sandboxed connection the query runs on
+	fileName string                     // The temporary file, deleted on Close(), or empty
+	columns  map[string]map[string]bool // table name -> set of column names
+	withHash bool                       // Add the _block_hash column
+	onCommit func(heights []int) error  // Called in the transaction adding the blocks
+	node     *Node
+}
+
+// Creates a temporary database combining the tables of the blocks in the given height range.
+// The rows are added from the lowest to the highest block, or in reverse.
+func (node *Node) queryCombineBlocks(ctx context.Context, minHeight, maxHeight int, reverse bool) (*queryCombinedDb, error) {
+	f, err := ioutil.TempFile("", "daisy-query-*.db")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	db, err := dbOpen(f.Name(), false)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	// ATTACH is per-connection
+	db.SetMaxOpenConns(1)
+	qdb := &queryCombinedDb{node: node, db: db, fileName: f.Name(), columns: map[string]map[string]bool{}}
+	for _, pragma := range []string{"PRAGMA journal_mode=OFF", "PRAGMA synchronous=OFF"} {
+		if _, err = db.Exec(pragma); err != nil {
+			qdb.Close()
+			return nil, err
+		}
+	}
+	heights := make([]int, 0, maxHeight-minHeight+1)
+	for h := minHeight; h <= maxHeight; h++ {
+		heights = append(heights, h)
+	}
+	if reverse {
+		for i, j := 0, len(heights)-1; i < j; i, j = i+1, j-1 {
+			heights[i], heights[j] = heights[j], heights[i]
+		}
+	}
+	for len(heights) > 0 {
+		n := queryAttachBatchSize
+		if n > len(heights) {
+			n = len(heights)
+		}
+		if err = qdb.addBlocks(ctx, heights[:n]); err != nil {
+			qdb.Close()
+			return nil, err
+		}
+		heights = heights[n:]
+	}
+	return qdb, nil
+}
+
+// Attaches the blocks with the given heights and appends the rows of their tables
+func (qdb *queryCombinedDb) addBlocks(ctx context.Context, heights []int) error {
+	var attached []string
+	defer func() {
+		for _, schema := range attached {
+			qdb.db.Exec("DETACH DATABASE " + schema)
+		}
+	}()
+	var hashes []string
+	for _, h := range heights {
+		hash, err := qdb.node.dbGetBlockHashByHeight(h)
+		if err != nil {
+			return err
+		}
+		if hash == "" {
+			return fmt.Errorf("No block at height %d", h)
+		}
+		schema := fmt.Sprintf("block_%d", h)
+		if _, err = qdb.db.Exec(fmt.Sprintf("ATTACH DATABASE ? AS %s", schema), "file:"+qdb.node.blockStore.Filename(hash)+"?mode=ro"); err != nil {
+			return fmt.Errorf("cannot attach block %d: %v", h, err)
+		}
+		attached = append(attached, schema)
+		hashes = append(hashes, hash)
+	}
+	if _, err := qdb.db.Exec("BEGIN"); err != nil {
+		return err
+	}
+	for i, schema := range attached {
+		if err := qdb.addBlock(ctx, heights[i], hashes[i], schema); err != nil {
+			qdb.db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	if qdb.onCommit != nil {
+		if err := qdb.onCommit(heights); err != nil {
+			qdb.db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	_, err := qdb.db.Exec("COMMIT")
+	return err
+}
+
+// Appends the rows of the tables in an attached block
+func (qdb *queryCombinedDb) addBlock(ctx context.Context, height int, hash string, schema string) error {
+	tables, err := dbQueryStrings(qdb.db, fmt.Sprintf("SELECT name FROM %s.sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%%' AND name NOT IN ('_meta', '_keys', '_params') ORDER BY name", schema))
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		columns, err := dbQueryStrings(qdb.db, "SELECT name FROM pragma_table_info(?, ?)", table, schema)
+		if err != nil {
+			return err
+		}
+		if err = qdb.ensureTable(table, columns); err != nil {
+			return err
+		}
+		quoted := make([]string, len(columns))
+		for i, c := range columns {
+			quoted[i] = dbQuoteIdentifier(c)
+		}
+		provenance, values := queryBlockHeightColumn, strconv.Itoa(height)
+		if qdb.withHash {
+			provenance, values = provenance+", "+queryBlockHashColumn, values+", '"+hash+"'"
+		}
+		_, err = qdb.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO main.%s (%s, %s) SELECT %s, %s FROM %s.%s",
+			dbQuoteIdentifier(table), provenance, strings.Join(quoted, ", "), values, strings.Join(quoted, ", "), schema, dbQuoteIdentifier(table)))
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read table %s in block %d: %v", table, height, err)
+		}
+	}
+	return nil
+}
+
+// Creates the combined table, or adds the columns it's missing. Blocks can have different
+// versions of a table, so the combined table has the union of their columns.
+func (qdb *queryCombinedDb) ensureTable(table string, columns []string) error {
+	known, ok := qdb.columns[table]
+	if !ok {
+		known = map[string]bool{}
+		quoted := []string{queryBlockHeightColumn + " INTEGER"}
+		if qdb.withHash {
+			quoted = append(quoted, queryBlockHashColumn+" VARCHAR")
+		}
+		for _, c := range columns {
+			quoted = append(quoted, dbQuoteIdentifier(c))
+			known[c] = true
+		}
+		if _, err := qdb.db.Exec(fmt.Sprintf("CREATE TABLE main.%s (%s)", dbQuoteIdentifier(table), strings.Join(quoted, ", "))); err != nil {
+			return err
+		}
+		if qdb.withHash {
+			if err := qdb.combinedIndex(table); err != nil {
+				return err
+			}
+		}
+		qdb.columns[table] = known
+		return nil
+	}
+	for _, c := range columns {
+		if known[c] {
+			continue
+		}
+		if _, err := qdb.db.Exec(fmt.Sprintf("ALTER TABLE main.%s ADD COLUMN %s", dbQuoteIdentifier(table), dbQuoteIdentifier(c))); err != nil {
+			return err
+		}
+		known[c] = true
+	}
+	return nil
+}
+
+// Closes and deletes the temporary database
+func (qdb *queryCombinedDb) Close() {
+	if qdb.conn != nil {
+		qdb.conn.Close()
+	}
+	qdb.db.Close()
+	if qdb.fileName != "" {
+		os.Remove(qdb.fileName)
+	}
+}
+
+// Runs a query returning a single column of strings
+func dbQueryStrings(db dbRowsQueryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
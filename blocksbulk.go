@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+ * The /blocks?from=H&to=H URL streams a range of blocks as a tar archive, so that a new node
+ * doesn't need a request per block. The first entry is manifest.json, describing the blocks
+ * with the signatures which are kept outside the block files, followed by the block files
+ * named <height>.db in the order of their heights.
+ */
+
+// The maximum number of blocks served in one bulk request
+const blocksBulkMaxCount = 1000
+
+const blocksBulkManifestName = "manifest.json"
+
+// blocksBulkEntry describes one block in the bulk download manifest
+type blocksBulkEntry struct {
+	Height        int                 `json:"height"`
+	Hash          string              `json:"hash"`
+	HashSignature string              `json:"hash_signature"`
+	Cosignatures  []p2pBlockSignature `json:"cosignatures,omitempty"`
+	Size          int64               `json:"size"`
+	FileName      string              `json:"file_name"`
+}
+
+// Streams the blocks in the requested height range as a tar archive
+func (node *Node) blockWebSendBlocks(w http.ResponseWriter, r *http.Request) {
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Cannot read the blockchain height", http.StatusInternalServerError)
+		return
+	}
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from < 0 {
+		http.Error(w, "Invalid from height", http.StatusBadRequest)
+		return
+	}
+	to := from + blocksBulkMaxCount - 1
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = strconv.Atoi(s); err != nil || to < from {
+			http.Error(w, "Invalid to height", http.StatusBadRequest)
+			return
+		}
+	}
+	if to-from+1 > blocksBulkMaxCount {
+		to = from + blocksBulkMaxCount - 1
+	}
+	if to > height {
+		to = height
+	}
+
+	manifest := []blocksBulkEntry{}
+	for h := from; h <= to; h++ {
+		dbb, err := node.dbGetBlockByHeight(h)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Cannot read block", http.StatusInternalServerError)
+			return
+		}
+		st, err := os.Stat(node.blockStore.Filename(dbb.Hash))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Cannot read block", http.StatusInternalServerError)
+			return
+		}
+		manifest = append(manifest, blocksBulkEntry{
+			Height:        h,
+			Hash:          dbb.Hash,
+			HashSignature: hex.EncodeToString(dbb.HashSignature),
+			Cosignatures:  p2pEncodeCosignatures(dbb.Cosignatures),
+			Size:          st.Size(),
+			FileName:      fmt.Sprintf("%d.db", h),
+		})
+	}
+
+	log.Println("HTTP serving blocks", from, "to", to, "to", r.RemoteAddr)
+	var out io.Writer = w
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if encoding := httpNegotiateEncoding(r); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		cw, err := httpCompressWriter(w, encoding)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer cw.Close()
+		out = cw
+	}
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	manifestJSON := jsonifyWhateverToBytes(manifest)
+	if err = tw.WriteHeader(&tar.Header{Name: blocksBulkManifestName, Mode: 0644, Size: int64(len(manifestJSON)), ModTime: time.Now()}); err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err = tw.Write(manifestJSON); err != nil {
+		log.Println(err)
+		return
+	}
+	for _, e := range manifest {
+		if err = node.blocksBulkWriteFile(tw, e); err != nil {
+			log.Println("Error serving block", e.Height, err)
+			return
+		}
+	}
+}
+
+// Writes one block file into the tar archive
+func (node *Node) blocksBulkWriteFile(tw *tar.Writer, e blocksBulkEntry) error {
+	f, err := os.Open(node.blockStore.Filename(e.Hash))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = tw.WriteHeader(&tar.Header{Name: e.FileName, Mode: 0644, Size: e.Size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Fetches the blocks above the current height from the node at baseURL with bulk requests,
+// and passes them through the acceptance pipeline. Returns the number of blocks imported.
+func (node *Node) pullBlocks(baseURL string) (int, error) {
+	count := 0
+	for {
+		height, err := node.dbGetBlockchainHeight()
+		if err != nil {
+			return count, err
+		}
+		from := height + 1
+		url := fmt.Sprintf("%sblocks?from=%d&to=%d", baseURL, from, from+blocksBulkMaxCount-1)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return count, err
+		}
+		resp, body, err := httpGetCompressed(http.DefaultClient, req)
+		if err != nil {
+			return count, err
+		}
+		n, err := node.pullBlocksArchive(baseURL, resp, body)
+		resp.Body.Close()
+		count += n
+		if err != nil || n == 0 {
+			return count, err
+		}
+		if height, err = node.dbGetBlockchainHeight(); err != nil {
+			return count, err
+		}
+		log.Println("Imported blocks up to height", height)
+	}
+}
+
+// Reads a bulk download archive and imports the blocks in it
+func (node *Node) pullBlocksArchive(baseURL string, resp *http.Response, body io.Reader) (int, error) {
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	tr := tar.NewReader(body)
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, err
+	}
+	if hdr.Name != blocksBulkManifestName {
+		return 0, fmt.Errorf("expecting %s in the archive, found %s", blocksBulkManifestName, hdr.Name)
+	}
+	var manifest []blocksBulkEntry
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, err
+	}
+	for n, e := range manifest {
+		if hdr, err = tr.Next(); err != nil {
+			return n, err
+		}
+		if hdr.Name != e.FileName || hdr.Size != e.Size {
+			return n, fmt.Errorf("unexpected archive entry %s, expecting %s", hdr.Name, e.FileName)
+		}
+		if err = node.pullImportBlock(baseURL, e, tr); err != nil {
+			return n, fmt.Errorf("block %d: %v", e.Height, err)
+		}
+	}
+	return len(manifest), nil
+}
+
+// Imports one block from the bulk download archive
+func (node *Node) pullImportBlock(baseURL string, e blocksBulkEntry, r io.Reader) error {
+	blockFile, err := ioutil.TempFile("", "daisy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(blockFile.Name())
+	if _, err = io.Copy(blockFile, r); err != nil {
+		blockFile.Close()
+		return err
+	}
+	if err = blockFile.Close(); err != nil {
+		return err
+	}
+	blk, err := OpenBlockFile(blockFile.Name())
+	if err != nil {
+		return err
+	}
+	defer blk.Close()
+	if blk.Hash != e.Hash {
+		return fmt.Errorf("the block hash %s doesn't match the manifest hash %s", blk.Hash, e.Hash)
+	}
+	if blk.HashSignature, err = hex.DecodeString(e.HashSignature); err != nil {
+		return err
+	}
+	if blk.Cosignatures, err = p2pDecodeCosignatures(StrIfMap{"cosignatures": e.Cosignatures}); err != nil {
+		return err
+	}
+	return node.blockchainAcceptBlock(&blockAcceptanceRequest{blk: blk, fileName: blockFile.Name(), source: baseURL})
+}
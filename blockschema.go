@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/*
+ * The schema of the blockchain metadata tables (_meta and _keys) within blocks. Blocks are
+ * checked against it when they are opened and when they are accepted, so that malformed
+ * metadata is reported precisely instead of failing somewhere deep in the verification.
+ */
+
+// blockMetaField describes one key in the _meta table
+type blockMetaField struct {
+	required bool
+	maxSize  int
+	validate func(value string) error
+}
+
+// Limits for _meta keys which are not in the schema. Unknown keys are allowed, so that
+// blocks can carry application-specific metadata (e.g. the default genesis block does).
+const blockMetaMaxKeys = 64
+const blockMetaMaxKeySize = 64
+const blockMetaMaxUnknownValueSize = 4096
+
+// Limits for the _keys table
+const blockKeysMaxRows = 1024
+const blockKeysMaxPublicKeySize = 1024 // hex-encoded
+const blockKeysMaxSignatureSize = 512  // hex-encoded
+const blockKeysMaxMetadataSize = 4096
+
+var blockMetaKeyRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+var blockHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+var blockPublicKeyHashRegexp = regexp.MustCompile(`^1:[0-9a-f]{64}$`)
+
+var blockMetaSchema = map[string]blockMetaField{
+	"Version":                    {required: true, maxSize: 10, validate: validateBlockMetaInt},
+	"PreviousBlockHash":          {required: true, maxSize: 64, validate: validateBlockMetaHash},
+	"PreviousBlockHashSignature": {required: true, maxSize: blockKeysMaxSignatureSize, validate: validateBlockMetaHex},
+	"CreatorPublicKey":           {required: true, maxSize: 66, validate: validateBlockMetaPublicKeyHash},
+	"Timestamp":                  {maxSize: 64, validate: validateBlockMetaTime},
+	"Creator":                    {maxSize: 256},
+	"CreatorPubKey":              {maxSize: 66, validate: validateBlockMetaPublicKeyHash}, // Written by older versions of newchain
+	"Description":                {maxSize: 4096},
+	"PoWHash":                    {maxSize: 16, validate: validateBlockMetaPoWHash}, // See powhash.go
+
+	"PreviousBlockTimestampToken": {maxSize: tsaMaxTokenSize, validate: validateBlockMetaBase64},         // See tsa.go
+	"Anchors":                     {maxSize: anchorsMaxMetaSize, validate: validateBlockMetaAnchors},     // See anchor.go
+	"ChainReferences":             {maxSize: chainRefsMaxMetaSize, validate: validateBlockMetaChainRefs}, // See chainrefs.go
+	"NotaryRoot":                  {maxSize: 64, validate: validateBlockMetaHash},                        // See notary.go
+	"NotaryRootSignature":         {maxSize: blockKeysMaxSignatureSize, validate: validateBlockMetaHex},
+}
+
+func validateBlockMetaInt(value string) error {
+	_, err := strconv.Atoi(value)
+	return err
+}
+
+func validateBlockMetaHash(value string) error {
+	if !blockHashRegexp.MatchString(value) {
+		return fmt.Errorf("not a lowercase hex-encoded SHA256 hash")
+	}
+	return nil
+}
+
+func validateBlockMetaHex(value string) error {
+	_, err := hex.DecodeString(value)
+	return err
+}
+
+func validateBlockMetaBase64(value string) error {
+	_, err := base64.StdEncoding.DecodeString(value)
+	return err
+}
+
+func validateBlockMetaPublicKeyHash(value string) error {
+	if !blockPublicKeyHashRegexp.MatchString(value) {
+		return fmt.Errorf("not a public key hash in the \"1:hex\" format")
+	}
+	return nil
+}
+
+func validateBlockMetaPoWHash(value string) error {
+	switch value {
+	case powHashSHA256, powHashSHA3, powHashArgon2id:
+		return nil
+	}
+	return fmt.Errorf("unknown PoW hash function")
+}
+
+func validateBlockMetaTime(value string) error {
+	_, err := time.Parse(time.RFC3339, value)
+	return err
+}
+
+// Validates the contents of the _meta table in the given block database
+func dbValidateBlockMeta(db *sql.DB) error {
+	exists, err := dbTableExists(db, "_meta")
+	if err != nil {
+		return fmt.Errorf("block metadata: %v", err)
+	}
+	if !exists {
+		return fmt.Errorf("block metadata: the _meta table is missing")
+	}
+	rows, err := db.Query("SELECT key, COALESCE(value, '') FROM _meta")
+	if err != nil {
+		return fmt.Errorf("block metadata: cannot read the _meta table: %v", err)
+	}
+	defer rows.Close()
+	found := map[string]bool{}
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return fmt.Errorf("block metadata: cannot read the _meta table: %v", err)
+		}
+		found[key] = true
+		if len(found) > blockMetaMaxKeys {
+			return fmt.Errorf("block metadata: more than %d keys", blockMetaMaxKeys)
+		}
+		field, known := blockMetaSchema[key]
+		if !known {
+			if len(key) > blockMetaMaxKeySize || !blockMetaKeyRegexp.MatchString(key) {
+				return fmt.Errorf("block metadata: invalid key name %s", strconv.Quote(key))
+			}
+			if len(value) > blockMetaMaxUnknownValueSize {
+				return fmt.Errorf("block metadata: value of %s is %d bytes, more than the maximum of %d", key, len(value), blockMetaMaxUnknownValueSize)
+			}
+			continue
+		}
+		if len(value) > field.maxSize {
+			return fmt.Errorf("block metadata: value of %s is %d bytes, more than the maximum of %d", key, len(value), field.maxSize)
+		}
+		if field.validate != nil {
+			if err = field.validate(value); err != nil {
+				return fmt.Errorf("block metadata: invalid value of %s %s: %v", key, strconv.Quote(value), err)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("block metadata: cannot read the _meta table: %v", err)
+	}
+	for key, field := range blockMetaSchema {
+		if field.required && !found[key] {
+			return fmt.Errorf("block metadata: required key %s is missing", key)
+		}
+	}
+	return nil
+}
+
+// Validates the format of the contents of the _keys table in the given block database.
+// This doesn't verify the signatures.
+func dbValidateBlockKeys(db *sql.DB) error {
+	exists, err := dbTableExists(db, "_keys")
+	if err != nil {
+		return fmt.Errorf("block key ops: %v", err)
+	}
+	if !exists {
+		return fmt.Errorf("block key ops: the _keys table is missing")
+	}
+	rows, err := db.Query("SELECT op, pubkey_hash, pubkey, sigkey_hash, signature, COALESCE(metadata, '') FROM _keys")
+	if err != nil {
+		return fmt.Errorf("block key ops: cannot read the _keys table: %v", err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var op, publicKeyHash, publicKey, signatureKeyHash, signature, metadata string
+		if err = rows.Scan(&op, &publicKeyHash, &publicKey, &signatureKeyHash, &signature, &metadata); err != nil {
+			return fmt.Errorf("block key ops: cannot read the _keys table: %v", err)
+		}
+		n++
+		if n > blockKeysMaxRows {
+			return fmt.Errorf("block key ops: more than %d key ops", blockKeysMaxRows)
+		}
+		if op != "A" && op != "R" && op != "M" {
+			return fmt.Errorf("block key ops: row %d: invalid op %s", n, strconv.Quote(op))
+		}
+		if op == "M" && (signatureKeyHash != publicKeyHash || metadata == "") {
+			return fmt.Errorf("block key ops: row %d: metadata ops must contain metadata signed by the key itself", n)
+		}
+		if err = validateBlockMetaPublicKeyHash(publicKeyHash); err != nil {
+			return fmt.Errorf("block key ops: row %d: invalid pubkey_hash %s: %v", n, strconv.Quote(publicKeyHash), err)
+		}
+		if err = validateBlockMetaPublicKeyHash(signatureKeyHash); err != nil {
+			return fmt.Errorf("block key ops: row %d: invalid sigkey_hash %s: %v", n, strconv.Quote(signatureKeyHash), err)
+		}
+		if len(publicKey) > blockKeysMaxPublicKeySize {
+			return fmt.Errorf("block key ops: row %d: pubkey is %d bytes, more than the maximum of %d", n, len(publicKey), blockKeysMaxPublicKeySize)
+		}
+		if err = validateBlockMetaHex(publicKey); err != nil {
+			return fmt.Errorf("block key ops: row %d: pubkey is not hex-encoded: %v", n, err)
+		}
+		if len(signature) > blockKeysMaxSignatureSize {
+			return fmt.Errorf("block key ops: row %d: signature is %d bytes, more than the maximum of %d", n, len(signature), blockKeysMaxSignatureSize)
+		}
+		if err = validateBlockMetaHex(signature); err != nil {
+			return fmt.Errorf("block key ops: row %d: signature is not hex-encoded: %v", n, err)
+		}
+		if len(metadata) > blockKeysMaxMetadataSize {
+			return fmt.Errorf("block key ops: row %d: metadata is %d bytes, more than the maximum of %d", n, len(metadata), blockKeysMaxMetadataSize)
+		}
+		if metadata != "" {
+			var m map[string]string
+			if err = json.Unmarshal([]byte(metadata), &m); err != nil {
+				return fmt.Errorf("block key ops: row %d: metadata is not a JSON object of strings: %v", n, err)
+			}
+			if err = validateKeyGovernanceMetadata(m); err != nil {
+				return fmt.Errorf("block key ops: row %d: %v", n, err)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("block key ops: cannot read the _keys table: %v", err)
+	}
+	return nil
+}
+
+// Validates the format of the contents of the _params table in the given block database, if
+// the block has one. This doesn't verify the signatures or the values.
+func dbValidateBlockParams(db *sql.DB) error {
+	exists, err := dbTableExists(db, "_params")
+	if err != nil {
+		return fmt.Errorf("block chain params: %v", err)
+	}
+	if !exists {
+		return nil
+	}
+	rows, err := db.Query("SELECT name, value, sigkey_hash, signature, expires FROM _params")
+	if err != nil {
+		return fmt.Errorf("block chain params: cannot read the _params table: %v", err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var name, value, signatureKeyHash, signature string
+		var expires int64
+		if err = rows.Scan(&name, &value, &signatureKeyHash, &signature, &expires); err != nil {
+			return fmt.Errorf("block chain params: cannot read the _params table: %v", err)
+		}
+		n++
+		if n > blockKeysMaxRows {
+			return fmt.Errorf("block chain params: more than %d rows", blockKeysMaxRows)
+		}
+		if !chainParamsUpdatable[name] {
+			return fmt.Errorf("block chain params: row %d: %s can't be updated", n, strconv.Quote(name))
+		}
+		if len(value) > blockKeysMaxMetadataSize || !json.Valid([]byte(value)) {
+			return fmt.Errorf("block chain params: row %d: the value must be JSON of at most %d bytes", n, blockKeysMaxMetadataSize)
+		}
+		if err = validateBlockMetaPublicKeyHash(signatureKeyHash); err != nil {
+			return fmt.Errorf("block chain params: row %d: invalid sigkey_hash %s: %v", n, strconv.Quote(signatureKeyHash), err)
+		}
+		if len(signature) > blockKeysMaxSignatureSize {
+			return fmt.Errorf("block chain params: row %d: signature is %d bytes, more than the maximum of %d", n, len(signature), blockKeysMaxSignatureSize)
+		}
+		if err = validateBlockMetaHex(signature); err != nil {
+			return fmt.Errorf("block chain params: row %d: signature is not hex-encoded: %v", n, err)
+		}
+		if expires < 1 || expires > math.MaxInt32 {
+			return fmt.Errorf("block chain params: row %d: invalid expires %d", n, expires)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("block chain params: cannot read the _params table: %v", err)
+	}
+	return nil
+}
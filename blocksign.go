@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+/*
+ * Chains with a block_signature_quorum greater than 1 need blocks signed by multiple
+ * signatories. The block's hash signatures can't be stored in the block file itself, so they
+ * are collected in a signatures file next to it: signblock (or signimportblock) creates it,
+ * each cosigner runs cosignblock on a copy of the block file and its signatures file, and
+ * importblock accepts the block once enough signatures are collected.
+ */
+
+const blockSignaturesFileSuffix = ".sigs.json"
+
+// blockSignatures is the content of a block's signatures file
+type blockSignatures struct {
+	Hash          string              `json:"hash"`
+	Creator       string              `json:"creator"`
+	HashSignature string              `json:"hash_signature"`
+	Cosignatures  []p2pBlockSignature `json:"cosignatures"`
+}
+
+func blockSignaturesFileName(fn string) string {
+	return fn + blockSignaturesFileSuffix
+}
+
+// Reads the signatures file for the given block file and checks that it matches the file
+func readBlockSignatures(fn string) (*blockSignatures, error) {
+	data, err := ioutil.ReadFile(blockSignaturesFileName(fn))
+	if err != nil {
+		return nil, err
+	}
+	var sigs blockSignatures
+	if err = json.Unmarshal(data, &sigs); err != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %v", blockSignaturesFileName(fn), err)
+	}
+	hash, err := hashFileToHexString(fn)
+	if err != nil {
+		return nil, err
+	}
+	if hash != sigs.Hash {
+		return nil, fmt.Errorf("The block file %s has been modified after it was signed", fn)
+	}
+	return &sigs, nil
+}
+
+// Writes the signatures file for the given block file
+func (sigs *blockSignatures) write(fn string) error {
+	data, err := json.MarshalIndent(sigs, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(blockSignaturesFileName(fn), append(data, '\n'), 0644)
+}
+
+// Signs the block file as its creator and writes the signatures file, without importing it
+func (node *Node) actionSignBlock(fn string) {
+	sigs := node.blockSignFile(fn)
+	if err := sigs.write(fn); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Signed block", sigs.Hash, "into", blockSignaturesFileName(fn))
+}
+
+// Adds a signature with the key selected by -key to the block's signatures file
+func (node *Node) actionCosignBlock(fn string) {
+	sigs, err := readBlockSignatures(fn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	keypair, publicKeyHash, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if publicKeyHash == sigs.Creator {
+		log.Fatalln("The block is already signed by", publicKeyHash, "as its creator")
+	}
+	for _, cs := range sigs.Cosignatures {
+		if cs.PublicKeyHash == publicKeyHash {
+			log.Fatalln("The block is already signed by", publicKeyHash)
+		}
+	}
+	signature, err := cryptoSignHex(keypair, sigs.Hash)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sigs.Cosignatures = append(sigs.Cosignatures, p2pBlockSignature{PublicKeyHash: publicKeyHash, Signature: signature})
+	if err = sigs.write(fn); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Cosigned block", sigs.Hash, "with", publicKeyHash, "- it now has", len(sigs.Cosignatures)+1, "signatures")
+}
+
+// Imports a block signed with signblock and cosignblock
+func (node *Node) actionImportBlock(fn string) {
+	sigs, err := readBlockSignatures(fn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	node.blockImportFile(fn, sigs)
+}
+
+// Accepts the signed block file into the blockchain
+func (node *Node) blockImportFile(fn string, sigs *blockSignatures) {
+	blk, err := node.blockImport(fn, sigs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Accepted block", blk.Hash, "at height", blk.Height)
+}
+
+// Accepts the signed block file into the blockchain. Returns the accepted block, which is
+// closed.
+func (node *Node) blockImport(fn string, sigs *blockSignatures) (*Block, error) {
+	blk, err := OpenBlockFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer blk.Close()
+	if blk.Hash != sigs.Hash {
+		return nil, fmt.Errorf("The block file %s has been modified after it was signed", fn)
+	}
+	if blk.HashSignature, err = hex.DecodeString(sigs.HashSignature); err != nil {
+		return nil, fmt.Errorf("Cannot decode the hash signature: %v", err)
+	}
+	for _, cs := range sigs.Cosignatures {
+		signature, err := hex.DecodeString(cs.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode the signature by %s: %v", cs.PublicKeyHash, err)
+		}
+		blk.Cosignatures = append(blk.Cosignatures, BlockSignature{PublicKeyHash: cs.PublicKeyHash, Signature: signature})
+	}
+	err = node.blockchainAcceptBlock(&blockAcceptanceRequest{blk: blk, fileName: fn, source: "local"})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot import block: %v", err)
+	}
+	return blk, nil
+}
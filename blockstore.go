@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Block files are stored in subdirectories named after the first two hex digits of their hash
+const blockStoreFilenameFormat = "%s/%s/%s.db"
+const blockStoreDirnameFormat = "%s/%s"
+
+// Block files used to be named after their heights. These are migrated on startup.
+const legacyBlockFilenameFormat = "%s/%04x/block_%08x.db"
+const legacyBlockDirnameFormat = "%s/%04x"
+
+// BlockStore holds block files (SQLite databases), addressed by the hex-encoded SHA256 hash
+// of their content. Files are never overwritten, so the same storage can back blocks from
+// multiple forks, and replacement blocks. The height index is the blockchain table in the
+// main database.
+type BlockStore struct {
+	dir  string
+	node *Node
+}
+
+// NewBlockStore returns a BlockStore keeping its files in the given directory
+func (node *Node) NewBlockStore(dir string) *BlockStore {
+	return &BlockStore{node: node, dir: dir}
+}
+
+// Filename returns the name of the file holding the block with the given hash
+func (bs *BlockStore) Filename(hash string) string {
+	if len(hash) < 2 {
+		return fmt.Sprintf(blockStoreFilenameFormat, bs.dir, "xx", hash)
+	}
+	return fmt.Sprintf(blockStoreFilenameFormat, bs.dir, hash[0:2], hash)
+}
+
+// FilenameByHeight returns the name of the file holding the block at the given height
+// in the current blockchain.
+func (bs *BlockStore) FilenameByHeight(height int) (string, error) {
+	hash, err := bs.node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		return "", err
+	}
+	if hash == "" {
+		return "", fmt.Errorf("No block at height %d", height)
+	}
+	return bs.Filename(hash), nil
+}
+
+// Has checks if the block with the given hash is present in the store
+func (bs *BlockStore) Has(hash string) bool {
+	return fileExists(bs.Filename(hash))
+}
+
+// Put copies the given file into the store and returns its hash. If the block already
+// exists in the store, it's left untouched.
+func (bs *BlockStore) Put(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("BlockStore.Put f.Close: %v", err)
+		}
+	}()
+	return bs.putReader(f)
+}
+
+// PutBytes stores the given block data and returns its hash.
+func (bs *BlockStore) PutBytes(data []byte) (string, error) {
+	return bs.putReader(bytes.NewReader(data))
+}
+
+// Writes the data into a temporary file while hashing it, then renames the file
+// into its final place.
+func (bs *BlockStore) putReader(r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile(bs.dir, "incoming")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if fileExists(tmp.Name()) {
+			if err := os.Remove(tmp.Name()); err != nil {
+				log.Printf("BlockStore remove: %v", err)
+			}
+		}
+	}()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	hashHex := hex.EncodeToString(hash.Sum(nil))
+	if bs.Has(hashHex) {
+		return hashHex, nil
+	}
+	if err = os.MkdirAll(fmt.Sprintf(blockStoreDirnameFormat, bs.dir, hashHex[0:2]), 0755); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	return hashHex, os.Rename(tmp.Name(), bs.Filename(hashHex))
+}
+
+// Remove deletes the block with the given hash from the store
+func (bs *BlockStore) Remove(hash string) error {
+	return os.Remove(bs.Filename(hash))
+}
+
+// Archive moves the block with the given hash out of the store, into the given directory
+func (bs *BlockStore) Archive(hash string, archiveDir string) error {
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return err
+	}
+	return os.Rename(bs.Filename(hash), fmt.Sprintf("%s/%s.db", archiveDir, hash))
+}
+
+// Moves block files named after their heights into the content-addressed layout.
+func (bs *BlockStore) migrateLegacyFiles() error {
+	if !fileExists(fmt.Sprintf(legacyBlockDirnameFormat, bs.dir, 0)) {
+		return nil
+	}
+	log.Println("Migrating block files to the content-addressed layout...")
+	maxHeight, err := bs.node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	for h := 0; h <= maxHeight; h++ {
+		legacyFilename := fmt.Sprintf(legacyBlockFilenameFormat, bs.dir, h/65536, h)
+		if !fileExists(legacyFilename) {
+			continue
+		}
+		hash, err := bs.node.dbGetBlockHashByHeight(h)
+		if err != nil {
+			return err
+		}
+		if hash == "" || bs.Has(hash) {
+			continue
+		}
+		if err := os.MkdirAll(fmt.Sprintf(blockStoreDirnameFormat, bs.dir, hash[0:2]), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(legacyFilename, bs.Filename(hash)); err != nil {
+			return err
+		}
+	}
+	for d := 0; d <= maxHeight/65536; d++ {
+		// Only succeeds if the directory is empty, which is what we want
+		os.Remove(fmt.Sprintf(legacyBlockDirnameFormat, bs.dir, d))
+	}
+	return nil
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-func blockWebSendBlock(w http.ResponseWriter, r *http.Request) {
+func (node *Node) blockWebSendBlock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	blockHeight, err := strconv.Atoi(vars["height"])
@@ -20,41 +25,189 @@ func blockWebSendBlock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	blockFilename := blockchainGetFilename(blockHeight)
+	blockFilename, err := node.blockStore.FilenameByHeight(blockHeight)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		log.Println(err)
+		return
+	}
 	if _, err := os.Stat(blockFilename); os.IsNotExist(err) {
 		w.WriteHeader(http.StatusNotFound)
 		log.Println("Block file not found:", blockFilename)
 		return
 	}
 
-	log.Println("HTTP serving block", blockHeight, "to", r.RemoteAddr)
+	// Range requests are served uncompressed
+	encoding := ""
+	if r.Header.Get("Range") == "" {
+		encoding = httpNegotiateEncoding(r)
+	}
+
+	// Block files are immutable, so the block hash is a strong ETag. Each encoding is a
+	// different representation, with its own ETag.
+	etag, err := node.dbGetBlockHashByHeight(blockHeight)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Vary", "Accept-Encoding")
 	w.Header().Set("Content-Type", "application/x-sqlite3")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%08x.db\"", blockHeight))
-	http.ServeFile(w, r, blockFilename)
-	// log.Println("Done serving block", blockHeight)
-}
+	if etagMatches(r.Header.Get("If-None-Match"), w.Header().Get("ETag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	log.Println("HTTP serving block", blockHeight, "to", r.RemoteAddr, encoding)
+	if encoding == "" {
+		http.ServeFile(w, r, blockFilename)
+		return
+	}
 
-func blockWebSendChainParams(w http.ResponseWriter, r *http.Request) {
-	log.Println("HTTP serving chainparams.json to", r.RemoteAddr)
+	f, err := os.Open(blockFilename)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Encoding", encoding)
+	cw, err := httpCompressWriter(w, encoding)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if _, err = io.Copy(cw, f); err != nil {
+		log.Println("Error serving block", blockHeight, err)
+	}
+	if err = cw.Close(); err != nil {
+		log.Println("Error serving block", blockHeight, err)
+	}
+}
 
+func (node *Node) blockWebSendChainParams(w http.ResponseWriter, r *http.Request) {
+	data := jsonifyWhateverToBytes(node.chainParams)
+	w.Header().Set("ETag", `"`+hashBytesToHexString(data)+`"`)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Disposition", "attachment; filename=\"chainparams.json\"")
-	_, err := w.Write(jsonifyWhateverToBytes(chainParams))
+	if etagMatches(r.Header.Get("If-None-Match"), w.Header().Get("ETag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	log.Println("HTTP serving chainparams.json to", r.RemoteAddr)
+	_, err := w.Write(data)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
-func blockWebServer() {
-	r := mux.NewRouter()
-	r.HandleFunc("/block/{height}", blockWebSendBlock)
-	r.HandleFunc("/chainparams.json", blockWebSendChainParams)
+// Checks if the If-None-Match header value matches the ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
 
-	serverAddress := fmt.Sprintf(":%d", cfg.httpPort)
+// Returns true if the HTTP server requires authentication
+func (node *Node) blockWebAuthRequired() bool {
+	return node.cfg.HTTPAuthToken != "" || node.cfg.HTTPAuthUser != ""
+}
+
+// Returns true if the HTTP server uses TLS
+func (node *Node) blockWebTLSEnabled() bool {
+	return len(node.cfg.HTTPACMEDomains) > 0 || node.cfg.HTTPTLSCertFile != ""
+}
 
-	log.Println("HTTP listening on", serverAddress)
-	err := http.ListenAndServe(serverAddress, r)
+// Checks the bearer token or the basic auth credentials, if they are configured
+func (node *Node) blockWebAuth(next http.Handler) http.Handler {
+	if !node.blockWebAuthRequired() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if node.cfg.HTTPAuthToken != "" && strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(node.cfg.HTTPAuthToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); ok && node.cfg.HTTPAuthUser != "" &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(node.cfg.HTTPAuthUser)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(node.cfg.HTTPAuthPassword)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Println("HTTP unauthorized request from", r.RemoteAddr)
+		if node.cfg.HTTPAuthUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="daisy"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+func (node *Node) blockWebServer() {
+	r := mux.NewRouter()
+	r.HandleFunc("/block/{height}", node.blockWebSendBlock)
+	r.HandleFunc("/blocks", node.blockWebSendBlocks)
+	r.HandleFunc("/api/blocks", node.blockWebSendBlockIndex)
+	r.HandleFunc("/api/query", node.blockWebQuery)
+	r.HandleFunc("/api/records", node.mempoolServeWebRecords)
+	r.HandleFunc("/api/notary", node.notaryServe)
+	r.HandleFunc("/api/notary/{digest}", node.notaryServe)
+	r.HandleFunc("/chainparams.json", node.blockWebSendChainParams)
+	r.HandleFunc("/status", node.blockWebSendStatus)
+	r.HandleFunc("/peers", node.blockWebSendPeers)
+	r.HandleFunc("/ws", node.blockWebEvents)
+	r.HandleFunc("/metrics", node.blockWebSendMetrics)
+
+	server := &http.Server{
+		Handler: node.newHTTPLimiter().Handler(node.blockWebAuth(r)),
+	}
+	addresses, err := node.httpListenAddresses()
 	if err != nil {
+		log.Fatalln(err)
+	}
+	listeners, err := listenAll(addresses)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if node.cfg.SinglePort {
+		log.Println("HTTP also served on the p2p port")
+		listeners = append(listeners, node.singlePortHTTPListener)
+	}
+	var serve func(l net.Listener) error
+	switch {
+	case len(node.cfg.HTTPACMEDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(node.cfg.HTTPACMEDomains...),
+			Cache:      autocert.DirCache(fmt.Sprintf("%s/acme", node.cfg.DataDir)),
+		}
+		server.TLSConfig = m.TLSConfig()
+		log.Println("HTTPS (ACME) listening on", addresses, "for", node.cfg.HTTPACMEDomains)
+		serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+	case node.cfg.HTTPTLSCertFile != "":
+		log.Println("HTTPS listening on", addresses)
+		serve = func(l net.Listener) error {
+			return server.ServeTLS(l, node.cfg.HTTPTLSCertFile, node.cfg.HTTPTLSKeyFile)
+		}
+	default:
+		log.Println("HTTP listening on", addresses)
+		serve = server.Serve
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { errs <- serve(l) }(l)
+	}
+	if err = <-errs; err != nil {
 		panic(err)
 	}
 }
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
 const (
 	ChainConsensusPoA = 0
 	ChainConsensusPoW = 1
@@ -28,4 +35,103 @@ type ChainParams struct {
 
 	// Description of the blockchain (e.g. its purpose)
 	Description string `json:"description"`
+
+	// The minimum number of distinct signatories (M of N) which must sign each block after the
+	// genesis block, counting the creator. 0 or 1 means that the creator's signature is enough.
+	BlockSignatureQuorum int `json:"block_signature_quorum,omitempty"`
+
+	// The quorum used instead of BlockSignatureQuorum by the nodes on the testnet or simnet
+	// networks, for experimenting with fewer signatories. 0 means no relaxation on testnet.
+	TestnetBlockSignatureQuorum int `json:"testnet_block_signature_quorum,omitempty"`
+
+	// The fraction (between 0 and 1) of the total weight of the signatories which must sign
+	// each key op, see keyweights.go. 0 means that QuorumForHeight() is used instead.
+	KeyOpWeightThreshold float64 `json:"key_op_weight_threshold,omitempty"`
+
+	// The policy of the number of signatures the key ops need as the chain grows, see
+	// quorum.go. If it's not set, the quorum grows with the logarithm of the height.
+	KeyOpQuorum *QuorumPolicy `json:"key_op_quorum,omitempty"`
+
+	// The rule changes signaled with the block version bits, and the number of blocks in
+	// which the signaling is counted, see softforks.go
+	SoftForks      []SoftForkDeployment `json:"soft_forks,omitempty"`
+	SoftForkWindow int                  `json:"soft_fork_window,omitempty"`
+
+	// The PoW difficulty, as the number of leading zero bits the block hashes must have, or as
+	// the target (a 256-bit hex number) the block hashes must not be above. The target
+	// overrides the bits if both are set.
+	PoWDifficultyBits int    `json:"pow_difficulty_bits,omitempty"`
+	PoWTarget         string `json:"pow_target,omitempty"`
+
+	// The PoW hash function: "sha256" (the default), "sha3-256" or "argon2id", with the
+	// Argon2id time, memory (in KiB) and threads parameters, see powhash.go
+	PoWHash          string `json:"pow_hash,omitempty"`
+	PoWArgon2Time    uint32 `json:"pow_argon2_time,omitempty"`
+	PoWArgon2Memory  uint32 `json:"pow_argon2_memory,omitempty"`
+	PoWArgon2Threads uint8  `json:"pow_argon2_threads,omitempty"`
+
+	// The maximum size of the block files in bytes, 0 for no limit
+	MaxBlockSize int64 `json:"max_block_size,omitempty"`
+}
+
+// Returns true if the blocks must have proof of work
+func (cp *ChainParams) isPoW() bool {
+	return cp.ConsensusType == ChainConsensusPoW || strings.EqualFold(cp.ConsensusTypeString, "PoW")
+}
+
+// Returns the PoW target the block hashes, as big-endian numbers, must not be above
+func (cp *ChainParams) powTarget() (*big.Int, error) {
+	if cp.PoWTarget != "" {
+		t, ok := new(big.Int).SetString(strings.TrimPrefix(cp.PoWTarget, "0x"), 16)
+		if !ok || t.Sign() < 0 || t.BitLen() > 256 {
+			return nil, fmt.Errorf("invalid pow_target %q", cp.PoWTarget)
+		}
+		return t, nil
+	}
+	if cp.PoWDifficultyBits < 0 || cp.PoWDifficultyBits > 256 {
+		return nil, fmt.Errorf("invalid pow_difficulty_bits %d", cp.PoWDifficultyBits)
+	}
+	return powTargetFromBits(cp.PoWDifficultyBits), nil
+}
+
+// Returns the target met by the hashes with at least the given number of leading zero bits
+func powTargetFromBits(bits int) *big.Int {
+	t := new(big.Int).Lsh(big.NewInt(1), uint(256-bits))
+	return t.Sub(t, big.NewInt(1))
+}
+
+// Returns true if the hash, as a big-endian number, isn't above the target
+func powHashMeetsTarget(hash []byte, target *big.Int) bool {
+	return new(big.Int).SetBytes(hash).Cmp(target) <= 0
+}
+
+// Checks the proof of work of the block at the given height, if the chain uses it, against
+// the target in effect at that height. powHashName is the PoW hash function recorded in the
+// block's metadata, which must be the chain's. The blocks are mined to meet the target by
+// blockMine(), when they're signed.
+func (node *Node) powCheckBlock(fileName, hexHash, powHashName string, height int) error {
+	if !node.chainParams.isPoW() {
+		return nil
+	}
+	if err := node.powCheckHashName(powHashName); err != nil {
+		return err
+	}
+	target, err := node.chainParamsAt(height).powTarget()
+	if err != nil {
+		return err
+	}
+	var hash []byte
+	if node.chainParams.powHashName() == powHashSHA256 {
+		// The PoW hash is the block hash
+		hash, err = hex.DecodeString(hexHash)
+	} else {
+		hash, err = node.powHashFile(fileName)
+	}
+	if err != nil {
+		return err
+	}
+	if !powHashMeetsTarget(hash, target) {
+		return fmt.Errorf("the %s PoW hash %x of block %s doesn't meet the PoW target %064x", node.chainParams.powHashName(), hash, hexHash, target)
+	}
+	return nil
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Cross-chain block references, for hierarchical or federated registries, e.g. a national
+ * registry whose blocks point to the blocks of the regional ones. A block's ChainReferences
+ * _meta lists the blocks of other daisy chains it refers to, as the chain's genesis block hash
+ * (which identifies the chain), the height and the block hash. They are added by signblock and
+ * signimportblock with -chain-ref <genesis hash>:<height>[:<block hash>].
+ *
+ * The other chains aren't part of the consensus rules, so the nodes only check the references
+ * to the chains configured in chain_refs, which maps the genesis block hashes to the URLs of
+ * the chains' nodes, e.g. of the other chain profiles served by the same daemon. The policy
+ * stage of the block acceptance vetoes the blocks referring to blocks which aren't in those
+ * chains, and without the block hash, -chain-ref looks it up in the configured chain. The
+ * references are verified before the block acceptance lock is taken, as the other chains'
+ * nodes can be slow to answer, and the verified references and the checks of the nodes'
+ * chains are cached.
+ */
+
+// The _meta key of the cross-chain references
+const blockMetaChainReferences = "ChainReferences"
+
+// The maximum size of the ChainReferences _meta
+const chainRefsMaxMetaSize = 4096
+
+// How long to wait for the node of the referenced chain
+const chainRefTimeout = 30 * time.Second
+
+// How long a failed check of a referenced chain's node is remembered, so that the blocks
+// referring to a chain whose node is down don't each wait for it
+const chainRefNodeRetryTime = time.Minute
+
+// chainRef is a reference to a block of another chain
+type chainRef struct {
+	Chain  string `json:"chain"` // The genesis block hash
+	Height int    `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+func (ref chainRef) String() string {
+	return fmt.Sprintf("%s:%d:%s", ref.Chain, ref.Height, ref.Hash)
+}
+
+// chainRefNodeCheck is the result of checking the chain of a node configured in chain_refs
+type chainRefNodeCheck struct {
+	nodeURL string
+	err     error
+	time    time.Time
+}
+
+// Parses the -chain-ref flag, a comma-separated list of <genesis hash>:<height>[:<block hash>]
+func parseChainRefsFlag(value string) ([]chainRef, error) {
+	var refs []chainRef
+	for _, s := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(s), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid chain reference %s, expecting <genesis hash>:<height>[:<block hash>]", strconv.Quote(s))
+		}
+		height, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid height in the chain reference %s", strconv.Quote(s))
+		}
+		ref := chainRef{Chain: parts[0], Height: height}
+		if len(parts) == 3 {
+			ref.Hash = parts[2]
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// Parses the ChainReferences _meta value, checking the format of the references
+func parseBlockChainRefs(value string) ([]chainRef, error) {
+	var refs []chainRef
+	if err := json.Unmarshal([]byte(value), &refs); err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if err := ref.validateFormat(); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+func (ref chainRef) validateFormat() error {
+	if !blockHashRegexp.MatchString(ref.Chain) {
+		return fmt.Errorf("invalid referenced chain %s, expecting its genesis block hash", strconv.Quote(ref.Chain))
+	}
+	if ref.Height < 0 || !blockHashRegexp.MatchString(ref.Hash) {
+		return fmt.Errorf("invalid referenced block %d %s", ref.Height, ref.Hash)
+	}
+	return nil
+}
+
+// Like validateFormat, and checks that the reference is to another chain
+func (ref chainRef) validate(node *Node) error {
+	if err := ref.validateFormat(); err != nil {
+		return err
+	}
+	if ref.Chain == node.chainParams.GenesisBlockHash {
+		return fmt.Errorf("the chain reference %s is to this chain", ref)
+	}
+	return nil
+}
+
+func validateBlockMetaChainRefs(value string) error {
+	_, err := parseBlockChainRefs(value)
+	return err
+}
+
+// Returns the cross-chain references in the block
+func (b *Block) dbGetChainRefs(node *Node) ([]chainRef, error) {
+	var count int
+	if err := b.queryRow("SELECT COUNT(*) FROM _meta WHERE key=?", blockMetaChainReferences).Scan(&count); err != nil || count == 0 {
+		return nil, err
+	}
+	value, err := b.dbGetMetaString(blockMetaChainReferences)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := parseBlockChainRefs(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if err = ref.validate(node); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// Returns the hash of the block at the height in the chain, from the chain's node configured in
+// chain_refs, or sql.ErrNoRows if the node doesn't have such a block
+func chainRefGetHash(nodeURL string, height int) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(nodeURL, "/") + "/api/blocks")
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = url.Values{"after": {strconv.Itoa(height - 1)}, "limit": {"1"}}.Encode()
+	client := http.Client{Timeout: chainRefTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: HTTP status %s", u, resp.Status)
+	}
+	var page blockIndexPage
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return "", fmt.Errorf("%s: %v", u, err)
+	}
+	if len(page.Blocks) == 0 || page.Blocks[0].Height != height {
+		return "", sql.ErrNoRows
+	}
+	return page.Blocks[0].Hash, nil
+}
+
+// Checks that the node configured for the chain is on that chain, and returns its URL, or ""
+// if the chain isn't configured in chain_refs. A successful check is kept, and a failed one
+// for chainRefNodeRetryTime.
+func (node *Node) chainRefNode(chain string) (string, error) {
+	nodeURL := node.cfg.ChainRefs[chain]
+	if nodeURL == "" {
+		return "", nil
+	}
+	var check chainRefNodeCheck
+	var cached bool
+	node.chainRefsNodes.lock.With(func() {
+		check, cached = node.chainRefsNodes.checks[chain]
+	})
+	if cached && check.nodeURL == nodeURL && (check.err == nil || time.Since(check.time) < chainRefNodeRetryTime) {
+		return nodeURL, check.err
+	}
+	check = chainRefNodeCheck{nodeURL: nodeURL, time: time.Now()}
+	genesisHash, err := chainRefGetHash(nodeURL, 0)
+	if err != nil {
+		check.err = fmt.Errorf("cannot get the genesis block from %s: %v", nodeURL, err)
+	} else if genesisHash != chain {
+		check.err = fmt.Errorf("the node %s is on the chain %s, not %s", nodeURL, genesisHash, chain)
+	}
+	node.chainRefsNodes.lock.With(func() {
+		node.chainRefsNodes.checks[chain] = check
+	})
+	if check.err != nil {
+		return "", check.err
+	}
+	return nodeURL, nil
+}
+
+// Verifies the reference against the referenced chain's node. Returns false if the chain isn't
+// configured in chain_refs.
+func (node *Node) verifyChainRef(ref chainRef) (bool, error) {
+	var verified bool
+	node.chainRefsVerified.lock.With(func() {
+		verified = node.chainRefsVerified.refs[ref]
+	})
+	if verified {
+		return true, nil
+	}
+	nodeURL, err := node.chainRefNode(ref.Chain)
+	if err != nil || nodeURL == "" {
+		return false, err
+	}
+	hash, err := chainRefGetHash(nodeURL, ref.Height)
+	if err == sql.ErrNoRows {
+		return true, fmt.Errorf("the referenced chain %s has no block at height %d", ref.Chain, ref.Height)
+	}
+	if err != nil {
+		return true, err
+	}
+	if hash != ref.Hash {
+		return true, fmt.Errorf("the block at height %d of the referenced chain %s is %s, not %s", ref.Height, ref.Chain, hash, ref.Hash)
+	}
+	node.chainRefsVerified.lock.With(func() {
+		node.chainRefsVerified.refs[ref] = true
+	})
+	return true, nil
+}
+
+// Adds the references given with -chain-ref into the _meta of a block being signed, looking up
+// the missing block hashes
+func (node *Node) blockAddChainRefs(db *sql.DB) error {
+	if node.cfg.chainRefs == "" {
+		return nil
+	}
+	refs, err := parseChainRefsFlag(node.cfg.chainRefs)
+	if err != nil {
+		return err
+	}
+	for i := range refs {
+		if refs[i].Hash == "" {
+			nodeURL, err := node.chainRefNode(refs[i].Chain)
+			if err != nil {
+				return err
+			}
+			if nodeURL == "" {
+				return fmt.Errorf("the chain %s isn't configured in chain_refs, so the block hash must be given", refs[i].Chain)
+			}
+			if refs[i].Hash, err = chainRefGetHash(nodeURL, refs[i].Height); err != nil {
+				return fmt.Errorf("cannot get block %d of the chain %s: %v", refs[i].Height, refs[i].Chain, err)
+			}
+		}
+		if err = refs[i].validate(node); err != nil {
+			return err
+		}
+		if _, err = node.verifyChainRef(refs[i]); err != nil {
+			return err
+		}
+	}
+	value := string(jsonifyWhateverToBytes(refs))
+	if len(value) > chainRefsMaxMetaSize {
+		return fmt.Errorf("the chain references take %d bytes, more than the maximum of %d", len(value), chainRefsMaxMetaSize)
+	}
+	return dbSetMetaString(db, blockMetaChainReferences, value)
+}
+
+// Verifies the block's references to the chains configured in chain_refs
+func (b *Block) verifyChainRefs(node *Node) error {
+	refs, err := b.dbGetChainRefs(node)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if _, err = node.verifyChainRef(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints the cross-chain references of the block at the given height, and whether they are
+// verified
+func (node *Node) actionChainRefs(height int) {
+	b, err := node.OpenBlockByHeight(height)
+	if err != nil {
+		log.Fatalln("Cannot open block", height, err)
+	}
+	defer b.Close()
+	refs, err := b.dbGetChainRefs(node)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(refs) == 0 {
+		fmt.Println("Block", height, "has no chain references")
+		return
+	}
+	for _, ref := range refs {
+		status := "verified"
+		if configured, err := node.verifyChainRef(ref); err != nil {
+			status = "not verified: " + err.Error()
+		} else if !configured {
+			status = "unverified, the chain isn't configured in chain_refs"
+		}
+		fmt.Printf("%s\t%d\t%s\t%s\n", ref.Chain, ref.Height, ref.Hash, status)
+	}
+}
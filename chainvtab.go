@@ -0,0 +1,362 @@
+//go:build sqlite_vtable && !sqlcipher
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+/*
+ * The chain_rows virtual table exposes the rows of all the blocks through a single database
+ * handle, without combining the blocks into a temporary database like the query command does:
+ * the block databases are read one at a time, as the rows are consumed. Each row of the virtual
+ * table is a row of a user table in a block, with the table_name and the row as a JSON object
+ * (which json_extract() can read), and the hidden block_height and block_hash columns, e.g.
+ *
+ *	SELECT json_extract(row, '$.title') FROM chain_rows WHERE table_name='wikinews_titles' AND block_height > 1000
+ *
+ * The constraints on table_name, block_height and block_hash select the tables and the blocks
+ * which are read. The virtual tables need go-sqlite3 built with "-tags sqlite_vtable".
+ */
+
+// The name of the virtual table, it's eponymous, so it doesn't need CREATE VIRTUAL TABLE
+const chainVTabName = "chain_rows"
+
+// The columns of chain_rows
+const (
+	chainVTabColTable = iota
+	chainVTabColRow
+	chainVTabColHeight
+	chainVTabColHash
+)
+
+// Opens an in-memory database with the chain_rows virtual table over the node's blocks. The
+// SQLite driver with the chain_rows module isn't registered, as the module is the node's.
+func (node *Node) chainVTabOpen() (*sql.DB, error) {
+	db := sql.OpenDB(chainVTabConnector{&sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.CreateModule(chainVTabName, chainRowsModule{node: node})
+		},
+	}})
+	// Each connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// chainVTabConnector opens the connections to the in-memory database with chain_rows
+type chainVTabConnector struct {
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c chainVTabConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(":memory:")
+}
+
+func (c chainVTabConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type chainRowsModule struct {
+	node *Node
+}
+
+func (m chainRowsModule) EponymousOnlyModule() {}
+
+func (m chainRowsModule) Create(c *sqlite3.SQLiteConn, args []string) (sqlite3.VTab, error) {
+	return m.Connect(c, args)
+}
+
+func (m chainRowsModule) Connect(c *sqlite3.SQLiteConn, args []string) (sqlite3.VTab, error) {
+	err := c.DeclareVTab("CREATE TABLE x(table_name TEXT, row TEXT, block_height INTEGER HIDDEN, block_hash TEXT HIDDEN)")
+	if err != nil {
+		return nil, err
+	}
+	return chainRowsVTab{node: m.node}, nil
+}
+
+func (m chainRowsModule) DestroyModule() {}
+
+type chainRowsVTab struct {
+	node *Node
+}
+
+// Uses the constraints which select the tables and the blocks. They're passed to Filter() in
+// the idxStr as a comma-separated list of <column>:<op>, in the order of the values.
+func (vt chainRowsVTab) BestIndex(constraints []sqlite3.InfoConstraint, orderBy []sqlite3.InfoOrderBy) (*sqlite3.IndexResult, error) {
+	used := make([]bool, len(constraints))
+	var idx []string
+	cost := 1e9
+	for i, c := range constraints {
+		if !c.Usable {
+			continue
+		}
+		switch {
+		case c.Column == chainVTabColTable && c.Op == sqlite3.OpEQ:
+			cost /= 10
+		case c.Column == chainVTabColHash && c.Op == sqlite3.OpEQ:
+			cost /= 1000
+		case c.Column == chainVTabColHeight && (c.Op == sqlite3.OpEQ || c.Op == sqlite3.OpGT || c.Op == sqlite3.OpGE || c.Op == sqlite3.OpLT || c.Op == sqlite3.OpLE):
+			cost /= 2
+		default:
+			continue
+		}
+		used[i] = true
+		idx = append(idx, fmt.Sprintf("%d:%d", c.Column, c.Op))
+	}
+	return &sqlite3.IndexResult{Used: used, IdxStr: strings.Join(idx, ","), EstimatedCost: cost}, nil
+}
+
+func (vt chainRowsVTab) Disconnect() error { return nil }
+
+func (vt chainRowsVTab) Destroy() error { return nil }
+
+func (vt chainRowsVTab) Open() (sqlite3.VTabCursor, error) {
+	return &chainRowsCursor{node: vt.node}, nil
+}
+
+// chainRowsCursor reads the rows of one table of one block at a time
+type chainRowsCursor struct {
+	table     string // Only this table, if not empty
+	hash      string // Only this block, if not empty
+	height    int    // The next block to read
+	maxHeight int
+
+	bdb       *BlockDB
+	bdbHash   string
+	bdbHeight int
+	tables    []string
+	rows      *sql.Rows
+	rowTable  string
+	cols      []string
+	values    []interface{}
+	valuePtrs []interface{}
+	rowid     int64
+	eof       bool
+	node      *Node
+}
+
+func (cur *chainRowsCursor) Filter(idxNum int, idxStr string, vals []interface{}) error {
+	cur.closeBlock()
+	maxHeight, err := cur.node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	cur.table, cur.hash, cur.height, cur.maxHeight = "", "", 0, maxHeight
+	cur.rowid, cur.eof = 0, false
+	if idxStr != "" {
+		for i, c := range strings.Split(idxStr, ",") {
+			var col, op int
+			if _, err := fmt.Sscanf(c, "%d:%d", &col, &op); err != nil || i >= len(vals) {
+				return fmt.Errorf("invalid %s index %s", chainVTabName, idxStr)
+			}
+			if err := cur.constrain(col, sqlite3.Op(op), vals[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if cur.hash != "" && !cur.eof {
+		dbb, err := cur.node.dbGetBlock(cur.hash)
+		if err != nil {
+			// Not a block in the chain
+			cur.eof = true
+			return nil
+		}
+		if dbb.Height > cur.height {
+			cur.height = dbb.Height
+		}
+		if dbb.Height < cur.maxHeight {
+			cur.maxHeight = dbb.Height
+		}
+	}
+	return cur.Next()
+}
+
+// Narrows the tables and the blocks the cursor reads with a constraint from BestIndex()
+func (cur *chainRowsCursor) constrain(col int, op sqlite3.Op, val interface{}) error {
+	switch col {
+	case chainVTabColTable:
+		table := queryValueString(val)
+		if val == nil || (cur.table != "" && table != cur.table) {
+			cur.eof = true
+		}
+		cur.table = table
+	case chainVTabColHash:
+		hash := queryValueString(val)
+		if val == nil || (cur.hash != "" && hash != cur.hash) {
+			cur.eof = true
+		}
+		cur.hash = hash
+	case chainVTabColHeight:
+		// The constraint isn't checked again by SQLite, so it follows SQLite's comparisons: NULL
+		// matches nothing, and a value which isn't a number is greater than any number
+		var v float64
+		switch val := val.(type) {
+		case nil:
+			cur.eof = true
+			return nil
+		case int64:
+			v = float64(val)
+		case float64:
+			v = val
+		default:
+			var err error
+			if v, err = strconv.ParseFloat(strings.TrimSpace(queryValueString(val)), 64); err != nil {
+				if op != sqlite3.OpLT && op != sqlite3.OpLE {
+					cur.eof = true
+				}
+				return nil
+			}
+		}
+		lo, hi := float64(cur.height), float64(cur.maxHeight)
+		switch op {
+		case sqlite3.OpEQ:
+			lo, hi = math.Max(lo, math.Ceil(v)), math.Min(hi, math.Floor(v))
+		case sqlite3.OpGT:
+			lo = math.Max(lo, math.Floor(v)+1)
+		case sqlite3.OpGE:
+			lo = math.Max(lo, math.Ceil(v))
+		case sqlite3.OpLT:
+			hi = math.Min(hi, math.Ceil(v)-1)
+		case sqlite3.OpLE:
+			hi = math.Min(hi, math.Floor(v))
+		}
+		if lo > hi {
+			cur.eof = true
+			return nil
+		}
+		cur.height, cur.maxHeight = int(lo), int(hi)
+	}
+	return nil
+}
+
+// Moves to the next row, reading the next table or the next block when the current one is done
+func (cur *chainRowsCursor) Next() error {
+	for !cur.eof {
+		if cur.rows != nil {
+			if cur.rows.Next() {
+				cur.rowid++
+				return cur.rows.Scan(cur.valuePtrs...)
+			}
+			err := cur.rows.Err()
+			cur.rows.Close()
+			cur.rows = nil
+			if err != nil {
+				return fmt.Errorf("cannot read table %s in block %d: %v", cur.rowTable, cur.bdbHeight, err)
+			}
+		}
+		if cur.bdb != nil && len(cur.tables) > 0 {
+			if err := cur.openTable(cur.tables[0]); err != nil {
+				return err
+			}
+			cur.tables = cur.tables[1:]
+			continue
+		}
+		cur.closeBlock()
+		if cur.height > cur.maxHeight {
+			cur.eof = true
+			return nil
+		}
+		if err := cur.openBlock(cur.height); err != nil {
+			return err
+		}
+		cur.height++
+	}
+	return nil
+}
+
+// Opens the block at the height, and lists the tables to read from it
+func (cur *chainRowsCursor) openBlock(height int) error {
+	hash, err := cur.node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		return err
+	}
+	if hash == "" || (cur.hash != "" && hash != cur.hash) {
+		return nil
+	}
+	bdb, err := cur.node.blockDBs.Get(hash)
+	if err != nil {
+		return fmt.Errorf("cannot open block %d: %v", height, err)
+	}
+	cur.bdb, cur.bdbHash, cur.bdbHeight = bdb, hash, height
+	tables, err := bdb.TableNames()
+	if err != nil {
+		return err
+	}
+	cur.tables = nil
+	for _, t := range tables {
+		if cur.table == "" || t == cur.table {
+			cur.tables = append(cur.tables, t)
+		}
+	}
+	return nil
+}
+
+func (cur *chainRowsCursor) openTable(table string) (err error) {
+	if cur.cols, err = cur.bdb.ColumnNames(table); err != nil {
+		return err
+	}
+	cur.values = make([]interface{}, len(cur.cols))
+	cur.valuePtrs = make([]interface{}, len(cur.cols))
+	for i := range cur.values {
+		cur.valuePtrs[i] = &cur.values[i]
+	}
+	cur.rowTable = table
+	cur.rows, err = cur.bdb.Query(fmt.Sprintf("SELECT * FROM %s", dbQuoteIdentifier(table)))
+	return err
+}
+
+func (cur *chainRowsCursor) closeBlock() {
+	if cur.rows != nil {
+		cur.rows.Close()
+		cur.rows = nil
+	}
+	if cur.bdb != nil {
+		cur.node.blockDBs.Release(cur.bdb)
+		cur.bdb = nil
+	}
+	cur.tables = nil
+}
+
+func (cur *chainRowsCursor) EOF() bool {
+	return cur.eof
+}
+
+func (cur *chainRowsCursor) Column(c *sqlite3.SQLiteContext, col int) error {
+	switch col {
+	case chainVTabColTable:
+		c.ResultText(cur.rowTable)
+	case chainVTabColRow:
+		row := []byte{'{'}
+		for i, name := range cur.cols {
+			if i > 0 {
+				row = append(row, ',')
+			}
+			row = appendQueryJSONValue(append(appendQueryJSONString(row, name), ':'), cur.values[i])
+		}
+		c.ResultText(string(append(row, '}')))
+	case chainVTabColHeight:
+		c.ResultInt64(int64(cur.bdbHeight))
+	case chainVTabColHash:
+		c.ResultText(cur.bdbHash)
+	default:
+		c.ResultNull()
+	}
+	return nil
+}
+
+func (cur *chainRowsCursor) Rowid() (int64, error) {
+	return cur.rowid, nil
+}
+
+func (cur *chainRowsCursor) Close() error {
+	cur.closeBlock()
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !sqlite_vtable || sqlcipher
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The chain_rows virtual table needs go-sqlite3's virtual table support, see chainvtab.go
+func (node *Node) chainVTabOpen() (*sql.DB, error) {
+	return nil, fmt.Errorf("This build of daisy doesn't support the chain_rows virtual table. Build it with: go build -tags sqlite_vtable")
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"reflect"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,204 +24,403 @@ import (
 // This function processes those and returns true if it has found something to execute.
 // The processActions() function is called after the blockchain database is initialised
 // and active.
-func processActions() bool {
-	if flag.NArg() == 0 {
-		return false
-	}
-	cmd := flag.Arg(0)
-	switch cmd {
-	case "help":
-		actionHelp()
-		return true
-	case "mykeys":
-		actionMyKeys()
-		return true
-	case "query":
-		actionQuery(flag.Arg(1))
-		return true
-	case "signimportblock":
-		if flag.NArg() < 2 {
-			log.Fatalln("Not enough arguments: expecting <sqlite db filename>")
-		}
-		actionSignImportBlock(flag.Arg(1))
-		return true
-	}
-	return false
+func (node *Node) processActions() bool {
+	return node.runCliCommand(false)
 }
 
 // processPreBlockchainActions is called to process actions which need to executed
 // before the blockchain database is running.
-func processPreBlockchainActions() bool {
+func (node *Node) processPreBlockchainActions() bool {
+	return node.runCliCommand(true)
+}
+
+// Looks up the command named by the first non-flag argument in the command registry
+// and runs it if its preBlockchain property matches. Returns true if a command was run.
+func (node *Node) runCliCommand(preBlockchain bool) bool {
 	if flag.NArg() == 0 {
 		return false
 	}
-	cmd := flag.Arg(0)
-	switch cmd {
-	case "newchain":
-		if flag.NArg() < 2 {
-			log.Fatalln("Not enough arguments: expecing chainparams.json")
-		}
-		actionNewChain(flag.Arg(1))
-		return true
-	case "pull":
-		if flag.NArg() < 2 {
-			log.Fatalln("Not enough arguments: expecting chain URL")
-		}
-		actionPull(flag.Arg(1))
-		return true
+	c := findCliCommand(flag.Arg(0))
+	if c == nil || c.preBlockchain != preBlockchain {
+		return false
+	}
+	args := flag.Args()[1:]
+	if len(args) < c.minArgs {
+		log.Fatalln("Not enough arguments: expecting", c.args)
 	}
-	return false
+	c.handler(node, args)
+	return true
 }
 
 // Opens the given block file (SQLite database), creates metadata tables in it, signes the
 // block with one of the private keys, and accepts the resulting block into the blockchain.
-func actionSignImportBlock(fn string) {
-	db, err := dbOpen(fn, false)
+// If the chain requires more than one signature per block, the signatures file is written
+// instead, for cosignblock and importblock.
+func (node *Node) actionSignImportBlock(fn string) {
+	sigs := node.blockSignFile(fn)
+	height, err := node.dbGetBlockchainHeight()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	dbEnsureBlockchainTables(db)
-	keypair, publicKeyHash, err := cryptoGetAPrivateKey()
+	if q := node.SignatureQuorumForHeight(height + 1); q > 1 {
+		if err := sigs.write(fn); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("The block needs", q-1, "more signatures: use cosignblock on", fn, "and then importblock")
+		return
+	}
+	node.blockImportFile(fn, sigs)
+}
+
+// Creates the metadata tables in the given block file and signs it with the key selected
+// by -key, as the block's creator. Mining is cancelled by SIGINT or SIGTERM.
+func (node *Node) blockSignFile(fn string) *blockSignatures {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	sigs, err := node.blockSign(ctx, fn)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	lastBlockHeight := dbGetBlockchainHeight()
-	dbb, err := dbGetBlockByHeight(lastBlockHeight)
+	return sigs
+}
+
+// Creates the metadata tables in the given block file, mines it if the chain uses PoW, and
+// signs it with the signing key, as the block's creator. Mining stops when the context is
+// cancelled.
+func (node *Node) blockSign(ctx context.Context, fn string) (*blockSignatures, error) {
+	keypair, publicKeyHash, err := node.cryptoGetSigningKey()
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	if err = dbSetMetaInt(db, "Version", CurrentBlockVersion); err != nil {
-		log.Panic(err)
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		return nil, err
 	}
-	err = dbSetMetaString(db, "PreviousBlockHash", dbb.Hash)
+	dbEnsureBlockchainTables(db)
+	if err = node.blockWriteMeta(db, keypair, publicKeyHash); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = db.Close(); err != nil {
+		return nil, err
+	}
+	if node.chainParams.isPoW() {
+		if err = node.blockMine(ctx, fn); err != nil {
+			return nil, err
+		}
+	}
+	blockHashHex, err := hashFileToHexString(fn)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	signature, err := cryptoSignHex(keypair, dbb.Hash)
+	signature, err := cryptoSignHex(keypair, blockHashHex)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	err = dbSetMetaString(db, "PreviousBlockHashSignature", signature)
+	return &blockSignatures{Hash: blockHashHex, Creator: publicKeyHash, HashSignature: signature}, nil
+}
+
+// Writes the block's metadata, linking it to the last block in the blockchain
+func (node *Node) blockWriteMeta(db *sql.DB, keypair *ecdsa.PrivateKey, publicKeyHash string) error {
+	height, err := node.dbGetBlockchainHeight()
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	err = dbSetMetaString(db, "Timestamp", time.Now().Format(time.RFC3339))
+	dbb, err := node.dbGetBlockByHeight(height)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-
-	pkdb, err := dbGetPublicKey(publicKeyHash)
+	if err = dbSetMetaInt(db, "Version", node.softForksBlockVersion()); err != nil {
+		return err
+	}
+	if err = dbSetMetaString(db, "PreviousBlockHash", dbb.Hash); err != nil {
+		return err
+	}
+	signature, err := cryptoSignHex(keypair, dbb.Hash)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if err = dbSetMetaString(db, "PreviousBlockHashSignature", signature); err != nil {
+		return err
+	}
+	if node.cfg.TSAURL != "" {
+		if token, err := node.tsaRequestToken(dbb.Hash); err != nil {
+			chainLog.Warn("Cannot get the timestamp token of block", dbb.Hash, "from", node.cfg.TSAURL, err)
+		} else if err = dbSetMetaString(db, blockMetaTimestampToken, token); err != nil {
+			return err
+		}
+	}
+	if err = dbSetMetaString(db, "Timestamp", time.Now().Format(time.RFC3339)); err != nil {
+		return err
 	}
-	previousBlockHashSignature, err := hex.DecodeString(signature)
+	pkdb, err := node.dbGetPublicKey(publicKeyHash)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 	if creatorString, ok := pkdb.metadata["BlockCreator"]; ok {
-		err = dbSetMetaString(db, "Creator", creatorString)
-		if err != nil {
-			log.Fatalln(err)
+		if err = dbSetMetaString(db, "Creator", creatorString); err != nil {
+			return err
+		}
+	}
+	if err = dbSetMetaString(db, "CreatorPublicKey", pkdb.publicKeyHash); err != nil {
+		return err
+	}
+	if err = node.blockAddPendingKeyMetadata(db, height+1); err != nil {
+		return err
+	}
+	if err = node.blockAddPendingAnchors(db); err != nil {
+		return err
+	}
+	if err = node.blockAddChainRefs(db); err != nil {
+		return err
+	}
+	if err = blockAddNotaryRoot(db, keypair, dbb.Hash); err != nil {
+		return err
+	}
+	if node.chainParams.isPoW() {
+		if err = dbSetMetaString(db, "PoWHash", node.chainParams.powHashName()); err != nil {
+			return err
 		}
 	}
-	err = dbSetMetaString(db, "CreatorPublicKey", pkdb.publicKeyHash)
+	return nil
+}
+
+// Runs a SQL query over the blocks selected with -from and -to. The tables of the blocks are
+// combined, with the _block_height column added to each of them, so the query can join and
+// aggregate across blocks. With -reverse, the rows of newer blocks come first in the combined
+// tables, and -limit stops the output after the given number of rows. The output format is
+// selected with -format, or the results are written to the file given with -output.
+func (node *Node) actionQuery(q string) {
+	qr := queryRequest{SQL: q, From: node.cfg.queryFrom, To: node.cfg.queryTo, Reverse: node.cfg.queryReverse, Limit: node.cfg.queryLimit, Format: node.cfg.queryFormat}
+	if err := qr.normalize(node); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkQueryOutputFile(node.cfg.queryOutput); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Collecting the blocks from", qr.From, "to", qr.To, "for the query")
+	ctx, cancel := context.WithTimeout(context.Background(), qr.timeout(node))
+	defer cancel()
+	qdb, rows, err := qr.run(node, ctx)
 	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer qdb.Close()
+	defer rows.Close()
+	if err = node.writeQueryOutput(node.cfg.queryOutput, rows, qr.Format, qr.Limit); err != nil {
+		log.Println(err)
+	}
+}
+
+// Runs a query on the chain_rows virtual table, with the limits of the query command
+func (node *Node) actionChainQuery(q string) {
+	qr := queryRequest{SQL: q, Limit: node.cfg.queryLimit, Format: node.cfg.queryFormat}
+	if err := qr.normalize(node); err != nil {
 		log.Fatalln(err)
 	}
-	if err = db.Close(); err != nil {
-		log.Panic(err)
+	if err := checkQueryOutputFile(node.cfg.queryOutput); err != nil {
+		log.Fatalln(err)
 	}
-	blockHashHex, err := hashFileToHexString(fn)
+	db, err := node.chainVTabOpen()
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln(err)
 	}
-	signature, err = cryptoSignHex(keypair, blockHashHex)
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), qr.timeout(node))
+	defer cancel()
+	conn, err := node.querySandboxConn(ctx, db)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln(err)
 	}
-	blockHashSignature, _ := hex.DecodeString(signature)
+	defer conn.Close()
+	rows, err := conn.QueryContext(ctx, qr.SQL, qr.Params...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer rows.Close()
+	if err = node.writeQueryOutput(node.cfg.queryOutput, rows, qr.Format, qr.Limit); err != nil {
+		log.Println(err)
+	}
+}
 
-	newBlockHeight := lastBlockHeight + 1
-	newBlock := DbBlockchainBlock{Hash: blockHashHex, HashSignature: blockHashSignature, PreviousBlockHash: dbb.Hash, PreviousBlockHashSignature: previousBlockHashSignature,
-		Version: CurrentBlockVersion, SignaturePublicKeyHash: pkdb.publicKeyHash, Height: newBlockHeight, TimeAccepted: time.Now()}
+// Information about one table, collected across blocks by actionSchema()
+type schemaTableInfo struct {
+	columns   []string
+	rowCount  int
+	numBlocks int
+	minHeight int
+	maxHeight int
+}
 
-	err = blockchainCopyFile(fn, newBlockHeight)
+// Scans the blocks and reports the union of tables, their columns and row counts across
+// the blockchain. If nBlocks is greater than 0, only that many most recent blocks are scanned.
+func (node *Node) actionSchema(nBlocks int) {
+	maxHeight, err := node.dbGetBlockchainHeight()
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln(err)
+	}
+	minHeight := 0
+	if nBlocks > 0 && maxHeight-nBlocks+1 > minHeight {
+		minHeight = maxHeight - nBlocks + 1
+	}
+	tables := map[string]*schemaTableInfo{}
+	for h := minHeight; h <= maxHeight; h++ {
+		b, err := node.OpenBlockByHeight(h)
+		if err != nil {
+			log.Fatalln("Cannot open block", h, err)
+		}
+		names, err := b.dbGetTableNames()
+		if err != nil {
+			log.Fatalln("Cannot read tables from block", h, err)
+		}
+		for _, name := range names {
+			ti, ok := tables[name]
+			if !ok {
+				ti = &schemaTableInfo{minHeight: h}
+				tables[name] = ti
+			}
+			columns, err := b.dbGetTableColumns(name)
+			if err != nil {
+				log.Fatalln("Cannot read columns of", name, "from block", h, err)
+			}
+			for _, col := range columns {
+				if !inStrings(col, ti.columns) {
+					ti.columns = append(ti.columns, col)
+				}
+			}
+			count, err := b.dbGetTableRowCount(name)
+			if err != nil {
+				log.Fatalln("Cannot count rows of", name, "in block", h, err)
+			}
+			ti.rowCount += count
+			ti.numBlocks++
+			ti.maxHeight = h
+		}
+		if err = b.Close(); err != nil {
+			log.Println(err)
+		}
 	}
 
-	err = dbInsertBlock(&newBlock)
-	if err != nil {
-		log.Panic(err)
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Scanned blocks %d to %d, found %d tables\n", minHeight, maxHeight, len(names))
+	for _, name := range names {
+		ti := tables[name]
+		fmt.Printf("\n%s: %d rows in %d blocks (heights %d to %d)\n", name, ti.rowCount, ti.numBlocks, ti.minHeight, ti.maxHeight)
+		for _, col := range ti.columns {
+			fmt.Printf("\t%s\n", col)
+		}
 	}
 }
 
-// Runs a SQL query over all the blocks.
-func actionQuery(q string) {
-	log.Println("Running query:", q)
-	errCount := 0
-	for h := dbGetBlockchainHeight(); h > 0; h-- {
-		fn := blockchainGetFilename(h)
-		db, err := dbOpen(fn, true)
+// Block files removed by rollback are moved into this subdirectory of the data directory
+const rollbackArchiveSubdirectory = "archive"
+
+// Removes the blocks above the given height from the blockchain, moves their files into the
+// archive directory, and reverses the key ops they have introduced. This is done before the
+// blockchain is initialised (and verified), so that a bad block can be undone.
+func (node *Node) actionRollback(height int) {
+	node.dbInit()
+	node.ensureBlockchainSubdirectoryExists()
+	maxHeight, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if height < 0 || height >= maxHeight {
+		log.Fatalln("Rollback height must be between 0 and", maxHeight-1)
+	}
+	archiveDir := fmt.Sprintf("%s/%s", node.cfg.DataDir, rollbackArchiveSubdirectory)
+	for h := maxHeight; h > height; h-- {
+		dbb, err := node.dbGetBlockByHeight(h)
 		if err != nil {
-			log.Panic(err)
+			log.Fatalln("Cannot get block", h, err)
 		}
-		rows, err := db.Query(q)
+		blk, err := OpenBlockFile(node.blockStore.Filename(dbb.Hash))
 		if err != nil {
-			errCount++
-			continue
+			log.Fatalln("Cannot open block", h, err)
 		}
-		cols, err := rows.Columns()
+		keyOps, err := blk.dbGetKeyOps()
 		if err != nil {
-			log.Panic(err)
+			log.Fatalln("Cannot read key ops from block", h, err)
 		}
-		for rows.Next() {
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			for i := range columns {
-				columnPointers[i] = &columns[i]
-			}
-			if err := rows.Scan(columnPointers...); err != nil {
-				log.Panic(err)
-			}
-			row := make(map[string]interface{})
-			for i, colName := range cols {
-				val := columnPointers[i].(*interface{})
-				if reflect.TypeOf(*val).String() == "[]uint8" {
-					row[colName] = string((*val).([]byte))
-				} else {
-					row[colName] = *val
-				}
+		if err = blk.Close(); err != nil {
+			log.Println(err)
+		}
+		for key, ops := range keyOps {
+			switch ops[0].op {
+			case "A":
+				err = node.dbDeletePublicKey(key)
+			case "R":
+				err = node.dbUnrevokePublicKey(key)
+			case "M":
+				log.Println("Block", h, "has changed the metadata of key", key, "- the current metadata is kept")
 			}
-			buf, err := json.Marshal(row)
 			if err != nil {
-				log.Panic(err)
+				log.Fatalln("Cannot reverse key op", ops[0].op, "for", key, "in block", h, err)
 			}
-			fmt.Println(string(buf))
 		}
+		if err = node.dbDeleteBlockByHeight(h); err != nil {
+			log.Fatalln("Cannot delete block", h, err)
+		}
+		if err = node.blockStore.Archive(dbb.Hash, archiveDir); err != nil {
+			log.Fatalln("Cannot archive block", h, err)
+		}
+		node.auditLog(auditBlockRollback, StrIfMap{"hash": dbb.Hash, "height": h})
+		node.nodeEvents.Publish(eventBlockRolledBack, StrIfMap{"hash": dbb.Hash, "height": h})
+		log.Println("Rolled back block", dbb.Hash, "at height", h)
+	}
+	if err := node.chainParamsRollbackUpdates(height); err != nil {
+		log.Println("Cannot roll back the chain param updates:", err)
 	}
-	if errCount != 0 {
-		log.Println("There have been", errCount, "errors.")
+	if err := node.dbAnchorsRollback(height); err != nil {
+		log.Println("Cannot roll back the anchors:", err)
 	}
+	if err := node.dbNotarizationsRollback(height); err != nil {
+		log.Println("Cannot roll back the notarizations:", err)
+	}
+	if err := node.userIndexesRollback(height); err != nil {
+		log.Println("Cannot roll back the indexes:", err)
+	}
+	if err := node.combinedDbRollback(height); err != nil {
+		log.Println("Cannot roll back", combinedDbFileName+":", err)
+	}
+	if err := node.softForksUpdate(); err != nil {
+		log.Println("Cannot update the soft fork states:", err)
+	}
+	log.Println("Blockchain rolled back to height", height, "- removed block files are in", archiveDir)
 }
 
-// Shows the help message.
-func actionHelp() {
-	fmt.Printf("usage: %s [flags] [command]\n", os.Args[0])
-	flag.PrintDefaults()
-	fmt.Println("Commands:")
-	fmt.Println("\thelp\t\tShows this help message")
-	fmt.Println("\tmykeys\t\tShows a list of my public keys")
-	fmt.Println("\tquery\t\tExecutes a SQL query on the blockchain (expects 1 argument: SQL query)")
-	fmt.Println("\tsignimportblock\tSigns a block (creates metadata tables in it first) and imports it into the blockchain (expects 1 argument: a sqlite db filename)")
-	fmt.Println("\tnewchain\tStarts a new chain with the given parameters (expects 1 argument: chainparams.json)")
-	fmt.Println("\tpull\t\tPulls a blockchain from a HTTP URL (expects 1 argument: URL, e.g. http://example.com:2018/)")
+// Shows the public keys which correspond to private keys in the system database.
+func (node *Node) actionMyKeys() {
+	names, err := node.dbGetMyKeyNames()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hashes, err := node.dbGetMyPublicKeyHashes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, k := range hashes {
+		if name, ok := names[k]; ok {
+			fmt.Printf("%s\t%s\n", k, name)
+		} else {
+			fmt.Println(k)
+		}
+	}
 }
 
-// Shows the public keys which correspond to private keys in the system database.
-func actionMyKeys() {
-	for _, k := range dbGetMyPublicKeyHashes() {
-		fmt.Println(k)
+// Sets or removes the name of one of my keys
+func (node *Node) actionNameKey(publicKeyHash string, name string) {
+	if strings.HasPrefix(name, "1:") {
+		log.Fatalln("Key names cannot look like public key hashes:", name)
+	}
+	if err := node.dbSetPrivateKeyName(publicKeyHash, name); err != nil {
+		log.Fatalln(err)
 	}
 }
 
@@ -223,9 +428,13 @@ func actionMyKeys() {
 type NewChainParams struct {
 	ChainParams
 	GenesisDb string `json:"genesis_db"`
+
+	// The initial signatories besides the creator, as PEM files or hex-encoded public keys.
+	// They are added in the genesis block, signed by the creator's key.
+	GenesisKeys []string `json:"genesis_keys"`
 }
 
-func actionNewChain(jsonFilename string) {
+func (node *Node) actionNewChain(jsonFilename string) {
 	jsonData, err := ioutil.ReadFile(jsonFilename)
 	if err != nil {
 		log.Fatalln(err)
@@ -242,20 +451,45 @@ func actionNewChain(jsonFilename string) {
 	if ncp.CreatorPublicKey != "" || ncp.GenesisBlockHash != "" || ncp.GenesisBlockHashSignature != "" {
 		log.Fatalln("chainparams.json must not contain cryptographic properties")
 	}
+	if err = ncp.quorumPolicy().validate(); err != nil {
+		log.Fatalln(err)
+	}
+	if err = ncp.validateSoftForks(); err != nil {
+		log.Fatalln(err)
+	}
+	if ncp.isPoW() {
+		if _, err = ncp.powTarget(); err != nil {
+			log.Fatalln(err)
+		}
+		if _, err = ncp.powHashFunc(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	genesisKeys := map[string][]byte{}
+	for _, keyArg := range ncp.GenesisKeys {
+		publicKeyBytes, err := readPublicKeyArg(keyArg)
+		if err != nil {
+			log.Fatalln("Invalid genesis key", keyArg, err)
+		}
+		genesisKeys[getPubKeyHash(publicKeyBytes)] = publicKeyBytes
+	}
 	log.Println("Creating a new blockchain from", jsonFilename)
 
-	empty, err := isDirEmpty(cfg.DataDir)
+	empty, err := isDirEmpty(node.cfg.DataDir)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	if !empty {
-		log.Fatalln("Data directory must not be empty:", cfg.DataDir)
+		log.Fatalln("Data directory must not be empty:", node.cfg.DataDir)
 	}
 
-	ensureBlockchainSubdirectoryExists()
+	node.ensureBlockchainSubdirectoryExists()
+	// The genesis block is assembled in a working file, and moved into the block store
+	// once it's complete and its hash is known.
+	blockFilename := fmt.Sprintf("%s/genesis.db.tmp", node.cfg.DataDir)
 	freshDb := true
 	if ncp.GenesisDb != "" && fileExists(ncp.GenesisDb) {
-		err = blockchainCopyFile(ncp.GenesisDb, 0)
+		err = copyFile(ncp.GenesisDb, blockFilename)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -263,7 +497,6 @@ func actionNewChain(jsonFilename string) {
 	}
 
 	// Modify the new genesis db to include the metadata
-	blockFilename := blockchainGetFilename(0)
 	log.Println("Creating the genesis block at", blockFilename)
 	db, err := dbOpen(blockFilename, false)
 	if err != nil {
@@ -303,22 +536,25 @@ func actionNewChain(jsonFilename string) {
 
 	if len(ncp.BootstrapPeers) > 0 {
 		// bootstrapPeers is required to be filled in before dbInit()
-		bootstrapPeers = peerStringMap{}
+		node.bootstrapPeers = peerStringMap{}
 		for _, peer := range ncp.BootstrapPeers {
-			bootstrapPeers[peer] = time.Now()
+			node.bootstrapPeers[peer] = time.Now()
 		}
 	}
 
-	dbInit()     // Create system databases
-	cryptoInit() // Create the genesis keypair
+	node.dbInit()     // Create system databases
+	node.cryptoInit() // Create the genesis keypair
 
-	pubKeys := dbGetMyPublicKeyHashes()
+	pubKeys, err := node.dbGetMyPublicKeyHashes()
+	if err != nil {
+		log.Fatalln(err)
+	}
 	if len(pubKeys) != 1 {
 		log.Fatalln("There should have been only one genesis keypair, found", len(pubKeys))
 	}
 	err = dbSetMetaString(db, "CreatorPublicKey", pubKeys[0])
 
-	pKey, pubKeyHash, err := cryptoGetAPrivateKey()
+	pKey, pubKeyHash, err := node.cryptoGetAPrivateKey()
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -340,7 +576,7 @@ func actionNewChain(jsonFilename string) {
 	}
 
 	// Write the public key into the genesis block
-	pubKey, err := dbGetPublicKey(pubKeyHash)
+	pubKey, err := node.dbGetPublicKey(pubKeyHash)
 	if err != nil {
 		log.Fatalln("Error getting public key from db", err)
 	}
@@ -354,16 +590,39 @@ func actionNewChain(jsonFilename string) {
 		log.Fatalln("Error recording the genesis block public key")
 	}
 
+	// Write the other initial signatories into the genesis block, signed by the creator
+	for publicKeyHash, publicKeyBytes := range genesisKeys {
+		if publicKeyHash == pubKeyHash {
+			continue
+		}
+		signature, err := cryptoSignPublicKeyHash(pKey, publicKeyHash)
+		if err != nil {
+			log.Fatalln("Error signing publicKey", err)
+		}
+		_, err = db.Exec("INSERT INTO _keys (op, pubkey_hash, pubkey, sigkey_hash, signature) VALUES (?, ?, ?, ?, ?)",
+			"A", publicKeyHash, hex.EncodeToString(publicKeyBytes), pubKeyHash, hex.EncodeToString(signature))
+		if err != nil {
+			log.Fatalln("Error recording the genesis block public key", publicKeyHash)
+		}
+		if err = dbWritePublicKey(node.mainDb, publicKeyBytes, publicKeyHash, 0); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Genesis signatory:", publicKeyHash)
+	}
+
 	err = db.Close()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	// Hash it, sign it, generate chainparams
-	hash, err := hashFileToHexString(blockFilename)
+	hash, err := node.blockStore.Put(blockFilename)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if err = os.Remove(blockFilename); err != nil {
+		log.Println(err)
+	}
 	ncp.GenesisBlockHash = hash
 	ncp.CreatorPublicKey = pubKeyHash
 	ncp.GenesisBlockHashSignature, err = cryptoSignHex(pKey, hash)
@@ -377,7 +636,7 @@ func actionNewChain(jsonFilename string) {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", cfg.DataDir, chainParamsBaseName), cpJSON, 0644)
+	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", node.cfg.DataDir, chainParamsBaseName), cpJSON, 0644)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -393,20 +652,20 @@ func actionNewChain(jsonFilename string) {
 		Height:                     0,
 		TimeAccepted:               time.Now(),
 	}
-	err = dbInsertBlock(&newBlock)
+	err = node.dbInsertBlock(&newBlock)
 	if err != nil {
 		log.Panic(err)
 	}
 
 	// Reopen the database to verify
 	log.Println("Reloading to verify...")
-	blockchainInit(false)
+	node.blockchainInit(false)
 
 	// If we make it to here, everything's ok.
 	log.Println("All done.")
 }
 
-func actionPull(baseURL string) {
+func (node *Node) actionPull(baseURL string) {
 	if !strings.HasSuffix(baseURL, "/") {
 		baseURL = baseURL + "/"
 	}
@@ -421,64 +680,80 @@ func actionPull(baseURL string) {
 	if err != nil {
 		log.Fatalln("Error reading chainparams", cpURL, err)
 	}
-	err = json.Unmarshal(body, &chainParams)
+	err = json.Unmarshal(body, &node.chainParams)
 	if err != nil {
 		log.Println(string(body))
 		log.Fatalln("Error decoding chainparams", cpURL, err)
 	}
-	if chainParams.GenesisBlockHash == "" || chainParams.GenesisBlockHashSignature == "" {
+	if node.chainParams.GenesisBlockHash == "" || node.chainParams.GenesisBlockHashSignature == "" {
 		log.Fatalln("Incomplete chainparams data", cpURL)
 	}
+	if err = node.chainParams.quorumPolicy().validate(); err != nil {
+		log.Fatalln("Invalid chainparams data", cpURL, err)
+	}
+	if err = node.chainParams.validateSoftForks(); err != nil {
+		log.Fatalln("Invalid chainparams data", cpURL, err)
+	}
 
 	// Step 2: Fetch the genesis block
 	gbURL := fmt.Sprintf("%s/block/0", baseURL)
-	resp, err = http.Get(gbURL)
+	req, err := http.NewRequest("GET", gbURL, nil)
+	if err != nil {
+		log.Fatalln("Error getting genesis block", gbURL, err)
+	}
+	resp, gbBody, err := httpGetCompressed(http.DefaultClient, req)
 	if err != nil {
 		log.Fatalln("Error getting genesis block", gbURL, err)
 	}
 	defer resp.Body.Close()
-	body, err = ioutil.ReadAll(resp.Body)
+	defer gbBody.Close()
+	maxSize := int64(mineWorkMaxSize)
+	if node.chainParams.MaxBlockSize > 0 {
+		maxSize = node.chainParams.MaxBlockSize
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(gbBody, maxSize+1))
 	if err != nil {
 		log.Fatalln("Error reading genesis block", gbURL, err)
 	}
+	if int64(len(body)) > maxSize {
+		log.Fatalln("The genesis block at", gbURL, "is larger than", maxSize, "bytes")
+	}
 
 	// Step 3: initialise data directories
-	if fileExists(cfg.DataDir) {
-		if empty, err := isDirEmpty(cfg.DataDir); err != nil || !empty {
-			log.Fatalln("Blockchain directory must be empty", cfg.DataDir)
+	if fileExists(node.cfg.DataDir) {
+		if empty, err := isDirEmpty(node.cfg.DataDir); err != nil || !empty {
+			log.Fatalln("Blockchain directory must be empty", node.cfg.DataDir)
 		}
 	}
-	if _, err = os.Stat(cfg.DataDir); err != nil {
-		log.Println("Data directory", cfg.DataDir, "doesn't exist, creating.")
-		err = os.Mkdir(cfg.DataDir, 0700)
+	if _, err = os.Stat(node.cfg.DataDir); err != nil {
+		log.Println("Data directory", node.cfg.DataDir, "doesn't exist, creating.")
+		err = os.Mkdir(node.cfg.DataDir, 0700)
 		if err != nil {
 			log.Panicln(err)
 		}
 	}
-	ensureBlockchainSubdirectoryExists()
+	node.ensureBlockchainSubdirectoryExists()
 
-	blockFilename := blockchainGetFilename(0)
-	err = ioutil.WriteFile(blockFilename, body, 0664)
+	hash, err := node.blockStore.PutBytes(body)
 	if err != nil {
-		log.Fatalln("Cannot write genesis block", blockFilename, err)
+		log.Fatalln("Cannot write genesis block", err)
 	}
-
-	hash, err := hashFileToHexString(blockFilename)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	if hash != chainParams.GenesisBlockHash {
+	if hash != node.chainParams.GenesisBlockHash {
+		if err = node.blockStore.Remove(hash); err != nil {
+			log.Println(err)
+		}
 		log.Fatalln("Mismatching genesis block hash")
 	}
+	blockFilename := node.blockStore.Filename(hash)
 
 	// Step 4: Initialise databases
-	dbInit()
-	dbClearSavedPeers()
-	cryptoInit()
+	node.dbInit()
+	node.dbClearSavedPeers()
+	node.cryptoInit()
 
 	blk, err := OpenBlockFile(blockFilename)
 	if err != nil {
-		log.Fatalln("Error opening genesis block", blockFilename, err, "--", cfg.DataDir, "is in inconsistent state")
+		log.Fatalln("Error opening genesis block", blockFilename, err, "--", node.cfg.DataDir, "is in inconsistent state")
 	}
 	kops, err := blk.dbGetKeyOps()
 	if err != nil {
@@ -489,6 +764,7 @@ func actionPull(baseURL string) {
 	}
 
 	verified := false
+	var creatorKey *ecdsa.PublicKey
 	for kHash, ops := range kops {
 		for _, op := range ops {
 			if op.op == "A" {
@@ -496,12 +772,15 @@ func actionPull(baseURL string) {
 				if err != nil {
 					log.Fatalln("Error decoding genesis block public key", kHash, err)
 				}
-				if chainParams.CreatorPublicKey != getPubKeyHash(op.publicKeyBytes) {
+				if node.chainParams.CreatorPublicKey != getPubKeyHash(op.publicKeyBytes) {
 					continue
 				}
-				if err = cryptoVerifyHex(pubKey, chainParams.GenesisBlockHash, chainParams.GenesisBlockHashSignature); err == nil {
+				if err = cryptoVerifyHex(pubKey, node.chainParams.GenesisBlockHash, node.chainParams.GenesisBlockHashSignature); err == nil {
 					verified = true
-					dbWritePublicKey(op.publicKeyBytes, chainParams.CreatorPublicKey, 0)
+					creatorKey = pubKey
+					if err = dbWritePublicKey(node.mainDb, op.publicKeyBytes, node.chainParams.CreatorPublicKey, 0); err != nil {
+						log.Fatalln(err)
+					}
 				} else {
 					log.Fatalln("Error verifying genesis block signature", err)
 				}
@@ -511,31 +790,55 @@ func actionPull(baseURL string) {
 	if !verified {
 		log.Fatalln("Cannot verify genesis block signature")
 	}
+	// The other initial signatories are signed by the creator
+	for kHash, ops := range kops {
+		if kHash == node.chainParams.CreatorPublicKey {
+			continue
+		}
+		for _, op := range ops {
+			if op.op != "A" || op.signatureKeyHash != node.chainParams.CreatorPublicKey {
+				continue
+			}
+			if err = cryptoVerifyKeyOpSignature(creatorKey, &op); err != nil {
+				log.Fatalln("Error verifying genesis block key", kHash, err)
+			}
+			if err = dbWritePublicKey(node.mainDb, op.publicKeyBytes, kHash, 0); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
 	blk.Close()
 
-	hashSignature, err := hex.DecodeString(chainParams.GenesisBlockHashSignature)
+	hashSignature, err := hex.DecodeString(node.chainParams.GenesisBlockHashSignature)
 	if err != nil {
 		log.Fatalln("Error hex-decoding hash signature", err)
 	}
 	blk.HashSignature = hashSignature
-	err = dbInsertBlock(blk.DbBlockchainBlock)
+	err = node.dbInsertBlock(blk.DbBlockchainBlock)
 	if err != nil {
 		log.Panic(err)
 	}
 
 	// Save the chainparams to the data dir
-	cpJSON, err := json.Marshal(chainParams)
+	cpJSON, err := json.Marshal(node.chainParams)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", cfg.DataDir, chainParamsBaseName), cpJSON, 0644)
+	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", node.cfg.DataDir, chainParamsBaseName), cpJSON, 0644)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	// Step 5: Fetch the rest of the blockchain
+	n, err := node.pullBlocks(baseURL)
+	if err != nil {
+		log.Println("Error fetching blocks, the rest will be fetched from peers:", err)
+	}
+	log.Println("Fetched", n, "blocks")
+
 	// Reopen the database to verify
 	log.Println("Reloading to verify...")
-	blockchainInit(false)
+	node.blockchainInit(false)
 
 	// If we make it to here, everything's ok.
 	log.Println("All done.")
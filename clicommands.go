@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cliCommand describes one CLI action. The registry of these is the single source of
+// information for dispatching commands, for the help message, for shell completion
+// scripts and for the man page.
+type cliCommand struct {
+	name          string
+	args          string // Human-readable argument synopsis, e.g. "<sqlite db filename>"
+	minArgs       int
+	description   string
+	examples      []string
+	preBlockchain bool // If true, executed before the blockchain database is initialised
+	handler       func(node *Node, args []string)
+}
+
+// The registry of all CLI commands, in the order they are shown in the help message.
+// It's filled in from init() because the help actions refer to it.
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{
+			name:          "help",
+			description:   "Shows this help message",
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { actionHelp() },
+		},
+		{
+			name:          "status",
+			description:   "Shows the chain height, sync progress, peers and other health information of the node",
+			examples:      []string{"daisy status"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionStatus() },
+		},
+		{
+			name:          "stop",
+			description:   "Stops the running node",
+			examples:      []string{"daisy stop"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionStop() },
+		},
+		{
+			name:          "config",
+			args:          "check",
+			minArgs:       1,
+			description:   "Validates the configuration file and the flags, and shows the effective configuration, without starting the node",
+			examples:      []string{"daisy -conf /etc/daisy/config.json config check"},
+			preBlockchain: true,
+			handler: func(node *Node, args []string) {
+				if args[0] != "check" {
+					log.Fatalln("Unknown config option:", args[0])
+				}
+				node.actionConfigCheck()
+			},
+		},
+		{
+			name:        "mykeys",
+			args:        "[mnemonic]",
+			description: "Shows a list of my public keys, optionally with mnemonic phrases for backing up their private keys",
+			examples:    []string{"daisy mykeys", "daisy mykeys mnemonic"},
+			handler: func(node *Node, args []string) {
+				if len(args) > 0 {
+					if args[0] != "mnemonic" {
+						log.Fatalln("Unknown mykeys option:", args[0])
+					}
+					node.actionMyKeysMnemonic()
+					return
+				}
+				node.actionMyKeys()
+			},
+		},
+		{
+			name:        "namekey",
+			args:        "<public key hash> [name]",
+			minArgs:     1,
+			description: "Names one of my keys, for selecting it with -key, or removes its name. The key named \"default\" is used if -key isn't given",
+			examples:    []string{"daisy namekey 1:a2b3c4... default", "daisy -key default signimportblock mydata.db"},
+			handler: func(node *Node, args []string) {
+				name := ""
+				if len(args) > 1 {
+					name = args[1]
+				}
+				node.actionNameKey(args[0], name)
+			},
+		},
+		{
+			name:        "addkey",
+			args:        "<public key PEM file or hex> [co-signature files...]",
+			minArgs:     1,
+			description: "Creates, signs and imports a block adding a signatory key, signed by a quorum of my keys and the co-signatures from signkeyop",
+			examples:    []string{"daisy addkey newnode.pem", "daisy -weight 2 -role admin addkey newnode.pem alice.json bob.json", "daisy -activation-delay 100 addkey newnode.pem"},
+			handler:     func(node *Node, args []string) { node.actionAddKey(args[0], args[1:]) },
+		},
+		{
+			name:        "revokekey",
+			args:        "<public key hash> [co-signature files...]",
+			minArgs:     1,
+			description: "Creates, signs and imports a block revoking a signatory key, signed by a quorum of my keys and the co-signatures from signkeyop",
+			examples:    []string{"daisy revokekey 1:a2b3c4... alice.json"},
+			handler:     func(node *Node, args []string) { node.actionRevokeKey(args[0], args[1:]) },
+		},
+		{
+			name:        "signkeyop",
+			args:        "<A|R> <public key hash>",
+			minArgs:     2,
+			description: "Co-signs adding (A) or revoking (R) a key with the key selected by -key, printing the signature for addkey or revokekey and announcing it to the peers through the running node",
+			examples:    []string{"daisy -key alice signkeyop A 1:a2b3c4... > alice.json", "daisy -key alice -weight 2 -role admin signkeyop A 1:a2b3c4... > alice.json"},
+			handler:     func(node *Node, args []string) { node.actionSignKeyOp(args[0], args[1]) },
+		},
+		{
+			name:          "keyops",
+			description:   "Lists the pending key ops collected by the running node, with the weight of their signatures and the weight they need",
+			examples:      []string{"daisy keyops"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionListKeyOps() },
+		},
+		{
+			name:        "setparam",
+			args:        "<param name> <JSON value> [co-signature files...]",
+			minArgs:     2,
+			description: "Creates, signs and imports a governance block updating a chain param, signed by a quorum of my keys and the co-signatures from signparam",
+			examples:    []string{"daisy setparam max_block_size 1048576", `daisy setparam key_op_quorum '{"type": "fixed", "quorum": 3}' alice.json bob.json`},
+			handler:     func(node *Node, args []string) { node.actionSetParam(args[0], args[1], args[2:]) },
+		},
+		{
+			name:        "signparam",
+			args:        "<param name> <JSON value>",
+			minArgs:     2,
+			description: "Co-signs a chain param update with the key selected by -key, printing the signature for setparam",
+			examples:    []string{"daisy -key alice signparam pow_difficulty_bits 24 > alice.json"},
+			handler:     func(node *Node, args []string) { node.actionSignParam(args[0], args[1]) },
+		},
+		{
+			name:        "equivocations",
+			description: "Shows the keys caught signing two different blocks at the same height, which should be revoked",
+			examples:    []string{"daisy equivocations"},
+			handler:     func(node *Node, args []string) { node.actionEquivocations() },
+		},
+		{
+			name:        "anchor",
+			description: "Anchors the tip of the blockchain now with the anchor_backend, to be recorded in the next block signed by this node",
+			examples:    []string{"daisy anchor"},
+			handler:     func(node *Node, args []string) { node.actionAnchor() },
+		},
+		{
+			name:        "anchors",
+			description: "Shows the anchors of the blockchain published by this node, and the blocks they are recorded in",
+			examples:    []string{"daisy anchors"},
+			handler:     func(node *Node, args []string) { node.actionAnchors() },
+		},
+		{
+			name:        "verifyidentity",
+			args:        "<public key hash>",
+			minArgs:     1,
+			description: "Checks the identity claimed by a signatory key with its dns and x509 metadata, and shows it",
+			examples:    []string{"daisy verifyidentity 1:a2b3c4..."},
+			handler:     func(node *Node, args []string) { node.actionVerifyIdentity(args[0]) },
+		},
+		{
+			name:        "identitycsr",
+			args:        "<domain name>",
+			minArgs:     1,
+			description: "Prints a certificate signing request for the key selected by -key, for the certificate in its x509 metadata",
+			examples:    []string{"daisy -key registry identitycsr registry.example.org > registry.csr"},
+			handler:     func(node *Node, args []string) { node.actionIdentityCSR(args[0]) },
+		},
+		{
+			name:        "keymeta",
+			args:        "<public key hash>",
+			minArgs:     1,
+			description: "Shows the metadata of a public key",
+			examples:    []string{"daisy keymeta 1:a2b3c4..."},
+			handler:     func(node *Node, args []string) { node.actionKeyMeta(args[0]) },
+		},
+		{
+			name:        "setkeymeta",
+			args:        "<public key hash> <name> [value]",
+			minArgs:     2,
+			description: "Sets or removes a metadata field (e.g. BlockCreator) of one of my keys, and publishes it in the next block I sign",
+			examples:    []string{`daisy setkeymeta 1:a2b3c4... BlockCreator "ACME Inc."`, "daisy setkeymeta 1:a2b3c4... BlockCreator"},
+			handler: func(node *Node, args []string) {
+				value := ""
+				if len(args) > 2 {
+					value = args[2]
+				}
+				node.actionSetKeyMeta(args[0], args[1], value)
+			},
+		},
+		{
+			name:        "restorekey",
+			args:        "<mnemonic phrase>",
+			minArgs:     1,
+			description: "Restores a keypair from the mnemonic phrase printed by mykeys",
+			examples:    []string{`daisy restorekey "abandon ability able ..."`},
+			handler:     func(node *Node, args []string) { node.actionRestoreKey(strings.Join(args, " ")) },
+		},
+		{
+			name:        "exportkey",
+			args:        "<public key hash> <file>",
+			minArgs:     2,
+			description: "Exports one of my keypairs into a PEM file",
+			examples:    []string{"daisy exportkey 1:a2b3c4... mykey.pem"},
+			handler:     func(node *Node, args []string) { node.actionExportKey(args[0], args[1]) },
+		},
+		{
+			name:        "importkey",
+			args:        "<file>",
+			minArgs:     1,
+			description: "Imports a keypair from a PEM file. The key becomes a signatory when it's added on-chain with addkey",
+			examples:    []string{"daisy importkey mykey.pem"},
+			handler:     func(node *Node, args []string) { node.actionImportKey(args[0]) },
+		},
+		{
+			name:        "query",
+			args:        "<SQL query>",
+			minArgs:     1,
+			description: "Executes a SQL query on the blockchain. The tables of all blocks are combined, with the _block_height column added",
+			examples: []string{`daisy query "SELECT COUNT(*) FROM wikinews_titles"`, `daisy query "SELECT _block_height, COUNT(*) FROM wikinews_titles GROUP BY _block_height"`,
+				`daisy -from 1000 -reverse -limit 10 query "SELECT * FROM wikinews_titles"`,
+				`daisy -format csv query "SELECT * FROM wikinews_titles" > titles.csv`, `daisy -output titles.db query "SELECT * FROM wikinews_titles"`},
+			handler: func(node *Node, args []string) { node.actionQuery(args[0]) },
+		},
+		{
+			name:        "chainquery",
+			args:        "<SQL query>",
+			minArgs:     1,
+			description: "Executes a SQL query on the chain_rows virtual table, which reads the rows of all blocks as JSON, with the hidden block_height and block_hash columns (needs a build with -tags sqlite_vtable)",
+			examples: []string{`daisy chainquery "SELECT json_extract(row, '$.title') FROM chain_rows WHERE table_name='wikinews_titles'"`,
+				`daisy chainquery "SELECT block_height, COUNT(*) FROM chain_rows WHERE table_name='wikinews_titles' AND block_height >= 1000 GROUP BY block_height"`},
+			handler: func(node *Node, args []string) { node.actionChainQuery(args[0]) },
+		},
+		{
+			name:        "lookup",
+			args:        "<table> <column=value...>",
+			minArgs:     2,
+			description: "Finds the rows of the table with the given column values in all blocks, with an index declared in the indexes config setting, and prints them as JSON",
+			examples:    []string{"daisy lookup wikinews_titles title=Daisy", "daisy lookup people last_name=Smith first_name=Ann"},
+			handler:     func(node *Node, args []string) { node.actionLookup(args[0], args[1:]) },
+		},
+		{
+			name:        "reindex",
+			description: "Rebuilds the indexes declared in the indexes config setting from the genesis block",
+			examples:    []string{"daisy reindex"},
+			handler:     func(node *Node, args []string) { node.actionReindex() },
+		},
+		{
+			name:        "updatecombined",
+			description: "Adds the blocks which aren't in combined.db yet, the combined view of the blocks' tables in the data directory",
+			examples:    []string{"daisy updatecombined"},
+			handler:     func(node *Node, args []string) { node.actionUpdateCombinedDb() },
+		},
+		{
+			name:        "diffblocks",
+			args:        "<block height or hash> <block height or hash>",
+			minArgs:     2,
+			description: "Compares the user tables of two blocks, and prints the added and removed tables and columns, and the added, removed and changed rows, as JSON",
+			examples:    []string{"daisy diffblocks 1233 1234"},
+			handler:     func(node *Node, args []string) { node.actionDiffBlocks(args[0], args[1]) },
+		},
+		{
+			name:        "savequery",
+			args:        "<name> <schedule> <output file or URL> <SQL query>",
+			minArgs:     4,
+			description: "Saves a query which the node runs after every block (schedule \"block\") or on an interval like 1h, writing the results to a file or POSTing them to a URL. The -from, -to, -reverse, -limit and -format flags are saved with it",
+			examples: []string{`daisy savequery titles block /srv/reports/titles.csv "SELECT * FROM wikinews_titles"`,
+				`daisy -format jsonl savequery counts 24h https://example.com/daisy-report "SELECT COUNT(*) FROM wikinews_titles"`},
+			handler: func(node *Node, args []string) { node.actionSaveQuery(args[0], args[1], args[2], args[3]) },
+		},
+		{
+			name:        "deletequery",
+			args:        "<name>",
+			minArgs:     1,
+			description: "Deletes a saved query",
+			examples:    []string{"daisy deletequery titles"},
+			handler:     func(node *Node, args []string) { node.actionDeleteQuery(args[0]) },
+		},
+		{
+			name:        "savedqueries",
+			description: "Shows the saved queries, with their schedules, outputs and last runs",
+			examples:    []string{"daisy savedqueries"},
+			handler:     func(node *Node, args []string) { node.actionSavedQueries() },
+		},
+		{
+			name:        "runquery",
+			args:        "<name>",
+			minArgs:     1,
+			description: "Runs a saved query now, writing the results to its output",
+			examples:    []string{"daisy runquery titles"},
+			handler:     func(node *Node, args []string) { node.actionRunQuery(args[0]) },
+		},
+		{
+			name:          "createblock",
+			args:          "<block file> <data files...>",
+			minArgs:       2,
+			description:   "Creates a block file from CSV, JSON or SQL files, one table per file named after the file",
+			examples:      []string{"daisy createblock newdata.db cities.csv people.json", "daisy createblock newdata.db schema.sql"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { actionCreateBlock(args[0], args[1:]) },
+		},
+		{
+			name:        "signimportblock",
+			args:        "<sqlite db filename>",
+			minArgs:     1,
+			description: "Signs a block (creates metadata tables in it first) with the key selected by -key, and imports it into the blockchain",
+			examples:    []string{"daisy signimportblock mydata.db"},
+			handler:     func(node *Node, args []string) { node.actionSignImportBlock(args[0]) },
+		},
+		{
+			name:        "signblock",
+			args:        "<sqlite db filename>",
+			minArgs:     1,
+			description: "Signs a block as its creator, writing the signatures file for cosignblock, without importing it",
+			examples:    []string{"daisy -key alice signblock mydata.db"},
+			handler:     func(node *Node, args []string) { node.actionSignBlock(args[0]) },
+		},
+		{
+			name:        "cosignblock",
+			args:        "<sqlite db filename>",
+			minArgs:     1,
+			description: "Adds my signature to a block's signatures file, for chains requiring multiple signatures per block",
+			examples:    []string{"daisy -key bob cosignblock mydata.db"},
+			handler:     func(node *Node, args []string) { node.actionCosignBlock(args[0]) },
+		},
+		{
+			name:        "importblock",
+			args:        "<sqlite db filename>",
+			minArgs:     1,
+			description: "Imports a block signed with signblock and cosignblock into the blockchain",
+			examples:    []string{"daisy importblock mydata.db"},
+			handler:     func(node *Node, args []string) { node.actionImportBlock(args[0]) },
+		},
+		{
+			name:        "submitrecord",
+			args:        "<table> <JSON object>",
+			minArgs:     2,
+			description: "Signs a record with the key selected by -key and submits it to the running node, which gossips it to its peers until it's included in a block",
+			examples:    []string{`daisy submitrecord readings '{"sensor": "s1", "value": 21.5}'`},
+			handler:     func(node *Node, args []string) { node.actionSubmitRecord(args[0], args[1]) },
+		},
+		{
+			name:          "records",
+			description:   "Lists the records pending in the running node's mempool",
+			examples:      []string{"daisy records"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionListRecords() },
+		},
+		{
+			name:          "droprecord",
+			args:          "<record ID>",
+			minArgs:       1,
+			description:   "Drops a record from the running node's mempool",
+			examples:      []string{"daisy droprecord 9f86d081884c7d65..."},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionDropRecord(args[0]) },
+		},
+		{
+			name:        "notarize",
+			args:        "<file or SHA256 digest> [metadata]",
+			minArgs:     1,
+			description: "Submits the digest of a document for notarization in the next block produced by this node",
+			examples:    []string{"daisy notarize contract.pdf 'Contract 2024/17'", "daisy notarize 9f86d081884c7d65..."},
+			handler: func(node *Node, args []string) {
+				metadata := ""
+				if len(args) > 1 {
+					metadata = args[1]
+				}
+				node.actionNotarize(args[0], metadata)
+			},
+		},
+		{
+			name:        "notaryproof",
+			args:        "<SHA256 digest>",
+			minArgs:     1,
+			description: "Shows the proof that a notarized digest is included in a block, as JSON",
+			examples:    []string{"daisy notaryproof 9f86d081884c7d65... > proof.json"},
+			handler:     func(node *Node, args []string) { node.actionNotaryProof(args[0]) },
+		},
+		{
+			name:        "verifynotaryproof",
+			args:        "<proof file>",
+			minArgs:     1,
+			description: "Checks a notarization proof, and that its block is in the blockchain",
+			examples:    []string{"daisy verifynotaryproof proof.json"},
+			handler:     func(node *Node, args []string) { node.actionVerifyNotaryProof(args[0]) },
+		},
+		{
+			name:        "signfile",
+			args:        "<file>",
+			minArgs:     1,
+			description: "Signs a file with the key selected by -key, writing a detached signature into <file>.sig",
+			examples:    []string{"daisy signfile contract.pdf"},
+			handler:     func(node *Node, args []string) { node.actionSignFile(args[0]) },
+		},
+		{
+			name:        "verifyfile",
+			args:        "<file> <signature or .sig file> <public key hash>",
+			minArgs:     3,
+			description: "Verifies a detached file signature made by a key known to the blockchain",
+			examples:    []string{"daisy verifyfile contract.pdf contract.pdf.sig 1:a2b3c4..."},
+			handler:     func(node *Node, args []string) { node.actionVerifyFile(args[0], args[1], args[2]) },
+		},
+		{
+			name:        "exportblock",
+			args:        "<height or hash> <file>",
+			minArgs:     2,
+			description: "Copies a block's SQLite file out of the blockchain",
+			examples:    []string{"daisy exportblock 1234 block1234.db"},
+			handler:     func(node *Node, args []string) { node.actionExportBlock(args[0], args[1]) },
+		},
+		{
+			name:        "inspectblock",
+			args:        "<height, hash or block file>",
+			minArgs:     1,
+			description: "Prints a block's metadata, key ops, tables and row counts as JSON",
+			examples:    []string{"daisy inspectblock 1234", "daisy inspectblock mydata.db"},
+			handler:     func(node *Node, args []string) { node.actionInspectBlock(args[0]) },
+		},
+		{
+			name:        "schema",
+			args:        "[number of recent blocks]",
+			description: "Reports the tables, their columns and row counts across all (or recent) blocks",
+			examples:    []string{"daisy schema", "daisy schema 100"},
+			handler: func(node *Node, args []string) {
+				n := 0
+				if len(args) > 0 {
+					var err error
+					if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+						log.Fatalln("Invalid number of blocks:", args[0])
+					}
+				}
+				node.actionSchema(n)
+			},
+		},
+		{
+			name:        "chainrefs",
+			args:        "<block height>",
+			minArgs:     1,
+			description: "Shows the blocks of other chains referenced by a block, verified against the chains configured in chain_refs",
+			examples:    []string{"daisy chainrefs 1234"},
+			handler: func(node *Node, args []string) {
+				h, err := strconv.Atoi(args[0])
+				if err != nil {
+					log.Fatalln("Invalid height:", args[0])
+				}
+				node.actionChainRefs(h)
+			},
+		},
+		{
+			name:        "blocktimestamp",
+			args:        "<block height>",
+			minArgs:     1,
+			description: "Shows the RFC 3161 timestamp of a block, from the token in the next block",
+			examples:    []string{"daisy blocktimestamp 1234"},
+			handler: func(node *Node, args []string) {
+				h, err := strconv.Atoi(args[0])
+				if err != nil {
+					log.Fatalln("Invalid height:", args[0])
+				}
+				node.actionBlockTimestamp(h)
+			},
+		},
+		{
+			name:        "softforks",
+			description: "Shows the states of the chain's soft forks, signaled with the block version bits",
+			examples:    []string{"daisy softforks"},
+			handler:     func(node *Node, args []string) { node.actionSoftForks() },
+		},
+		{
+			name:          "newchain",
+			args:          "[chainparams.json]",
+			description:   "Starts a new chain with the given parameters, by default the chain_params file of the chain profile",
+			examples:      []string{"daisy -dir /srv/mychain newchain chainparams.json", "daisy -chain test newchain"},
+			preBlockchain: true,
+			handler: func(node *Node, args []string) {
+				node.actionNewChain(argOrConfig(args, node.cfg.ChainParamsFile, "chain_params"))
+			},
+		},
+		{
+			name:          "pull",
+			args:          "[URL]",
+			description:   "Pulls a blockchain from a HTTP URL, by default the chain_url of the chain profile",
+			examples:      []string{"daisy -dir /srv/mychain pull http://example.com:2018/", "daisy -chain test pull"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionPull(argOrConfig(args, node.cfg.ChainURL, "chain_url")) },
+		},
+		{
+			name:          "serve",
+			args:          "[chain profile names...]",
+			description:   "Runs the nodes of the chain profiles in the config file (all of them by default) in this process",
+			examples:      []string{"daisy -conf /etc/daisy/config.json serve", "daisy -conf /etc/daisy/config.json serve registry test"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionServeChains(args) },
+		},
+		{
+			name:          "rollback",
+			args:          "<height>",
+			minArgs:       1,
+			description:   "Removes blocks above the given height, archives their files and reverses their key ops (the node must not be running)",
+			examples:      []string{"daisy rollback 1234"},
+			preBlockchain: true,
+			handler: func(node *Node, args []string) {
+				h, err := strconv.Atoi(args[0])
+				if err != nil {
+					log.Fatalln("Invalid height:", args[0])
+				}
+				node.actionRollback(h)
+			},
+		},
+		{
+			name:          "backup",
+			description:   "Backs up the system databases and chainparams.json into a new directory in backup_dir (by default, the backups directory in the data directory)",
+			examples:      []string{"daisy backup"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionBackup() },
+		},
+		{
+			name:          "restore",
+			args:          "<backup dir>",
+			minArgs:       1,
+			description:   "Restores the system databases and chainparams.json from a backup (the node must not be running)",
+			examples:      []string{"daisy restore ~/.daisy/backups/daisy-20260101-120000"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionRestore(args[0]) },
+		},
+		{
+			name:          "verify",
+			description:   "Verifies the blockchain (or the blocks selected with -from and -to) without starting the node, and reports all the errors",
+			examples:      []string{"daisy verify", "daisy -from 1000 -report verify.json verify"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { node.actionVerify() },
+		},
+		{
+			name:        "replay",
+			args:        "<session dir> [number of messages]",
+			minArgs:     1,
+			description: "Replays a p2p session recorded with -record, against the data directory (use a scratch copy)",
+			examples:    []string{"daisy -dir /tmp/scratch -faster replay /tmp/session 500"},
+			handler: func(node *Node, args []string) {
+				n := 0
+				if len(args) > 1 {
+					var err error
+					if n, err = strconv.Atoi(args[1]); err != nil {
+						log.Fatalln("Invalid number of messages:", args[1])
+					}
+				}
+				node.actionReplay(args[0], n)
+			},
+		},
+		{
+			name:          "peers",
+			args:          "[export|import <file>]",
+			description:   "Lists the connected and saved peers, or exports the saved peers into a signed snapshot file, or imports peers from one",
+			examples:      []string{"daisy peers", "daisy peers export peers.json", "daisy -dir /srv/mychain peers import peers.json"},
+			preBlockchain: true,
+			handler: func(node *Node, args []string) {
+				if len(args) == 0 {
+					node.actionPeersList()
+					return
+				}
+				if len(args) < 2 {
+					log.Fatalln("Not enough arguments: expecting <export|import> <file>")
+				}
+				node.dbInit()
+				node.blockchainLoad(false)
+				switch args[0] {
+				case "export":
+					node.actionPeersExport(args[1])
+				case "import":
+					node.actionPeersImport(args[1])
+				default:
+					log.Fatalln("Unknown peers subcommand:", args[0])
+				}
+			},
+		},
+		{
+			name:          "completion",
+			args:          "<bash|zsh>",
+			minArgs:       1,
+			description:   "Prints a shell completion script for the given shell",
+			examples:      []string{"daisy completion bash > /etc/bash_completion.d/daisy"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { actionCompletion(args[0]) },
+		},
+		{
+			name:          "manpage",
+			description:   "Prints the man page in roff format",
+			examples:      []string{"daisy manpage > /usr/local/share/man/man1/daisy.1"},
+			preBlockchain: true,
+			handler:       func(node *Node, args []string) { actionManPage() },
+		},
+	}
+}
+
+// Returns the first argument, or the value of the config setting if there are no arguments
+func argOrConfig(args []string, value string, setting string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	if value == "" {
+		log.Fatalln("Not enough arguments, and", setting, "isn't configured")
+	}
+	return value
+}
+
+// Returns the registered command with the given name, or nil.
+func findCliCommand(name string) *cliCommand {
+	for i := range cliCommands {
+		if cliCommands[i].name == name {
+			return &cliCommands[i]
+		}
+	}
+	return nil
+}
+
+// Returns the base name of the executable, used in generated help texts.
+func cliProgramName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// Shows the help message.
+func actionHelp() {
+	fmt.Printf("usage: %s [flags] [command]\n", cliProgramName())
+	flag.PrintDefaults()
+	fmt.Println("Commands:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "\t%s %s\t%s\n", c.name, c.args, c.description)
+	}
+	if err := w.Flush(); err != nil {
+		log.Println(err)
+	}
+	fmt.Println("Examples:")
+	for _, c := range cliCommands {
+		for _, ex := range c.examples {
+			fmt.Printf("\t%s\n", ex)
+		}
+	}
+}
+
+// Prints a shell completion script for the given shell.
+func actionCompletion(shell string) {
+	var names []string
+	for _, c := range cliCommands {
+		names = append(names, c.name)
+	}
+	var flags []string
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+	})
+	prog := cliProgramName()
+
+	switch shell {
+	case "bash":
+		fmt.Printf(`_%[1]s_complete() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=( $(compgen -W "%[2]s" -- "$cur") )
+	else
+		COMPREPLY=( $(compgen -W "%[3]s" -- "$cur") )
+	fi
+}
+complete -o default -F _%[1]s_complete %[1]s
+`, prog, strings.Join(flags, " "), strings.Join(names, " "))
+	case "zsh":
+		fmt.Printf("#compdef %s\n\n_arguments \\\n", prog)
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("\t'-%s[%s]' \\\n", f.Name, zshEscape(f.Usage))
+		})
+		fmt.Println("\t'1:command:->command' \\\n\t'*::arg:_files'\n\ncase $state in\n\tcommand)\n\t\tlocal -a commands\n\t\tcommands=(")
+		for _, c := range cliCommands {
+			fmt.Printf("\t\t\t'%s:%s'\n", c.name, zshEscape(c.description))
+		}
+		fmt.Println("\t\t)\n\t\t_describe 'command' commands\n\t\t;;\nesac")
+	default:
+		log.Fatalln("Unsupported shell:", shell)
+	}
+}
+
+// Escapes a string so it's usable in a zsh completion spec.
+func zshEscape(s string) string {
+	s = strings.Replace(s, "'", "'\\''", -1)
+	s = strings.Replace(s, ":", "\\:", -1)
+	s = strings.Replace(s, "[", "\\[", -1)
+	return strings.Replace(s, "]", "\\]", -1)
+}
+
+// Escapes a string for use in roff text.
+func roffEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\e", -1)
+	s = strings.Replace(s, "-", "\\-", -1)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = "\\&" + s
+	}
+	return s
+}
+
+// Prints the man page in roff format. The date is always formatted as YYYY-MM-DD in UTC,
+// regardless of the locale.
+func actionManPage() {
+	prog := cliProgramName()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, ".TH %s 1 \"%s\" \"%s\"\n", strings.ToUpper(prog), time.Now().UTC().Format("2006-01-02"), p2pClientVersionString)
+	fmt.Fprintf(&buf, ".SH NAME\n%s \\- a proof of authority blockchain where blocks are SQLite databases\n", prog)
+	fmt.Fprintf(&buf, ".SH SYNOPSIS\n.B %s\n[\\fIflags\\fR] [\\fIcommand\\fR] [\\fIargs\\fR]\n", prog)
+	buf.WriteString(".SH OPTIONS\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&buf, ".TP\n.B \\-%s\n%s", f.Name, roffEscape(f.Usage))
+		if f.DefValue != "" {
+			fmt.Fprintf(&buf, " (default: %s)", roffEscape(f.DefValue))
+		}
+		buf.WriteString("\n")
+	})
+	buf.WriteString(".SH COMMANDS\n")
+	for _, c := range cliCommands {
+		fmt.Fprintf(&buf, ".TP\n.B %s", c.name)
+		if c.args != "" {
+			fmt.Fprintf(&buf, " \\fI%s\\fR", roffEscape(c.args))
+		}
+		fmt.Fprintf(&buf, "\n%s\n", roffEscape(c.description))
+	}
+	buf.WriteString(".SH EXAMPLES\n")
+	for _, c := range cliCommands {
+		for _, ex := range c.examples {
+			fmt.Fprintf(&buf, ".PP\n.nf\n%s\n.fi\n", roffEscape(ex))
+		}
+	}
+	if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+		log.Println(err)
+	}
+}
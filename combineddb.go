@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+/*
+ * The materialized combined view of the blockchain. With combined_db enabled, the node keeps
+ * combined.db in the data directory, in which the rows of all the blocks' tables are combined
+ * into tables of the same name, like for the query command, with the _block_height and
+ * _block_hash columns telling which block a row comes from, and an index on _block_height
+ * named _combined_<table>. The blocks are added as they are accepted, and the _combined table
+ * records the last one, so the database can be used by any SQLite tool without combining the
+ * blocks for every query. It's in WAL mode, so it can be read while the node updates it. If the last block in it is no longer in the chain, it's rebuilt,
+ * and the rollback command removes the rows of the rolled back blocks.
+ */
+
+// The file name of the combined database, in the data directory
+const combinedDbFileName = "combined.db"
+
+const combinedDbStateTableCreate = `
+CREATE TABLE IF NOT EXISTS _combined (
+	id				INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+	block_height	INTEGER NOT NULL,
+	block_hash		VARCHAR NOT NULL
+);
+INSERT INTO _combined(id, block_height, block_hash) VALUES (1, -1, '') ON CONFLICT(id) DO NOTHING;
+`
+
+// Opens combined.db, and reads the columns of its tables
+func (node *Node) combinedDbOpen() (*queryCombinedDb, error) {
+	db, err := dbOpen(fmt.Sprintf("%s/%s", node.cfg.DataDir, combinedDbFileName), false)
+	if err != nil {
+		return nil, err
+	}
+	// The blocks are ATTACHed to the connection
+	db.SetMaxOpenConns(1)
+	qdb := &queryCombinedDb{node: node, db: db, columns: map[string]map[string]bool{}, withHash: true}
+	for _, q := range []string{"PRAGMA journal_mode=WAL", combinedDbStateTableCreate} {
+		if _, err = db.Exec(q); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	tables, err := dbQueryStrings(db, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name != '_combined'")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, table := range tables {
+		columns, err := dbQueryStrings(db, "SELECT name FROM pragma_table_info(?) WHERE name NOT IN (?, ?)", table, queryBlockHeightColumn, queryBlockHashColumn)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		// combined.db files from before the index was added don't have it
+		if err = qdb.combinedIndex(table); err != nil {
+			db.Close()
+			return nil, err
+		}
+		qdb.columns[table] = map[string]bool{}
+		for _, c := range columns {
+			qdb.columns[table][c] = true
+		}
+	}
+	qdb.onCommit = func(heights []int) error {
+		last := heights[len(heights)-1]
+		hash, err := node.dbGetBlockHashByHeight(last)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("UPDATE _combined SET block_height=?, block_hash=?", last, hash)
+		return err
+	}
+	return qdb, nil
+}
+
+// Creates the index on the block height of the combined table, for removing the rows of the
+// rolled back blocks
+func (qdb *queryCombinedDb) combinedIndex(table string) error {
+	_, err := qdb.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS main.%s ON %s (%s)",
+		dbQuoteIdentifier("_combined_"+table), dbQuoteIdentifier(table), queryBlockHeightColumn))
+	return err
+}
+
+// Returns the last block in combined.db
+func (qdb *queryCombinedDb) combinedState() (height int, hash string, err error) {
+	err = qdb.db.QueryRow("SELECT block_height, block_hash FROM _combined").Scan(&height, &hash)
+	return
+}
+
+// Removes the rows of the blocks above the height
+func (qdb *queryCombinedDb) combinedTruncate(height int) error {
+	hash := ""
+	if height >= 0 {
+		var err error
+		if hash, err = qdb.node.dbGetBlockHashByHeight(height); err != nil {
+			return err
+		}
+	}
+	tx, err := qdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	for table := range qdb.columns {
+		if _, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s > ?", dbQuoteIdentifier(table), queryBlockHeightColumn), height); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec("UPDATE _combined SET block_height=?, block_hash=? WHERE block_height > ?", height, hash, height); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Calls the function with combined.db, opening it on the first use. If the function fails,
+// combined.db is closed, so the columns of its tables are read again when it's reopened,
+// instead of trusting the ones added in a rolled back transaction.
+func (node *Node) withCombinedDb(f func(qdb *queryCombinedDb) error) (err error) {
+	node.combinedDb.lock.With(func() {
+		if node.combinedDb.qdb == nil {
+			if node.combinedDb.qdb, err = node.combinedDbOpen(); err != nil {
+				return
+			}
+		}
+		if err = f(node.combinedDb.qdb); err != nil {
+			node.combinedDb.qdb.Close()
+			node.combinedDb.qdb = nil
+		}
+	})
+	return
+}
+
+// Adds the blocks which aren't in combined.db yet
+func (node *Node) combinedDbUpdate() error {
+	return node.withCombinedDb(func(qdb *queryCombinedDb) error {
+		height, hash, err := qdb.combinedState()
+		if err != nil {
+			return err
+		}
+		if height >= 0 {
+			chainHash, err := node.dbGetBlockHashByHeight(height)
+			if err != nil {
+				return err
+			}
+			if chainHash != hash {
+				log.Println("The last block in", combinedDbFileName, "is no longer in the chain, rebuilding it")
+				if err = qdb.combinedTruncate(-1); err != nil {
+					return err
+				}
+				height = -1
+			}
+		}
+		chainHeight, err := node.dbGetBlockchainHeight()
+		if err != nil {
+			return err
+		}
+		var heights []int
+		for h := height + 1; h <= chainHeight; h++ {
+			heights = append(heights, h)
+		}
+		for len(heights) > 0 {
+			n := queryAttachBatchSize
+			if n > len(heights) {
+				n = len(heights)
+			}
+			if err = qdb.addBlocks(context.Background(), heights[:n]); err != nil {
+				return err
+			}
+			heights = heights[n:]
+		}
+		return nil
+	})
+}
+
+// Removes the rows of the blocks above the height from combined.db, after a rollback
+func (node *Node) combinedDbRollback(height int) error {
+	if !node.cfg.CombinedDb {
+		return nil
+	}
+	return node.withCombinedDb(func(qdb *queryCombinedDb) error {
+		return qdb.combinedTruncate(height)
+	})
+}
+
+// Starts updating combined.db as the blocks are accepted
+func (node *Node) combinedDbStart() {
+	if !node.cfg.CombinedDb {
+		return
+	}
+	update := func() {
+		if err := node.combinedDbUpdate(); err != nil {
+			chainLog.Error("Cannot update", combinedDbFileName+":", err)
+		}
+	}
+	go update()
+	node.nodeEvents.Handle("combineddb", []string{eventBlockAccepted}, func(ev nodeEvent) {
+		update()
+	})
+}
+
+// Brings combined.db up to date, e.g. before copying it
+func (node *Node) actionUpdateCombinedDb() {
+	if err := node.combinedDbUpdate(); err != nil {
+		log.Fatalln(err)
+	}
+	var height int
+	err := node.withCombinedDb(func(qdb *queryCombinedDb) (err error) {
+		height, _, err = qdb.combinedState()
+		return
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println(combinedDbFileName, "is up to date with block", height)
+}
@@ -8,6 +8,10 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // DefaultP2PPort is the default TCP port for p2p connections
@@ -16,81 +20,409 @@ const DefaultP2PPort = 2017
 // DefaultBlockWebServerPort is the default TCP port for the HTTP server
 const DefaultBlockWebServerPort = 2018
 
+// DefaultSyncBatchSize is the default number of block hashes requested at a time while syncing
+const DefaultSyncBatchSize = 500
+
 // DefaultConfigFile is the default configuration filename
 const DefaultConfigFile = "/etc/daisy/config.json"
 
+// The prefix of the environment variables with the settings
+const configEnvPrefix = "DAISY_"
+
 // DefaultDataDir is the default data directory
 const DefaultDataDir = ".daisy"
 
-var cfg struct {
-	configFile     string
-	P2pPort        int    `json:"p2p_port"`
-	DataDir        string `json:"data_dir"`
-	httpPort       int    `json:"http_port"`
-	showHelp       bool
-	faster         bool
-	p2pBlockInline bool
+// Config is the configuration of a node, see configInit()
+type Config struct {
+	configFile       string
+	chain            string                     // The selected chain profile
+	Chains           map[string]json.RawMessage `json:"chains"`       // Chain profiles, with the settings which override the top level ones
+	ChainParamsFile  string                     `json:"chain_params"` // chainparams.json for newchain
+	ChainURL         string                     `json:"chain_url"`    // URL of a node to pull the chain from
+	P2pPort          int                        `json:"p2p_port"`
+	P2pListen        []string                   `json:"p2p_listen"` // Addresses the p2p server listens on, see listen.go
+	DataDir          string                     `json:"data_dir"`
+	HTTPPort         int                        `json:"http_port"`
+	HTTPListen       []string                   `json:"http_listen"` // Addresses the HTTP server listens on
+	SinglePort       bool                       `json:"single_port"` // Serve HTTP on the p2p port too, see singleport.go
+	showHelp         bool
+	faster           bool
+	P2pBlockInline   bool     `json:"p2p_block_inline"`  // Send blocks to peers inline instead of over HTTP
+	P2pMaxPeers      int      `json:"p2p_max_peers"`     // Evict the worst peer beyond this many connections, see p2pscore.go
+	P2pCompression   []string `json:"p2p_compression"`   // Accepted compression methods for the p2p messages, see p2pcompress.go
+	SyncBatchSize    int      `json:"sync_batch_size"`   // Block hashes requested at a time while syncing, see p2psync.go
+	BootstrapPeers   []string `json:"bootstrap_peers"`   // Replace the default bootstrap peers
+	CreateDataDir    bool     `json:"create_data_dir"`   // Create the data directory if it doesn't exist
+	Network          string   `json:"network"`           // main, testnet or simnet, see network.go
+	MiningCooperate  bool     `json:"mining_cooperate"`  // Accept mining work from peers, see p2pmining.go
+	MiningDistribute bool     `json:"mining_distribute"` // Share the mining work with the cooperating peers
+	Relay            bool     `json:"relay"`             // Relay the connections of the nodes behind NAT, see p2prelay.go
+	UseRelays        bool     `json:"use_relays"`        // Connect to the other nodes through the relays
+	recordDir        string
+	SigningKey       string `json:"signing_key"`        // Name or public key hash of the key to sign with
+	PublicAddress    string `json:"public_address"`     // Host or host:port the HTTP server is reachable at by peers
+	MainDbURL        string `json:"main_db"`            // postgres:// URL of the main database, if it's not in DataDir
+	DbPassphraseFile string `json:"db_passphrase_file"` // File with the passphrase of the encrypted system databases
+	TSAURL           string `json:"tsa_url"`            // RFC 3161 Time Stamping Authority for the block timestamps, see tsa.go
+	TSARoots         string `json:"tsa_roots"`          // PEM file with the roots the TSA certificates must chain to
+	queryFrom        int
+	queryTo          int
+	queryLimit       int
+	queryReverse     bool
+	queryFormat      string
+	queryOutput      string // The file the query results are written to, see queryoutput.go
+	verifyReport     string
+	keyOpWeight      string // The weight of the key added by addkey or signkeyop, see keyweights.go
+	keyOpRole        string // The role of the key added by addkey or signkeyop
+	keyOpDelay       string // The activation delay of the key added by addkey or signkeyop
+	keyOpDNS         string // The domain name claimed by the key added by addkey or signkeyop, see identity.go
+	keyOpCert        string // The file with the certificate chain claimed by the key added by addkey or signkeyop
+	chainRefs        string // The blocks of other chains referenced by the block signed, see chainrefs.go
+
+	// Block acceptance pipeline configuration, see blockaccept.go
+	BlockAcceptanceStages []string `json:"block_acceptance_stages"`
+	BlockAcceptHook       string   `json:"block_accept_hook"`
+	PolicyMaxBlockSize    int64    `json:"policy_max_block_size"`
+	PolicyDenyTables      []string `json:"policy_deny_tables"`
+	PolicyRequireIdentity bool     `json:"policy_require_identity"` // Only accept blocks from creators with a verified identity, see identity.go
+	PolicyIdentityRoots   string   `json:"policy_identity_roots"`   // PEM file with the roots of the identity certificates, the system roots if empty
+
+	// Cross-chain block references, see chainrefs.go
+	ChainRefs map[string]string `json:"chain_refs"` // Genesis block hashes of the referenced chains to the URLs of their nodes
+
+	// User-defined indexes over the block content, see indexes.go
+	Indexes []userIndexConfig `json:"indexes"`
+
+	// The materialized combined view of the blocks' tables, see combineddb.go
+	CombinedDb bool `json:"combined_db"`
+
+	// Event webhooks, see webhooks.go
+	Webhooks      []string `json:"webhooks"`       // URLs the events are POSTed to
+	WebhookEvents []string `json:"webhook_events"` // The events sent to the webhooks, all if empty
+
+	// Block web server TLS and authentication, see blockwebserver.go
+	HTTPTLSCertFile  string   `json:"http_tls_cert"`
+	HTTPTLSKeyFile   string   `json:"http_tls_key"`
+	HTTPACMEDomains  []string `json:"http_acme_domains"`
+	HTTPAuthToken    string   `json:"http_auth_token"`
+	HTTPAuthUser     string   `json:"http_auth_user"`
+	HTTPAuthPassword string   `json:"http_auth_password"`
+
+	// Time between the maintenance runs on the system databases, see dbmaintenance.go
+	DbMaintenanceInterval string `json:"db_maintenance_interval"` // e.g. "24h", "0" to disable
+
+	// Scheduled backups, see backup.go
+	BackupDir      string `json:"backup_dir"`
+	BackupInterval string `json:"backup_interval"` // e.g. "24h", empty for no scheduled backups
+	BackupKeep     int    `json:"backup_keep"`
+	BackupHook     string `json:"backup_hook"`
+
+	// Automatic block production, see blockproducer.go
+	BlockProducerDir      string `json:"block_producer_dir"`      // Relative to the data directory, empty to disable
+	BlockProducerInterval string `json:"block_producer_interval"` // e.g. "6h"
+	BlockProducerMaxSize  int64  `json:"block_producer_max_size"` // Bytes of pending data which trigger a block
+
+	// Anchoring the chain to an external chain or log, see anchor.go
+	AnchorBackend  string `json:"anchor_backend"`  // http or command, empty to disable
+	AnchorTarget   string `json:"anchor_target"`   // The URL or the command the backend publishes with
+	AnchorInterval string `json:"anchor_interval"` // e.g. "24h", the default
+
+	// Logging, see logging.go
+	LogLevel    string `json:"log_level"`    // debug, info, warn or error, optionally followed by subsystem levels, e.g. "info,p2p=debug"
+	LogFormat   string `json:"log_format"`   // text or json
+	LogFile     string `json:"log_file"`     // Relative to the data directory, stderr if empty
+	LogMaxSize  int    `json:"log_max_size"` // In MB
+	LogMaxFiles int    `json:"log_max_files"`
+
+	// Per-IP limits for the HTTP server, see ratelimit.go
+	HTTPRateLimit         float64 `json:"http_rate_limit"` // Requests per second
+	HTTPRateBurst         int     `json:"http_rate_burst"`
+	HTTPMaxDownloadsPerIP int     `json:"http_max_downloads_per_ip"`
+
+	// Limits of the inbound p2p connections, see p2pthrottle.go
+	P2pInboundPerIP      int `json:"p2p_inbound_per_ip"` // New connections a minute from an IP address
+	P2pInboundTotal      int `json:"p2p_inbound_total"`  // New connections a minute from all the addresses
+	P2pInboundHandshakes int `json:"p2p_inbound_handshakes"`
+
+	// Limits of the queries over the blockchain, from the CLI and HTTP, see querysandbox.go
+	QueryMaxRows       int `json:"query_max_rows"`
+	QueryMaxResultSize int `json:"query_max_result_size"` // In MB of output
+	QueryMaxMemory     int `json:"query_max_memory"`      // In MB
+	QueryBlockTimeout  int `json:"query_block_timeout"`   // Seconds per block combined for the query
+	QueryTimeout       int `json:"query_timeout"`         // Seconds
 }
 
-// Initialises defaults, parses command line
-func configInit() {
+// Returns the default data directory, in the user's home directory
+func configDefaultDataDir() string {
 	u, err := user.Current()
 	if err != nil {
 		log.Panicln(err)
 	}
-	cfg.DataDir = fmt.Sprintf("%s/%s", u.HomeDir, DefaultDataDir)
+	return fmt.Sprintf("%s/%s", u.HomeDir, DefaultDataDir)
+}
 
-	// Init defaults
-	cfg.P2pPort = DefaultP2PPort
-	cfg.httpPort = DefaultBlockWebServerPort
+// Initialises defaults, parses command line
+func (node *Node) configInit() {
+	defaultDataDir := configDefaultDataDir()
 
-	// Config file is parsed first
+	// Config file is parsed first, then the environment
+	configFile := os.Getenv(configEnvPrefix + "CONFIG")
+	chain := os.Getenv(configEnvPrefix + "CHAIN")
 	for i, arg := range os.Args {
 		if arg == "-conf" || arg == "--conf" {
 			if i+1 >= len(os.Args) {
 				log.Fatal("-conf requires filename argument")
 			}
-			cfg.configFile = os.Args[i+1]
+			configFile = os.Args[i+1]
+		}
+		if arg == "-chain" || arg == "--chain" {
+			if i+1 >= len(os.Args) {
+				log.Fatal("-chain requires the chain profile name")
+			}
+			chain = os.Args[i+1]
 		}
 	}
-	if cfg.configFile != "" {
-		loadConfigFile()
+	if configFile == "" && chain != "" && fileExists(DefaultConfigFile) {
+		configFile = DefaultConfigFile
 	}
+	if configFile == "" && chain != "" {
+		log.Fatal("The chain profiles are configured in the config file, see -conf")
+	}
+	node.configLoad(defaultDataDir, configFile, chain)
 
 	// Then override the configuration with command-line flags
-	flag.IntVar(&cfg.P2pPort, "port", cfg.P2pPort, "P2P port")
-	flag.IntVar(&cfg.httpPort, "http-port", cfg.httpPort, "HTTP port")
-	flag.StringVar(&cfg.DataDir, "dir", cfg.DataDir, "Data directory")
-	flag.BoolVar(&cfg.showHelp, "help", false, "Shows CLI usage information")
-	flag.BoolVar(&cfg.faster, "faster", false, "Be faster when starting up")
-	flag.BoolVar(&cfg.p2pBlockInline, "p2pblockinline", false, "Send blocks to peers inline instead of over HTTP")
+	node.configFlags(flag.CommandLine)
 	flag.Parse()
+	if node.cfg.chain != chain {
+		log.Fatal("The chain profile must be selected with -chain <name>")
+	}
 
-	if cfg.showHelp {
+	if node.cfg.showHelp {
 		actionHelp()
 		os.Exit(0)
 	}
+	node.configApply(defaultDataDir)
 
-	if _, err := os.Stat(cfg.DataDir); err != nil {
-		log.Println("Data directory", cfg.DataDir, "doesn't exist, creating.")
-		err = os.Mkdir(cfg.DataDir, 0700)
+	// The config command reports the problems itself
+	if flag.Arg(0) == "config" {
+		return
+	}
+	node.configCheck()
+	if err := node.logInit(); err != nil {
+		log.Fatalln("Cannot set up logging:", err)
+	}
+}
+
+// Sets up the configuration of the node of the chain profile run by the serve command, like
+// configInit() does with -chain: the command-line flags given to serve apply to all the nodes.
+func (node *Node) configInitChain(configFile, chain string) {
+	defaultDataDir := configDefaultDataDir()
+	node.configLoad(defaultDataDir, configFile, chain)
+	fs := flag.NewFlagSet(chain, flag.ExitOnError)
+	node.configFlags(fs)
+	fs.Parse(os.Args[1:])
+	node.configApply(defaultDataDir)
+	node.configCheck()
+}
+
+// Sets the defaults, and loads the config file, with the chain profile if one is selected,
+// and the environment over them
+func (node *Node) configLoad(defaultDataDir, configFile, chain string) {
+	node.cfg.DataDir = defaultDataDir
+	node.cfg.P2pPort = DefaultP2PPort
+	node.cfg.HTTPPort = DefaultBlockWebServerPort
+	node.cfg.CreateDataDir = true
+	node.cfg.SyncBatchSize = DefaultSyncBatchSize
+	node.cfg.P2pCompression = p2pCompressions
+	node.cfg.configFile = configFile
+	node.cfg.chain = chain
+	if configFile != "" {
+		node.loadConfigFile()
+	}
+	if err := node.configLoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Defines the command-line flags, which override the configuration
+func (node *Node) configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&node.cfg.configFile, "conf", node.cfg.configFile, "JSON configuration file")
+	fs.StringVar(&node.cfg.chain, "chain", node.cfg.chain, "Name of the chain profile from the config file")
+	fs.IntVar(&node.cfg.P2pPort, "port", node.cfg.P2pPort, "P2P port")
+	fs.IntVar(&node.cfg.HTTPPort, "http-port", node.cfg.HTTPPort, "HTTP port")
+	fs.Func("p2p-listen", "Comma-separated addresses the p2p server listens on (default all interfaces)", func(s string) error {
+		node.cfg.P2pListen = splitList(s)
+		return nil
+	})
+	fs.Func("http-listen", "Comma-separated addresses the HTTP server listens on (default all interfaces)", func(s string) error {
+		node.cfg.HTTPListen = splitList(s)
+		return nil
+	})
+	fs.BoolVar(&node.cfg.SinglePort, "single-port", node.cfg.SinglePort, "Serve HTTP on the p2p port too")
+	fs.StringVar(&node.cfg.DataDir, "dir", node.cfg.DataDir, "Data directory")
+	fs.BoolVar(&node.cfg.showHelp, "help", false, "Shows CLI usage information")
+	fs.BoolVar(&node.cfg.faster, "faster", false, "Be faster when starting up")
+	fs.BoolVar(&node.cfg.P2pBlockInline, "p2pblockinline", node.cfg.P2pBlockInline, "Send blocks to peers inline instead of over HTTP")
+	fs.IntVar(&node.cfg.P2pMaxPeers, "max-peers", node.cfg.P2pMaxPeers, "Maximum number of p2p connections (0 for no limit)")
+	fs.Func("p2p-compression", "Comma-separated compression methods accepted for the p2p messages (zstd, zlib or none)", func(s string) error {
+		node.cfg.P2pCompression = splitList(s)
+		return nil
+	})
+	fs.IntVar(&node.cfg.SyncBatchSize, "sync-batch-size", node.cfg.SyncBatchSize, "Number of block hashes requested at a time while syncing")
+	fs.Func("bootstrap-peers", "Comma-separated addresses of the peers to bootstrap from, instead of the default ones", func(s string) error {
+		node.cfg.BootstrapPeers = splitList(s)
+		return nil
+	})
+	fs.StringVar(&node.cfg.Network, "network", node.cfg.Network, "Network mode: main, testnet or simnet")
+	fs.BoolVar(&node.cfg.CreateDataDir, "create-data-dir", node.cfg.CreateDataDir, "Create the data directory if it doesn't exist")
+	fs.BoolVar(&node.cfg.MiningCooperate, "mining-cooperate", node.cfg.MiningCooperate, "Accept mining work from peers")
+	fs.BoolVar(&node.cfg.MiningDistribute, "mining-distribute", node.cfg.MiningDistribute, "Share the mining work with the peers which accept it")
+	fs.BoolVar(&node.cfg.Relay, "relay", node.cfg.Relay, "Relay the connections of the nodes which can't accept connections")
+	fs.BoolVar(&node.cfg.UseRelays, "use-relays", node.cfg.UseRelays, "Connect to the other nodes through the relays")
+	fs.StringVar(&node.cfg.BlockProducerDir, "block-producer-dir", node.cfg.BlockProducerDir, "Directory to produce blocks from automatically")
+	fs.StringVar(&node.cfg.SigningKey, "key", node.cfg.SigningKey, "Name or public key hash of the key to sign with")
+	fs.StringVar(&node.cfg.LogLevel, "log-level", node.cfg.LogLevel, "Log level: debug, info, warn or error, optionally followed by subsystem levels, e.g. info,p2p=debug")
+	fs.StringVar(&node.cfg.LogFormat, "log-format", node.cfg.LogFormat, "Log format: text or json")
+	fs.StringVar(&node.cfg.LogFile, "log-file", node.cfg.LogFile, "Log file, instead of stderr")
+	fs.StringVar(&node.cfg.recordDir, "record", "", "Record inbound p2p messages and blocks into a session directory, for the replay command")
+	fs.StringVar(&node.cfg.DbPassphraseFile, "db-passphrase-file", node.cfg.DbPassphraseFile, "File containing the passphrase of the encrypted system databases")
+	fs.StringVar(&node.cfg.PublicAddress, "public-address", node.cfg.PublicAddress, "Host name or IP address (optionally with the port) at which peers can reach the HTTP server")
+	fs.StringVar(&node.cfg.HTTPTLSCertFile, "tls-cert", node.cfg.HTTPTLSCertFile, "TLS certificate file for the HTTP server")
+	fs.StringVar(&node.cfg.HTTPTLSKeyFile, "tls-key", node.cfg.HTTPTLSKeyFile, "TLS private key file for the HTTP server")
+	fs.StringVar(&node.cfg.BlockAcceptHook, "accept-hook", node.cfg.BlockAcceptHook, "Command executed to approve each new block, with the block filename and hash as arguments")
+	fs.IntVar(&node.cfg.queryFrom, "from", 0, "The lowest block height included in the query or verification")
+	fs.IntVar(&node.cfg.queryTo, "to", 0, "The highest block height included in the query or verification (0 for the last block)")
+	fs.IntVar(&node.cfg.queryLimit, "limit", 0, "The maximum number of rows output by the query (0 for no limit)")
+	fs.BoolVar(&node.cfg.queryReverse, "reverse", false, "Combine the blocks for the query from the newest to the oldest")
+	fs.StringVar(&node.cfg.queryFormat, "format", "jsonl", "Query output format: jsonl, csv or table")
+	fs.StringVar(&node.cfg.queryOutput, "output", "", "Write the query results to a new .db (SQLite), .csv or .jsonl file instead of stdout")
+	fs.StringVar(&node.cfg.verifyReport, "report", "", "Write the result of the verify command to the given JSON file")
+	fs.StringVar(&node.cfg.keyOpWeight, "weight", "", "The weight of the signatory key added by addkey or signkeyop A (1 by default)")
+	fs.StringVar(&node.cfg.keyOpDelay, "activation-delay", "", "The number of blocks after which the signatory key added by addkey or signkeyop A can sign")
+	fs.StringVar(&node.cfg.keyOpRole, "role", "", "The role of the signatory key added by addkey or signkeyop A: admin, signer or observer")
+	fs.StringVar(&node.cfg.keyOpDNS, "dns", "", "The domain name vouching for the signatory key added by addkey or signkeyop A")
+	fs.StringVar(&node.cfg.keyOpCert, "cert", "", "The PEM file with the certificate chain issued for the signatory key added by addkey or signkeyop A")
+	fs.StringVar(&node.cfg.chainRefs, "chain-ref", "", "Blocks of other chains referenced by the block signed by signblock or signimportblock, as <genesis hash>:<height>[:<block hash>], separated by commas")
+}
+
+// Applies the network mode and the bootstrap peers from the configuration
+func (node *Node) configApply(defaultDataDir string) {
+	if err := networkValidate(node.cfg.Network); err != nil {
+		log.Fatal(err)
+	}
+	node.networkApplyDefaults(defaultDataDir)
+	if node.networkIsTest() {
+		chainLog.Info("Running on the", node.networkName(), "network, in", node.cfg.DataDir)
+	}
+
+	if len(node.cfg.BootstrapPeers) > 0 {
+		node.bootstrapPeers = peerStringMap{}
+		for _, peer := range node.cfg.BootstrapPeers {
+			node.bootstrapPeers[peer] = time.Now()
+		}
+	}
+}
+
+// Stops the node if the configuration is invalid, and creates the data directory
+func (node *Node) configCheck() {
+	failed := false
+	for _, p := range node.configValidate() {
+		if !p.warning {
+			chainLog.Error(p)
+			failed = true
+		}
+	}
+	if failed {
+		log.Fatalln("Invalid configuration; see \"daisy config check\"")
+	}
+
+	if _, err := os.Stat(node.cfg.DataDir); err != nil {
+		chainLog.Info("Data directory", node.cfg.DataDir, "doesn't exist, creating.")
+		err = os.Mkdir(node.cfg.DataDir, 0700)
 		if err != nil {
 			log.Panicln(err)
 		}
 	}
-	if cfg.P2pPort < 1 || cfg.P2pPort > 65535 {
-		log.Fatal("Invalid TCP port", cfg.P2pPort)
+}
+
+// Overrides the configuration with the DAISY_* environment variables: each setting from the
+// config file can be given as the variable named by its key in upper case, e.g. DAISY_P2P_PORT,
+// with the lists comma-separated.
+func (node *Node) configLoadEnv() error {
+	v := reflect.ValueOf(&node.cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := configEnvPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetInt(n)
+		case reflect.Float64:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetFloat(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetBool(b)
+		case reflect.Slice:
+			if f.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s cannot be set from the environment", name)
+			}
+			f.Set(reflect.ValueOf(splitList(value)))
+		default:
+			return fmt.Errorf("%s cannot be set from the environment", name)
+		}
 	}
+	return nil
 }
 
-// Loads the JSON config file.
-func loadConfigFile() {
-	data, err := ioutil.ReadFile(cfg.configFile)
+// Loads the JSON config file, and applies the selected chain profile over it. The profile's
+// data directory is by default the top level one with "-<profile name>" appended.
+func (node *Node) loadConfigFile() {
+	data, err := ioutil.ReadFile(node.cfg.configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = json.Unmarshal(data, &cfg)
+	err = json.Unmarshal(data, &node.cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if node.cfg.chain == "" {
+		return
+	}
+	profile, ok := node.cfg.Chains[node.cfg.chain]
+	if !ok {
+		log.Fatalf("Unknown chain profile %q in %s", node.cfg.chain, node.cfg.configFile)
+	}
+	var keys map[string]json.RawMessage
+	if err = json.Unmarshal(profile, &keys); err != nil {
+		log.Fatalf("Chain profile %q: %v", node.cfg.chain, err)
+	}
+	if _, ok := keys["data_dir"]; !ok {
+		node.cfg.DataDir = node.cfg.DataDir + "-" + node.cfg.chain
+	}
+	chains := node.cfg.Chains
+	if err = json.Unmarshal(profile, &node.cfg); err != nil {
+		log.Fatalf("Chain profile %q: %v", node.cfg.chain, err)
+	}
+	node.cfg.Chains = chains
 }
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Validation of the configuration. configInit refuses to start with a configuration which has
+ * errors, and the "config check" command reports all the problems, errors and warnings, and
+ * prints the effective configuration (the config file with the command line flags and the
+ * defaults applied), so deployments can be verified before the node is restarted.
+ */
+
+// configProblem is a problem with a configuration setting
+type configProblem struct {
+	field   string
+	message string
+	warning bool // If false, the node won't start with this configuration
+}
+
+func (p configProblem) String() string {
+	kind := "ERROR"
+	if p.warning {
+		kind = "WARNING"
+	}
+	return fmt.Sprintf("%s: %s: %s", kind, p.field, p.message)
+}
+
+// Validates the configuration, returning all the problems found
+func (node *Node) configValidate() []configProblem {
+	var problems []configProblem
+	fail := func(field, format string, args ...interface{}) {
+		problems = append(problems, configProblem{field: field, message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(field, format string, args ...interface{}) {
+		problems = append(problems, configProblem{field: field, message: fmt.Sprintf(format, args...), warning: true})
+	}
+
+	if node.cfg.P2pPort < 1 || node.cfg.P2pPort > 65535 {
+		fail("p2p_port", "invalid TCP port %d", node.cfg.P2pPort)
+	}
+	if node.cfg.HTTPPort < 1 || node.cfg.HTTPPort > 65535 {
+		fail("http_port", "invalid TCP port %d", node.cfg.HTTPPort)
+	}
+	if node.cfg.P2pMaxPeers < 0 {
+		fail("p2p_max_peers", "cannot be negative")
+	}
+	for _, c := range node.cfg.P2pCompression {
+		if c != p2pCompressionNone && !inStrings(c, p2pCompressions) {
+			fail("p2p_compression", "unknown compression %s, must be one of: %s, %s", c, strings.Join(p2pCompressions, ", "), p2pCompressionNone)
+		}
+	}
+	if node.cfg.SyncBatchSize < 1 || node.cfg.SyncBatchSize > p2pMaxBlockHashes {
+		fail("sync_batch_size", "must be between 1 and %d", p2pMaxBlockHashes)
+	}
+	p2pAddresses, err := node.p2pListenAddresses()
+	if err != nil {
+		fail("p2p_listen", "%v", err)
+	}
+	httpAddresses, err := node.httpListenAddresses()
+	if err != nil {
+		fail("http_listen", "%v", err)
+	}
+	if configListenConflict(p2pAddresses, httpAddresses) {
+		fail("http_listen", "the p2p and the HTTP servers would listen on the same port")
+	}
+
+	if st, err := os.Stat(node.cfg.DataDir); err != nil {
+		if !os.IsNotExist(err) {
+			fail("data_dir", "%v", err)
+		} else if node.cfg.CreateDataDir {
+			warn("data_dir", "%s doesn't exist, and will be created", node.cfg.DataDir)
+		} else {
+			fail("data_dir", "%s doesn't exist, and create_data_dir is false", node.cfg.DataDir)
+		}
+	} else if !st.IsDir() {
+		fail("data_dir", "%s isn't a directory", node.cfg.DataDir)
+	} else if f, err := ioutil.TempFile(node.cfg.DataDir, ".configcheck"); err != nil {
+		fail("data_dir", "not writable: %v", err)
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if err := networkValidate(node.cfg.Network); err != nil {
+		fail("network", "%v", err)
+	}
+	if _, _, err := logParseLevels(node.cfg.LogLevel); err != nil {
+		fail("log_level", "%v", err)
+	}
+	if node.cfg.LogFormat != "" && node.cfg.LogFormat != "text" && node.cfg.LogFormat != "json" {
+		fail("log_format", "must be text or json")
+	}
+	if filepath.IsAbs(node.cfg.LogFile) {
+		if st, err := os.Stat(filepath.Dir(node.logFileName())); err != nil || !st.IsDir() {
+			fail("log_file", "the directory of %s doesn't exist", node.logFileName())
+		}
+	}
+	if node.cfg.LogMaxSize < 0 {
+		fail("log_max_size", "cannot be negative")
+	}
+	if node.cfg.LogMaxFiles < 0 {
+		fail("log_max_files", "cannot be negative")
+	}
+
+	if node.cfg.PublicAddress != "" {
+		host, port, err := splitAddress(node.cfg.PublicAddress)
+		if err != nil || host == "" || port < 0 || port > 65535 {
+			fail("public_address", "%q isn't a host name or IP address with an optional port", node.cfg.PublicAddress)
+		}
+	}
+	for peer := range node.bootstrapPeers {
+		if err := configCheckPeerAddress(peer); err != nil {
+			fail("bootstrap peers", "%s: %v", peer, err)
+		}
+	}
+
+	if node.cfg.MainDbURL != "" {
+		if dbDialectForURL(node.cfg.MainDbURL).name() != "postgres" {
+			fail("main_db", "only postgres:// URLs are supported")
+		} else if u, err := url.Parse(node.cfg.MainDbURL); err != nil {
+			fail("main_db", "%v", err)
+		} else if u.Host == "" {
+			fail("main_db", "the URL has no host")
+		}
+	}
+	if node.cfg.DbPassphraseFile != "" && os.Getenv(dbPassphraseEnv) == "" {
+		if data, err := ioutil.ReadFile(node.cfg.DbPassphraseFile); err != nil {
+			fail("db_passphrase_file", "%v", err)
+		} else if strings.TrimRight(string(data), "\r\n") == "" {
+			fail("db_passphrase_file", "the file is empty")
+		} else if !dbEncryptionSupported {
+			fail("db_passphrase_file", "this build doesn't support encrypted databases")
+		}
+	}
+
+	if (node.cfg.HTTPTLSCertFile == "") != (node.cfg.HTTPTLSKeyFile == "") {
+		fail("http_tls_cert", "both the TLS certificate and the key file must be configured")
+	} else if node.cfg.HTTPTLSCertFile != "" {
+		if len(node.cfg.HTTPACMEDomains) > 0 {
+			warn("http_tls_cert", "ignored, as http_acme_domains is configured")
+		}
+		if cert, err := tls.LoadX509KeyPair(node.cfg.HTTPTLSCertFile, node.cfg.HTTPTLSKeyFile); err != nil {
+			fail("http_tls_cert", "%v", err)
+		} else if leaf, err := configParseLeaf(cert); err != nil {
+			fail("http_tls_cert", "%v", err)
+		} else if time.Now().After(leaf.NotAfter) {
+			fail("http_tls_cert", "the certificate expired at %v", leaf.NotAfter)
+		} else if time.Until(leaf.NotAfter) < 14*24*time.Hour {
+			warn("http_tls_cert", "the certificate expires at %v", leaf.NotAfter)
+		}
+	}
+	if node.cfg.HTTPAuthUser != "" && node.cfg.HTTPAuthPassword == "" {
+		fail("http_auth_password", "must be configured with the user name")
+	}
+	if node.cfg.HTTPAuthToken != "" && node.cfg.HTTPAuthUser != "" {
+		warn("http_auth_token", "both the token and the basic auth are configured")
+	}
+	if node.cfg.HTTPRateLimit < 0 {
+		fail("http_rate_limit", "cannot be negative")
+	}
+	if node.cfg.HTTPRateBurst < 0 {
+		fail("http_rate_burst", "cannot be negative")
+	}
+	if node.cfg.HTTPMaxDownloadsPerIP < 0 {
+		fail("http_max_downloads_per_ip", "cannot be negative")
+	}
+	if node.cfg.P2pInboundPerIP < 0 {
+		fail("p2p_inbound_per_ip", "cannot be negative")
+	}
+	if node.cfg.P2pInboundTotal < 0 {
+		fail("p2p_inbound_total", "cannot be negative")
+	}
+	if node.cfg.P2pInboundHandshakes < 0 {
+		fail("p2p_inbound_handshakes", "cannot be negative")
+	}
+	if node.cfg.QueryMaxRows < 0 {
+		fail("query_max_rows", "cannot be negative")
+	}
+	if node.cfg.QueryBlockTimeout < 0 {
+		fail("query_block_timeout", "cannot be negative")
+	}
+	if node.cfg.QueryTimeout < 0 {
+		fail("query_timeout", "cannot be negative")
+	}
+	if node.cfg.QueryMaxMemory < 0 || node.cfg.QueryMaxMemory > 2047 {
+		fail("query_max_memory", "must be between 0 (the default) and 2047 MB")
+	}
+	if node.cfg.QueryMaxResultSize < 0 {
+		fail("query_max_result_size", "cannot be negative")
+	}
+
+	if err := node.blockAcceptanceInit(); err != nil {
+		fail("block_acceptance_stages", "%v", err)
+	}
+	if node.cfg.PolicyMaxBlockSize < 0 {
+		fail("policy_max_block_size", "cannot be negative")
+	}
+	if node.cfg.TSAURL != "" {
+		if u, err := url.Parse(node.cfg.TSAURL); err != nil {
+			fail("tsa_url", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("tsa_url", "%s is not an http:// or https:// URL", node.cfg.TSAURL)
+		}
+	}
+	if node.cfg.TSARoots != "" {
+		if _, err := node.tsaRoots(); err != nil {
+			fail("tsa_roots", "%v", err)
+		}
+	}
+	for chain, nodeURL := range node.cfg.ChainRefs {
+		if !blockHashRegexp.MatchString(chain) {
+			fail("chain_refs", "%s is not a genesis block hash", chain)
+		}
+		if u, err := url.Parse(nodeURL); err != nil {
+			fail("chain_refs", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("chain_refs", "%s is not an http:// or https:// URL", nodeURL)
+		}
+	}
+	indexNames := map[string]bool{}
+	for _, ix := range node.cfg.Indexes {
+		if ix.Table == "" || len(ix.Columns) == 0 {
+			fail("indexes", "an index needs a table and at least one column")
+			continue
+		}
+		for _, c := range ix.Columns {
+			if c == "" {
+				fail("indexes", "the index %s has an empty column name", ix.name())
+			}
+		}
+		if indexNames[ix.name()] {
+			fail("indexes", "the index %s is declared twice", ix.name())
+		}
+		indexNames[ix.name()] = true
+	}
+	if node.cfg.PolicyIdentityRoots != "" {
+		if _, err := node.identityRoots(); err != nil {
+			fail("policy_identity_roots", "%v", err)
+		}
+	}
+	for _, webhook := range node.cfg.Webhooks {
+		if u, err := url.Parse(webhook); err != nil {
+			fail("webhooks", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("webhooks", "%s is not an http:// or https:// URL", webhook)
+		}
+	}
+	for _, event := range node.cfg.WebhookEvents {
+		if !inStrings(event, nodeEventNames) {
+			fail("webhook_events", "unknown event %s", event)
+		}
+	}
+	if len(node.cfg.WebhookEvents) > 0 && len(node.cfg.Webhooks) == 0 {
+		warn("webhooks", "not set, so webhook_events has no effect")
+	}
+	for field, cmd := range map[string]string{"block_accept_hook": node.cfg.BlockAcceptHook, "backup_hook": node.cfg.BackupHook} {
+		if cmd == "" {
+			continue
+		}
+		if _, err := exec.LookPath(cmd); err != nil {
+			fail(field, "%v", err)
+		}
+	}
+
+	if node.cfg.DbMaintenanceInterval != "" {
+		if _, err := time.ParseDuration(node.cfg.DbMaintenanceInterval); err != nil {
+			fail("db_maintenance_interval", "%v", err)
+		}
+	}
+	if node.cfg.BackupInterval != "" {
+		if d, err := time.ParseDuration(node.cfg.BackupInterval); err != nil {
+			fail("backup_interval", "%v", err)
+		} else if d < time.Minute {
+			fail("backup_interval", "must be at least a minute")
+		}
+	}
+	if node.cfg.BackupKeep < 0 {
+		fail("backup_keep", "cannot be negative")
+	}
+	if node.cfg.BackupDir != "" && !filepath.IsAbs(node.cfg.BackupDir) {
+		warn("backup_dir", "%s is relative to the working directory", node.cfg.BackupDir)
+	}
+
+	if node.cfg.BlockProducerInterval != "" {
+		if d, err := time.ParseDuration(node.cfg.BlockProducerInterval); err != nil {
+			fail("block_producer_interval", "%v", err)
+		} else if d < time.Minute {
+			fail("block_producer_interval", "must be at least a minute")
+		}
+	}
+	if node.cfg.BlockProducerMaxSize < 0 {
+		fail("block_producer_max_size", "cannot be negative")
+	}
+	if node.cfg.BlockProducerDir != "" && node.cfg.BlockProducerInterval == "" && node.cfg.BlockProducerMaxSize == 0 {
+		fail("block_producer_dir", "needs block_producer_interval or block_producer_max_size")
+	}
+	if node.cfg.BlockProducerDir == "" && (node.cfg.BlockProducerInterval != "" || node.cfg.BlockProducerMaxSize != 0) {
+		warn("block_producer_dir", "not set, so blocks won't be produced automatically")
+	}
+
+	if _, err := node.anchorGetBackend(); err != nil {
+		fail("anchor_backend", "%v", err)
+	}
+	if _, err := node.anchorGetInterval(); err != nil {
+		fail("anchor_interval", "%v", err)
+	}
+	if node.cfg.AnchorBackend == "" && (node.cfg.AnchorTarget != "" || node.cfg.AnchorInterval != "") {
+		warn("anchor_backend", "not set, so the chain won't be anchored")
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return !problems[i].warning && problems[j].warning
+	})
+	return problems
+}
+
+// Returns true if two listen addresses from the lists would conflict, having the same port and
+// the same or the unspecified host
+func configListenConflict(a, b []string) bool {
+	for _, x := range a {
+		xHost, xPort, _ := net.SplitHostPort(x)
+		for _, y := range b {
+			yHost, yPort, _ := net.SplitHostPort(y)
+			if xPort == yPort && (xHost == yHost || xHost == "" || yHost == "") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks that the peer address is a host and a valid port
+func configCheckPeerAddress(address string) error {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("no host")
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	if strings.HasPrefix(host, "[") {
+		if net.ParseIP(strings.Trim(host, "[]")) == nil {
+			return fmt.Errorf("invalid IPv6 address")
+		}
+	}
+	return nil
+}
+
+// Returns the parsed leaf certificate of the chain
+func configParseLeaf(cert tls.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificates in the file")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// Returns the configuration file's keys which don't match any setting
+func (node *Node) configUnknownKeys() ([]string, error) {
+	data, err := ioutil.ReadFile(node.cfg.configFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]json.RawMessage
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	known, err := json.Marshal(node.cfg)
+	if err != nil {
+		return nil, err
+	}
+	var knownKeys map[string]json.RawMessage
+	if err = json.Unmarshal(known, &knownKeys); err != nil {
+		return nil, err
+	}
+	var unknown []string
+	for k := range keys {
+		if _, ok := knownKeys[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	if profile, ok := node.cfg.Chains[node.cfg.chain]; ok {
+		var profileKeys map[string]json.RawMessage
+		if err = json.Unmarshal(profile, &profileKeys); err != nil {
+			return nil, err
+		}
+		for k := range profileKeys {
+			if _, ok := knownKeys[k]; !ok || k == "chains" {
+				unknown = append(unknown, "chains."+node.cfg.chain+"."+k)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// Returns the effective configuration as indented JSON, with the secrets masked
+func (node *Node) configEffectiveJSON() ([]byte, error) {
+	c := node.cfg
+	for _, secret := range []*string{&c.HTTPAuthToken, &c.HTTPAuthPassword} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&m); err != nil {
+		return nil, err
+	}
+	// The defaults used for the settings which aren't configured
+	m["block_acceptance_stages"] = node.blockAcceptancePipeline
+	m["backup_dir"] = node.backupGetDir()
+	if node.cfg.BackupKeep <= 0 {
+		m["backup_keep"] = backupDefaultKeep
+	}
+	if node.cfg.DbMaintenanceInterval == "" {
+		m["db_maintenance_interval"] = dbMaintenanceDefaultInterval.String()
+	}
+	// Settings which can only be given on the command line
+	m["p2p_listen"], _ = node.p2pListenAddresses()
+	m["http_listen"], _ = node.httpListenAddresses()
+	m["config_file"] = node.cfg.configFile
+	m["chain"] = node.cfg.chain
+	delete(m, "chains")
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// Validates the configuration, prints the problems and the effective configuration, and exits
+// with status 1 if there are errors
+func (node *Node) actionConfigCheck() {
+	problems := node.configValidate()
+	if node.cfg.configFile != "" {
+		unknown, err := node.configUnknownKeys()
+		if err != nil {
+			problems = append(problems, configProblem{field: "config file", message: err.Error()})
+		}
+		for _, k := range unknown {
+			problems = append(problems, configProblem{field: k, message: "unknown setting in " + node.cfg.configFile, warning: true})
+		}
+	}
+	nErrors := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.warning {
+			nErrors++
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Println()
+	}
+	data, err := node.configEffectiveJSON()
+	if err != nil {
+		fmt.Println("Cannot show the effective configuration:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+	if nErrors > 0 {
+		fmt.Printf("\n%d errors\n", nErrors)
+		os.Exit(1)
+	}
+	fmt.Println("\nThe configuration is valid")
+}
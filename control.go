@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * A running node listens on a Unix domain socket in the data directory, through which the CLI
+ * commands (status, peers, stop, the mempool commands and keyops) talk to it instead of opening the databases the node is
+ * using. The protocol is HTTP, with JSON responses.
+ */
+
+const controlSocketFileName = "daisy.sock"
+
+// Returns the path of the control socket in the data directory
+func (node *Node) controlSocketPath() string {
+	return fmt.Sprintf("%s/%s", node.cfg.DataDir, controlSocketFileName)
+}
+
+// Listens on the control socket and serves requests from the CLI
+func (node *Node) controlServer() {
+	path := node.controlSocketPath()
+	if fileExists(path) {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			log.Fatalln("Another node is already running with the data directory", node.cfg.DataDir)
+		}
+		// A stale socket left by a node which hasn't exited cleanly
+		if err := os.Remove(path); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalln("Cannot listen on the control socket:", err)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		log.Println(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		controlSendJSON(w, node.getNodeStatus(true))
+	})
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		controlSendJSON(w, node.p2pPeers.Info())
+	})
+	mux.HandleFunc("/peers/saved", func(w http.ResponseWriter, r *http.Request) {
+		saved, err := node.getSavedPeerInfo()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		controlSendJSON(w, saved)
+	})
+	mux.HandleFunc("/records", node.mempoolServeRecords)
+	mux.HandleFunc("/keyops", node.keyOpServeProposals)
+	mux.HandleFunc("/records/drop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if node.mempool.Remove([]string{id}) == 0 {
+			http.Error(w, "No such record", http.StatusNotFound)
+			return
+		}
+		log.Println("Record", id, "dropped over the control socket")
+		controlSendJSON(w, StrIfMap{"dropped": id})
+	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		log.Println("Stop requested over the control socket")
+		controlSendJSON(w, StrIfMap{"stopping": true})
+		go func() {
+			// Give the response a chance to reach the client
+			time.Sleep(100 * time.Millisecond)
+			sysEventChannel <- sysEventMessage{event: eventQuit, idata: 0}
+		}()
+	})
+	log.Println("Control socket listening on", path)
+	if err = http.Serve(listener, mux); err != nil {
+		log.Println("Control socket:", err)
+	}
+}
+
+// Removes the control socket when the node exits
+func (node *Node) controlShutdown() {
+	if err := os.Remove(node.controlSocketPath()); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+func controlSendJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(jsonifyWhateverToBytes(v)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Sends a request to the running node over the control socket, and decodes the JSON response
+// into result. Returns an error if the node isn't running.
+func (node *Node) controlRequest(method string, path string, result interface{}) error {
+	return node.controlRequestBody(method, path, nil, result)
+}
+
+// Sends a request with body encoded as JSON, if it isn't nil, to the running node over the
+// control socket, and decodes the JSON response into result
+func (node *Node) controlRequestBody(method string, path string, body interface{}, result interface{}) error {
+	socketPath := node.controlSocketPath()
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(jsonifyWhateverToBytes(body))
+	}
+	req, err := http.NewRequest(method, "http://daisy"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if len(msg) > 0 {
+			return fmt.Errorf("HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Asks the running node to stop
+func (node *Node) actionStop() {
+	if err := node.controlRequest(http.MethodPost, "/stop", nil); err != nil {
+		log.Fatalln("Cannot reach the running node:", err)
+	}
+	log.Println("The node is stopping")
+}
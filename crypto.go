@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"database/sql"
 	"encoding/asn1"
 	"encoding/hex"
 	"fmt"
@@ -21,16 +22,16 @@ type ecdsaSignature struct {
 	S *big.Int
 }
 
-func cryptoInit() {
-	if dbNumPrivateKeys() == 0 {
+func (node *Node) cryptoInit() {
+	if node.dbNumPrivateKeys() == 0 {
 		log.Println("Generating the initial wallet keypair...")
-		generatePrivateKey(-1)
+		node.generatePrivateKey(-1)
 		log.Println("Generated.")
 	}
 }
 
 // Generates a keypair and writes it to the private database
-func generatePrivateKey(height int) *ecdsa.PrivateKey {
+func (node *Node) generatePrivateKey(height int) *ecdsa.PrivateKey {
 	keys, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		log.Fatal(err)
@@ -45,8 +46,12 @@ func generatePrivateKey(height int) *ecdsa.PrivateKey {
 	}
 	publicKeyHash := getPubKeyHash(publicKey)
 
-	dbWritePublicKey(publicKey, publicKeyHash, height)
-	dbWritePrivateKey(privateKey, publicKeyHash)
+	if err = dbWritePublicKey(node.mainDb, publicKey, publicKeyHash, height); err != nil {
+		log.Fatal(err)
+	}
+	if err = node.dbWritePrivateKey(privateKey, publicKeyHash); err != nil {
+		log.Fatal(err)
+	}
 
 	return keys
 }
@@ -58,29 +63,73 @@ func getPubKeyHash(b []byte) string {
 	return "1:" + hex.EncodeToString(hash[:])
 }
 
-// getAPrivateKey returns a random keypair read from the database
+// getAPrivateKey returns the oldest keypair read from the database
 // This is mostly useful when the database has only one keypair ;)
-func cryptoGetAPrivateKey() (*ecdsa.PrivateKey, string, error) {
-	privateKeyBytes, publicKeyHash, err := dbGetAPrivateKey()
+// Use cryptoGetSigningKey() to sign with the key selected by the user.
+func (node *Node) cryptoGetAPrivateKey() (*ecdsa.PrivateKey, string, error) {
+	privateKeyBytes, publicKeyHash, err := node.dbGetAPrivateKey()
 	if err != nil {
 		return nil, "", err
 	}
-	dbPubKey, err := dbGetPublicKey(publicKeyHash)
+	keys, err := node.cryptoLoadPrivateKey(privateKeyBytes, publicKeyHash)
+	return keys, publicKeyHash, err
+}
+
+// The name of the key used for signing if no key is selected by -key or the config file
+const defaultKeyName = "default"
+
+// Returns the keypair to sign with: the one selected with -key or the signing_key config
+// setting (either a key name or a public key hash), or the key named "default", or the
+// oldest key.
+func (node *Node) cryptoGetSigningKey() (*ecdsa.PrivateKey, string, error) {
+	if node.cfg.SigningKey != "" {
+		publicKeyHash, err := node.dbFindPrivateKeyHash(node.cfg.SigningKey)
+		if err != nil {
+			return nil, "", err
+		}
+		keys, err := node.cryptoGetPrivateKey(publicKeyHash)
+		return keys, publicKeyHash, err
+	}
+	if publicKeyHash, err := node.dbFindPrivateKeyHash(defaultKeyName); err == nil {
+		keys, err := node.cryptoGetPrivateKey(publicKeyHash)
+		return keys, publicKeyHash, err
+	}
+	if n := node.dbNumPrivateKeys(); n > 1 {
+		log.Println("Warning: there are", n, "keys and none is selected with -key, signing with the oldest one")
+	}
+	return node.cryptoGetAPrivateKey()
+}
+
+// Returns the keypair with the given public key hash, read from the database
+func (node *Node) cryptoGetPrivateKey(publicKeyHash string) (*ecdsa.PrivateKey, error) {
+	privateKeyBytes, err := node.dbGetPrivateKey(publicKeyHash)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
+	return node.cryptoLoadPrivateKey(privateKeyBytes, publicKeyHash)
+}
+
+// Parses the private key and checks it against its public key in the database. Keys which
+// aren't (yet) signatories, e.g. imported ones, have no public key in the database, and are
+// checked against the public key derived from the private one.
+func (node *Node) cryptoLoadPrivateKey(privateKeyBytes []byte, publicKeyHash string) (*ecdsa.PrivateKey, error) {
 	keys, err := x509.ParseECPrivateKey(privateKeyBytes)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	pubKey, err := x509.ParsePKIXPublicKey(dbPubKey.publicKeyBytes)
-	if err != nil {
-		log.Panicln(err)
-		return nil, "", err
+	dbPubKey, err := node.dbGetPublicKey(publicKeyHash)
+	if err == nil {
+		pubKey, err := x509.ParsePKIXPublicKey(dbPubKey.publicKeyBytes)
+		if err != nil {
+			log.Panicln(err)
+			return nil, err
+		}
+		keys.PublicKey = *pubKey.(*ecdsa.PublicKey)
+	} else if err != sql.ErrNoRows {
+		return nil, err
 	}
-	keys.PublicKey = *pubKey.(*ecdsa.PublicKey)
 	if !elliptic.P256().IsOnCurve(keys.PublicKey.X, keys.PublicKey.Y) {
-		return nil, "", fmt.Errorf("Elliptic key verification error for %s", publicKeyHash)
+		return nil, fmt.Errorf("Elliptic key verification error for %s", publicKeyHash)
 	}
 
 	// Check if we can get the right public key hash back again
@@ -90,10 +139,10 @@ func cryptoGetAPrivateKey() (*ecdsa.PrivateKey, string, error) {
 	}
 	testPublicKeyHash := getPubKeyHash(testPublicKeyBytes)
 	if testPublicKeyHash != publicKeyHash {
-		return nil, "", fmt.Errorf("Loaded keypair %s, but the calculated public key hash doesn't match: %s", publicKeyHash, testPublicKeyHash)
+		return nil, fmt.Errorf("Loaded keypair %s, but the calculated public key hash doesn't match: %s", publicKeyHash, testPublicKeyHash)
 	}
 
-	return keys, publicKeyHash, nil
+	return keys, nil
 }
 
 // Decodes the given bytes into a public key
@@ -123,6 +172,32 @@ func cryptoSignPublicKeyHash(myPrivateKey *ecdsa.PrivateKey, publicKeyHash strin
 	return cryptoSignBytes(myPrivateKey, publicKeyHashBytes)
 }
 
+// Returns the hash signed in the "A" key ops with metadata: the SHA256 hash of the public key
+// hash and the metadata JSON, separated by a newline.
+func cryptoKeyMetadataHash(publicKeyHash string, metadataJSON string) []byte {
+	hash := sha256.Sum256([]byte(publicKeyHash + "\n" + metadataJSON))
+	return hash[:]
+}
+
+// Returns the hash signed in key metadata ("M") key ops: the SHA256 hash of "M", the height of
+// the block with the op, the public key hash and the metadata JSON, separated by newlines. The
+// height binds the signature to the block, so an old metadata op can't be replayed later to
+// bring back the metadata it has set.
+func cryptoKeyMetadataOpHash(publicKeyHash string, metadataJSON string, height int) []byte {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("M\n%d\n%s\n%s", height, publicKeyHash, metadataJSON)))
+	return hash[:]
+}
+
+// Signs the metadata of the key, with the key itself
+func cryptoSignKeyMetadata(myPrivateKey *ecdsa.PrivateKey, publicKeyHash string, metadataJSON string) ([]byte, error) {
+	return cryptoSignBytes(myPrivateKey, cryptoKeyMetadataHash(publicKeyHash, metadataJSON))
+}
+
+// Returns nil if the key metadata signature is valid
+func cryptoVerifyKeyMetadataSignature(publicKey *ecdsa.PublicKey, publicKeyHash string, metadataJSON string, signature []byte) error {
+	return cryptoVerifyBytes(publicKey, cryptoKeyMetadataHash(publicKeyHash, metadataJSON), signature)
+}
+
 // Returns nil (i.e. "no error") if the verification succeeds
 func cryptoVerifyPublicKeyHashSignature(publicKey *ecdsa.PublicKey, publicKeyHash string, signature []byte) error {
 	if publicKeyHash[1] != ':' {
@@ -7,9 +7,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 /*********************************************************************************************************************
@@ -29,6 +28,13 @@ type DbBlockchainBlock struct {
 	HashSignature              []byte
 	TimeAccepted               time.Time
 	Version                    int
+	Cosignatures               []BlockSignature // Signatures of the block hash by signatories other than the creator
+}
+
+// BlockSignature is a signature of a block's hash by a co-signing signatory
+type BlockSignature struct {
+	PublicKeyHash string
+	Signature     []byte
 }
 
 // Note: all db times are Unix timestamps in the UTC zone
@@ -41,10 +47,20 @@ CREATE TABLE blockchain (
 	hash_signature		VARCHAR NOT NULL,
 	prev_hash			VARCHAR NOT NULL,
 	prev_hash_signature	VARCHAR NOT NULL,
-	time_accepted		INTEGER NOT NULL,
+	time_accepted		BIGINT NOT NULL,
 	version				INTEGER NOT NULL
 );
 CREATE INDEX blockchain_sigkey_hash ON blockchain(sigkey_hash);
+CREATE INDEX blockchain_sigkey_hash_height ON blockchain(sigkey_hash, height);
+`
+
+const blockSignaturesTableCreate = `
+CREATE TABLE block_signatures (
+	hash				VARCHAR NOT NULL,
+	sigkey_hash			VARCHAR NOT NULL,
+	hash_signature		VARCHAR NOT NULL,
+	PRIMARY KEY (hash, sigkey_hash)
+);
 `
 
 // DbPubKey is the convenience structure holding information from the pubkeys table
@@ -64,8 +80,8 @@ CREATE TABLE pubkeys (
 	pubkey_hash		VARCHAR NOT NULL PRIMARY KEY,
 	pubkey			VARCHAR NOT NULL,
 	state			CHAR NOT NULL,
-	time_added		INTEGER NOT NULL,
-	time_revoked	INTEGER,
+	time_added		BIGINT NOT NULL,
+	time_revoked	BIGINT,
 	block_height	INTEGER NOT NULL,
 	metadata		VARCHAR -- JSON
 );`
@@ -74,7 +90,16 @@ const privateTableCreate = `
 CREATE TABLE privkeys (
 	pubkey_hash		VARCHAR NOT NULL PRIMARY KEY,
 	privkey			VARCHAR NOT NULL,
-	time_added		INTEGER NOT NULL
+	time_added		INTEGER NOT NULL,
+	name			VARCHAR UNIQUE -- optional label, for selecting the key with -key
+);
+`
+
+// Key metadata changes waiting to be published in a block I sign
+const pendingKeyMetadataTableCreate = `
+CREATE TABLE pending_key_metadata (
+	pubkey_hash		VARCHAR NOT NULL PRIMARY KEY,
+	metadata		VARCHAR NOT NULL -- JSON
 );
 `
 
@@ -88,8 +113,13 @@ CREATE TABLE config (
 const peersTableCreate = `
 CREATE TABLE peers (
 	address			VARCHAR NOT NULL PRIMARY KEY,	-- in the format "address:port", lowercase
-	time_added		INTEGER NOT NULL, -- time last seen
-	permanent		BOOLEAN NOT NULL DEFAULT 0
+	time_added		BIGINT NOT NULL, -- time last seen
+	permanent		BOOLEAN NOT NULL DEFAULT FALSE,
+	last_success	BIGINT,			-- time of the last successful connection
+	last_failure	BIGINT,			-- time of the last failed connection
+	fail_count		INTEGER NOT NULL DEFAULT 0, -- failed connections since the last success
+	latency			INTEGER,		-- connection time in ms, at the last success
+	banned_until	BIGINT			-- not connecting to the peer before this time
 );
 `
 
@@ -115,66 +145,41 @@ CREATE TABLE _keys (
 );
 `
 
-var mainDb *sql.DB
-var privateDb *sql.DB
-
-// Initialises the system databases
-func dbInit() {
-	dbFileName := fmt.Sprintf("%s/%s", cfg.DataDir, mainDbFileName)
-	_, err := os.Stat(dbFileName)
-	mainDbFileExists := err == nil
-	mainDb, err = sql.Open("sqlite3", dbFileName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if !mainDbFileExists || !dbTableExists(mainDb, "blockchain") {
-		// Create system tables
-		_, err = mainDb.Exec(blockchainTableCreate)
-		if err != nil {
-			log.Panic(err)
-		}
-	}
-	if !dbTableExists(mainDb, "pubkeys") {
-		_, err = mainDb.Exec(pubKeysTableCreate)
-		if err != nil {
-			log.Panic(err)
+// Initialises the system databases, creating them or migrating their schemas as needed
+func (node *Node) dbInit() {
+	var err error
+	mainDbURL := node.cfg.MainDbURL
+	if mainDbURL == "" {
+		mainDbURL = fmt.Sprintf("%s/%s", node.cfg.DataDir, mainDbFileName)
+		node.mainDb, err = dbOpenHandle(node.dbSystemDSN(mainDbURL))
+		if err == nil {
+			dbCheckReadable(node.mainDb, mainDbURL)
 		}
+	} else {
+		node.mainDb, err = dbOpenHandle(mainDbURL)
 	}
-	if !dbTableExists(mainDb, "config") {
-		_, err = mainDb.Exec(configTableCreate)
-		if err != nil {
-			log.Panic(err)
-		}
+	if err != nil {
+		dbLog.Fatal(err)
 	}
-	if !dbTableExists(mainDb, "peers") {
-		_, err = mainDb.Exec(peersTableCreate)
-		if err != nil {
-			log.Panic(err)
-		}
-		for peer := range bootstrapPeers {
-			_, err = mainDb.Exec("INSERT INTO peers(address, time_added, permanent) VALUES (?, ?, ?)", peer, getNowUTC(), true)
-			if err != nil {
-				log.Panic(err)
-			}
-		}
+	if err = node.dbMigrate(node.mainDb, "main", mainDbMigrations); err != nil {
+		dbLog.Fatal(err)
 	}
 
-	dbFileName = fmt.Sprintf("%s/%s", cfg.DataDir, privateDbFilename)
+	dbFileName := fmt.Sprintf("%s/%s", node.cfg.DataDir, privateDbFilename)
 	_, err = os.Stat(dbFileName)
 	privateDbExists := err == nil
-	privateDb, err = sql.Open("sqlite3", dbFileName)
+	node.privateDb, err = dbOpenHandle(node.dbSystemDSN(dbFileName))
 	if err != nil {
-		log.Fatal(err)
+		dbLog.Fatal(err)
+	}
+	dbCheckReadable(node.privateDb, dbFileName)
+	if err = node.dbMigrate(node.privateDb, "private", privateDbMigrations); err != nil {
+		dbLog.Fatal(err)
 	}
 	if !privateDbExists {
-		// Create tables
-		_, err = privateDb.Exec(privateTableCreate)
-		if err != nil {
-			log.Fatal(err)
-		}
 		err = os.Chmod(dbFileName, 0600)
 		if err != nil {
-			log.Fatalf("chmod: %v", err)
+			dbLog.Fatalf("chmod: %v", err)
 		}
 	}
 }
@@ -188,152 +193,303 @@ func dbOpen(fileName string, readOnly bool) (*sql.DB, error) {
 }
 
 // Counts the number of private keys in the system databases
-func dbNumPrivateKeys() int {
-	assertSysDbOpen()
+func (node *Node) dbNumPrivateKeys() int {
+	node.assertSysDbOpen()
 	var count int
-	err := privateDb.QueryRow("SELECT COUNT(*) FROM privkeys").Scan(&count)
+	err := node.privateDb.QueryRow("SELECT COUNT(*) FROM privkeys").Scan(&count)
 	if err != nil {
-		log.Fatal(err)
+		dbLog.Fatal(err)
 	}
 	return count
 }
 
-// Checks to see if a table exists in the given database
-func dbTableExists(db *sql.DB, name string) bool {
+// Counts the public keys which are valid signatories, i.e. not revoked
+func (node *Node) dbNumValidPublicKeys() int {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", name).Scan(&count)
+	err := node.mainDb.QueryRow("SELECT COUNT(*) FROM pubkeys WHERE time_revoked IS NULL").Scan(&count)
 	if err != nil {
-		log.Panicln(err)
+		dbLog.Fatal(err)
+	}
+	return count
+}
+
+// Returns the total weight of the valid public keys which can sign key ops at the given height
+func (node *Node) dbGetKeyOpWeight(height int) (int, error) {
+	_, weight, err := node.dbGetKeyOpSignatories(height)
+	return weight, err
+}
+
+// Returns the number of the keys which can sign key ops at the given height, and their total
+// weight
+func (node *Node) dbGetKeyOpSignatories(height int) (count int, weight int, err error) {
+	rows, err := node.mainDb.Query("SELECT COALESCE(metadata, ''), block_height FROM pubkeys WHERE time_revoked IS NULL")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metadataJSON string
+		var addHeight int
+		if err = rows.Scan(&metadataJSON, &addHeight); err != nil {
+			return 0, 0, err
+		}
+		var metadata map[string]string
+		if metadataJSON != "" {
+			if err = json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+				return 0, 0, err
+			}
+		}
+		if keyCanSignKeyOps(metadata) && keyCheckActive(addHeight, metadata, height) == nil {
+			count++
+			weight += keyWeight(metadata)
+		}
 	}
-	return count > 0
+	return count, weight, rows.Err()
+}
+
+// dbRowsQueryer is implemented by *sql.DB, *sql.Tx and *BlockDB
+type dbRowsQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// dbQueryer is implemented by both *sql.DB and *sql.Tx
+type dbQueryer interface {
+	dbRowsQueryer
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Checks to see if a table exists in the given database
+func dbTableExists(db dbQueryer, name string) (bool, error) {
+	var count int
+	err := db.QueryRow(dbDialectOf(db).tableExistsQuery(), name).Scan(&count)
+	return count > 0, err
+}
+
+// Checks to see if an index exists in the database
+func dbIndexExists(db dbQueryer, name string) (bool, error) {
+	var count int
+	err := db.QueryRow(dbDialectOf(db).indexExistsQuery(), name).Scan(&count)
+	return count > 0, err
+}
+
+// Checks to see if a column exists in the given table
+func dbColumnExists(db dbQueryer, table string, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(dbDialectOf(db).columnExistsQuery(), table, column).Scan(&count)
+	return count > 0, err
+}
+
+// Quotes a table or column name for use in SQL statements
+func dbQuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
 }
 
 // Panics if the system databases are not open
-func assertSysDbOpen() {
-	if mainDb == nil || privateDb == nil {
+func (node *Node) assertSysDbOpen() {
+	if node.mainDb == nil || node.privateDb == nil {
 		log.Panic("Databases are not open")
 	}
 }
 
 // Checks if a public key is present in the system databases
-func dbPublicKeyExists(hash string) bool {
+func (node *Node) dbPublicKeyExists(hash string) (bool, error) {
 	var count int
-	if err := mainDb.QueryRow("SELECT COUNT(*) FROM pubkeys WHERE pubkey_hash=?", hash).Scan(&count); err != nil {
-		log.Panicln(err)
-	}
-	return count > 0
+	err := node.mainDb.QueryRow("SELECT CASE WHEN EXISTS (SELECT 1 FROM pubkeys WHERE pubkey_hash=?) THEN 1 ELSE 0 END", hash).Scan(&count)
+	return count > 0, err
 }
 
-// Writes a public key to the system databases
-func dbWritePublicKey(pubkey []byte, hash string, blockHeight int) {
-	_, err := mainDb.Exec("INSERT INTO pubkeys(pubkey_hash, pubkey, state, time_added, block_height) VALUES (?, ?, ?, ?, ?)",
+// Writes a public key to the main database, or the transaction on it
+func dbWritePublicKey(db dbQueryer, pubkey []byte, hash string, blockHeight int) error {
+	_, err := db.Exec("INSERT INTO pubkeys(pubkey_hash, pubkey, state, time_added, block_height) VALUES (?, ?, ?, ?, ?)",
 		hash, hex.EncodeToString(pubkey), "A", time.Now().Unix(), blockHeight)
-	if err != nil {
-		log.Panic(err)
-	}
+	return err
 }
 
 // Marks a public key as revoked.
-func dbRevokePublicKey(hash string) {
-	_, err := mainDb.Exec("UPDATE pubkeys SET time_revoked=? WHERE pubkey_hash=?", getNowUTC(), hash)
-	if err != nil {
-		log.Panic(err)
+func dbRevokePublicKey(db dbQueryer, hash string) error {
+	_, err := db.Exec("UPDATE pubkeys SET time_revoked=? WHERE pubkey_hash=?", getNowUTC(), hash)
+	return err
+}
+
+// Deletes a public key from the system databases, e.g. when the block which has added it is rolled back.
+func (node *Node) dbDeletePublicKey(hash string) error {
+	_, err := node.mainDb.Exec("DELETE FROM pubkeys WHERE pubkey_hash=?", hash)
+	return err
+}
+
+// Clears the revoked status of a public key, e.g. when the block which has revoked it is rolled back.
+func (node *Node) dbUnrevokePublicKey(hash string) error {
+	_, err := node.mainDb.Exec("UPDATE pubkeys SET time_revoked=NULL WHERE pubkey_hash=?", hash)
+	return err
+}
+
+// Sets the metadata of a public key in the main database, or the transaction on it
+func dbSetPublicKeyMetadata(db dbQueryer, hash string, metadata map[string]string) error {
+	var metadataJSON interface{}
+	if len(metadata) > 0 {
+		metadataJSON = string(jsonifyWhateverToBytes(metadata))
 	}
+	_, err := db.Exec("UPDATE pubkeys SET metadata=? WHERE pubkey_hash=?", metadataJSON, hash)
+	return err
 }
 
-// Writes the given private key byte blob to the system databases
-func dbWritePrivateKey(privkey []byte, hash string) {
-	_, err := privateDb.Exec("INSERT INTO privkeys(pubkey_hash, privkey, time_added) VALUES (?, ?, ?)", hash, hex.EncodeToString(privkey), time.Now().Unix())
+// Queues the metadata of one of my keys, to be published in the next block I sign
+func (node *Node) dbQueuePendingKeyMetadata(hash string, metadataJSON string) error {
+	_, err := node.privateDb.Exec("INSERT OR REPLACE INTO pending_key_metadata(pubkey_hash, metadata) VALUES (?, ?)", hash, metadataJSON)
+	return err
+}
+
+// Returns the queued key metadata, as a map of public key hashes to metadata JSON
+func (node *Node) dbGetPendingKeyMetadata() (map[string]string, error) {
+	result := map[string]string{}
+	rows, err := node.privateDb.Query("SELECT pubkey_hash, metadata FROM pending_key_metadata")
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, metadataJSON string
+		if err = rows.Scan(&hash, &metadataJSON); err != nil {
+			return nil, err
+		}
+		result[hash] = metadataJSON
+	}
+	return result, rows.Err()
+}
+
+// Removes the queued key metadata once it's been published, unless it has been changed since
+func (node *Node) dbClearPendingKeyMetadata(hash string, metadataJSON string) error {
+	_, err := node.privateDb.Exec("DELETE FROM pending_key_metadata WHERE pubkey_hash=? AND metadata=?", hash, metadataJSON)
+	return err
+}
+
+// Writes the given private key byte blob to the system databases
+func (node *Node) dbWritePrivateKey(privkey []byte, hash string) error {
+	_, err := node.privateDb.Exec("INSERT INTO privkeys(pubkey_hash, privkey, time_added) VALUES (?, ?, ?)", hash, hex.EncodeToString(privkey), time.Now().Unix())
+	return err
 }
 
 // Returns a list of public keys hashes corresponding to private keys in the system databases
-func dbGetMyPublicKeyHashes() []string {
-	var result []string
-	rows, err := privateDb.Query("SELECT pubkey_hash FROM privkeys")
+func (node *Node) dbGetMyPublicKeyHashes() ([]string, error) {
+	return dbQueryStrings(node.privateDb, "SELECT pubkey_hash FROM privkeys ORDER BY time_added, pubkey_hash")
+}
+
+// Returns a map of public key hashes to names, for my named keys
+func (node *Node) dbGetMyKeyNames() (map[string]string, error) {
+	result := map[string]string{}
+	rows, err := node.privateDb.Query("SELECT pubkey_hash, name FROM privkeys WHERE name IS NOT NULL")
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var pubkeyHash string
-		err := rows.Scan(&pubkeyHash)
-		if err != nil {
-			log.Panic(err)
+		var pubkeyHash, name string
+		if err = rows.Scan(&pubkeyHash, &name); err != nil {
+			return nil, err
 		}
-		result = append(result, pubkeyHash)
+		result[pubkeyHash] = name
 	}
-	return result
+	return result, rows.Err()
 }
 
-// Returns the current blockchain height
-func dbGetBlockchainHeight() int {
-	assertSysDbOpen()
-	var height int
-	err := mainDb.QueryRow("SELECT COALESCE(MAX(height), -1) FROM blockchain").Scan(&height)
+// Sets the name of one of my keys. An empty name removes it.
+func (node *Node) dbSetPrivateKeyName(publicKeyHash string, name string) error {
+	var res sql.Result
+	var err error
+	if name == "" {
+		res, err = node.privateDb.Exec("UPDATE privkeys SET name=NULL WHERE pubkey_hash=?", publicKeyHash)
+	} else {
+		res, err = node.privateDb.Exec("UPDATE privkeys SET name=? WHERE pubkey_hash=?", name, publicKeyHash)
+	}
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No private key for %s", publicKeyHash)
+	}
+	return nil
+}
+
+// Returns the public key hash of my key with the given name or public key hash
+func (node *Node) dbFindPrivateKeyHash(nameOrHash string) (string, error) {
+	var publicKeyHash string
+	err := node.privateDb.QueryRow("SELECT pubkey_hash FROM privkeys WHERE pubkey_hash=? OR name=?", nameOrHash, nameOrHash).Scan(&publicKeyHash)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("No private key named %s", nameOrHash)
 	}
-	return height
+	return publicKeyHash, err
+}
+
+// Returns the current blockchain height
+func (node *Node) dbGetBlockchainHeight() (int, error) {
+	node.assertSysDbOpen()
+	var height int
+	err := node.mainDb.QueryRow("SELECT COALESCE(MAX(height), -1) FROM blockchain").Scan(&height)
+	return height, err
 }
 
 // Returns a map of heights and hashes for the requested range of block heights
-func dbGetHeightHashes(minHeight, maxHeight int) map[int]string {
-	rows, err := mainDb.Query("SELECT height, hash FROM blockchain WHERE height BETWEEN ? AND ? ORDER BY height", minHeight, maxHeight)
+func (node *Node) dbGetHeightHashes(minHeight, maxHeight int) (map[int]string, error) {
+	rows, err := node.mainDb.Query("SELECT height, hash FROM blockchain WHERE height BETWEEN ? AND ? ORDER BY height", minHeight, maxHeight)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	defer func() {
-		err = rows.Close()
-		if err != nil {
-			log.Fatalf("dbGetHeightHashes rows.Close: %v", err)
-		}
-	}()
+	defer rows.Close()
 	hh := make(map[int]string)
 	for rows.Next() {
 		var height int
 		var hash string
 		if err = rows.Scan(&height, &hash); err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 		hh[height] = hash
 	}
-	return hh
+	return hh, rows.Err()
 }
 
-// Returns a random private key from the system databases
-func dbGetAPrivateKey() ([]byte, string, error) {
+// Returns the oldest private key from the system databases
+func (node *Node) dbGetAPrivateKey() ([]byte, string, error) {
 	var publicKeyHash string
 	var privateKey string
-	err := privateDb.QueryRow("SELECT pubkey_hash, privkey FROM privkeys LIMIT 1").Scan(&publicKeyHash, &privateKey)
+	err := node.privateDb.QueryRow("SELECT pubkey_hash, privkey FROM privkeys ORDER BY time_added, pubkey_hash LIMIT 1").Scan(&publicKeyHash, &privateKey)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatal(err)
+		dbLog.Fatal(err)
 	}
 	if err == sql.ErrNoRows {
 		return nil, "", err
 	}
 	privateKeyBytes, err := hex.DecodeString(privateKey)
 	if err != nil {
-		log.Println(err)
+		dbLog.Warn(err)
 		return nil, "", err
 	}
 	return privateKeyBytes, publicKeyHash, nil
 }
 
+// Returns the private key for the given public key hash from the system databases
+func (node *Node) dbGetPrivateKey(publicKeyHash string) ([]byte, error) {
+	var privateKey string
+	err := node.privateDb.QueryRow("SELECT privkey FROM privkeys WHERE pubkey_hash=?", publicKeyHash).Scan(&privateKey)
+	if err != nil && err != sql.ErrNoRows {
+		dbLog.Fatal(err)
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("No private key for %s", publicKeyHash)
+	}
+	return hex.DecodeString(privateKey)
+}
+
 // Returns the public key corresponding to the given public key hash, by reading it from the system databases.
-func dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
+func (node *Node) dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
 	var dbpk DbPubKey
 	var publicKeyHexString string
 	var timeAdded int
 	var timeRevoked int
 	var metadata string
-	err := mainDb.QueryRow("SELECT pubkey_hash, pubkey, state, time_added, COALESCE(time_revoked, -1), COALESCE(metadata, ''), block_height FROM pubkeys WHERE pubkey_hash=?", publicKeyHash).Scan(
+	err := node.mainDb.QueryRow("SELECT pubkey_hash, pubkey, state, time_added, COALESCE(time_revoked, -1), COALESCE(metadata, ''), block_height FROM pubkeys WHERE pubkey_hash=?", publicKeyHash).Scan(
 		&dbpk.publicKeyHash, &publicKeyHexString, &dbpk.state, &timeAdded, &timeRevoked, &metadata, &dbpk.addBlockHeight)
-	if err != nil && err != sql.ErrNoRows {
-		log.Panicln(err)
-	}
-	if err == sql.ErrNoRows {
+	if err != nil {
 		return nil, err
 	}
 	dbpk.publicKeyBytes, err = hex.DecodeString(publicKeyHexString)
@@ -347,7 +503,7 @@ func dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
 	if timeRevoked != -1 {
 		dbpk.timeRevoked = unixTimeStampToUTCTime(timeRevoked)
 		if err != nil {
-			log.Println("Public key timeRevoked parsing failed for", publicKeyHash)
+			dbLog.Error("Public key timeRevoked parsing failed for", publicKeyHash)
 			return nil, err
 		}
 		dbpk.isRevoked = true
@@ -357,37 +513,32 @@ func dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
 	if metadata != "" {
 		err = json.Unmarshal([]byte(metadata), &dbpk.metadata)
 		if err != nil {
-			log.Println("Public key metadata unmarshall failed for", publicKeyHash)
+			dbLog.Error("Public key metadata unmarshall failed for", publicKeyHash)
 			return nil, err
 		}
 	}
 	return &dbpk, nil
 }
 
-// Returns a block hash by its height
-func dbGetBlockHashByHeight(height int) string {
+// Returns a block hash by its height, or "" if there is no such block
+func (node *Node) dbGetBlockHashByHeight(height int) (string, error) {
 	var hash string
-	err := mainDb.QueryRow("SELECT hash FROM blockchain WHERE height=?", height).Scan(&hash)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			log.Panicln(err)
-		}
+	err := node.mainDb.QueryRow("SELECT hash FROM blockchain WHERE height=?", height).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	return hash
+	return hash, err
 }
 
 // Returns a block indexed by the given height.
-func dbGetBlockByHeight(height int) (*DbBlockchainBlock, error) {
+func (node *Node) dbGetBlockByHeight(height int) (*DbBlockchainBlock, error) {
 	var dbb DbBlockchainBlock
 	var hashSignatureHex string
 	var prevHashSignatureHex string
 	var timeAccepted int
-	err := mainDb.QueryRow("SELECT hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version FROM blockchain WHERE height=?", height).Scan(
+	err := node.mainDb.QueryRow("SELECT hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version FROM blockchain WHERE height=?", height).Scan(
 		&dbb.Hash, &dbb.Height, &dbb.PreviousBlockHash, &dbb.SignaturePublicKeyHash, &hashSignatureHex, &prevHashSignatureHex, &timeAccepted, &dbb.Version)
-	if err != nil && err != sql.ErrNoRows {
-		log.Panicln(err)
-	}
-	if err == sql.ErrNoRows {
+	if err != nil {
 		return nil, err
 	}
 	dbb.PreviousBlockHashSignature, err = hex.DecodeString(prevHashSignatureHex)
@@ -399,24 +550,21 @@ func dbGetBlockByHeight(height int) (*DbBlockchainBlock, error) {
 		return nil, err
 	}
 	dbb.TimeAccepted = unixTimeStampToUTCTime(timeAccepted)
-	if err != nil {
+	if dbb.Cosignatures, err = node.dbGetBlockCosignatures(dbb.Hash); err != nil {
 		return nil, err
 	}
 	return &dbb, nil
 }
 
 // Returns a block of the given hash
-func dbGetBlock(hash string) (*DbBlockchainBlock, error) {
+func (node *Node) dbGetBlock(hash string) (*DbBlockchainBlock, error) {
 	var dbb DbBlockchainBlock
 	var hashSignatureHex string
 	var prevHashSignatureHex string
 	var timeAccepted int
-	err := mainDb.QueryRow("SELECT hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version FROM blockchain WHERE hash=?", hash).Scan(
+	err := node.mainDb.QueryRow("SELECT hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version FROM blockchain WHERE hash=?", hash).Scan(
 		&dbb.Hash, &dbb.Height, &dbb.PreviousBlockHash, &dbb.SignaturePublicKeyHash, &hashSignatureHex, &prevHashSignatureHex, &timeAccepted, &dbb.Version)
-	if err != nil && err != sql.ErrNoRows {
-		log.Panicln(err)
-	}
-	if err == sql.ErrNoRows {
+	if err != nil {
 		return nil, err
 	}
 	dbb.PreviousBlockHashSignature, err = hex.DecodeString(prevHashSignatureHex)
@@ -428,74 +576,315 @@ func dbGetBlock(hash string) (*DbBlockchainBlock, error) {
 		return nil, err
 	}
 	dbb.TimeAccepted = unixTimeStampToUTCTime(timeAccepted)
-	if err != nil {
+	if dbb.Cosignatures, err = node.dbGetBlockCosignatures(dbb.Hash); err != nil {
 		return nil, err
 	}
 	return &dbb, nil
 }
 
-// Tests if a block with the given hash exists in the db
-func dbBlockHashExists(hash string) bool {
-	var count int
-	err := mainDb.QueryRow("SELECT COUNT(*) FROM blockchain WHERE hash=?", hash).Scan(&count)
+// Returns up to limit blocks with heights above the given one, in the order of their heights.
+// If signer is not empty, only the blocks signed by that key are returned.
+func (node *Node) dbGetBlocksAfter(after int, limit int, signer string) ([]*DbBlockchainBlock, error) {
+	query := "SELECT hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version FROM blockchain WHERE height > ?"
+	args := []interface{}{after}
+	if signer != "" {
+		query += " AND sigkey_hash = ?"
+		args = append(args, signer)
+	}
+	query += " ORDER BY height LIMIT ?"
+	args = append(args, limit)
+	rows, err := node.mainDb.Query(query, args...)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+	var result []*DbBlockchainBlock
+	for rows.Next() {
+		var dbb DbBlockchainBlock
+		var hashSignatureHex, prevHashSignatureHex string
+		var timeAccepted int
+		if err = rows.Scan(&dbb.Hash, &dbb.Height, &dbb.PreviousBlockHash, &dbb.SignaturePublicKeyHash, &hashSignatureHex, &prevHashSignatureHex, &timeAccepted, &dbb.Version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if dbb.PreviousBlockHashSignature, err = hex.DecodeString(prevHashSignatureHex); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if dbb.HashSignature, err = hex.DecodeString(hashSignatureHex); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		dbb.TimeAccepted = unixTimeStampToUTCTime(timeAccepted)
+		result = append(result, &dbb)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
-	return count > 0
+	// The cosignatures are read after the rows are closed, as the database can be limited to
+	// a single connection
+	for _, dbb := range result {
+		if dbb.Cosignatures, err = node.dbGetBlockCosignatures(dbb.Hash); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
-// Tests if the block with the given height exists in the db
-func dbBlockHeightExists(h int) bool {
+// Tests if a block with the given hash exists in the db
+func (node *Node) dbBlockHashExists(hash string) (bool, error) {
 	var count int
-	err := mainDb.QueryRow("SELECT COUNT(*) FROM blockchain WHERE height=?", h).Scan(&count)
+	err := node.mainDb.QueryRow("SELECT CASE WHEN EXISTS (SELECT 1 FROM blockchain WHERE hash=?) THEN 1 ELSE 0 END", hash).Scan(&count)
+	return count > 0, err
+}
+
+// Returns the cosignatures of the block with the given hash
+func (node *Node) dbGetBlockCosignatures(hash string) ([]BlockSignature, error) {
+	rows, err := node.mainDb.Query("SELECT sigkey_hash, hash_signature FROM block_signatures WHERE hash=? ORDER BY sigkey_hash", hash)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	return count > 0
+	defer rows.Close()
+	var result []BlockSignature
+	for rows.Next() {
+		var sig BlockSignature
+		var signatureHex string
+		if err = rows.Scan(&sig.PublicKeyHash, &signatureHex); err != nil {
+			return nil, err
+		}
+		if sig.Signature, err = hex.DecodeString(signatureHex); err != nil {
+			return nil, err
+		}
+		result = append(result, sig)
+	}
+	return result, rows.Err()
 }
 
 // Inserts a block record into the main database, without validation
-func dbInsertBlock(dbb *DbBlockchainBlock) error {
-	_, err := mainDb.Exec("INSERT INTO blockchain (hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+func (node *Node) dbInsertBlock(dbb *DbBlockchainBlock) error {
+	tx, err := node.mainDb.Begin()
+	if err != nil {
+		return err
+	}
+	if err = dbInsertBlockTx(tx, dbb); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Inserts a block record in the transaction on the main database, without validation
+func dbInsertBlockTx(tx *dbTx, dbb *DbBlockchainBlock) error {
+	_, err := tx.Exec("INSERT INTO blockchain (hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
 		dbb.Hash, dbb.Height, dbb.PreviousBlockHash, dbb.SignaturePublicKeyHash, hex.EncodeToString(dbb.HashSignature), hex.EncodeToString(dbb.PreviousBlockHashSignature),
 		dbb.TimeAccepted.UTC().Unix(), dbb.Version)
+	if err != nil {
+		return err
+	}
+	for _, sig := range dbb.Cosignatures {
+		_, err = tx.Exec("INSERT INTO block_signatures (hash, sigkey_hash, hash_signature) VALUES (?, ?, ?)", dbb.Hash, sig.PublicKeyHash, hex.EncodeToString(sig.Signature))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the block record at the given height from the main database
+func (node *Node) dbDeleteBlockByHeight(height int) error {
+	_, err := node.mainDb.Exec("DELETE FROM block_signatures WHERE hash IN (SELECT hash FROM blockchain WHERE height=?)", height)
+	if err != nil {
+		return err
+	}
+	_, err = node.mainDb.Exec("DELETE FROM blockchain WHERE height=?", height)
 	return err
 }
 
-func dbClearSavedPeers() error {
-	_, err := mainDb.Exec("DELETE FROM peers")
+func (node *Node) dbClearSavedPeers() error {
+	_, err := node.mainDb.Exec("DELETE FROM peers")
 	return err
 }
 
 // Gets a list of saved p2p peer addresses
-func dbGetSavedPeers() peerStringMap {
+func (node *Node) dbGetSavedPeers() (peerStringMap, error) {
 	result := peerStringMap{}
-	rows, err := mainDb.Query("SELECT address, time_added FROM peers")
+	rows, err := node.mainDb.Query("SELECT address, time_added FROM peers")
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	defer func() {
-		err = rows.Close()
-		if err != nil {
-			log.Fatalf("dbGetSavedPeers rows.Close: %v", err)
-		}
-	}()
+	defer rows.Close()
 	for rows.Next() {
 		var tmInt int
 		var address string
 		if err = rows.Scan(&address, &tmInt); err != nil {
-			log.Println(err)
+			dbLog.Warn(err)
 			continue
 		}
 		result[address] = unixTimeStampToUTCTime(tmInt)
 	}
-	return result
+	return result, rows.Err()
 }
 
-// Saves a p2p peer address to the db
-func dbSavePeer(address string) {
-	_, err := mainDb.Exec("INSERT OR REPLACE INTO peers(address, time_added) VALUES (?, ?)", address, getNowUTC())
+// A row in the peers table
+type dbPeer struct {
+	address     string
+	timeAdded   time.Time
+	permanent   bool
+	lastSuccess time.Time // zero if never
+	lastFailure time.Time // zero if never
+	failCount   int
+	latency     time.Duration // zero if unknown
+	bannedUntil time.Time     // zero if not banned
+}
+
+const dbPeerColumns = "address, time_added, permanent, last_success, last_failure, fail_count, latency, banned_until"
+
+// Reads the rows of a query of dbPeerColumns
+func dbScanPeers(rows *sql.Rows) ([]dbPeer, error) {
+	defer rows.Close()
+	result := []dbPeer{}
+	for rows.Next() {
+		var p dbPeer
+		var tmInt int
+		var lastSuccess, lastFailure, latency, bannedUntil sql.NullInt64
+		if err := rows.Scan(&p.address, &tmInt, &p.permanent, &lastSuccess, &lastFailure, &p.failCount, &latency, &bannedUntil); err != nil {
+			dbLog.Warn(err)
+			continue
+		}
+		p.timeAdded = unixTimeStampToUTCTime(tmInt)
+		if lastSuccess.Valid {
+			p.lastSuccess = unixTimeStampToUTCTime(int(lastSuccess.Int64))
+		}
+		if lastFailure.Valid {
+			p.lastFailure = unixTimeStampToUTCTime(int(lastFailure.Int64))
+		}
+		if latency.Valid {
+			p.latency = time.Duration(latency.Int64) * time.Millisecond
+		}
+		if bannedUntil.Valid {
+			p.bannedUntil = unixTimeStampToUTCTime(int(bannedUntil.Int64))
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// Gets all the saved p2p peers, with their metadata
+func (node *Node) dbGetSavedPeerRecords() ([]dbPeer, error) {
+	rows, err := node.mainDb.Query("SELECT " + dbPeerColumns + " FROM peers ORDER BY address")
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	return dbScanPeers(rows)
+}
+
+// Returns the time the peer was last seen, by this node or by the peer which shared its address
+func (p *dbPeer) lastSeen() time.Time {
+	if p.lastSuccess.After(p.timeAdded) {
+		return p.lastSuccess
+	}
+	return p.timeAdded
+}
+
+// Deletes the saved p2p peers which aren't permanent, haven't been seen since the given time,
+// and have failed to connect since they were last seen
+func (node *Node) dbDeleteStalePeers(before time.Time) (int64, error) {
+	// No MAX(a, b) in PostgreSQL
+	lastSeen := "CASE WHEN COALESCE(last_success, 0) > time_added THEN last_success ELSE time_added END"
+	res, err := node.mainDb.Exec(fmt.Sprintf("DELETE FROM peers WHERE NOT permanent AND %s < ? AND COALESCE(last_failure, 0) > %s", lastSeen, lastSeen), before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Gets the saved p2p peers which aren't banned, the most reliable first: the ones with the
+// fewest recent failures, then the ones most recently connected to, then the fastest ones.
+func (node *Node) dbGetPeerCandidates() ([]dbPeer, error) {
+	rows, err := node.mainDb.Query("SELECT "+dbPeerColumns+` FROM peers WHERE banned_until IS NULL OR banned_until <= ?
+		ORDER BY fail_count, COALESCE(last_success, 0) DESC, COALESCE(latency, 2147483647), address`, getNowUTC())
+	if err != nil {
+		return nil, err
+	}
+	return dbScanPeers(rows)
+}
+
+// Records a successful connection to a saved peer. The failures are only cleared when the
+// connection has lasted long enough, see dbClearPeerFailures.
+func (node *Node) dbRecordPeerSuccess(address string, latency time.Duration) error {
+	_, err := node.mainDb.Exec("UPDATE peers SET last_success=?, latency=?, banned_until=NULL WHERE address=?",
+		getNowUTC(), latency.Milliseconds(), address)
+	return err
+}
+
+// Clears the consecutive failures of a saved peer
+func (node *Node) dbClearPeerFailures(address string) error {
+	_, err := node.mainDb.Exec("UPDATE peers SET fail_count=0 WHERE address=?", address)
+	return err
+}
+
+// Records a failed connection to a saved peer, and bans it for a time which doubles with
+// each consecutive failure, from p2pPeerBackoffMin up to p2pPeerBackoffMax.
+func (node *Node) dbRecordPeerFailure(address string) error {
+	tx, err := node.mainDb.Begin()
+	if err != nil {
+		return err
+	}
+	var failCount int
+	err = tx.QueryRow("SELECT fail_count FROM peers WHERE address=?", address).Scan(&failCount)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	failCount++
+	now := getNowUTC()
+	_, err = tx.Exec("UPDATE peers SET last_failure=?, fail_count=?, banned_until=? WHERE address=?",
+		now, failCount, now+int64(p2pPeerBackoff(failCount)/time.Second), address)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Bans a saved peer until the given time
+func (node *Node) dbBanPeer(address string, until time.Time) error {
+	_, err := node.mainDb.Exec("UPDATE peers SET banned_until=? WHERE address=?", until.Unix(), address)
+	return err
+}
+
+// Saves a p2p peer with its metadata to the db, keeping the newer time and the permanent flag
+// if the peer already exists.
+func (node *Node) dbSavePeerRecord(p dbPeer) error {
+	_, err := node.mainDb.Exec(`INSERT INTO peers(address, time_added, permanent) VALUES (?, ?, ?)
+		ON CONFLICT(address) DO UPDATE SET time_added=CASE WHEN excluded.time_added > peers.time_added THEN excluded.time_added ELSE peers.time_added END,
+		permanent=(peers.permanent OR excluded.permanent)`,
+		p.address, p.timeAdded.Unix(), p.permanent)
+	return err
+}
+
+// Returns the value of the key in the config table, or an empty string if it isn't set
+func (node *Node) dbGetConfigValue(key string) (string, error) {
+	var value string
+	err := node.mainDb.QueryRow("SELECT value FROM config WHERE key=?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// Sets the value of the key in the config table
+func (node *Node) dbSetConfigValue(key, value string) error {
+	_, err := node.mainDb.Exec("INSERT INTO config(key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value", key, value)
+	return err
+}
+
+// Saves a p2p peer address to the db
+func (node *Node) dbSavePeer(address string) error {
+	_, err := node.mainDb.Exec("INSERT INTO peers(address, time_added) VALUES (?, ?) ON CONFLICT(address) DO UPDATE SET time_added=excluded.time_added", address, getNowUTC())
+	return err
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+/*
+ * The main database (the blockchain, pubkeys, peers and config tables) can be kept in SQLite,
+ * in the data directory, or in PostgreSQL, for deployments which need replication or external
+ * readers. The private database and the block files are always local SQLite databases.
+ *
+ * The SQL in db.go is written for both: queries use ? placeholders, which dbHandle and dbTx
+ * rewrite for the database, and the schema checks go through the dbDialect.
+ */
+
+// dbDialect describes the differences between the supported databases
+type dbDialect interface {
+	name() string
+	rebind(query string) string
+	tableExistsQuery() string  // with the table name as the argument
+	indexExistsQuery() string  // with the index name as the argument
+	columnExistsQuery() string // with the table and column names as arguments
+}
+
+type dbDialectSQLite struct{}
+
+func (dbDialectSQLite) name() string               { return "sqlite3" }
+func (dbDialectSQLite) rebind(query string) string { return query }
+func (dbDialectSQLite) tableExistsQuery() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?"
+}
+func (dbDialectSQLite) indexExistsQuery() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name=?"
+}
+func (dbDialectSQLite) columnExistsQuery() string {
+	return "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?"
+}
+
+type dbDialectPostgres struct{}
+
+func (dbDialectPostgres) name() string { return "postgres" }
+
+// Replaces the ? placeholders with $1, $2... outside of string literals and quoted identifiers
+func (dbDialectPostgres) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+func (dbDialectPostgres) tableExistsQuery() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=current_schema() AND table_name=?"
+}
+func (dbDialectPostgres) indexExistsQuery() string {
+	return "SELECT COUNT(*) FROM pg_indexes WHERE schemaname=current_schema() AND indexname=?"
+}
+func (dbDialectPostgres) columnExistsQuery() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=? AND column_name=?"
+}
+
+// Returns the dialect for a main database URL: PostgreSQL URLs start with postgres:// or
+// postgresql://, anything else is a SQLite file name.
+func dbDialectForURL(url string) dbDialect {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		return dbDialectPostgres{}
+	}
+	return dbDialectSQLite{}
+}
+
+// dbHandle is a database with its dialect, rewriting the queries for it
+type dbHandle struct {
+	*sql.DB
+	dialect dbDialect
+}
+
+// Opens the database at the given URL or file name
+func dbOpenHandle(url string) (*dbHandle, error) {
+	d := dbDialectForURL(url)
+	db, err := sql.Open(d.name(), url)
+	if err != nil {
+		return nil, err
+	}
+	return &dbHandle{DB: db, dialect: d}, nil
+}
+
+func (h *dbHandle) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return h.DB.Exec(h.dialect.rebind(query), args...)
+}
+
+func (h *dbHandle) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return h.DB.Query(h.dialect.rebind(query), args...)
+}
+
+func (h *dbHandle) QueryRow(query string, args ...interface{}) *sql.Row {
+	return h.DB.QueryRow(h.dialect.rebind(query), args...)
+}
+
+func (h *dbHandle) Begin() (*dbTx, error) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, dialect: h.dialect}, nil
+}
+
+func (h *dbHandle) getDialect() dbDialect {
+	return h.dialect
+}
+
+// dbTx is a transaction with its dialect, rewriting the queries for it
+type dbTx struct {
+	*sql.Tx
+	dialect dbDialect
+}
+
+func (tx *dbTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) getDialect() dbDialect {
+	return tx.dialect
+}
+
+// Returns the dialect of the database, SQLite unless it's a dbHandle or a dbTx
+func dbDialectOf(db dbQueryer) dbDialect {
+	if d, ok := db.(interface{ getDialect() dbDialect }); ok {
+		return d.getDialect()
+	}
+	return dbDialectSQLite{}
+}
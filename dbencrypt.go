@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+ * The system databases can be encrypted at rest with SQLCipher, for nodes on shared or portable
+ * hardware. This needs a binary built with "-tags sqlcipher". The passphrase is read from the
+ * DAISY_DB_PASSPHRASE environment variable, or from the file given with -db-passphrase-file.
+ * The blocks are public, so they're never encrypted.
+ */
+
+const dbPassphraseEnv = "DAISY_DB_PASSPHRASE"
+
+// Returns the passphrase of the system databases, or "" if they aren't encrypted
+func (node *Node) dbGetPassphrase() string {
+	if p := os.Getenv(dbPassphraseEnv); p != "" {
+		return p
+	}
+	if node.cfg.DbPassphraseFile == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(node.cfg.DbPassphraseFile)
+	if err != nil {
+		log.Fatalln("Cannot read the database passphrase:", err)
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// Returns the DSN for opening a local system database, with the passphrase if there is one
+func (node *Node) dbSystemDSN(fileName string) string {
+	passphrase := node.dbGetPassphrase()
+	if passphrase == "" {
+		return fileName
+	}
+	if !dbEncryptionSupported {
+		log.Fatalln("A database passphrase is configured, but this build of daisy doesn't support encryption. Build it with: go build -tags sqlcipher")
+	}
+	return fmt.Sprintf("%s?%s", fileName, dbEncryptionDSNParams(passphrase))
+}
+
+// Checks that the database can be read, which fails if the passphrase is wrong or missing
+func dbCheckReadable(db *dbHandle, fileName string) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&count); err != nil {
+		log.Fatalln("Cannot read", fileName, "- is the database passphrase correct?", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Periodic maintenance of the local system databases: PRAGMA optimize, an integrity check, and
+ * a VACUUM if enough of the database is free pages. It's started by the p2p coordinator when
+ * the node is idle (no new blocks for a while, and not syncing), at most once per
+ * db_maintenance_interval, and the results are reported in the node status.
+ */
+
+// The default time between maintenance runs
+const dbMaintenanceDefaultInterval = 24 * time.Hour
+
+// How long the node must be without new blocks to be considered idle
+const dbMaintenanceIdleTime = 5 * time.Minute
+
+// The fraction of free pages above which the database is vacuumed
+const dbMaintenanceVacuumThreshold = 0.1
+
+// dbMaintenanceResult is the outcome of the maintenance of one database
+type dbMaintenanceResult struct {
+	Database  string `json:"database"`
+	Integrity string `json:"integrity"` // "ok", or the problems found
+	Vacuumed  bool   `json:"vacuumed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// dbMaintenanceReport is the outcome of the last maintenance run
+type dbMaintenanceReport struct {
+	Time     time.Time             `json:"time"`
+	Duration string                `json:"duration"`
+	Results  []dbMaintenanceResult `json:"results"`
+}
+
+// OK returns true if all the databases have passed the maintenance
+func (r *dbMaintenanceReport) OK() bool {
+	for _, res := range r.Results {
+		if res.Integrity != "ok" || res.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the configured time between maintenance runs, or 0 if maintenance is disabled
+func (node *Node) dbMaintenanceInterval() time.Duration {
+	if node.cfg.DbMaintenanceInterval == "" {
+		return dbMaintenanceDefaultInterval
+	}
+	d, err := time.ParseDuration(node.cfg.DbMaintenanceInterval)
+	if err != nil {
+		log.Println("Invalid db_maintenance_interval, using the default:", err)
+		return dbMaintenanceDefaultInterval
+	}
+	return d
+}
+
+// Returns the report of the last maintenance run, or nil if there hasn't been one
+func (node *Node) dbGetMaintenanceReport() (r *dbMaintenanceReport) {
+	node.dbMaintenance.lock.With(func() {
+		r = node.dbMaintenance.last
+	})
+	return
+}
+
+// Starts the maintenance in the background if it's due, unless it's already running
+func (node *Node) dbMaintenanceStartIfDue() {
+	interval := node.dbMaintenanceInterval()
+	if interval <= 0 {
+		return
+	}
+	due := false
+	node.dbMaintenance.lock.With(func() {
+		// The first run is a full interval after the start
+		if node.dbMaintenance.lastRun.IsZero() {
+			node.dbMaintenance.lastRun = time.Now()
+		}
+		due = time.Since(node.dbMaintenance.lastRun) >= interval
+	})
+	if !due || !atomic.CompareAndSwapInt32(&node.dbMaintenance.running, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&node.dbMaintenance.running, 0)
+		r := node.dbRunMaintenance()
+		node.dbMaintenance.lock.With(func() {
+			node.dbMaintenance.last = r
+			node.dbMaintenance.lastRun = time.Now()
+		})
+	}()
+}
+
+// Runs the maintenance on the local system databases
+func (node *Node) dbRunMaintenance() *dbMaintenanceReport {
+	r := &dbMaintenanceReport{Time: time.Now().UTC()}
+	start := time.Now()
+	if node.cfg.MainDbURL == "" {
+		r.Results = append(r.Results, dbMaintain(mainDbFileName, node.mainDb))
+	}
+	r.Results = append(r.Results, dbMaintain(privateDbFilename, node.privateDb))
+	r.Duration = time.Since(start).Round(time.Millisecond).String()
+	if r.OK() {
+		log.Println("Database maintenance finished in", r.Duration)
+	} else {
+		log.Println("ERROR: Database maintenance found problems:", jsonifyWhatever(r.Results))
+	}
+	return r
+}
+
+// Optimizes, checks and if needed vacuums one database
+func dbMaintain(name string, db *dbHandle) (res dbMaintenanceResult) {
+	res.Database = name
+	if _, err := db.Exec("PRAGMA optimize"); err != nil {
+		res.Error = err.Error()
+		return
+	}
+	problems, err := dbQueryStrings(db, "PRAGMA integrity_check")
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	res.Integrity = strings.Join(problems, "; ")
+	if res.Integrity != "ok" {
+		// Vacuuming a damaged database could make things worse
+		return
+	}
+	var pages, free int
+	if err = db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		res.Error = err.Error()
+		return
+	}
+	if err = db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		res.Error = err.Error()
+		return
+	}
+	if pages > 0 && float64(free)/float64(pages) > dbMaintenanceVacuumThreshold {
+		log.Printf("Vacuuming %s (%d of %d pages free)", name, free, pages)
+		if _, err = db.Exec("VACUUM"); err != nil {
+			res.Error = err.Error()
+			return
+		}
+		res.Vacuumed = true
+	}
+	return
+}
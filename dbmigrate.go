@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+/*
+ * The schemas of the system databases are versioned. The version is kept under the
+ * schema_version key in each database's config table, and dbInit applies the migrations with
+ * higher versions, in order, each in its own transaction. Databases created before the
+ * versioning have no schema_version, so the first migrations check for what already exists.
+ *
+ * To change a schema, append a migration to the list; never modify or reorder the existing ones.
+ */
+
+const dbSchemaVersionKey = "schema_version"
+
+// dbMigration is one step in the evolution of a database schema
+type dbMigration struct {
+	version     int
+	description string
+	apply       func(node *Node, tx *dbTx) error
+}
+
+// Migrations of the main database
+var mainDbMigrations = []dbMigration{
+	{1, "create the system tables", func(node *Node, tx *dbTx) error {
+		for _, t := range []struct{ name, create string }{
+			{"blockchain", blockchainTableCreate},
+			{"block_signatures", blockSignaturesTableCreate},
+			{"pubkeys", pubKeysTableCreate},
+		} {
+			exists, err := dbTableExists(tx, t.name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if _, err := tx.Exec(t.create); err != nil {
+				return err
+			}
+		}
+		if exists, err := dbTableExists(tx, "peers"); err != nil || exists {
+			return err
+		}
+		if _, err := tx.Exec(peersTableCreate); err != nil {
+			return err
+		}
+		for peer := range node.bootstrapPeers {
+			if _, err := tx.Exec("INSERT INTO peers(address, time_added, permanent) VALUES (?, ?, ?)", peer, getNowUTC(), true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{2, "index blocks by signer and height", func(node *Node, tx *dbTx) error {
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS blockchain_sigkey_hash_height ON blockchain(sigkey_hash, height)")
+		return err
+	}},
+	{3, "add covering indexes for the sync lookups", func(node *Node, tx *dbTx) error {
+		// The index of the height's UNIQUE constraint doesn't cover the hash, so the height and
+		// hash lookups during the sync had to read the table rows
+		for _, q := range []string{
+			"CREATE INDEX IF NOT EXISTS blockchain_height_hash ON blockchain(height, hash)",
+			"CREATE INDEX IF NOT EXISTS blockchain_prev_hash ON blockchain(prev_hash)",
+			"CREATE INDEX IF NOT EXISTS peers_time_added ON peers(time_added)",
+		} {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "track peer reliability", func(node *Node, tx *dbTx) error {
+		for _, c := range []struct{ name, def string }{
+			{"last_success", "BIGINT"},
+			{"last_failure", "BIGINT"},
+			{"fail_count", "INTEGER NOT NULL DEFAULT 0"},
+			{"latency", "INTEGER"},
+			{"banned_until", "BIGINT"},
+		} {
+			exists, err := dbColumnExists(tx, "peers", c.name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if _, err := tx.Exec("ALTER TABLE peers ADD COLUMN " + c.name + " " + c.def); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{5, "track the soft fork states", func(node *Node, tx *dbTx) error {
+		_, err := tx.Exec(softForksTableCreate)
+		return err
+	}},
+	{6, "record the equivocating keys", func(node *Node, tx *dbTx) error {
+		_, err := tx.Exec(equivocationsTableCreate)
+		return err
+	}},
+	{7, "record the anchors", func(node *Node, tx *dbTx) error {
+		_, err := tx.Exec(anchorsTableCreate)
+		return err
+	}},
+	{8, "record the notarizations", func(node *Node, tx *dbTx) error {
+		_, err := tx.Exec(notarizationsTableCreate)
+		return err
+	}},
+	{9, "record the notarization submitters", func(node *Node, tx *dbTx) error {
+		_, err := tx.Exec("ALTER TABLE notarizations ADD COLUMN " + notarizationsSubmitterColumn)
+		return err
+	}},
+}
+
+// Migrations of the private database
+var privateDbMigrations = []dbMigration{
+	{1, "create the private key tables", func(node *Node, tx *dbTx) error {
+		for _, t := range []struct{ name, create string }{
+			{"privkeys", privateTableCreate},
+			{"pending_key_metadata", pendingKeyMetadataTableCreate},
+		} {
+			exists, err := dbTableExists(tx, t.name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if _, err := tx.Exec(t.create); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{2, "add key names", func(node *Node, tx *dbTx) error {
+		if exists, err := dbColumnExists(tx, "privkeys", "name"); err != nil || exists {
+			return err
+		}
+		if _, err := tx.Exec("ALTER TABLE privkeys ADD COLUMN name VARCHAR"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("CREATE UNIQUE INDEX privkeys_name ON privkeys(name)")
+		return err
+	}},
+}
+
+// Returns the schema version of the database, 0 if it's not versioned yet
+func dbSchemaVersion(db dbQueryer) (int, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM config WHERE key=?", dbSchemaVersionKey).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Brings the database schema up to date by applying the migrations newer than its version
+func (node *Node) dbMigrate(db *dbHandle, name string, migrations []dbMigration) error {
+	exists, err := dbTableExists(db, "config")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.Exec(configTableCreate); err != nil {
+			return err
+		}
+	}
+	version, err := dbSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return fmt.Errorf("the %s database has schema version %d, newer than the supported %d", name, version, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if version > 0 {
+			log.Printf("Migrating the %s database to schema version %d: %s", name, m.version, m.description)
+		}
+		if err = node.dbApplyMigration(db, m); err != nil {
+			return fmt.Errorf("%s database migration %d (%s): %v", name, m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// Applies a single migration and records the new schema version, in a transaction
+func (node *Node) dbApplyMigration(db *dbHandle, m dbMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = m.apply(node, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO config(key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value", dbSchemaVersionKey, strconv.Itoa(m.version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
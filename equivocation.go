@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+/*
+ * Equivocation detection. A signatory which signs two different blocks extending the same
+ * previous block, i.e. at the same height, tries to fork the chain, and its key can't be
+ * trusted anymore. When the validation worker receives a block which conflicts with the local
+ * chain's block at its height, and both are signed by the same key, it keeps the conflicting
+ * block file in the block store and records both blocks' hashes and signatures in the
+ * equivocations table of the main database. Since the block hashes cover the blocks'
+ * PreviousBlockHash metadata, the two block files are the proof.
+ *
+ * The table is only advisory: the nodes don't all see the conflicting blocks, or see them at
+ * the same time, so the consensus rules can't depend on it without forking the chain. The key
+ * stays a valid signatory until the others revoke it on-chain with revokekey, and until then
+ * the policy stage warns about the blocks it signs.
+ *
+ * The evidence is sent to the peers with the equivocation message. A peer which has one of
+ * the two blocks in its chain checks the signatures of the hashes and asks for the other block,
+ * which goes through the same detection, and is in turn sent to its peers.
+ */
+
+// The message with the evidence of an equivocation
+const p2pMsgEquivocation = "equivocation"
+
+type p2pMsgEquivocationStruct struct {
+	p2pMsgHeader
+	PublicKeyHash  string    `json:"pubkey_hash"`
+	Height         int       `json:"height"`
+	Hashes         [2]string `json:"hashes"`
+	HashSignatures [2]string `json:"hash_signatures"`
+}
+
+const equivocationsTableCreate = `
+CREATE TABLE equivocations (
+	sigkey_hash		VARCHAR NOT NULL PRIMARY KEY,
+	height			INTEGER NOT NULL,
+	hash			VARCHAR NOT NULL, -- The block in the local chain
+	hash_signature		VARCHAR NOT NULL,
+	other_hash		VARCHAR NOT NULL, -- The conflicting block
+	other_hash_signature	VARCHAR NOT NULL,
+	time_detected		INTEGER NOT NULL
+);
+`
+
+// equivocation is the proof that a key has signed two blocks at the same height
+type equivocation struct {
+	PublicKeyHash      string    `json:"pubkey_hash"`
+	Height             int       `json:"height"`
+	Hash               string    `json:"hash"`
+	HashSignature      []byte    `json:"hash_signature"`
+	OtherHash          string    `json:"other_hash"`
+	OtherHashSignature []byte    `json:"other_hash_signature"`
+	TimeDetected       time.Time `json:"time_detected"`
+}
+
+// Records the proof of an equivocation. Returns false if the key's equivocation has already
+// been recorded.
+func (node *Node) dbInsertEquivocation(eq *equivocation) (bool, error) {
+	res, err := node.mainDb.Exec("INSERT INTO equivocations(sigkey_hash, height, hash, hash_signature, other_hash, other_hash_signature, time_detected) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(sigkey_hash) DO NOTHING",
+		eq.PublicKeyHash, eq.Height, eq.Hash, hex.EncodeToString(eq.HashSignature), eq.OtherHash, hex.EncodeToString(eq.OtherHashSignature), eq.TimeDetected.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Returns the recorded equivocations
+func (node *Node) dbGetEquivocations() ([]equivocation, error) {
+	rows, err := node.mainDb.Query("SELECT sigkey_hash, height, hash, hash_signature, other_hash, other_hash_signature, time_detected FROM equivocations ORDER BY height")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var eqs []equivocation
+	for rows.Next() {
+		var eq equivocation
+		var hashSignature, otherHashSignature string
+		var timeDetected int
+		if err = rows.Scan(&eq.PublicKeyHash, &eq.Height, &eq.Hash, &hashSignature, &eq.OtherHash, &otherHashSignature, &timeDetected); err != nil {
+			return nil, err
+		}
+		if eq.HashSignature, err = hex.DecodeString(hashSignature); err != nil {
+			return nil, err
+		}
+		if eq.OtherHashSignature, err = hex.DecodeString(otherHashSignature); err != nil {
+			return nil, err
+		}
+		eq.TimeDetected = unixTimeStampToUTCTime(timeDetected)
+		eqs = append(eqs, eq)
+	}
+	return eqs, rows.Err()
+}
+
+// Returns the conflicting block of an equivocation proof, which isn't in the local chain, so
+// it can be sent to the peers verifying the proof. Returns sql.ErrNoRows if there's no such block.
+func (node *Node) dbGetEquivocationBlock(hash string) (*DbBlockchainBlock, error) {
+	var dbb DbBlockchainBlock
+	var hashSignature string
+	err := node.mainDb.QueryRow("SELECT other_hash, height, sigkey_hash, other_hash_signature FROM equivocations WHERE other_hash=?", hash).Scan(
+		&dbb.Hash, &dbb.Height, &dbb.SignaturePublicKeyHash, &hashSignature)
+	if err != nil {
+		return nil, err
+	}
+	if !node.blockStore.Has(hash) {
+		return nil, sql.ErrNoRows
+	}
+	dbb.HashSignature, err = hex.DecodeString(hashSignature)
+	return &dbb, err
+}
+
+// Returns the height at which the key has been caught signing two blocks, or 0
+func (node *Node) dbGetEquivocationHeight(publicKeyHash string) (int, error) {
+	var height int
+	err := node.mainDb.QueryRow("SELECT height FROM equivocations WHERE sigkey_hash=?", publicKeyHash).Scan(&height)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return height, err
+}
+
+// Checks if the received block, whose file and creator's hash signature are given, conflicts
+// with the block at the same height in the local chain, signed by the same key. If it does, the
+// proof is recorded and sent to the peers, and true is returned.
+func (node *Node) equivocationCheckBlock(blk *Block, fileName string, hashSignature []byte) (bool, error) {
+	prevBlk, err := node.dbGetBlock(blk.PreviousBlockHash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	height := prevBlk.Height + 1
+	dbb, err := node.dbGetBlockByHeight(height)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if dbb.Hash == blk.Hash || dbb.SignaturePublicKeyHash != blk.SignaturePublicKeyHash {
+		return false, nil
+	}
+	dbpk, err := node.dbGetPublicKey(blk.SignaturePublicKeyHash)
+	if err != nil {
+		return false, nil
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		return false, err
+	}
+	hash, err := hex.DecodeString(blk.Hash)
+	if err != nil {
+		return false, err
+	}
+	if err = cryptoVerifyBytes(publicKey, hash, hashSignature); err != nil {
+		// Not signed by the key, so it's not an equivocation but an invalid block
+		return false, nil
+	}
+	if _, err = node.blockStore.Put(fileName); err != nil {
+		return false, err
+	}
+	eq := &equivocation{PublicKeyHash: blk.SignaturePublicKeyHash, Height: height, Hash: dbb.Hash, HashSignature: dbb.HashSignature,
+		OtherHash: blk.Hash, OtherHashSignature: hashSignature, TimeDetected: time.Now()}
+	isNew, err := node.dbInsertEquivocation(eq)
+	if err != nil || !isNew {
+		return true, err
+	}
+	fields := StrIfMap{"pubkey_hash": eq.PublicKeyHash, "height": height, "hash": eq.Hash, "other_hash": eq.OtherHash}
+	chainLog.Errorf("The key %s has signed two different blocks at height %d: %s and %s. It should be revoked with revokekey.",
+		eq.PublicKeyHash, height, eq.Hash, eq.OtherHash)
+	node.auditLog(auditKeyEquivocation, fields)
+	node.nodeEvents.Publish(eventKeyEquivocation, fields)
+	node.p2pBroadcastEquivocation(eq)
+	return true, nil
+}
+
+// Sends the evidence of the equivocation to all the peers
+func (node *Node) p2pBroadcastEquivocation(eq *equivocation) {
+	msg := p2pMsgEquivocationStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: node.p2pEphemeralID,
+			Root:  node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgEquivocation,
+		},
+		PublicKeyHash:  eq.PublicKeyHash,
+		Height:         eq.Height,
+		Hashes:         [2]string{eq.Hash, eq.OtherHash},
+		HashSignatures: [2]string{hex.EncodeToString(eq.HashSignature), hex.EncodeToString(eq.OtherHashSignature)},
+	}
+	node.p2pPeers.lock.With(func() {
+		for p2pc := range node.p2pPeers.peers {
+			p2pc.send(msg)
+		}
+	})
+}
+
+// equivocation: a peer sends the evidence that a key has signed two blocks at the same height
+func (p2pc *p2pConnection) handleEquivocation(msg StrIfMap) {
+	publicKeyHash, err := msg.GetString("pubkey_hash")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	height, err := msg.GetInt("height")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	hashes, err := msg.GetStringList("hashes")
+	if err != nil || len(hashes) != 2 {
+		p2pLog.Warn(p2pc.conn, "invalid hashes in the equivocation message", err)
+		return
+	}
+	hashSignatures, err := msg.GetStringList("hash_signatures")
+	if err != nil || len(hashSignatures) != 2 {
+		p2pLog.Warn(p2pc.conn, "invalid hash signatures in the equivocation message", err)
+		return
+	}
+	if eqHeight, err := p2pc.node.dbGetEquivocationHeight(publicKeyHash); err != nil || eqHeight != 0 {
+		// Already known
+		return
+	}
+	dbpk, err := p2pc.node.dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		p2pLog.Warn(p2pc.address, "has sent the evidence of an equivocation by an unknown key", publicKeyHash)
+		return
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		p2pLog.Error(err)
+		return
+	}
+	if hashes[0] == hashes[1] {
+		p2pLog.Warn(p2pc.address, "has sent the evidence of an equivocation with the same block twice")
+		p2pc.score.recordError()
+		return
+	}
+	for i := range hashes {
+		if err = cryptoVerifyHex(publicKey, hashes[i], hashSignatures[i]); err != nil {
+			p2pLog.Warn(p2pc.address, "has sent the evidence of an equivocation with an invalid signature:", err)
+			p2pc.score.recordError()
+			return
+		}
+	}
+	// The hash signatures don't prove that the blocks are at the same height: that's checked
+	// with the block which isn't in the local chain
+	myHash, err := p2pc.node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		p2pLog.Error(err)
+		return
+	}
+	switch myHash {
+	case hashes[0]:
+		p2pc.requestBlock(hashes[1], height)
+	case hashes[1]:
+		p2pc.requestBlock(hashes[0], height)
+	default:
+		p2pLog.Warn(p2pc.address, "has sent the evidence of an equivocation by", publicKeyHash, "at height", height,
+			"but neither block is in the local chain")
+	}
+}
+
+// Prints the recorded equivocations
+func (node *Node) actionEquivocations() {
+	eqs, err := node.dbGetEquivocations()
+	if err != nil {
+		chainLog.Fatal(err)
+	}
+	if len(eqs) == 0 {
+		fmt.Println("No equivocations have been detected")
+		return
+	}
+	for _, eq := range eqs {
+		fmt.Printf("%s\tat height %d\t%s vs %s\tdetected %s\n", eq.PublicKeyHash, eq.Height, eq.Hash, eq.OtherHash, eq.TimeDetected.Format(time.RFC3339))
+	}
+}
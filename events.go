@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The node's event bus. The modules publish what happens to the blockchain and the peers
+ * with nodeEvents.Publish(), and the consumers subscribe to the events they need: the
+ * coordinator (to announce new blocks and the sync progress), the miner (to stop mining on a
+ * new block), the WebSocket server, the webhooks and the metrics. Publishing never blocks, so
+ * the events can be published while holding locks: a subscriber which doesn't keep up loses
+ * events, which are counted.
+ */
+
+// Node events
+const (
+	eventBlockAccepted    = "block_accepted"
+	eventBlockRejected    = "block_rejected"
+	eventPeerConnected    = "peer_connected"
+	eventPeerDisconnected = "peer_disconnected"
+	eventSyncProgress     = "sync_progress"
+	eventChainDesync      = "chain_desync"   // A majority of the peers disagree with the local chain
+	eventChainResynced    = "chain_resynced" // The peers agree with the local chain again
+	eventBlockRolledBack  = "block_rolled_back"
+	eventKeyAdded         = "key_added"
+	eventKeyRevoked       = "key_revoked"
+	eventSoftFork         = "softfork"         // A soft fork has changed its state, see softforks.go
+	eventKeyEquivocation  = "key_equivocation" // A key has signed two blocks at the same height, see equivocation.go
+	eventBlockAnchored    = "block_anchored"   // The tip has been anchored to an external chain or log, see anchor.go
+)
+
+// All the events, for checking the configuration
+var nodeEventNames = []string{eventBlockAccepted, eventBlockRejected, eventPeerConnected, eventPeerDisconnected,
+	eventSyncProgress, eventChainDesync, eventChainResynced, eventBlockRolledBack, eventKeyAdded, eventKeyRevoked, eventSoftFork,
+	eventKeyEquivocation, eventBlockAnchored}
+
+// Events which are only sent to local subscribers, as they reveal the node's peers
+var nodeEventsLocalOnly = map[string]bool{
+	eventPeerConnected:    true,
+	eventPeerDisconnected: true,
+}
+
+// nodeEvent is an event delivered to subscribers
+type nodeEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  StrIfMap  `json:"data"`
+}
+
+// The number of events buffered for a subscriber before new events are dropped
+const nodeEventBufferSize = 64
+
+// nodeEventSubscriber receives the events it has subscribed to on its channel
+type nodeEventSubscriber struct {
+	events  chan nodeEvent
+	filter  map[string]bool // If empty, all events are delivered
+	isLocal bool
+	dropped int64 // Accessed atomically
+}
+
+type nodeEventHub struct {
+	lock        WithMutex
+	subscribers map[*nodeEventSubscriber]bool
+}
+
+// Adds a subscriber for the given events, or all events if none are given
+func (h *nodeEventHub) Subscribe(events []string, isLocal bool) *nodeEventSubscriber {
+	s := &nodeEventSubscriber{events: make(chan nodeEvent, nodeEventBufferSize), filter: map[string]bool{}, isLocal: isLocal}
+	for _, e := range events {
+		s.filter[e] = true
+	}
+	h.lock.With(func() {
+		h.subscribers[s] = true
+	})
+	return s
+}
+
+// Removes the subscriber
+func (h *nodeEventHub) Unsubscribe(s *nodeEventSubscriber) {
+	h.lock.With(func() {
+		delete(h.subscribers, s)
+	})
+}
+
+// Subscribes a module of the node to the given events, or all events if none are given, and
+// calls the handler for each of them in a new goroutine, for the lifetime of the node. The
+// events are handled one at a time, in the order they were published.
+func (h *nodeEventHub) Handle(name string, events []string, handler func(ev nodeEvent)) {
+	h.handle(name, h.Subscribe(events, true), handler)
+}
+
+// Like Handle, for the handlers which pass the events on outside the node, e.g. to webhooks,
+// and so don't get the local-only events
+func (h *nodeEventHub) HandleRemote(name string, events []string, handler func(ev nodeEvent)) {
+	h.handle(name, h.Subscribe(events, false), handler)
+}
+
+// Calls the handler for each of the subscriber's events, in a new goroutine
+func (h *nodeEventHub) handle(name string, s *nodeEventSubscriber, handler func(ev nodeEvent)) {
+	go func() {
+		var lastDropped int64
+		for ev := range s.events {
+			if dropped := atomic.LoadInt64(&s.dropped); dropped > lastDropped {
+				chainLog.Warn("The", name, "event handler has lost", dropped-lastDropped, "events")
+				lastDropped = dropped
+			}
+			handler(ev)
+		}
+	}()
+}
+
+// Delivers the event to the subscribers. Never blocks: subscribers which don't keep up lose
+// events.
+func (h *nodeEventHub) Publish(event string, data StrIfMap) {
+	ev := nodeEvent{Event: event, Time: time.Now().UTC(), Data: data}
+	h.lock.With(func() {
+		for s := range h.subscribers {
+			if len(s.filter) > 0 && !s.filter[event] {
+				continue
+			}
+			if nodeEventsLocalOnly[event] && !s.isLocal {
+				continue
+			}
+			select {
+			case s.events <- ev:
+			default:
+				atomic.AddInt64(&s.dropped, 1)
+			}
+		}
+	})
+}
+
+// Publishes the sync progress, while the node is behind its peers
+func (node *Node) publishSyncProgress() {
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		chainLog.Error("Cannot read the blockchain height:", err)
+		return
+	}
+	_, bestPeerHeight := node.p2pPeers.Stats()
+	if bestPeerHeight <= 0 {
+		return
+	}
+	progress := 100.0
+	if bestPeerHeight > height {
+		progress = float64(height) * 100 / float64(bestPeerHeight)
+	}
+	node.nodeEvents.Publish(eventSyncProgress, StrIfMap{"height": height, "best_peer_height": bestPeerHeight, "progress": progress})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Detached file signatures are the hex-encoded ASN.1 ECDSA signatures of the file's SHA256 hash
+const fileSignatureSuffix = ".sig"
+
+// Signs the file with the key selected by -key, writing the signature into a .sig file
+// next to it, and printing it together with the signer's public key hash.
+func (node *Node) actionSignFile(fn string) {
+	keypair, publicKeyHash, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hash, err := hashFileToHexString(fn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	signature, err := cryptoSignHex(keypair, hash)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = ioutil.WriteFile(fn+fileSignatureSuffix, []byte(signature+"\n"), 0644); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(signature, publicKeyHash)
+}
+
+// Verifies a detached signature of the file, made with the key with the given public key
+// hash. The signature can be given as a hex string, or as the name of a .sig file.
+func (node *Node) actionVerifyFile(fn string, sig string, publicKeyHash string) {
+	if fileExists(sig) {
+		data, err := ioutil.ReadFile(sig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sig = strings.TrimSpace(string(data))
+	}
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		log.Fatalln("Unknown public key", publicKeyHash)
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hash, err := hashFileToHexString(fn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = cryptoVerifyHex(publicKey, hash, sig); err != nil {
+		log.Fatalln("Signature verification failed:", err)
+	}
+	if dbpk.isRevoked {
+		log.Fatalln("The signature is valid, but the key", publicKeyHash, "has been revoked on", dbpk.timeRevoked)
+	}
+	fmt.Println("Signature OK, signed by", publicKeyHash)
+}
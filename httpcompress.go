@@ -0,0 +1,90 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The content encodings supported for blocks, in the order of preference
+var httpContentEncodings = []string{"zstd", "gzip"}
+
+// Returns the preferred content encoding accepted by the client, or "" if none
+func httpNegotiateEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+	for _, enc := range httpContentEncodings {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// Returns a writer compressing into w with the given content encoding
+func httpCompressWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+}
+
+// Asks the server to compress the response. This disables the transparent gzip decompression
+// in net/http, so the response body must be read with httpResponseBody.
+func httpAcceptCompression(req *http.Request) {
+	req.Header.Set("Accept-Encoding", strings.Join(httpContentEncodings, ", "))
+}
+
+// Returns the response body, decompressed according to its Content-Encoding
+func httpResponseBody(resp *http.Response) (io.ReadCloser, error) {
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "zstd":
+		d, err := zstd.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", enc)
+	}
+}
+
+// Makes a GET request accepting compressed responses, and returns the decompressed body
+func httpGetCompressed(client *http.Client, req *http.Request) (*http.Response, io.ReadCloser, error) {
+	httpAcceptCompression(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := httpResponseBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
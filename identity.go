@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Binding signatory keys to real-world identities, for the public registries which need to
+ * show who has created their blocks. The key metadata can claim an identity in two ways, set
+ * with -dns and -cert for addkey and signkeyop, or later by the key itself with setkeymeta:
+ *
+ *   dns  - a domain name, whose _daisy TXT record (e.g. _daisy.example.org) contains
+ *          "daisy-key=<public key hash>", so the domain's owner vouches for the key
+ *   x509 - a PEM certificate chain, leaf first, whose leaf certificate is issued for the key
+ *          itself (see identitycsr), verified against the system roots or the roots in
+ *          policy_identity_roots. With dns, the certificate must also be valid for the domain.
+ *
+ * The claims are only checked by the nodes, not by the consensus rules, as the DNS and the
+ * certificates change over time, and the older blocks may have other values for these metadata
+ * keys: their format is only checked by the commands setting them. verifyidentity checks a
+ * key's claims, and with policy_require_identity, the node's policy stage only accepts blocks
+ * from the creators with a verified identity. The verified identities are cached for
+ * identityCacheTime, and the failures for identityErrorCacheTime, so that a DNS outage doesn't
+ * hold the creator's blocks back for long.
+ */
+
+// The key metadata fields claiming an identity
+const (
+	keyMetaDNS  = "dns"
+	keyMetaX509 = "x509"
+)
+
+// The DNS name prefix of the TXT records vouching for the keys
+const identityDNSPrefix = "_daisy."
+
+// The prefix of the TXT record value vouching for a key
+const identityTXTPrefix = "daisy-key="
+
+// How long a verified identity is trusted before checking it again
+const identityCacheTime = time.Hour
+
+// How long a failed verification is remembered before trying again
+const identityErrorCacheTime = time.Minute
+
+// keyIdentity is the verified identity of a key
+type keyIdentity struct {
+	DNS     string    `json:"dns,omitempty"`
+	Subject string    `json:"subject,omitempty"` // Of the leaf certificate
+	Issuer  string    `json:"issuer,omitempty"`
+	Expires time.Time `json:"expires,omitempty"` // Of the leaf certificate
+}
+
+type identityCacheEntry struct {
+	identity *keyIdentity
+	err      error
+	time     time.Time
+}
+
+// Checks the format of the identity claims in the key metadata
+func validateKeyIdentityMetadata(metadata map[string]string) error {
+	if name, ok := metadata[keyMetaDNS]; ok {
+		if err := validateIdentityDNSName(name); err != nil {
+			return err
+		}
+	}
+	if chain, ok := metadata[keyMetaX509]; ok {
+		if _, err := identityParseCertificates(chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that the string is a domain name
+func validateIdentityDNSName(name string) error {
+	if len(name) == 0 || len(name) > 253 || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("invalid identity domain name %s", strconv.Quote(name))
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid identity domain name %s", strconv.Quote(name))
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid identity domain name %s", strconv.Quote(name))
+			}
+		}
+	}
+	return nil
+}
+
+// Parses the PEM certificate chain, leaf first
+func identityParseCertificates(chain string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("the identity certificate chain has no certificates")
+	}
+	return certs, nil
+}
+
+// Returns the roots the identity certificates are verified against
+func (node *Node) identityRoots() (*x509.CertPool, error) {
+	if node.cfg.PolicyIdentityRoots == "" {
+		return x509.SystemCertPool()
+	}
+	data, err := ioutil.ReadFile(node.cfg.PolicyIdentityRoots)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", node.cfg.PolicyIdentityRoots)
+	}
+	return pool, nil
+}
+
+// Checks that the domain's _daisy TXT record vouches for the key
+func identityVerifyDNS(name string, publicKeyHash string) error {
+	records, err := net.LookupTXT(identityDNSPrefix + name)
+	if err != nil {
+		return fmt.Errorf("cannot look up the TXT records of %s%s: %v", identityDNSPrefix, name, err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == identityTXTPrefix+publicKeyHash {
+			return nil
+		}
+	}
+	return fmt.Errorf("the TXT records of %s%s don't contain %s%s", identityDNSPrefix, name, identityTXTPrefix, publicKeyHash)
+}
+
+// Checks that the leaf certificate is issued for the key, and that the chain is valid for the
+// domain name, if it's not empty
+func (node *Node) identityVerifyCertificates(chain string, publicKeyBytes []byte, name string) (*x509.Certificate, error) {
+	certs, err := identityParseCertificates(chain)
+	if err != nil {
+		return nil, err
+	}
+	leaf := certs[0]
+	leafKey, err := x509.MarshalPKIXPublicKey(leaf.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(leafKey, publicKeyBytes) {
+		return nil, fmt.Errorf("the identity certificate %q isn't issued for the key", leaf.Subject.String())
+	}
+	roots, err := node.identityRoots()
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("the identity certificate %q is not valid: %v", leaf.Subject.String(), err)
+	}
+	return leaf, nil
+}
+
+// Verifies the identity claimed in the key's metadata. Returns an error if the key doesn't
+// claim an identity, or if any of its claims can't be verified.
+func (node *Node) verifyKeyIdentity(dbpk *DbPubKey) (*keyIdentity, error) {
+	name := dbpk.metadata[keyMetaDNS]
+	chain := dbpk.metadata[keyMetaX509]
+	if name == "" && chain == "" {
+		return nil, fmt.Errorf("the key %s doesn't claim an identity", dbpk.publicKeyHash)
+	}
+	identity := keyIdentity{DNS: name}
+	if name != "" {
+		if err := identityVerifyDNS(name, dbpk.publicKeyHash); err != nil {
+			return nil, err
+		}
+	}
+	if chain != "" {
+		leaf, err := node.identityVerifyCertificates(chain, dbpk.publicKeyBytes, name)
+		if err != nil {
+			return nil, err
+		}
+		identity.Subject = leaf.Subject.String()
+		identity.Issuer = leaf.Issuer.String()
+		identity.Expires = leaf.NotAfter
+	}
+	return &identity, nil
+}
+
+// Returns the verified identity of the key, from the cache if it has been verified recently
+func (node *Node) cachedKeyIdentity(dbpk *DbPubKey) (*keyIdentity, error) {
+	var entry identityCacheEntry
+	var ok bool
+	node.identityCache.lock.With(func() {
+		entry, ok = node.identityCache.entries[dbpk.publicKeyHash]
+	})
+	if ok && (time.Since(entry.time) < identityCacheTime && entry.err == nil || time.Since(entry.time) < identityErrorCacheTime) {
+		return entry.identity, entry.err
+	}
+	identity, err := node.verifyKeyIdentity(dbpk)
+	node.identityCache.lock.With(func() {
+		node.identityCache.entries[dbpk.publicKeyHash] = identityCacheEntry{identity: identity, err: err, time: time.Now()}
+	})
+	return identity, err
+}
+
+// Checks the identity claims of a key, and prints the verified identity
+func (node *Node) actionVerifyIdentity(publicKeyHash string) {
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		log.Fatalln("Unknown public key", publicKeyHash)
+	}
+	identity, err := node.verifyKeyIdentity(dbpk)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(jsonifyWhatever(identity))
+}
+
+// Prints a certificate signing request for the signing key, selected with -key, and the given
+// domain name, for getting the certificate claimed in the key's x509 metadata
+func (node *Node) actionIdentityCSR(name string) {
+	if err := validateIdentityDNSName(name); err != nil {
+		log.Fatalln(err)
+	}
+	keypair, _, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, keypair)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * User-defined indexes over the block content. The operators declare the (table, columns)
+ * combinations in the indexes config setting, and the node keeps an index of each of them in
+ * the indexes.db SQLite database in the data directory, updated as the blocks are accepted, so
+ * looking up the rows with given values in the whole chain doesn't need to scan the blocks.
+ *
+ * Each index is a table named like "wikinews_titles(title)", with the indexed columns, the
+ * _block_height, _block_hash and _rowid of the row in its block, and an SQLite index on the
+ * columns. The _indexes table records the block each index is built up to, so the indexes
+ * added to the config are built from the genesis block, and the ones which are on blocks no
+ * longer in the chain are rebuilt. The lookup command finds the rows and reads them from the
+ * blocks, and indexes.db can be used by other SQLite tools too.
+ */
+
+// The file name of the index database, in the data directory
+const userIndexesDbFileName = "indexes.db"
+
+const userIndexesStateTableCreate = `
+CREATE TABLE IF NOT EXISTS _indexes (
+	name			VARCHAR NOT NULL PRIMARY KEY,
+	block_height	INTEGER NOT NULL,
+	block_hash		VARCHAR NOT NULL
+);
+`
+
+// userIndexConfig is an index declared in the config
+type userIndexConfig struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+}
+
+// Returns the name of the index, which is also the name of its table
+func (ix userIndexConfig) name() string {
+	return fmt.Sprintf("%s(%s)", ix.Table, strings.Join(ix.Columns, ","))
+}
+
+// Opens the index database and creates the index tables, on the first use
+func (node *Node) userIndexesDb() (db *sql.DB, err error) {
+	node.userIndexes.lock.With(func() {
+		if node.userIndexes.db != nil {
+			db = node.userIndexes.db
+			return
+		}
+		if db, err = dbOpen(fmt.Sprintf("%s/%s", node.cfg.DataDir, userIndexesDbFileName), false); err != nil {
+			return
+		}
+		// The blocks are ATTACHed to the connection
+		db.SetMaxOpenConns(1)
+		if _, err = db.Exec(userIndexesStateTableCreate); err != nil {
+			db.Close()
+			return
+		}
+		for _, ix := range node.cfg.Indexes {
+			if err = userIndexCreate(db, ix); err != nil {
+				db.Close()
+				return
+			}
+		}
+		node.userIndexes.db = db
+	})
+	return
+}
+
+// Creates the index table and its state, if they don't exist
+func userIndexCreate(db *sql.DB, ix userIndexConfig) error {
+	name := dbQuoteIdentifier(ix.name())
+	quoted := make([]string, len(ix.Columns))
+	for i, c := range ix.Columns {
+		quoted[i] = dbQuoteIdentifier(c)
+	}
+	cols := strings.Join(quoted, ", ")
+	for _, q := range []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s, _block_height INTEGER NOT NULL, _block_hash VARCHAR NOT NULL, _rowid INTEGER NOT NULL)", name, cols),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", dbQuoteIdentifier("idx "+ix.name()), name, cols),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (_block_height)", dbQuoteIdentifier("height "+ix.name()), name),
+	} {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("INSERT INTO _indexes(name, block_height, block_hash) VALUES (?, -1, '') ON CONFLICT(name) DO NOTHING", ix.name())
+	return err
+}
+
+// Returns the block the index is built up to
+func userIndexGetState(db *sql.DB, ix userIndexConfig) (height int, hash string, err error) {
+	err = db.QueryRow("SELECT block_height, block_hash FROM _indexes WHERE name=?", ix.name()).Scan(&height, &hash)
+	return
+}
+
+// Removes the index rows from the blocks above the height
+func (node *Node) userIndexTruncate(db *sql.DB, ix userIndexConfig, height int) error {
+	hash := ""
+	if height >= 0 {
+		var err error
+		if hash, err = node.dbGetBlockHashByHeight(height); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE _block_height > ?", dbQuoteIdentifier(ix.name())), height); err != nil {
+		return err
+	}
+	_, err := db.Exec("UPDATE _indexes SET block_height=?, block_hash=? WHERE name=? AND block_height > ?", height, hash, ix.name(), height)
+	return err
+}
+
+// Brings the indexes up to the current block
+func (node *Node) userIndexesUpdate() (err error) {
+	if len(node.cfg.Indexes) == 0 {
+		return nil
+	}
+	node.userIndexes.update.With(func() {
+		err = node.userIndexesUpdateLocked()
+	})
+	return
+}
+
+func (node *Node) userIndexesUpdateLocked() error {
+	db, err := node.userIndexesDb()
+	if err != nil {
+		return err
+	}
+	chainHeight, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	from := chainHeight + 1
+	for _, ix := range node.cfg.Indexes {
+		height, hash, err := userIndexGetState(db, ix)
+		if err != nil {
+			return err
+		}
+		if height >= 0 {
+			chainHash, err := node.dbGetBlockHashByHeight(height)
+			if err != nil {
+				return err
+			}
+			if chainHash != hash {
+				log.Println("The index", ix.name(), "is on a block no longer in the chain, rebuilding it")
+				if err = node.userIndexTruncate(db, ix, -1); err != nil {
+					return err
+				}
+				height = -1
+			}
+		}
+		if height+1 < from {
+			from = height + 1
+		}
+	}
+	for h := from; h <= chainHeight; h++ {
+		if err = node.userIndexesAddBlock(db, h); err != nil {
+			return fmt.Errorf("cannot index block %d: %v", h, err)
+		}
+	}
+	return nil
+}
+
+// Adds the rows of the block at the height to the indexes which aren't built up to it yet
+func (node *Node) userIndexesAddBlock(db *sql.DB, height int) error {
+	hash, err := node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		return fmt.Errorf("no block at height %d", height)
+	}
+	bdb, err := node.blockDBs.Get(hash)
+	if err != nil {
+		return err
+	}
+	defer node.blockDBs.Release(bdb)
+	tables, err := bdb.TableNames()
+	if err != nil {
+		return err
+	}
+	if _, err = db.Exec("ATTACH DATABASE ? AS block", "file:"+node.blockStore.Filename(hash)+"?mode=ro"); err != nil {
+		return err
+	}
+	defer db.Exec("DETACH DATABASE block")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, ix := range node.cfg.Indexes {
+		var indexed int
+		if err = tx.QueryRow("SELECT block_height FROM _indexes WHERE name=?", ix.name()).Scan(&indexed); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if indexed >= height {
+			continue
+		}
+		if inStrings(ix.Table, tables) {
+			if err = userIndexAddTable(tx, bdb, ix, height, hash); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err = tx.Exec("UPDATE _indexes SET block_height=?, block_hash=? WHERE name=?", height, hash, ix.name()); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Copies the indexed columns of the table in the attached block into the index. The columns
+// the block's version of the table doesn't have are NULL.
+func userIndexAddTable(tx *sql.Tx, bdb *BlockDB, ix userIndexConfig, height int, hash string) error {
+	columns, err := bdb.ColumnNames(ix.Table)
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(ix.Columns))
+	values := make([]string, len(ix.Columns))
+	for i, c := range ix.Columns {
+		quoted[i] = dbQuoteIdentifier(c)
+		values[i] = "NULL"
+		if inStrings(c, columns) {
+			values[i] = quoted[i]
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s, _block_height, _block_hash, _rowid) SELECT %s, ?, ?, rowid FROM block.%s",
+		dbQuoteIdentifier(ix.name()), strings.Join(quoted, ", "), strings.Join(values, ", "), dbQuoteIdentifier(ix.Table)), height, hash)
+	return err
+}
+
+// Removes the rows of the blocks above the height from the indexes, after a rollback
+func (node *Node) userIndexesRollback(height int) error {
+	if len(node.cfg.Indexes) == 0 {
+		return nil
+	}
+	db, err := node.userIndexesDb()
+	if err != nil {
+		return err
+	}
+	for _, ix := range node.cfg.Indexes {
+		if err = node.userIndexTruncate(db, ix, height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts updating the indexes as the blocks are accepted
+func (node *Node) userIndexesStart() {
+	if len(node.cfg.Indexes) == 0 {
+		return
+	}
+	update := func() {
+		if err := node.userIndexesUpdate(); err != nil {
+			chainLog.Error("Cannot update the indexes:", err)
+		}
+	}
+	go update()
+	node.nodeEvents.Handle("indexes", []string{eventBlockAccepted}, func(ev nodeEvent) {
+		update()
+	})
+}
+
+// Returns the declared index on the table which starts with the given columns, preferring the
+// ones with the fewest other columns
+func (node *Node) userIndexFind(table string, columns []string) (ix userIndexConfig, ok bool) {
+	for _, candidate := range node.cfg.Indexes {
+		if candidate.Table != table || len(candidate.Columns) < len(columns) {
+			continue
+		}
+		match := true
+		for i, c := range columns {
+			if candidate.Columns[i] != c {
+				match = false
+				break
+			}
+		}
+		if match && (!ok || len(candidate.Columns) < len(ix.Columns)) {
+			ix, ok = candidate, true
+		}
+	}
+	return
+}
+
+// Prints the rows of the table with the given column values, found with an index, as JSON
+// objects with the _block_height of each row. The conditions are like column=value.
+func (node *Node) actionLookup(table string, conditions []string) {
+	var columns []string
+	var where []string
+	var args []interface{}
+	for _, cond := range conditions {
+		parts := strings.SplitN(cond, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalln("Invalid condition", strconv.Quote(cond), "- expecting column=value")
+		}
+		columns = append(columns, parts[0])
+		// The value can match as text or as a number, like the values from the blocks' JSON
+		var number interface{} = parts[1]
+		if i, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			number = i
+		} else if f, err := strconv.ParseFloat(parts[1], 64); err == nil {
+			number = f
+		}
+		where = append(where, dbQuoteIdentifier(parts[0])+" IN (?, ?)")
+		args = append(args, parts[1], number)
+	}
+	ix, ok := node.userIndexFind(table, columns)
+	if !ok {
+		log.Fatalln("No index on", table, "starts with the columns", strings.Join(columns, ", "), "- declare it in the indexes config setting")
+	}
+	if err := node.userIndexesUpdate(); err != nil {
+		log.Fatalln(err)
+	}
+	db, err := node.userIndexesDb()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT _block_height, _block_hash, _rowid FROM %s WHERE %s ORDER BY _block_height, _rowid",
+		dbQuoteIdentifier(ix.name()), strings.Join(where, " AND ")), args...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	type found struct {
+		height int
+		hash   string
+		rowid  int64
+	}
+	var results []found
+	for rows.Next() {
+		var f found
+		if err = rows.Scan(&f.height, &f.hash, &f.rowid); err != nil {
+			log.Fatalln(err)
+		}
+		results = append(results, f)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	rows.Close()
+	for _, f := range results {
+		bdb, err := node.blockDBs.Get(f.hash)
+		if err != nil {
+			log.Fatalln("Cannot open block", f.height, err)
+		}
+		rows, err := bdb.Query(fmt.Sprintf("SELECT * FROM %s WHERE rowid=?", dbQuoteIdentifier(table)), f.rowid)
+		if err != nil {
+			log.Fatalln("Cannot read block", f.height, err)
+		}
+		cols, err := rows.Columns()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		values := make([]interface{}, len(cols))
+		valuePtrs := make([]interface{}, len(cols))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		for rows.Next() {
+			if err = rows.Scan(valuePtrs...); err != nil {
+				log.Fatalln(err)
+			}
+			line := strconv.AppendInt(append(appendQueryJSONString([]byte{'{'}, queryBlockHeightColumn), ':'), int64(f.height), 10)
+			for i, c := range cols {
+				line = appendQueryJSONValue(append(appendQueryJSONString(append(line, ','), c), ':'), values[i])
+			}
+			os.Stdout.Write(append(line, '}', '\n'))
+		}
+		rows.Close()
+		node.blockDBs.Release(bdb)
+	}
+}
+
+// Rebuilds the indexes from the genesis block
+func (node *Node) actionReindex() {
+	db, err := node.userIndexesDb()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, ix := range node.cfg.Indexes {
+		if err = node.userIndexTruncate(db, ix, -1); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err = node.userIndexesUpdate(); err != nil {
+		log.Fatalln(err)
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Rebuilt", len(node.cfg.Indexes), "indexes up to block", height)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// PEM block types used in key files
+const (
+	pemTypeECPrivateKey = "EC PRIVATE KEY"
+	pemTypePrivateKey   = "PRIVATE KEY" // PKCS #8, accepted on import
+	pemTypePublicKey    = "PUBLIC KEY"
+)
+
+// Writes the keypair with the given public key hash into a PEM file, containing the
+// EC private key and the public key.
+func (node *Node) actionExportKey(publicKeyHash string, fileName string) {
+	keys, err := node.cryptoGetPrivateKey(publicKeyHash)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	privateKeyBytes, err := x509.MarshalECPrivateKey(keys)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&keys.PublicKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: pemTypeECPrivateKey, Bytes: privateKeyBytes})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: pemTypePublicKey, Bytes: publicKeyBytes})...)
+	if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Exported", publicKeyHash, "to", fileName)
+}
+
+// Imports a keypair from a PEM file into the private database. The key only becomes a
+// signatory when an A key op adding it is accepted in a block, so a file with only a public
+// key is refused: such keys are added with addkey.
+func (node *Node) actionImportKey(fileName string) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	privateKey, publicKey, err := pemDecodeKeys(data)
+	if err != nil {
+		log.Fatalln(fileName, err)
+	}
+	if privateKey != nil {
+		publicKeyHash, err := node.cryptoImportPrivateKey(privateKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Imported the keypair", publicKeyHash)
+		return
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Fatalln(fileName, "only contains the public key", getPubKeyHash(publicKeyBytes)+": public keys are added to the signatories with addkey")
+}
+
+// Writes the private key into the private database and returns its public key hash. Fails
+// if the private key is already present. The public key isn't written to pubkeys: it's
+// trusted only once it's added on-chain.
+func (node *Node) cryptoImportPrivateKey(privateKey *ecdsa.PrivateKey) (string, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	publicKeyHash := getPubKeyHash(publicKeyBytes)
+	if _, err = node.dbGetPrivateKey(publicKeyHash); err == nil {
+		return "", fmt.Errorf("The private key for %s already exists", publicKeyHash)
+	}
+	privateKeyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	if err = node.dbWritePrivateKey(privateKeyBytes, publicKeyHash); err != nil {
+		return "", err
+	}
+	return publicKeyHash, nil
+}
+
+// Decodes the PEM blocks in data. Returns the private key if there is one, and the public
+// key if there is one. If both are present, they must match.
+func pemDecodeKeys(data []byte) (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
+	var privateKey *ecdsa.PrivateKey
+	var publicKey *ecdsa.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case pemTypeECPrivateKey:
+			k, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			privateKey = k
+		case pemTypePrivateKey:
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			ecKey, ok := k.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("the private key is not an EC key")
+			}
+			privateKey = ecKey
+		case pemTypePublicKey:
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			ecKey, ok := k.(*ecdsa.PublicKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("the public key is not an EC key")
+			}
+			publicKey = ecKey
+		default:
+			log.Println("Ignoring PEM block of type", block.Type)
+		}
+	}
+	if privateKey == nil && publicKey == nil {
+		return nil, nil, fmt.Errorf("no PEM-encoded keys found")
+	}
+	if privateKey != nil {
+		if privateKey.Curve != elliptic.P256() {
+			return nil, nil, fmt.Errorf("only P-256 keys are supported")
+		}
+		if publicKey != nil && (publicKey.X.Cmp(privateKey.X) != 0 || publicKey.Y.Cmp(privateKey.Y) != 0) {
+			return nil, nil, fmt.Errorf("the public key doesn't match the private key")
+		}
+	} else if publicKey.Curve != elliptic.P256() {
+		return nil, nil, fmt.Errorf("only P-256 keys are supported")
+	}
+	return privateKey, publicKey, nil
+}
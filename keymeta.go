@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Prints the metadata of a public key
+func (node *Node) actionKeyMeta(publicKeyHash string) {
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		log.Fatalln("Unknown public key", publicKeyHash)
+	}
+	metadata := dbpk.metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	data, err := json.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(string(data))
+}
+
+// Sets (or with an empty value, removes) a metadata field of one of my keys. The change is
+// made locally, and published to other nodes in the next block I sign.
+func (node *Node) actionSetKeyMeta(publicKeyHash string, name string, value string) {
+	if _, err := node.dbGetPrivateKey(publicKeyHash); err != nil {
+		log.Fatalln("Only the metadata of my own keys can be changed:", err)
+	}
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		log.Fatalln("Unknown public key", publicKeyHash)
+	}
+	if dbpk.isRevoked {
+		log.Fatalln("The key", publicKeyHash, "is revoked")
+	}
+	if name == keyMetaWeight || name == keyMetaRole {
+		log.Fatalln("The key's", name, "can only be set when it's added, with addkey")
+	}
+	metadata := dbpk.metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	if value == "" {
+		delete(metadata, name)
+	} else {
+		metadata[name] = value
+	}
+	if err = validateKeyIdentityMetadata(metadata); err != nil {
+		log.Fatalln(err)
+	}
+	metadataJSON := string(jsonifyWhateverToBytes(metadata))
+	if len(metadataJSON) > blockKeysMaxMetadataSize {
+		log.Fatalln("The metadata is", len(metadataJSON), "bytes, more than the maximum of", blockKeysMaxMetadataSize)
+	}
+	if err = dbSetPublicKeyMetadata(node.mainDb, publicKeyHash, metadata); err != nil {
+		log.Fatalln(err)
+	}
+	if err = node.dbQueuePendingKeyMetadata(publicKeyHash, metadataJSON); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Metadata of", publicKeyHash, "updated, it will be published in the next block signed by this node")
+}
+
+// Adds metadata ("M") key ops for the queued metadata of my keys into a block being signed,
+// which will be at the given height. Keys which already have key ops in the block are
+// skipped, and stay queued.
+func (node *Node) blockAddPendingKeyMetadata(db *sql.DB, height int) error {
+	pending, err := node.dbGetPendingKeyMetadata()
+	if err != nil {
+		return err
+	}
+	for publicKeyHash, metadataJSON := range pending {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM _keys WHERE pubkey_hash=?", publicKeyHash).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		dbpk, err := node.dbGetPublicKey(publicKeyHash)
+		if err != nil || dbpk.isRevoked {
+			log.Println("Not publishing metadata for", publicKeyHash, "which isn't a valid key")
+			continue
+		}
+		keypair, err := node.cryptoGetPrivateKey(publicKeyHash)
+		if err != nil {
+			return err
+		}
+		signature, err := cryptoSignBytes(keypair, cryptoKeyMetadataOpHash(publicKeyHash, metadataJSON, height))
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO _keys(op, pubkey_hash, pubkey, sigkey_hash, signature, metadata) VALUES (?, ?, ?, ?, ?, ?)",
+			"M", publicKeyHash, hex.EncodeToString(dbpk.publicKeyBytes), publicKeyHash, hex.EncodeToString(signature), metadataJSON)
+		if err != nil {
+			return err
+		}
+		log.Println("Publishing the metadata of", publicKeyHash)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+ * Adding and revoking signatory keys is done with blocks containing key ops in their _keys
+ * table, signed by signatories with a total weight of at least KeyOpThreshold (see
+ * keyweights.go). The addkey and revokekey commands sign the key op with all of my valid keys,
+ * add the co-signatures made by other signatories with signkeyop, given as files or collected by
+ * the running node from the peers (see keyproposals.go), and create, sign and import the block.
+ * The weight, the role and the activation delay of an added key are given with -weight, -role
+ * and -activation-delay, and must be the same for all the signatures.
+ */
+
+// keyOpSignature is a signature of a key op by one signatory, exchanged as a JSON file
+type keyOpSignature struct {
+	Op            string `json:"op"`
+	PublicKeyHash string `json:"pubkey_hash"`
+	SignerKeyHash string `json:"sigkey_hash"`
+	Signature     string `json:"signature"`
+	Metadata      string `json:"metadata,omitempty"`
+}
+
+// Reads the public key given either as a PEM file or as a hex-encoded PKIX blob
+func readPublicKeyArg(arg string) ([]byte, error) {
+	if fileExists(arg) {
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, publicKey, err := pemDecodeKeys(data)
+		if err != nil {
+			return nil, err
+		}
+		if privateKey != nil {
+			publicKey = &privateKey.PublicKey
+		}
+		return x509.MarshalPKIXPublicKey(publicKey)
+	}
+	publicKeyBytes, err := hex.DecodeString(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a file nor a hex-encoded public key", arg)
+	}
+	if _, err = cryptoDecodePublicKeyBytes(publicKeyBytes); err != nil {
+		return nil, err
+	}
+	return publicKeyBytes, nil
+}
+
+// Signs a key op with one of my keys, selected with -key, and prints the signature as JSON
+// for the signatory running addkey or revokekey.
+func (node *Node) actionSignKeyOp(op string, publicKeyHash string) {
+	if op != "A" && op != "R" {
+		log.Fatalln("The key op must be A (add) or R (revoke)")
+	}
+	keypair, signerKeyHash, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	metadataJSON := ""
+	if op == "A" {
+		if metadataJSON, err = node.keyOpMetadataJSON(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	signature, err := cryptoSignKeyOp(keypair, op, publicKeyHash, metadataJSON)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(jsonifyWhatever(keyOpSignature{Op: op, PublicKeyHash: publicKeyHash, SignerKeyHash: signerKeyHash, Signature: hex.EncodeToString(signature), Metadata: metadataJSON}))
+	if err = node.keyOpAnnounce(op, publicKeyHash, metadataJSON, map[string][]byte{signerKeyHash: signature}); err != nil {
+		log.Println("The signature can't be announced to the peers, the node isn't running:", err)
+	} else {
+		log.Println("The signature has been announced to the peers")
+	}
+}
+
+// Checks that the key op signature is made by a valid signatory which can sign key ops at the
+// given height. Returns the signatory's weight and the decoded signature.
+func (node *Node) keyOpVerifySignature(kos *keyOpSignature, height int) (int, []byte, error) {
+	signer, err := node.dbGetPublicKey(kos.SignerKeyHash)
+	if err != nil || signer.isRevoked || !keyCanSignKeyOps(signer.metadata) {
+		return 0, nil, fmt.Errorf("is not signed by a valid signatory which can sign key ops: %s", kos.SignerKeyHash)
+	}
+	if err = keyCheckActive(signer.addBlockHeight, signer.metadata, height); err != nil {
+		return 0, nil, fmt.Errorf("is signed by %s which can't sign yet: %v", kos.SignerKeyHash, err)
+	}
+	signerKey, err := cryptoDecodePublicKeyBytes(signer.publicKeyBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	signature, err := hex.DecodeString(kos.Signature)
+	if err != nil {
+		return 0, nil, keyOpInvalidError{err: fmt.Errorf("has a malformed signature: %v", err)}
+	}
+	kop := BlockKeyOp{op: kos.Op, publicKeyHash: kos.PublicKeyHash, signature: signature, metadataJSON: kos.Metadata}
+	if err = cryptoVerifyKeyOpSignature(signerKey, &kop); err != nil {
+		return 0, nil, keyOpInvalidError{err: fmt.Errorf("has an invalid signature: %v", err)}
+	}
+	return keyWeight(signer.metadata), signature, nil
+}
+
+// Creates, signs and imports a block adding the given public key as a signatory
+func (node *Node) actionAddKey(keyArg string, cosignatureFiles []string) {
+	publicKeyBytes, err := readPublicKeyArg(keyArg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publicKeyHash := getPubKeyHash(publicKeyBytes)
+	if _, err := node.dbGetPublicKey(publicKeyHash); err == nil {
+		log.Fatalln("The key", publicKeyHash, "is already known to this node")
+	}
+	metadataJSON, err := node.keyOpMetadataJSON()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	node.createKeyOpBlock("A", publicKeyHash, publicKeyBytes, metadataJSON, cosignatureFiles)
+}
+
+// Creates, signs and imports a block revoking the given signatory key
+func (node *Node) actionRevokeKey(publicKeyHash string, cosignatureFiles []string) {
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		log.Fatalln("Unknown public key", publicKeyHash)
+	}
+	if dbpk.isRevoked {
+		log.Fatalln("The key", publicKeyHash, "is already revoked")
+	}
+	node.createKeyOpBlock("R", publicKeyHash, dbpk.publicKeyBytes, "", cosignatureFiles)
+}
+
+// Collects the key op signatures with the threshold weight, creates the key op block, and
+// signs and imports it
+func (node *Node) createKeyOpBlock(op string, publicKeyHash string, publicKeyBytes []byte, metadataJSON string, cosignatureFiles []string) {
+	chainHeight, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	height := chainHeight + 1
+	totalWeight, err := node.dbGetKeyOpWeight(height)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	threshold := node.KeyOpThreshold(height, totalWeight)
+	signatures := map[string][]byte{}
+	weight := 0
+
+	// My keys which are valid signatories
+	myKeyHashes, err := node.dbGetMyPublicKeyHashes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, myKeyHash := range myKeyHashes {
+		if weight >= threshold {
+			break
+		}
+		dbpk, err := node.dbGetPublicKey(myKeyHash)
+		if err != nil || dbpk.isRevoked || myKeyHash == publicKeyHash || !keyCanSignKeyOps(dbpk.metadata) || keyCheckActive(dbpk.addBlockHeight, dbpk.metadata, height) != nil {
+			continue
+		}
+		keypair, err := node.cryptoGetPrivateKey(myKeyHash)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if signatures[myKeyHash], err = cryptoSignKeyOp(keypair, op, publicKeyHash, metadataJSON); err != nil {
+			log.Fatalln(err)
+		}
+		weight += keyWeight(dbpk.metadata)
+	}
+
+	// Co-signatures by other signatories
+	for _, fn := range cosignatureFiles {
+		if weight >= threshold {
+			break
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		var kos keyOpSignature
+		if err = json.Unmarshal(data, &kos); err != nil {
+			log.Fatalln("Cannot parse", fn, err)
+		}
+		if kos.Op != op || kos.PublicKeyHash != publicKeyHash || kos.Metadata != metadataJSON {
+			log.Fatalln(fn, "is a signature for a different key op:", kos.Op, kos.PublicKeyHash, kos.Metadata)
+		}
+		if _, ok := signatures[kos.SignerKeyHash]; ok {
+			continue
+		}
+		signerWeight, signature, err := node.keyOpVerifySignature(&kos, height)
+		if err != nil {
+			log.Fatalln(fn, err)
+		}
+		signatures[kos.SignerKeyHash] = signature
+		weight += signerWeight
+	}
+
+	// Co-signatures announced by other signatories, collected by the running node
+	if weight < threshold {
+		for _, kos := range node.keyOpCollectedSignatures(op, publicKeyHash, metadataJSON) {
+			if weight >= threshold {
+				break
+			}
+			if _, ok := signatures[kos.SignerKeyHash]; ok {
+				continue
+			}
+			signerWeight, signature, err := node.keyOpVerifySignature(kos, height)
+			if err != nil {
+				log.Println("Ignoring the co-signature by", kos.SignerKeyHash, "collected by the node:", err)
+				continue
+			}
+			signatures[kos.SignerKeyHash] = signature
+			weight += signerWeight
+		}
+	}
+
+	if weight < threshold {
+		if len(signatures) > 0 {
+			if err = node.keyOpAnnounce(op, publicKeyHash, metadataJSON, signatures); err != nil {
+				log.Println("The key op can't be announced to the peers, the node isn't running:", err)
+			} else {
+				log.Println("The key op has been announced to the peers, run this command again when enough signatories have signed it")
+			}
+		}
+		log.Fatalf("The key op needs signatures with the weight of %d, only %d is available. Other signatories can sign it with: daisy signkeyop %s %s",
+			threshold, weight, op, publicKeyHash)
+	}
+
+	fn := fmt.Sprintf("%s/keyop-%s-%d.db", node.cfg.DataDir, op, time.Now().Unix())
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dbEnsureBlockchainTables(db)
+	var metadata interface{}
+	if metadataJSON != "" {
+		metadata = metadataJSON
+	}
+	for signerKeyHash, signature := range signatures {
+		_, err = db.Exec("INSERT INTO _keys(op, pubkey_hash, pubkey, sigkey_hash, signature, metadata) VALUES (?, ?, ?, ?, ?, ?)",
+			op, publicKeyHash, hex.EncodeToString(publicKeyBytes), signerKeyHash, hex.EncodeToString(signature), metadata)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		log.Fatalln(err)
+	}
+
+	sigs := node.blockSignFile(fn)
+	if q := node.SignatureQuorumForHeight(height); q > 1 {
+		if err = sigs.write(fn); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("The key op block needs", q-1, "more signatures: use cosignblock on", fn, "and then importblock")
+		return
+	}
+	node.blockImportFile(fn, sigs)
+	if err = os.Remove(fn); err != nil {
+		log.Println(err)
+	}
+}
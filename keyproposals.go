@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Pending key op proposals. Instead of passing the signkeyop signature files around, the
+ * signatories announce their signatures of a key op which isn't in a block yet to their running
+ * nodes, which gossip them to their peers with the keyop message. Each node collects the valid
+ * signatures of each proposed key op, from signatories which can sign key ops, and the node of
+ * the signatory running addkey or revokekey provides them to the command, which creates the
+ * block once their weight reaches the threshold. The signatures are only collected, never made
+ * by the nodes: each signatory still decides to sign with signkeyop. The proposals are kept in
+ * memory, and expire after keyOpProposalTTL or when their key op is in a block. A proposal
+ * can't have more signatures than there are signatories. The peers sending malformed
+ * proposals or forged signatures are penalized, but not the ones relaying stale proposals,
+ * whose signers can't sign anymore or which have expired, as honest peers can be behind.
+ */
+
+// How long a proposal is kept, from its first announcement
+const keyOpProposalTTL = 7 * 24 * time.Hour
+
+// The maximum number of pending proposals
+const keyOpMaxProposals = 100
+
+// The maximum number of signatures of a proposal
+const keyOpMaxSignatures = 1000
+
+// The message carrying a proposal
+const p2pMsgKeyOp = "keyop"
+
+type p2pMsgKeyOpStruct struct {
+	p2pMsgHeader
+	Proposal *keyOpProposal `json:"proposal"`
+}
+
+// keyOpProposal is a key op with the signatures collected so far
+type keyOpProposal struct {
+	Op            string            `json:"op"`
+	PublicKeyHash string            `json:"pubkey_hash"`
+	Metadata      string            `json:"metadata,omitempty"`
+	Time          int64             `json:"time"`       // Unix time of the first announcement
+	Signatures    map[string]string `json:"signatures"` // Hex-encoded signatures by the signer key hashes
+}
+
+// keyOpProposalInfo is a proposal with the weight of its signatures, for the keyops command
+type keyOpProposalInfo struct {
+	*keyOpProposal
+	Weight    int `json:"weight"`
+	Threshold int `json:"threshold"`
+}
+
+type keyOpProposalPool struct {
+	lock      WithMutex
+	proposals map[string]*keyOpProposal
+	node      *Node
+}
+
+// Returns the key identifying the proposed key op: the signatures of the same op with different
+// metadata are for different key ops
+func (p *keyOpProposal) key() string {
+	return p.Op + "\n" + p.PublicKeyHash + "\n" + p.Metadata
+}
+
+// Returns the proposal's signature by the signer, as exchanged in the signature files
+func (p *keyOpProposal) signature(signerKeyHash string) *keyOpSignature {
+	return &keyOpSignature{Op: p.Op, PublicKeyHash: p.PublicKeyHash, SignerKeyHash: signerKeyHash, Signature: p.Signatures[signerKeyHash], Metadata: p.Metadata}
+}
+
+// Returns true if the key op isn't in a block yet: the key to add isn't known, or the key to
+// revoke isn't revoked
+func (node *Node) keyOpIsPending(op string, publicKeyHash string) bool {
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	if op == "A" {
+		return err != nil
+	}
+	return err == nil && !dbpk.isRevoked
+}
+
+// keyOpInvalidError is the error of a proposal or a signature which isn't valid, as opposed to
+// one which couldn't be checked. Unless it's only stale, the peers sending it are penalized.
+type keyOpInvalidError struct {
+	err   error
+	stale bool // Valid before, e.g. signed by a key which has been revoked since
+}
+
+func (e keyOpInvalidError) Error() string {
+	return e.err.Error()
+}
+
+// Checks the proposal and removes the signatures which aren't valid at the given height, the
+// next block's, at which there are the given number of signatories. Returns an error if no
+// signature is left.
+func (p *keyOpProposal) validate(node *Node, height int, signatories int) error {
+	if p.Op != "A" && p.Op != "R" {
+		return fmt.Errorf("invalid key op %q", p.Op)
+	}
+	if p.PublicKeyHash == "" {
+		return fmt.Errorf("the key op has no public key hash")
+	}
+	if p.Op == "R" && p.Metadata != "" {
+		return fmt.Errorf("the revoke key op has metadata")
+	}
+	if len(p.Metadata) > blockKeysMaxMetadataSize {
+		return fmt.Errorf("the key op metadata is larger than %d bytes", blockKeysMaxMetadataSize)
+	}
+	t := time.Unix(p.Time, 0)
+	if time.Since(t) >= keyOpProposalTTL {
+		return keyOpInvalidError{err: fmt.Errorf("the proposal has expired"), stale: true}
+	}
+	if time.Until(t) > 10*time.Minute {
+		return fmt.Errorf("the proposal's time is in the future")
+	}
+	if len(p.Signatures) > keyOpMaxSignatures {
+		return fmt.Errorf("the proposal has more than %d signatures", keyOpMaxSignatures)
+	}
+	// The signatories can have been revoked since the signatures were collected
+	if len(p.Signatures) > signatories {
+		return keyOpInvalidError{err: fmt.Errorf("the proposal has %d signatures, but there are only %d signatories", len(p.Signatures), signatories), stale: true}
+	}
+	if len(p.Signatures) == 0 {
+		return fmt.Errorf("the key op for %s has no signatures", p.PublicKeyHash)
+	}
+	var lastErr error
+	for signerKeyHash := range p.Signatures {
+		if _, _, err := node.keyOpVerifySignature(p.signature(signerKeyHash), height); err != nil {
+			if _, ok := err.(keyOpInvalidError); ok {
+				return fmt.Errorf("the key op for %s %v", p.PublicKeyHash, err)
+			}
+			lastErr = err
+			delete(p.Signatures, signerKeyHash)
+		}
+	}
+	if len(p.Signatures) == 0 {
+		return keyOpInvalidError{err: fmt.Errorf("the key op for %s %v", p.PublicKeyHash, lastErr), stale: true}
+	}
+	return nil
+}
+
+// Validates the proposal and merges its signatures into the pool. Returns a copy of the merged
+// proposal if it has any new signatures, to be gossiped, or nil.
+func (kp *keyOpProposalPool) Add(p *keyOpProposal) (*keyOpProposal, error) {
+	if !kp.node.keyOpIsPending(p.Op, p.PublicKeyHash) {
+		return nil, nil
+	}
+	chainHeight, err := kp.node.dbGetBlockchainHeight()
+	if err != nil {
+		return nil, err
+	}
+	height := chainHeight + 1
+	signatories, _, err := kp.node.dbGetKeyOpSignatories(height)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.validate(kp.node, height, signatories); err != nil {
+		if _, ok := err.(keyOpInvalidError); !ok {
+			err = keyOpInvalidError{err: err}
+		}
+		return nil, err
+	}
+	var merged *keyOpProposal
+	kp.lock.With(func() {
+		kp.expire()
+		existing, ok := kp.proposals[p.key()]
+		if !ok {
+			if len(kp.proposals) >= keyOpMaxProposals {
+				return
+			}
+			existing = &keyOpProposal{Op: p.Op, PublicKeyHash: p.PublicKeyHash, Metadata: p.Metadata, Time: p.Time, Signatures: map[string]string{}}
+			kp.proposals[p.key()] = existing
+		}
+		added := false
+		for signerKeyHash, signature := range p.Signatures {
+			if _, ok := existing.Signatures[signerKeyHash]; !ok {
+				existing.Signatures[signerKeyHash] = signature
+				added = true
+			}
+		}
+		if added {
+			merged = existing.copy()
+		}
+	})
+	return merged, nil
+}
+
+// Returns copies of the pending proposals, the oldest first. The proposals whose key ops are
+// already in blocks are removed.
+func (kp *keyOpProposalPool) List() []*keyOpProposal {
+	var result []*keyOpProposal
+	kp.lock.With(func() {
+		kp.expire()
+		for _, p := range kp.proposals {
+			result = append(result, p.copy())
+		}
+	})
+	pending := result[:0]
+	for _, p := range result {
+		if kp.node.keyOpIsPending(p.Op, p.PublicKeyHash) {
+			pending = append(pending, p)
+		} else {
+			kp.lock.With(func() {
+				delete(kp.proposals, p.key())
+			})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Time != pending[j].Time {
+			return pending[i].Time < pending[j].Time
+		}
+		return pending[i].key() < pending[j].key()
+	})
+	return pending
+}
+
+// Removes the expired proposals. Must be called with the lock held.
+func (kp *keyOpProposalPool) expire() {
+	for k, p := range kp.proposals {
+		if time.Since(time.Unix(p.Time, 0)) >= keyOpProposalTTL {
+			delete(kp.proposals, k)
+		}
+	}
+}
+
+// Returns a copy of the proposal, with its own map of the signatures
+func (p *keyOpProposal) copy() *keyOpProposal {
+	c := *p
+	c.Signatures = make(map[string]string, len(p.Signatures))
+	for k, v := range p.Signatures {
+		c.Signatures[k] = v
+	}
+	return &c
+}
+
+// Returns the total weight of the proposal's signatures which are valid at the next block's
+// height, and the weight the key op needs
+func (p *keyOpProposal) weight(node *Node) (weight int, threshold int, err error) {
+	chainHeight, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	height := chainHeight + 1
+	totalWeight, err := node.dbGetKeyOpWeight(height)
+	if err != nil {
+		return 0, 0, err
+	}
+	for signerKeyHash := range p.Signatures {
+		if w, _, err := node.keyOpVerifySignature(p.signature(signerKeyHash), height); err == nil {
+			weight += w
+		}
+	}
+	return weight, node.KeyOpThreshold(height, totalWeight), nil
+}
+
+// Sends the proposals to the peer
+func (p2pc *p2pConnection) sendKeyOps(proposals []*keyOpProposal) {
+	for _, p := range proposals {
+		p2pc.send(p2pMsgKeyOpStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pc.node.p2pEphemeralID,
+				Root:  p2pc.node.chainParams.GenesisBlockHash,
+				Msg:   p2pMsgKeyOp,
+			},
+			Proposal: p,
+		})
+	}
+}
+
+// Sends the proposal to all the peers except the one it came from. The signatories' nodes can
+// be anywhere, so it isn't routed by the peer capabilities.
+func (node *Node) p2pGossipKeyOp(p *keyOpProposal, from *p2pConnection) {
+	var peers []*p2pConnection
+	node.p2pPeers.lock.With(func() {
+		for p2pc := range node.p2pPeers.peers {
+			if p2pc != from {
+				peers = append(peers, p2pc)
+			}
+		}
+	})
+	// Sending can block, so it's done without holding the lock
+	for _, p2pc := range peers {
+		p2pc.sendKeyOps([]*keyOpProposal{p})
+	}
+}
+
+// keyop: the peer announces the signatures of a pending key op
+func (p2pc *p2pConnection) handleKeyOp(msg StrIfMap) {
+	var p keyOpProposal
+	if err := json.Unmarshal(jsonifyWhateverToBytes(msg["proposal"]), &p); err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	merged, err := p2pc.node.keyOpProposals.Add(&p)
+	if invalid, ok := err.(keyOpInvalidError); ok {
+		if invalid.stale {
+			p2pLog.Debug("Ignoring the stale key op proposal from", p2pc.address, err)
+			return
+		}
+		p2pc.misbehaved(p2pPenaltyInvalidKeyOp, fmt.Sprintf("has sent an invalid key op proposal: %v", err))
+		return
+	}
+	if err != nil {
+		p2pLog.Error("Cannot check the key op proposal from", p2pc.address, err)
+		return
+	}
+	if merged != nil {
+		p2pLog.Info("Key op", merged.Op, "for", merged.PublicKeyHash, "from", p2pc.address, "now has", len(merged.Signatures), "signatures")
+		go p2pc.node.p2pGossipKeyOp(merged, p2pc)
+	}
+}
+
+// Handles the key op requests on the control socket: GET lists the pending proposals with their
+// weights, and POST announces the signatures of a key op
+func (node *Node) keyOpServeProposals(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		result := []keyOpProposalInfo{}
+		for _, p := range node.keyOpProposals.List() {
+			weight, threshold, err := p.weight(node)
+			if err != nil {
+				chainLog.Error("Cannot weigh the key op proposal:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result = append(result, keyOpProposalInfo{keyOpProposal: p, Weight: weight, Threshold: threshold})
+		}
+		controlSendJSON(w, result)
+	case http.MethodPost:
+		var p keyOpProposal
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot parse the key op: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !node.keyOpIsPending(p.Op, p.PublicKeyHash) {
+			http.Error(w, "The key op is already in a block", http.StatusConflict)
+			return
+		}
+		merged, err := node.keyOpProposals.Add(&p)
+		if _, ok := err.(keyOpInvalidError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			chainLog.Error("Cannot check the key op proposal:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if merged != nil {
+			chainLog.Info("Key op", merged.Op, "for", merged.PublicKeyHash, "announced, it now has", len(merged.Signatures), "signatures")
+			go node.p2pGossipKeyOp(merged, nil)
+		}
+		controlSendJSON(w, StrIfMap{"signatures": len(p.Signatures)})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Announces my signatures of the key op to the peers, through the running node
+func (node *Node) keyOpAnnounce(op string, publicKeyHash string, metadataJSON string, signatures map[string][]byte) error {
+	p := &keyOpProposal{Op: op, PublicKeyHash: publicKeyHash, Metadata: metadataJSON, Time: time.Now().Unix(), Signatures: map[string]string{}}
+	for signerKeyHash, signature := range signatures {
+		p.Signatures[signerKeyHash] = hex.EncodeToString(signature)
+	}
+	return node.controlRequestBody(http.MethodPost, "/keyops", p, nil)
+}
+
+// Returns the signatures of the key op collected by the running node, or nil if it isn't running
+func (node *Node) keyOpCollectedSignatures(op string, publicKeyHash string, metadataJSON string) []*keyOpSignature {
+	var proposals []keyOpProposalInfo
+	if err := node.controlRequest(http.MethodGet, "/keyops", &proposals); err != nil {
+		return nil
+	}
+	var result []*keyOpSignature
+	for _, p := range proposals {
+		if p.Op != op || p.PublicKeyHash != publicKeyHash || p.Metadata != metadataJSON {
+			continue
+		}
+		for signerKeyHash := range p.Signatures {
+			result = append(result, p.signature(signerKeyHash))
+		}
+	}
+	return result
+}
+
+// Lists the key op proposals collected by the running node
+func (node *Node) actionListKeyOps() {
+	var proposals []keyOpProposalInfo
+	if err := node.controlRequest(http.MethodGet, "/keyops", &proposals); err != nil {
+		log.Fatalln("Cannot reach the running node:", err)
+	}
+	for _, p := range proposals {
+		var signers []string
+		for signerKeyHash := range p.Signatures {
+			signers = append(signers, signerKeyHash)
+		}
+		sort.Strings(signers)
+		fmt.Println(p.Op, p.PublicKeyHash, fmt.Sprintf("%d/%d", p.Weight, p.Threshold), time.Unix(p.Time, 0).Format(time.RFC3339), strings.Join(signers, ","), p.Metadata)
+	}
+}
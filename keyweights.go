@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+)
+
+/*
+ * Signatory weights and roles. The metadata of the key op adding a key ("A") can give the key
+ * a weight and a role, which are fixed for the key's lifetime: metadata ops ("M") can't change
+ * them. The signatures of an "A" key op with metadata cover the metadata too (see
+ * cryptoKeyMetadataHash), so the quorum agrees to them together with the key.
+ *
+ *   weight - a non-negative integer, 1 by default
+ *   role   - "admin" keys only sign key ops, "signer" keys only sign blocks, and "observer"
+ *            keys sign neither. Keys without a role can sign both.
+ *   activation_delay - the number of blocks after the one adding the key during which the
+ *            key can't sign anything yet, 0 by default. It limits the damage a compromised
+ *            quorum can do by adding keys of its own, as the other signatories have the time
+ *            to notice and react.
+ *
+ * A key op must be signed by keys which can sign key ops, with a total weight of at least
+ * KeyOpThreshold(). By default it's QuorumForHeight(); with key_op_weight_threshold in the
+ * chain params, it's that fraction of the total weight of the valid and active keys which can
+ * sign key ops.
+ */
+
+// The key metadata fields set by the "A" key ops
+const (
+	keyMetaWeight          = "weight"
+	keyMetaRole            = "role"
+	keyMetaActivationDelay = "activation_delay"
+)
+
+// Key roles
+const (
+	keyRoleAdmin    = "admin"
+	keyRoleSigner   = "signer"
+	keyRoleObserver = "observer"
+)
+
+// Returns the weight of the key with the given metadata
+func keyWeight(metadata map[string]string) int {
+	w, err := strconv.Atoi(metadata[keyMetaWeight])
+	if err != nil || w < 0 {
+		return 1
+	}
+	return w
+}
+
+// Returns the first block height at which the key added at the given height can sign
+func keyActivationHeight(addHeight int, metadata map[string]string) int {
+	delay, err := strconv.Atoi(metadata[keyMetaActivationDelay])
+	if err != nil || delay < 0 {
+		return addHeight
+	}
+	return addHeight + delay
+}
+
+// Returns nil if the key added at the given height can sign the block at the given height
+func keyCheckActive(addHeight int, metadata map[string]string, height int) error {
+	if a := keyActivationHeight(addHeight, metadata); height < a {
+		return fmt.Errorf("the key isn't active until block %d", a)
+	}
+	return nil
+}
+
+// Returns true if the key with the given metadata can sign blocks
+func keyCanSignBlocks(metadata map[string]string) bool {
+	role := metadata[keyMetaRole]
+	return role == "" || role == keyRoleSigner
+}
+
+// Returns true if the key with the given metadata can sign key ops
+func keyCanSignKeyOps(metadata map[string]string) bool {
+	role := metadata[keyMetaRole]
+	return role == "" || role == keyRoleAdmin
+}
+
+// Checks the weight and the role in the key metadata
+func validateKeyGovernanceMetadata(metadata map[string]string) error {
+	if s, ok := metadata[keyMetaWeight]; ok {
+		if w, err := strconv.Atoi(s); err != nil || w < 0 {
+			return fmt.Errorf("invalid key weight %s", strconv.Quote(s))
+		}
+	}
+	if s, ok := metadata[keyMetaActivationDelay]; ok {
+		if d, err := strconv.Atoi(s); err != nil || d < 0 {
+			return fmt.Errorf("invalid key activation delay %s", strconv.Quote(s))
+		}
+	}
+	switch role := metadata[keyMetaRole]; role {
+	case "", keyRoleAdmin, keyRoleSigner, keyRoleObserver:
+	default:
+		return fmt.Errorf("invalid key role %s", strconv.Quote(role))
+	}
+	return nil
+}
+
+// Returns nil if the new metadata of a key keeps its weight, role and activation delay
+func checkKeyGovernanceUnchanged(old, new map[string]string) error {
+	for _, field := range []string{keyMetaWeight, keyMetaRole, keyMetaActivationDelay} {
+		if old[field] != new[field] {
+			return fmt.Errorf("the key's %s can only be set when it's added", field)
+		}
+	}
+	return nil
+}
+
+// Returns the metadata JSON of the key added by addkey or signkeyop, with the weight, the
+// role and the activation delay given by -weight, -role and -activation-delay, and the
+// identity given by -dns and -cert, or "" if none of them is given
+func (node *Node) keyOpMetadataJSON() (string, error) {
+	metadata := map[string]string{}
+	if node.cfg.keyOpWeight != "" {
+		metadata[keyMetaWeight] = node.cfg.keyOpWeight
+	}
+	if node.cfg.keyOpRole != "" {
+		metadata[keyMetaRole] = node.cfg.keyOpRole
+	}
+	if node.cfg.keyOpDelay != "" {
+		metadata[keyMetaActivationDelay] = node.cfg.keyOpDelay
+	}
+	if node.cfg.keyOpDNS != "" {
+		metadata[keyMetaDNS] = node.cfg.keyOpDNS
+	}
+	if node.cfg.keyOpCert != "" {
+		chain, err := ioutil.ReadFile(node.cfg.keyOpCert)
+		if err != nil {
+			return "", err
+		}
+		metadata[keyMetaX509] = string(chain)
+	}
+	if len(metadata) == 0 {
+		return "", nil
+	}
+	if err := validateKeyGovernanceMetadata(metadata); err != nil {
+		return "", err
+	}
+	if err := validateKeyIdentityMetadata(metadata); err != nil {
+		return "", err
+	}
+	metadataJSON := string(jsonifyWhateverToBytes(metadata))
+	if len(metadataJSON) > blockKeysMaxMetadataSize {
+		return "", fmt.Errorf("the metadata is %d bytes, more than the maximum of %d", len(metadataJSON), blockKeysMaxMetadataSize)
+	}
+	return metadataJSON, nil
+}
+
+// Returns the total weight of the signatures a key op in the block at the given height needs.
+// totalWeight is the total weight of the valid and active keys which can sign key ops.
+func (node *Node) KeyOpThreshold(h int, totalWeight int) int {
+	if cp := node.chainParamsAt(h); cp.KeyOpWeightThreshold > 0 {
+		return int(math.Ceil(cp.KeyOpWeightThreshold * float64(totalWeight)))
+	}
+	return node.QuorumForHeight(h)
+}
+
+// Signs a key op. The signatures of "A" key ops with metadata cover the metadata too.
+func cryptoSignKeyOp(myPrivateKey *ecdsa.PrivateKey, op string, publicKeyHash string, metadataJSON string) ([]byte, error) {
+	if op == "A" && metadataJSON != "" {
+		return cryptoSignKeyMetadata(myPrivateKey, publicKeyHash, metadataJSON)
+	}
+	return cryptoSignPublicKeyHash(myPrivateKey, publicKeyHash)
+}
+
+// Returns nil if the key op's signature by the given key is valid
+func cryptoVerifyKeyOpSignature(publicKey *ecdsa.PublicKey, kop *BlockKeyOp) error {
+	if kop.op == "A" && kop.metadataJSON != "" {
+		return cryptoVerifyKeyMetadataSignature(publicKey, kop.publicKeyHash, kop.metadataJSON, kop.signature)
+	}
+	return cryptoVerifyPublicKeyHashSignature(publicKey, kop.publicKeyHash, kop.signature)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The addresses the p2p and HTTP servers listen on. By default they listen on all the
+ * interfaces, on the p2p and HTTP ports. p2p_listen and http_listen (or -p2p-listen and
+ * -http-listen, comma-separated) list the addresses to listen on instead, as host:port, or as
+ * a host only, with the default port, e.g. ["127.0.0.1:2018", "[::1]:2018"] for a node behind
+ * a reverse proxy.
+ */
+
+// Splits a comma-separated list, dropping the empty items
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Returns the listen addresses as host:port, with the default port added where it's missing
+func listenAddresses(list []string, defaultPort int) ([]string, error) {
+	if len(list) == 0 {
+		return []string{":" + strconv.Itoa(defaultPort)}, nil
+	}
+	var result []string
+	seen := map[string]bool{}
+	for _, a := range list {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			// A host without the port
+			host, port = strings.Trim(a, "[]"), strconv.Itoa(defaultPort)
+		}
+		if host != "" && net.ParseIP(host) == nil && host != "localhost" {
+			return nil, fmt.Errorf("%q: the host must be an IP address", a)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("%q: invalid port", a)
+		}
+		address := net.JoinHostPort(host, port)
+		if !seen[address] {
+			seen[address] = true
+			result = append(result, address)
+		}
+	}
+	return result, nil
+}
+
+// Returns the addresses the p2p server listens on
+func (node *Node) p2pListenAddresses() ([]string, error) {
+	return listenAddresses(node.cfg.P2pListen, node.cfg.P2pPort)
+}
+
+// Returns the addresses the HTTP server listens on
+func (node *Node) httpListenAddresses() ([]string, error) {
+	return listenAddresses(node.cfg.HTTPListen, node.cfg.HTTPPort)
+}
+
+// Returns the port of the HTTP server, to be given to peers: the port of the first address it
+// listens on, or of the first p2p address with single_port, see singleport.go
+func (node *Node) httpListenPort() int {
+	addresses, err := node.httpListenAddresses()
+	if node.cfg.SinglePort {
+		addresses, err = node.p2pListenAddresses()
+	}
+	if err != nil {
+		return node.cfg.HTTPPort
+	}
+	_, port, _ := net.SplitHostPort(addresses[0])
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Opens listeners on all the addresses, closing them all if one fails
+func listenAll(addresses []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, a := range addresses {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("cannot listen on %s: %v", a, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
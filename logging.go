@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * Leveled logging. Each subsystem has its own logger, which tags the messages with the
+ * subsystem's name, and the messages below the configured level for the subsystem are
+ * discarded. The log_level setting is the default level, optionally followed by levels for
+ * individual subsystems, e.g. "info,p2p=debug".
+ *
+ * The messages are written as text (the default) or as JSON lines, to stderr or to log_file,
+ * which is rotated when it grows over log_max_size MB, keeping log_max_files old files. The
+ * messages from the standard log package, which include the fatal errors and panics, are
+ * written the same way at the info level, but are never discarded.
+ */
+
+type logLevel int
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+	logError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// The defaults for log rotation
+const logDefaultMaxSize = 100 // MB
+const logDefaultMaxFiles = 5
+
+// logger writes the messages of one subsystem
+type logger struct {
+	subsystem string
+}
+
+// The loggers of the subsystems
+var (
+	p2pLog    = &logger{"p2p"}
+	chainLog  = &logger{"blockchain"}
+	dbLog     = &logger{"db"}
+	miningLog = &logger{"mining"}
+)
+
+var logState struct {
+	lock         WithMutex
+	level        logLevel
+	levels       map[string]logLevel // Per subsystem
+	json         bool
+	out          io.Writer
+	file         *os.File
+	fileName     string
+	fileSize     int64
+	maxSize      int64
+	maxFiles     int
+	rotateFailed bool
+}
+
+func init() {
+	logState.level = logInfo
+	logState.out = os.Stderr
+}
+
+// Parses a log_level setting into the default level and the per-subsystem levels
+func logParseLevels(s string) (logLevel, map[string]logLevel, error) {
+	level := logInfo
+	levels := map[string]logLevel{}
+	if s == "" {
+		return level, levels, nil
+	}
+	for i, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		subsystem := ""
+		if eq := strings.Index(part, "="); eq != -1 {
+			subsystem, part = part[:eq], part[eq+1:]
+		} else if i > 0 {
+			return 0, nil, fmt.Errorf("expecting subsystem=level after the default level, got %q", part)
+		}
+		l, err := logParseLevel(part)
+		if err != nil {
+			return 0, nil, err
+		}
+		if subsystem == "" {
+			level = l
+		} else {
+			levels[subsystem] = l
+		}
+	}
+	return level, levels, nil
+}
+
+func logParseLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Returns the log file name from the config, relative to the data directory
+func (node *Node) logFileName() string {
+	if node.cfg.LogFile == "" || filepath.IsAbs(node.cfg.LogFile) {
+		return node.cfg.LogFile
+	}
+	return filepath.Join(node.cfg.DataDir, node.cfg.LogFile)
+}
+
+// Sets up the logging from the config. The standard log package is redirected to it.
+func (node *Node) logInit() error {
+	level, levels, err := logParseLevels(node.cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	var size int64
+	fileName := node.logFileName()
+	if fileName != "" {
+		if f, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size = st.Size()
+	}
+	logState.lock.With(func() {
+		logState.level = level
+		logState.levels = levels
+		logState.json = node.cfg.LogFormat == "json"
+		if f != nil {
+			logState.out = f
+			logState.file = f
+			logState.fileName = fileName
+			logState.fileSize = size
+		}
+		logState.maxSize = int64(node.cfg.LogMaxSize) * 1024 * 1024
+		if logState.maxSize <= 0 {
+			logState.maxSize = logDefaultMaxSize * 1024 * 1024
+		}
+		logState.maxFiles = node.cfg.LogMaxFiles
+		if logState.maxFiles <= 0 {
+			logState.maxFiles = logDefaultMaxFiles
+		}
+	})
+	log.SetFlags(0)
+	log.SetOutput(logStdWriter{})
+	return nil
+}
+
+// Returns true if the messages of the subsystem at the level are written
+func logEnabled(subsystem string, level logLevel) (enabled bool) {
+	logState.lock.With(func() {
+		min, ok := logState.levels[subsystem]
+		if !ok {
+			min = logState.level
+		}
+		enabled = level >= min
+	})
+	return
+}
+
+// Writes a log message
+func logWrite(subsystem string, level logLevel, msg string) {
+	now := time.Now()
+	var line []byte
+	logState.lock.With(func() {
+		if logState.json {
+			entry := StrIfMap{"time": now.UTC().Format(time.RFC3339Nano), "level": level.String(), "msg": msg}
+			if subsystem != "" {
+				entry["subsystem"] = subsystem
+			}
+			line = append(jsonifyWhateverToBytes(entry), '\n')
+		} else {
+			tag := ""
+			if subsystem != "" {
+				tag = "[" + subsystem + "] "
+			}
+			line = []byte(fmt.Sprintf("%s %-5s %s%s\n", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), tag, msg))
+		}
+		if logState.file != nil && logState.fileSize+int64(len(line)) > logState.maxSize {
+			logRotate()
+		}
+		n, _ := logState.out.Write(line)
+		logState.fileSize += int64(n)
+	})
+}
+
+// Renames the log file to .1, the .1 file to .2 and so on, deleting the oldest one, and
+// starts a new log file. Called with the lock held.
+func logRotate() {
+	name := logState.fileName
+	logState.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", name, logState.maxFiles))
+	for i := logState.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+	}
+	err := os.Rename(name, name+".1")
+	f, err2 := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err2 != nil {
+		// Nowhere else to log to
+		logState.out = os.Stderr
+		logState.file = nil
+		fmt.Fprintln(os.Stderr, "Cannot open the log file:", err2)
+		return
+	}
+	logState.out = f
+	logState.file = f
+	logState.fileSize = 0
+	if err != nil && !logState.rotateFailed {
+		logState.rotateFailed = true
+		fmt.Fprintln(os.Stderr, "Cannot rotate the log file:", err)
+	}
+}
+
+// logStdWriter receives the messages from the standard log package
+type logStdWriter struct{}
+
+// Write writes the message regardless of the configured level: the standard log package is
+// used for the fatal errors and panics, which must never be discarded.
+func (logStdWriter) Write(p []byte) (int, error) {
+	logWrite("", logInfo, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+func (l *logger) log(level logLevel, v ...interface{}) {
+	if logEnabled(l.subsystem, level) {
+		logWrite(l.subsystem, level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	}
+}
+
+func (l *logger) logf(level logLevel, format string, v ...interface{}) {
+	if logEnabled(l.subsystem, level) {
+		logWrite(l.subsystem, level, fmt.Sprintf(format, v...))
+	}
+}
+
+// Debug logs the arguments, formatted as with fmt.Println, at the debug level
+func (l *logger) Debug(v ...interface{}) { l.log(logDebug, v...) }
+
+// Debugf logs a message formatted as with fmt.Printf at the debug level
+func (l *logger) Debugf(format string, v ...interface{}) { l.logf(logDebug, format, v...) }
+
+// Info logs the arguments, formatted as with fmt.Println, at the info level
+func (l *logger) Info(v ...interface{}) { l.log(logInfo, v...) }
+
+// Infof logs a message formatted as with fmt.Printf at the info level
+func (l *logger) Infof(format string, v ...interface{}) { l.logf(logInfo, format, v...) }
+
+// Warn logs the arguments, formatted as with fmt.Println, at the warn level
+func (l *logger) Warn(v ...interface{}) { l.log(logWarn, v...) }
+
+// Warnf logs a message formatted as with fmt.Printf at the warn level
+func (l *logger) Warnf(format string, v ...interface{}) { l.logf(logWarn, format, v...) }
+
+// Error logs the arguments, formatted as with fmt.Println, at the error level
+func (l *logger) Error(v ...interface{}) { l.log(logError, v...) }
+
+// Errorf logs a message formatted as with fmt.Printf at the error level
+func (l *logger) Errorf(format string, v ...interface{}) { l.logf(logError, format, v...) }
+
+// Fatal logs the arguments at the error level and exits
+func (l *logger) Fatal(v ...interface{}) {
+	l.log(logError, v...)
+	os.Exit(1)
+}
+
+// Fatalf logs a formatted message at the error level and exits
+func (l *logger) Fatalf(format string, v ...interface{}) {
+	l.logf(logError, format, v...)
+	os.Exit(1)
+}
@@ -21,33 +21,61 @@ type sysEventMessage struct {
 var sysEventChannel = make(chan sysEventMessage, 5)
 
 func main() {
-	rand.Seed(p2pEphemeralID + getNowUTC()) // Initialise weak RNG with strong RNG
+	node := newNode()
+	rand.Seed(node.p2pEphemeralID + getNowUTC()) // Initialise weak RNG with strong RNG
 	log.Println("Starting up", p2pClientVersionString, "...")
-	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
 
-	configInit()
-	if processPreBlockchainActions() {
+	node.configInit()
+	if node.processPreBlockchainActions() {
 		return
 	}
-	dbInit()
-	cryptoInit()
-	blockchainInit(true)
-	if processActions() {
+	node.dbInit()
+	node.cryptoInit()
+	node.blockchainInit(true)
+	if node.processActions() {
 		return
 	}
-	log.Printf("Ephemeral ID: %x\n", p2pEphemeralID)
-	go p2pCoordinator.Run()
-	go p2pServer()
-	go p2pClient()
-	go blockWebServer()
+	node.start()
+	runNodes([]*Node{node})
+}
 
+// Starts the node's servers and background tasks
+func (node *Node) start() {
+	log.Printf("Ephemeral ID: %x\n", node.p2pEphemeralID)
+	if node.cfg.recordDir != "" {
+		node.p2pRecorderInit(node.cfg.recordDir)
+	}
+	node.metricsStart()
+	node.webhooksStart()
+	node.mempoolStart()
+	node.softForksStart()
+	node.reportsStart()
+	node.userIndexesStart()
+	node.combinedDbStart()
+	go node.p2pCoordinator.Run()
+	go node.p2pServer()
+	go node.p2pClient()
+	go node.blockWebServer()
+	go node.controlServer()
+	go node.backupScheduler()
+	go node.blockProducer()
+	go node.anchorScheduler()
+}
+
+// Runs the started nodes until the process is asked to quit, then stops them and exits
+func runNodes(nodes []*Node) {
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		select {
 		case msg := <-sysEventChannel:
 			switch msg.event {
 			case eventQuit:
 				log.Println("Exiting")
+				for _, node := range nodes {
+					node.controlShutdown()
+					node.blockDBs.Flush()
+				}
 				os.Exit(msg.idata)
 			}
 		case sig := <-sigChannel:
@@ -61,5 +89,4 @@ func main() {
 			}
 		}
 	}
-
 }
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * The mempool of pending records. Clients submit individual rows, signed with their keys, to
+ * any node: over the control socket with the submitrecord command, or with POST /api/records
+ * on the HTTP server, which only accepts the records signed by the chain's keys unless it
+ * requires authentication. The nodes gossip the records to each other with the records message, and
+ * a node producing blocks (see blockproducer.go) includes the pending records in its next
+ * block, one table per record table, with the _record_id, _record_signer, _record_signature
+ * and _record_time columns added. When a block with records is accepted, the records are
+ * removed from the mempools of all the nodes.
+ *
+ * A record's ID is the SHA256 hash of its table name, its data (a JSON object, with the keys
+ * sorted and without whitespace), its Unix time and the hex-encoded public key of the signer,
+ * separated by newlines, and the signature is the signature of the ID. The mempool is kept in
+ * memory, and the records expire after mempoolRecordTTL.
+ */
+
+// How long a record is kept in the mempool, waiting for a block
+const mempoolRecordTTL = 24 * time.Hour
+
+// The maximum number of records in the mempool
+const mempoolMaxRecords = 10000
+
+// The maximum size of a record's data
+const mempoolMaxRecordSize = 64 * 1024
+
+// The maximum number of records sent in one records message
+const mempoolGossipBatch = 500
+
+// The message carrying pending records
+const p2pMsgRecords = "records"
+
+type p2pMsgRecordsStruct struct {
+	p2pMsgHeader
+	Records []*mempoolRecord `json:"records"`
+}
+
+// mempoolRecord is a signed row waiting to be included in a block
+type mempoolRecord struct {
+	Table     string `json:"table"`
+	Data      string `json:"data"`   // A JSON object with the row's columns
+	Time      int64  `json:"time"`   // Unix time of the submission
+	PublicKey string `json:"pubkey"` // Hex-encoded public key of the signer
+	Signature string `json:"signature"`
+	ID        string `json:"id,omitempty"`     // Filled in by the node
+	Signer    string `json:"signer,omitempty"` // Public key hash, filled in by the node
+}
+
+type mempoolType struct {
+	lock    WithMutex
+	records map[string]*mempoolRecord
+	size    int64
+	removed *StringSetWithExpiry // Records which have been included in blocks or dropped
+}
+
+// Returns the record's ID
+func (rec *mempoolRecord) hash() string {
+	hash := sha256.Sum256([]byte(rec.Table + "\n" + rec.Data + "\n" + fmt.Sprint(rec.Time) + "\n" + rec.PublicKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// Normalizes the record's data into the form which is signed. Returns the decoded data.
+func (rec *mempoolRecord) canonicalize() (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(rec.Data))
+	dec.UseNumber()
+	var data map[string]interface{}
+	if err := dec.Decode(&data); err != nil {
+		return nil, fmt.Errorf("the record data must be a JSON object: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("the record has no columns")
+	}
+	// SQLite compares the column names case-insensitively
+	seen := map[string]bool{}
+	for column := range data {
+		if column == "" || strings.HasPrefix(column, "_") {
+			return nil, fmt.Errorf("%q is not a valid column name", column)
+		}
+		if seen[strings.ToLower(column)] {
+			return nil, fmt.Errorf("the column %q is duplicated", column)
+		}
+		seen[strings.ToLower(column)] = true
+	}
+	rec.Data = string(jsonifyWhateverToBytes(data))
+	return data, nil
+}
+
+// Checks the record and its signature, and fills in its ID and signer
+func (rec *mempoolRecord) validate() error {
+	if !blockCreateValidTableName(rec.Table) {
+		return fmt.Errorf("%s is not a valid table name", rec.Table)
+	}
+	if len(rec.Data) > mempoolMaxRecordSize {
+		return fmt.Errorf("the record data is larger than %d bytes", mempoolMaxRecordSize)
+	}
+	if _, err := rec.canonicalize(); err != nil {
+		return err
+	}
+	t := time.Unix(rec.Time, 0)
+	if time.Since(t) >= mempoolRecordTTL {
+		return fmt.Errorf("the record has expired")
+	}
+	if time.Until(t) > 10*time.Minute {
+		return fmt.Errorf("the record's time is in the future")
+	}
+	publicKeyBytes, err := hex.DecodeString(rec.PublicKey)
+	if err != nil {
+		return fmt.Errorf("cannot decode the public key: %v", err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(publicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("cannot parse the public key: %v", err)
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the public key is not an ECDSA key")
+	}
+	rec.ID = rec.hash()
+	rec.Signer = getPubKeyHash(publicKeyBytes)
+	if err = cryptoVerifyHex(ecdsaKey, rec.ID, rec.Signature); err != nil {
+		return fmt.Errorf("invalid record signature: %v", err)
+	}
+	return nil
+}
+
+// Adds a validated record to the mempool. Returns false if it's already there, has already
+// been included in a block or dropped, or the mempool is full.
+func (m *mempoolType) Add(rec *mempoolRecord) bool {
+	if m.removed.Has(rec.ID) {
+		return false
+	}
+	added := false
+	m.lock.With(func() {
+		m.expire()
+		if _, ok := m.records[rec.ID]; ok || len(m.records) >= mempoolMaxRecords {
+			return
+		}
+		m.records[rec.ID] = rec
+		m.size += int64(len(rec.Data))
+		added = true
+	})
+	return added
+}
+
+// Removes the records, which won't be added again until they expire. Returns the number of
+// records which were in the mempool.
+func (m *mempoolType) Remove(ids []string) int {
+	n := 0
+	for _, id := range ids {
+		m.removed.Add(id)
+	}
+	m.lock.With(func() {
+		for _, id := range ids {
+			if rec, ok := m.records[id]; ok {
+				m.size -= int64(len(rec.Data))
+				delete(m.records, id)
+				n++
+			}
+		}
+	})
+	return n
+}
+
+// Returns the pending records, ordered by time, and the total size of their data
+func (m *mempoolType) List() ([]*mempoolRecord, int64) {
+	var result []*mempoolRecord
+	var size int64
+	m.lock.With(func() {
+		m.expire()
+		for _, rec := range m.records {
+			result = append(result, rec)
+		}
+		size = m.size
+	})
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Time != result[j].Time {
+			return result[i].Time < result[j].Time
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, size
+}
+
+// Returns the number of pending records
+func (m *mempoolType) Len() (n int) {
+	m.lock.With(func() {
+		n = len(m.records)
+	})
+	return
+}
+
+// Removes the expired records. Must be called with the lock held.
+func (m *mempoolType) expire() {
+	for id, rec := range m.records {
+		if time.Since(time.Unix(rec.Time, 0)) >= mempoolRecordTTL {
+			m.size -= int64(len(rec.Data))
+			delete(m.records, id)
+		}
+	}
+}
+
+// Validates the records and adds them to the mempool, returning the ones which are new
+func (node *Node) mempoolAddRecords(records []*mempoolRecord) ([]*mempoolRecord, error) {
+	var added []*mempoolRecord
+	for _, rec := range records {
+		if err := rec.validate(); err != nil {
+			return added, err
+		}
+		if node.mempool.Add(rec) {
+			added = append(added, rec)
+		}
+	}
+	return added, nil
+}
+
+// Removes the records included in accepted blocks from the mempool
+func (node *Node) mempoolStart() {
+	node.nodeEvents.Handle("mempool", []string{eventBlockAccepted}, func(ev nodeEvent) {
+		hash, _ := ev.Data["hash"].(string)
+		if hash == "" || node.mempool.Len() == 0 {
+			return
+		}
+		ids, err := node.blockRecordIDs(hash)
+		if err != nil {
+			chainLog.Warn("Cannot read the records of block", hash, err)
+			return
+		}
+		if n := node.mempool.Remove(ids); n > 0 {
+			chainLog.Info("Block", hash, "includes", n, "pending records")
+		}
+	})
+}
+
+// Returns the IDs of the records included in the block
+func (node *Node) blockRecordIDs(hash string) ([]string, error) {
+	bdb, err := node.blockDBs.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer node.blockDBs.Release(bdb)
+	tables, err := bdb.TableNames()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, table := range tables {
+		columns, err := bdb.ColumnNames(table)
+		if err != nil {
+			return nil, err
+		}
+		if !inStrings("_record_id", columns) {
+			continue
+		}
+		tableIDs, err := dbQueryStrings(bdb, fmt.Sprintf("SELECT _record_id FROM %s", dbQuoteIdentifier(table)))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, tableIDs...)
+	}
+	return ids, nil
+}
+
+// Sends the records to the peer
+func (p2pc *p2pConnection) sendRecords(records []*mempoolRecord) {
+	for len(records) > 0 {
+		n := len(records)
+		if n > mempoolGossipBatch {
+			n = mempoolGossipBatch
+		}
+		p2pc.send(p2pMsgRecordsStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pc.node.p2pEphemeralID,
+				Root:  p2pc.node.chainParams.GenesisBlockHash,
+				Msg:   p2pMsgRecords,
+			},
+			Records: records[:n],
+		})
+		records = records[n:]
+	}
+}
+
+// Sends the new records to the peers which take them, except the one they came from. If none
+// of them does, the records are sent to all the peers, to be passed on to the block producers.
+// The peers only take the records signed by the chain's keys, so the others, submitted by the
+// authenticated clients, stay in this node's mempool.
+func (node *Node) p2pGossipRecords(records []*mempoolRecord, from *p2pConnection) {
+	var known []*mempoolRecord
+	for _, rec := range records {
+		if node.mempoolKnownSigner(rec.Signer) {
+			known = append(known, rec)
+		}
+	}
+	records = known
+	if len(records) == 0 {
+		return
+	}
+	var peers, others []*p2pConnection
+	node.p2pPeers.lock.With(func() {
+		for p2pc := range node.p2pPeers.peers {
+			if p2pc == from {
+				continue
+			}
+			if p2pc.takesRecords() {
+				peers = append(peers, p2pc)
+			} else {
+				others = append(others, p2pc)
+			}
+		}
+	})
+	if len(peers) == 0 {
+		peers = others
+	}
+	// Sending can block, so it's done without holding the lock
+	for _, p2pc := range peers {
+		p2pc.sendRecords(records)
+	}
+}
+
+// records: the peer sends pending records. Like on the HTTP server without authentication,
+// only the records signed by the chain's keys are accepted. The records of revoked keys can
+// come from the peers which haven't seen the revocation yet, but the nodes never gossip the
+// records of keys which aren't in the chain, so the peer is penalized for those.
+func (p2pc *p2pConnection) handleRecords(msg StrIfMap) {
+	var records []*mempoolRecord
+	if err := json.Unmarshal(jsonifyWhateverToBytes(msg["records"]), &records); err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	var known []*mempoolRecord
+	unknown := 0
+	for _, rec := range records {
+		if err := rec.validate(); err != nil {
+			p2pLog.Warn("Invalid record from", p2pc.address, err)
+			p2pc.score.recordError()
+			continue
+		}
+		if p2pc.node.mempoolKnownSigner(rec.Signer) {
+			known = append(known, rec)
+		} else if exists, err := p2pc.node.dbPublicKeyExists(rec.Signer); err == nil && !exists {
+			unknown++
+		}
+	}
+	if unknown > 0 && p2pc.misbehaved(p2pPenaltyUnknownSigner, fmt.Sprintf("has sent %d records not signed by the chain's keys", unknown)) {
+		return
+	}
+	added, err := p2pc.node.mempoolAddRecords(known)
+	if err != nil {
+		p2pLog.Warn("Invalid record from", p2pc.address, err)
+		p2pc.score.recordError()
+	}
+	if len(added) > 0 {
+		p2pLog.Debug("Received", len(added), "new records from", p2pc.address)
+		go p2pc.node.p2pGossipRecords(added, p2pc)
+	}
+}
+
+// Creates the tables for the records in the block, with the record metadata columns, and
+// returns the records which are in the block. The table and the column names are compared in
+// lower case, as SQLite compares them case-insensitively, and their first spelling is used.
+// The records for the tables which are already in the block, created from the pending files,
+// are left in the mempool for a later block, and the records which can't be added are dropped,
+// so that they can't stop the block production.
+func (node *Node) blockCreateAddRecords(db *sql.DB, records []*mempoolRecord) ([]*mempoolRecord, error) {
+	existing, err := dbQueryStrings(db, "SELECT lower(name) FROM sqlite_master WHERE type='table'")
+	if err != nil {
+		return nil, err
+	}
+	byTable := map[string][]*mempoolRecord{}
+	var tables []string
+	for _, rec := range records {
+		table := strings.ToLower(rec.Table)
+		if inStrings(table, existing) {
+			continue
+		}
+		if _, ok := byTable[table]; !ok {
+			tables = append(tables, table)
+		}
+		byTable[table] = append(byTable[table], rec)
+	}
+	sort.Strings(tables)
+	var included, dropped []*mempoolRecord
+	for _, table := range tables {
+		var columns []string
+		names := map[string]string{}
+		var objects []map[string]interface{}
+		var tableRecords []*mempoolRecord
+		for _, rec := range byTable[table] {
+			data, err := rec.canonicalize()
+			if err != nil {
+				chainLog.Warn("Dropping record", rec.ID, err)
+				dropped = append(dropped, rec)
+				continue
+			}
+			obj := map[string]interface{}{}
+			for name, value := range data {
+				column := strings.ToLower(name)
+				if _, ok := names[column]; !ok {
+					names[column] = name
+					columns = append(columns, column)
+				}
+				obj[column] = value
+			}
+			objects = append(objects, obj)
+			tableRecords = append(tableRecords, rec)
+		}
+		if len(tableRecords) == 0 {
+			continue
+		}
+		sort.Strings(columns)
+		rows := make([][]interface{}, len(objects))
+		for i, obj := range objects {
+			rec := tableRecords[i]
+			row := make([]interface{}, 0, len(columns)+4)
+			for _, column := range columns {
+				row = append(row, blockCreateJSONValue(obj[column]))
+			}
+			rows[i] = append(row, rec.ID, rec.Signer, rec.Signature, rec.Time)
+		}
+		for i, column := range columns {
+			columns[i] = names[column]
+		}
+		columns = append(columns, "_record_id", "_record_signer", "_record_signature", "_record_time")
+		table = tableRecords[0].Table
+		log.Println("Creating table", table, "with", len(rows), "pending records")
+		skipped, err := blockCreateTableRows(db, table, columns, rows, true)
+		if err != nil {
+			chainLog.Warn("Dropping the", len(tableRecords), "records of", table, err)
+			dropped = append(dropped, tableRecords...)
+			continue
+		}
+		for i, rec := range tableRecords {
+			if len(skipped) > 0 && skipped[0] == i {
+				chainLog.Warn("Dropping record", rec.ID, "which can't be added to", table)
+				dropped = append(dropped, rec)
+				skipped = skipped[1:]
+				continue
+			}
+			included = append(included, rec)
+		}
+	}
+	if len(dropped) > 0 {
+		ids := make([]string, len(dropped))
+		for i, rec := range dropped {
+			ids[i] = rec.ID
+		}
+		node.mempool.Remove(ids)
+	}
+	return included, nil
+}
+
+// Handles the mempool requests on the control socket: GET lists the pending records, and POST
+// submits a signed record
+func (node *Node) mempoolServeRecords(w http.ResponseWriter, r *http.Request) {
+	node.mempoolServe(w, r, false)
+}
+
+// Handles the mempool requests on the HTTP server. Anyone can reach it if it doesn't require
+// authentication, so only the records signed by the chain's keys are accepted then.
+func (node *Node) mempoolServeWebRecords(w http.ResponseWriter, r *http.Request) {
+	node.mempoolServe(w, r, !node.blockWebAuthRequired())
+}
+
+// Returns true if the signer is a valid key of the chain
+func (node *Node) mempoolKnownSigner(publicKeyHash string) bool {
+	dbpk, err := node.dbGetPublicKey(publicKeyHash)
+	return err == nil && !dbpk.isRevoked
+}
+
+func (node *Node) mempoolServe(w http.ResponseWriter, r *http.Request, knownSigners bool) {
+	switch r.Method {
+	case http.MethodGet:
+		records, _ := node.mempool.List()
+		if records == nil {
+			records = []*mempoolRecord{}
+		}
+		controlSendJSON(w, records)
+	case http.MethodPost:
+		var rec mempoolRecord
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*mempoolMaxRecordSize)).Decode(&rec); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot parse the record: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := rec.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if knownSigners && !node.mempoolKnownSigner(rec.Signer) {
+			http.Error(w, "The record isn't signed by a key of the chain", http.StatusForbidden)
+			return
+		}
+		added, err := node.mempoolAddRecords([]*mempoolRecord{&rec})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(added) == 0 {
+			http.Error(w, "The record is already pending, has been included in a block, or the mempool is full", http.StatusConflict)
+			return
+		}
+		log.Println("Record", rec.ID, "for", rec.Table, "submitted by", rec.Signer)
+		go node.p2pGossipRecords(added, nil)
+		controlSendJSON(w, StrIfMap{"id": rec.ID})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Signs a record for the table with the key selected by -key, and submits it to the running
+// node
+func (node *Node) actionSubmitRecord(table string, data string) {
+	keypair, _, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&keypair.PublicKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rec := &mempoolRecord{Table: table, Data: data, Time: time.Now().Unix(), PublicKey: hex.EncodeToString(publicKeyBytes)}
+	if _, err = rec.canonicalize(); err != nil {
+		log.Fatalln(err)
+	}
+	if rec.Signature, err = cryptoSignHex(keypair, rec.hash()); err != nil {
+		log.Fatalln(err)
+	}
+	var result StrIfMap
+	if err = node.controlRequestBody(http.MethodPost, "/records", rec, &result); err != nil {
+		log.Fatalln("Cannot submit the record to the running node:", err)
+	}
+	fmt.Println(result["id"])
+}
+
+// Lists the records pending in the running node's mempool
+func (node *Node) actionListRecords() {
+	var records []*mempoolRecord
+	if err := node.controlRequest(http.MethodGet, "/records", &records); err != nil {
+		log.Fatalln("Cannot reach the running node:", err)
+	}
+	for _, rec := range records {
+		fmt.Println(rec.ID, time.Unix(rec.Time, 0).Format(time.RFC3339), rec.Signer, rec.Table, rec.Data)
+	}
+}
+
+// Drops a record from the running node's mempool
+func (node *Node) actionDropRecord(id string) {
+	if err := node.controlRequest(http.MethodPost, "/records/drop?id="+id, nil); err != nil {
+		log.Fatalln("Cannot drop the record:", err)
+	}
+	log.Println("Dropped record", id)
+}
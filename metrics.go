@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+ * Metrics. The node counts the events published on the event bus, and serves the counts,
+ * together with the blockchain height and the number of peers, at the /metrics URL in the
+ * Prometheus text format. Like /peers, it's only available to local clients.
+ */
+
+// Subscribes the metrics to all the events on the event bus
+func (node *Node) metricsStart() {
+	node.nodeEvents.Handle("metrics", nil, func(ev nodeEvent) {
+		var count *int64
+		node.nodeMetrics.lock.With(func() {
+			if count = node.nodeMetrics.events[ev.Event]; count == nil {
+				count = new(int64)
+				node.nodeMetrics.events[ev.Event] = count
+			}
+		})
+		atomic.AddInt64(count, 1)
+	})
+}
+
+// Serves the metrics in the Prometheus text format
+func (node *Node) blockWebSendMetrics(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	peers, bestPeerHeight := node.p2pPeers.Stats()
+	fmt.Fprintln(w, "# TYPE daisy_blockchain_height gauge")
+	fmt.Fprintln(w, "daisy_blockchain_height", height)
+	fmt.Fprintln(w, "# TYPE daisy_best_peer_height gauge")
+	fmt.Fprintln(w, "daisy_best_peer_height", bestPeerHeight)
+	fmt.Fprintln(w, "# TYPE daisy_peers gauge")
+	fmt.Fprintln(w, "daisy_peers", peers)
+	counts := map[string]int64{}
+	node.nodeMetrics.lock.With(func() {
+		for event, count := range node.nodeMetrics.events {
+			counts[event] = atomic.LoadInt64(count)
+		}
+	})
+	events := make([]string, 0, len(counts))
+	for event := range counts {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	fmt.Fprintln(w, "# TYPE daisy_events_total counter")
+	for _, event := range events {
+		fmt.Fprintf(w, "daisy_events_total{event=%q} %d\n", event, counts[event])
+	}
+}
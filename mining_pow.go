@@ -1,38 +1,311 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Returns the target as a 32-byte big-endian number, comparable with the hashes
+func powTargetBytes(target *big.Int) []byte {
+	b := make([]byte, sha256.Size)
+	if target.BitLen() > 8*sha256.Size {
+		// Every hash meets it
+		for i := range b {
+			b[i] = 0xff
+		}
+		return b
+	}
+	return target.FillBytes(b)
+}
+
+// The time between the mining progress reports
+const mineProgressInterval = 5 * time.Second
+
+// The number of hashes a worker computes before adding them to the shared counter
+const mineCountBatch = 1024
+
+// mineProgress describes the progress of mining a block
+type mineProgress struct {
+	File         string    `json:"file"`
+	Started      time.Time `json:"started"`
+	Hashes       uint64    `json:"hashes"`
+	Elapsed      string    `json:"elapsed"`
+	Hashrate     float64   `json:"hashrate"`      // Hashes per second
+	ExpectedTime string    `json:"expected_time"` // Expected time to find a solution, from now
+	Done         bool      `json:"done"`
+}
+
+// Returns the progress of the current or the last mining, or nil if there hasn't been any
+func (node *Node) mineGetStatus() (p *mineProgress) {
+	node.mineStatus.lock.With(func() {
+		if node.mineStatus.last != nil {
+			c := *node.mineStatus.last
+			p = &c
+		}
+	})
+	return
+}
+
+// Returns the expected number of hashes needed to find one meeting the target
+func mineExpectedHashes(target *big.Int) float64 {
+	space := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), 256))
+	f, _ := new(big.Float).Quo(space, new(big.Float).SetInt(new(big.Int).Add(target, big.NewInt(1)))).Float64()
+	return f
+}
+
+// Computes a progress report
+func newMineProgress(fileName string, started time.Time, hashes uint64, expectedHashes float64, done bool) mineProgress {
+	elapsed := time.Since(started)
+	p := mineProgress{
+		File:    fileName,
+		Started: started,
+		Hashes:  hashes,
+		Elapsed: elapsed.Round(time.Second).String(),
+		Done:    done,
+	}
+	if elapsed > 0 {
+		p.Hashrate = float64(hashes) / elapsed.Seconds()
+	}
+	if p.Hashrate > 0 && !done {
+		// Every hash is an independent try, so the expected time doesn't depend on the hashes
+		// already computed
+		p.ExpectedTime = mineFormatExpectedTime(expectedHashes / p.Hashrate)
+	}
+	return p
+}
+
+// Formats the expected time to a solution, which with a hard target and a slow hash rate can be
+// longer than a time.Duration can hold
+func mineFormatExpectedTime(seconds float64) string {
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return fmt.Sprintf("%.3g years", seconds/(365.25*24*60*60))
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+// The offset of the user_version field in the SQLite database header, used as the nonce.
+// See https://www.sqlite.org/fileformat2.html#database_header
+const sqliteNonceOffset = 60
+
 // mineSqlite3Database mines a SQLite3 database file, by adjusting the user_version field
-// in the database header as a "nonce", and using SHA256 for the actual hashing. The file
-// must exist and must be closed.
-func mineSqlite3Database(fileName string, difficultyBits int) (string, error) {
-	startNonce := uint32(time.Now().Unix())
+// in the database header as a "nonce", and using the PoW hash function (see powhash.go) for
+// the actual hashing, until the hash (as a big-endian number) isn't above the target, see
+// ChainParams.powTarget. The file must exist and must be closed. Returns the SHA256 hash of
+// the mined file, i.e. the block hash.
+//
+// The nonces are searched for in parallel, on all the CPUs: each goroutine hashes its own
+// in-memory copy of the file, trying every n-th nonce, and only the nonce found is written
+// into the file. With mining_distribute, the nonces are also split with the cooperating
+// peers, see p2pmining.go. Returns an empty hash if all the nonces have been tried.
+//
+// The whole file is hashed for each nonce: the nonce is in the first 64-byte block of the
+// hash functions, so there is no prefix whose hash state could be computed once and reused.
+//
+// The progress is logged, available in the node status, and given to the progress callback
+// (if it's not nil) every mineProgressInterval and at the end.
+//
+// Mining stops when the context is cancelled, e.g. on shutdown or when a competing block has
+// been accepted (see mineCancelOnNewBlock), in which case the file is left unchanged and the
+// context's error is returned.
+func (node *Node) mineSqlite3Database(ctx context.Context, fileName string, hashFunc powHashFunc, target *big.Int, progress func(mineProgress)) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	started := time.Now()
+	expectedHashes := mineExpectedHashes(target)
+	var hashes uint64 // Accessed atomically
+	report := func(done bool) {
+		p := newMineProgress(fileName, started, atomic.LoadUint64(&hashes), expectedHashes, done)
+		node.mineStatus.lock.With(func() {
+			node.mineStatus.last = &p
+		})
+		if done {
+			miningLog.Infof("Mining %s finished after %d hashes in %s, %.0f H/s", fileName, p.Hashes, p.Elapsed, p.Hashrate)
+		} else {
+			miningLog.Infof("Mining %s: %d hashes in %s, %.0f H/s, expected time to solution %s", fileName, p.Hashes, p.Elapsed, p.Hashrate, p.ExpectedTime)
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(mineProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				report(false)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	nonce, _, found := node.mineFindNonce(ctx, data, hashFunc, target, &hashes)
+	// The final report mustn't be overwritten by a periodic one still in progress
+	close(stop)
+	<-stopped
+	report(true)
+	if err = ctx.Err(); err != nil && !found {
+		miningLog.Info("Mining", fileName, "cancelled:", err)
+		return "", err
+	}
+	if !found {
+		return "", nil
+	}
 	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 	b := make([]byte, 4)
-	for nonce := startNonce + 1; nonce != startNonce; nonce++ {
-		binary.LittleEndian.PutUint32(b, nonce)
-		_, err := f.WriteAt(b, 60) // https://www.sqlite.org/fileformat2.html#database_header
-		if err != nil {
-			return "", err
-		}
-		f.Sync()
-		hash, err := hashFileToBytes(fileName)
-		if err != nil {
-			return "", err
+	binary.LittleEndian.PutUint32(b, nonce)
+	if _, err = f.WriteAt(b, sqliteNonceOffset); err != nil {
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		return "", err
+	}
+	copy(data[sqliteNonceOffset:], b)
+	blockHash := sha256.Sum256(data)
+	return hex.EncodeToString(blockHash[:]), nil
+}
+
+// Searches for a nonce giving the data a hash meeting the target, with the given number of
+// goroutines, adding the number of hashes computed to the counter. Returns false if all the
+// nonces have been tried, or if the context has been cancelled.
+func mineNonce(ctx context.Context, data []byte, hashFunc powHashFunc, target *big.Int, workers int, hashes *uint64) (nonce uint32, hash []byte, found bool) {
+	return mineNonceRange(ctx, data, hashFunc, target, workers, mineRange{uint32(time.Now().Unix()), 1 << 32}, hashes)
+}
+
+// Mines the block file with the chain's PoW hash function and the target of the next block.
+// Mining stops when the context is cancelled, or when another block is accepted in the meantime.
+func (node *Node) blockMine(ctx context.Context, fn string) error {
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	target, err := node.chainParamsAt(height + 1).powTarget()
+	if err != nil {
+		return err
+	}
+	hashFunc, err := node.chainParams.powHashFunc()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := node.mineCancelOnNewBlock(ctx)
+	defer cancel()
+	hash, err := node.mineSqlite3Database(ctx, fn, hashFunc, target, nil)
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		return fmt.Errorf("no nonce meets the PoW target; change the block and try again")
+	}
+	return nil
+}
+
+// Returns a context which is cancelled together with the parent, or when a block is accepted
+// into the blockchain, which makes the block being mined on top of the previous one stale
+func (node *Node) mineCancelOnNewBlock(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sub := node.nodeEvents.Subscribe([]string{eventBlockAccepted}, true)
+	go func() {
+		defer node.nodeEvents.Unsubscribe(sub)
+		select {
+		case ev := <-sub.events:
+			miningLog.Info("Block", ev.Data["hash"], "has been accepted, cancelling mining")
+			cancel()
+		case <-ctx.Done():
 		}
-		nZeroes := countStartZeroBits(hash)
-		if nZeroes == difficultyBits {
-			return hex.EncodeToString(hash), nil
+	}()
+	return ctx, cancel
+}
+
+// mineRange is a range of nonces, wrapping around the uint32 space
+type mineRange struct {
+	start uint32
+	count uint64
+}
+
+// Searches the range of nonces for one giving the data a hash meeting the target, with the
+// given number of goroutines, adding the number of hashes computed to the counter. The search
+// stops when a nonce is found or when the context is cancelled. Returns false if no nonce has
+// been found.
+func mineNonceRange(ctx context.Context, data []byte, hashFunc powHashFunc, target *big.Int, workers int, r mineRange, hashes *uint64) (nonce uint32, hash []byte, found bool) {
+	if workers < 1 {
+		workers = 1
+	}
+	// The workers check the flag instead of the context, which is much cheaper
+	var stop int32
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&stop, 1)
+		case <-finished:
 		}
+	}()
+	// Comparing the hashes with the target's bytes avoids allocating in the loop
+	targetBytes := powTargetBytes(target)
+	var once sync.Once
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			buf := make([]byte, len(data))
+			copy(buf, data)
+			count := uint64(0)
+			defer func() {
+				atomic.AddUint64(hashes, count)
+			}()
+			// Every nonce in the range is tried by exactly one worker
+			for n := first; n < r.count; n += uint64(workers) {
+				if atomic.LoadInt32(&stop) != 0 {
+					return
+				}
+				candidate := r.start + uint32(n)
+				binary.LittleEndian.PutUint32(buf[sqliteNonceOffset:], candidate)
+				sum := hashFunc(buf)
+				if count++; count == mineCountBatch {
+					atomic.AddUint64(hashes, count)
+					count = 0
+				}
+				if bytes.Compare(sum[:], targetBytes) <= 0 {
+					once.Do(func() {
+						nonce, hash, found = candidate, sum[:], true
+						atomic.StoreInt32(&stop, 1)
+					})
+					return
+				}
+			}
+		}(uint64(w))
 	}
-	return "", nil
+	wg.Wait()
+	return
+}
+
+// Returns the PoW hash of the data with the nonce
+func mineHashWithNonce(data []byte, hashFunc powHashFunc, nonce uint32) []byte {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	binary.LittleEndian.PutUint32(buf[sqliteNonceOffset:], nonce)
+	sum := hashFunc(buf)
+	return sum[:]
 }
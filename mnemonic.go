@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+)
+
+/*
+ * Mnemonic phrases encode private keys as words, the same way BIP39 encodes its entropy:
+ * the 32 bytes of the P-256 private key are followed by the first 8 bits of their SHA256
+ * hash as a checksum, and every 11 bits select a word from the wordlist, for 24 words.
+ * Unlike BIP39, the phrase is the private key itself, not a seed to derive keys from.
+ */
+
+// The size of a P-256 private key, in bytes
+const mnemonicKeySize = 32
+
+// Encodes the data (a multiple of 4 bytes long) into a mnemonic phrase
+func mnemonicEncode(data []byte) (string, error) {
+	if len(data) == 0 || len(data)%4 != 0 {
+		return "", fmt.Errorf("Cannot encode %d bytes as a mnemonic", len(data))
+	}
+	checksumBits := len(data) * 8 / 32
+	hash := sha256.Sum256(data)
+	bits := new(big.Int).SetBytes(data)
+	bits.Lsh(bits, uint(checksumBits))
+	bits.Or(bits, big.NewInt(int64(hash[0]>>uint(8-checksumBits))))
+
+	nWords := (len(data)*8 + checksumBits) / 11
+	words := make([]string, nWords)
+	mask := big.NewInt(2047)
+	for i := nWords - 1; i >= 0; i-- {
+		words[i] = mnemonicWords[new(big.Int).And(bits, mask).Int64()]
+		bits.Rsh(bits, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Decodes a mnemonic phrase, verifying its checksum
+func mnemonicDecode(phrase string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	if len(words) == 0 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("Invalid number of words in the mnemonic: %d", len(words))
+	}
+	index := make(map[string]int, len(mnemonicWords))
+	for i, w := range mnemonicWords {
+		index[w] = i
+	}
+	bits := new(big.Int)
+	for _, w := range words {
+		i, ok := index[w]
+		if !ok {
+			return nil, fmt.Errorf("Unknown word in the mnemonic: %s", w)
+		}
+		bits.Lsh(bits, 11)
+		bits.Or(bits, big.NewInt(int64(i)))
+	}
+	checksumBits := len(words) * 11 / 33
+	dataSize := (len(words)*11 - checksumBits) / 8
+	checksum := new(big.Int).And(bits, big.NewInt(int64(1<<uint(checksumBits)-1))).Int64()
+	bits.Rsh(bits, uint(checksumBits))
+	data := make([]byte, dataSize)
+	bits.FillBytes(data)
+	hash := sha256.Sum256(data)
+	if int64(hash[0]>>uint(8-checksumBits)) != checksum {
+		return nil, fmt.Errorf("Invalid mnemonic checksum")
+	}
+	return data, nil
+}
+
+// Returns the mnemonic phrase for the given private key
+func cryptoPrivateKeyToMnemonic(privateKey *ecdsa.PrivateKey) (string, error) {
+	data := make([]byte, mnemonicKeySize)
+	privateKey.D.FillBytes(data)
+	return mnemonicEncode(data)
+}
+
+// Reconstructs the keypair from its mnemonic phrase
+func cryptoPrivateKeyFromMnemonic(phrase string) (*ecdsa.PrivateKey, error) {
+	data, err := mnemonicDecode(phrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != mnemonicKeySize {
+		return nil, fmt.Errorf("The mnemonic encodes %d bytes, expecting a %d-byte private key", len(data), mnemonicKeySize)
+	}
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(data)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("The mnemonic doesn't encode a valid private key")
+	}
+	privateKey := &ecdsa.PrivateKey{D: d}
+	privateKey.PublicKey.Curve = curve
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(data)
+	return privateKey, nil
+}
+
+// Prints my public keys, with the mnemonic phrases for their private keys
+func (node *Node) actionMyKeysMnemonic() {
+	hashes, err := node.dbGetMyPublicKeyHashes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, k := range hashes {
+		privateKey, err := node.cryptoGetPrivateKey(k)
+		if err != nil {
+			log.Fatalln(k, err)
+		}
+		phrase, err := cryptoPrivateKeyToMnemonic(privateKey)
+		if err != nil {
+			log.Fatalln(k, err)
+		}
+		fmt.Println(k)
+		fmt.Println("\t" + phrase)
+	}
+}
+
+// Restores a keypair from its mnemonic phrase into the system databases
+func (node *Node) actionRestoreKey(phrase string) {
+	privateKey, err := cryptoPrivateKeyFromMnemonic(phrase)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publicKeyHash, err := node.cryptoImportPrivateKey(privateKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Restored the keypair", publicKeyHash)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+)
+
+/*
+ * Hosting several chains in one daemon. "daisy -conf config.json serve" runs the node of each
+ * chain profile in the config file (or only of the named ones) in this process, each as its
+ * own Node (see node.go), so the chains share nothing but the logging. Each node is configured
+ * like with -chain <name>: the top level of the config file with the profile applied over it,
+ * and the other command-line flags given to serve over them. The flags which would make the
+ * nodes collide, like the ports and the data directory, are refused, and set in the profiles
+ * instead. The nodes are stopped together, on SIGINT or SIGTERM, or by the stop command sent
+ * to any of them.
+ */
+
+// The flags which can't be the same for all the nodes, and are set in the chain profiles
+var multiChainProfileFlags = []string{"port", "http-port", "p2p-listen", "http-listen", "dir", "block-producer-dir", "record"}
+
+// Runs the nodes of the given chain profiles, or of all of them if none are given, until
+// the daemon is stopped
+func (node *Node) actionServeChains(names []string) {
+	if node.cfg.configFile == "" {
+		log.Fatalln("The chain profiles are configured in the config file, see -conf")
+	}
+	if node.cfg.chain != "" {
+		log.Fatalln("serve runs the nodes of the chain profiles itself, and can't be used with -chain")
+	}
+	if len(names) == 0 {
+		for name := range node.cfg.Chains {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		log.Fatalln("There are no chain profiles in", node.cfg.configFile)
+	}
+	for _, name := range names {
+		if _, ok := node.cfg.Chains[name]; !ok {
+			log.Fatalf("Unknown chain profile %q in %s", name, node.cfg.configFile)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if inStrings(f.Name, multiChainProfileFlags) {
+			log.Fatalf("-%s can't be the same for all the chains, set it in their profiles instead", f.Name)
+		}
+	})
+
+	nodes := make([]*Node, len(names))
+	for i, name := range names {
+		nodes[i] = newNode()
+		nodes[i].configInitChain(node.cfg.configFile, name)
+		for j := 0; j < i; j++ {
+			if nodes[j].cfg.DataDir == nodes[i].cfg.DataDir {
+				log.Fatalf("The chain profiles %q and %q have the same data directory %s", names[j], name, nodes[i].cfg.DataDir)
+			}
+			if nodes[j].cfg.P2pPort == nodes[i].cfg.P2pPort {
+				log.Fatalf("The chain profiles %q and %q have the same p2p port %d", names[j], name, nodes[i].cfg.P2pPort)
+			}
+			if nodes[j].cfg.HTTPPort == nodes[i].cfg.HTTPPort {
+				log.Fatalf("The chain profiles %q and %q have the same HTTP port %d", names[j], name, nodes[i].cfg.HTTPPort)
+			}
+		}
+	}
+	for _, chainNode := range nodes {
+		chainNode.dbInit()
+		chainNode.cryptoInit()
+		chainNode.blockchainInit(true)
+	}
+	for i, chainNode := range nodes {
+		chainLog.Info("Starting the node of chain", names[i], "in", chainNode.cfg.DataDir)
+		chainNode.start()
+	}
+	runNodes(nodes)
+}
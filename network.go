@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+ * Network modes, for experimenting without touching the production chain. With -network
+ * testnet or -network simnet (or network in the config file), the node uses its own default
+ * ports and data directory (the default one with "-testnet" or "-simnet" appended), doesn't
+ * bootstrap from the default peers, and uses the chain's relaxed testnet_block_signature_quorum
+ * if it has one. The network is announced in the hello message, and peers on other networks
+ * are dropped.
+ *
+ * simnet is for local simulations: it additionally requires only the creator's signature on
+ * the blocks unless the chain sets the testnet quorum.
+ */
+
+const (
+	networkMain    = "main"
+	networkTestnet = "testnet"
+	networkSimnet  = "simnet"
+)
+
+// networkMode holds the defaults of a network mode
+type networkMode struct {
+	p2pPort  int
+	httpPort int
+}
+
+var networkModes = map[string]networkMode{
+	networkMain:    {DefaultP2PPort, DefaultBlockWebServerPort},
+	networkTestnet: {DefaultP2PPort + 10000, DefaultBlockWebServerPort + 10000},
+	networkSimnet:  {DefaultP2PPort + 20000, DefaultBlockWebServerPort + 20000},
+}
+
+// Returns the network the node is on
+func (node *Node) networkName() string {
+	if node.cfg.Network == "" {
+		return networkMain
+	}
+	return node.cfg.Network
+}
+
+// Returns true if the node isn't on the production network
+func (node *Node) networkIsTest() bool {
+	return node.networkName() != networkMain
+}
+
+// Returns the default p2p port of the network, on which the peers are assumed to listen
+func (node *Node) networkP2PPort() int {
+	return networkModes[node.networkName()].p2pPort
+}
+
+// Checks the network name
+func networkValidate(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := networkModes[name]; !ok {
+		return fmt.Errorf("unknown network %q, expecting %s, %s or %s", name, networkMain, networkTestnet, networkSimnet)
+	}
+	return nil
+}
+
+// Replaces the defaults which haven't been changed by the configuration with the ones of the
+// network mode
+func (node *Node) networkApplyDefaults(defaultDataDir string) {
+	mode, ok := networkModes[node.networkName()]
+	if !ok || !node.networkIsTest() {
+		return
+	}
+	if node.cfg.P2pPort == DefaultP2PPort {
+		node.cfg.P2pPort = mode.p2pPort
+	}
+	if node.cfg.HTTPPort == DefaultBlockWebServerPort {
+		node.cfg.HTTPPort = mode.httpPort
+	}
+	if node.cfg.DataDir == defaultDataDir {
+		node.cfg.DataDir = defaultDataDir + "-" + node.networkName()
+	}
+	if len(node.cfg.BootstrapPeers) == 0 {
+		// Never bootstrap a test network from the production peers
+		node.bootstrapPeers = peerStringMap{}
+	}
+}
+
+// Returns the block signature quorum of the chain, relaxed on the test networks
+func (node *Node) networkSignatureQuorum() int {
+	if node.networkIsTest() && node.chainParams.TestnetBlockSignatureQuorum > 0 {
+		return node.chainParams.TestnetBlockSignatureQuorum
+	}
+	if node.networkName() == networkSimnet {
+		return 1
+	}
+	return node.chainParams.BlockSignatureQuorum
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+/*
+ * The node of a chain. All the state of a chain's node (the configuration, the databases, the
+ * chain params, the peers, the p2p coordinator and the rest) is kept in a Node, so that one
+ * process can run the nodes of several chains, see multichain.go. The functions which work
+ * with the state are methods of Node, and the objects belonging to a node, like the p2p
+ * connections and the block store, point back to it. What's left global is shared by all the
+ * nodes of the process: the logging, the registries of the commands, the stages and the
+ * backends, and the constant tables.
+ */
+
+// Node is the state of the node of one chain
+type Node struct {
+	cfg Config
+
+	// The system databases, see db.go
+	mainDb    *dbHandle
+	privateDb *dbHandle
+
+	chainParams ChainParams
+	// The accepted chain param updates, by height
+	chainParamsUpdates struct {
+		lock    WithMutex
+		updates []chainParamsUpdate
+	}
+	blockchainSubdirectory      string
+	blockchainVerificationState string      // The result of the blockchain verification on startup, reported by the status command
+	blockStore                  *BlockStore // Initialised by ensureBlockchainSubdirectoryExists()
+	blockDBs                    *blockDBCache
+
+	// Serializes the blocks going through the acceptance pipeline, so that the height a block
+	// is checked for is still the tip when it's inserted
+	blockAcceptLock         WithMutex
+	blockAcceptancePipeline []string // The stage names in the order they are executed
+
+	// The references which have been verified, so the other chains' nodes aren't asked again
+	chainRefsVerified struct {
+		lock WithMutex
+		refs map[chainRef]bool
+	}
+	// The checks of the nodes configured in chain_refs, by chain
+	chainRefsNodes struct {
+		lock   WithMutex
+		checks map[string]chainRefNodeCheck
+	}
+
+	combinedDb struct {
+		lock WithMutex
+		qdb  *queryCombinedDb
+	}
+	userIndexes struct {
+		lock   WithMutex
+		update WithMutex // Serialises the updates
+		db     *sql.DB
+	}
+	dbMaintenance struct {
+		lock    WithMutex
+		last    *dbMaintenanceReport
+		lastRun time.Time
+		running int32 // Accessed atomically
+	}
+	auditLock   WithMutex
+	reportsLock WithMutex // Serialises the runs of the reports
+
+	nodeEvents  nodeEventHub
+	nodeMetrics struct {
+		lock   WithMutex
+		events map[string]*int64 // Counts by event name, updated atomically
+	}
+	// The cache of the verified identities
+	identityCache struct {
+		lock    WithMutex
+		entries map[string]identityCacheEntry
+	}
+
+	mempool        *mempoolType
+	keyOpProposals *keyOpProposalPool
+
+	// The progress of the current or the last mining, for the node status
+	mineStatus struct {
+		lock WithMutex
+		last *mineProgress
+	}
+	// The jobs this node coordinates, by ID
+	mineJobs struct {
+		lock WithMutex
+		jobs map[string]*mineJob
+	}
+	// The work being done for the peers, one per connection
+	mineWorks struct {
+		lock  WithMutex
+		works map[*p2pConnection]*mineWork
+	}
+
+	bootstrapPeers peerStringMap
+	p2pEphemeralID int64 // The temporary ID of this node, using strong RNG
+	p2pPeers       p2pPeersSet
+	p2pCoordinator p2pCoordinatorType
+
+	// Messages to the coordinator go into two queues. The control queue is for messages which
+	// must not be lost and are always handled first. The bulk queue is for work which can be
+	// dropped if there's too much of it, such as connecting to newly learned peers, and its
+	// handling is rate-limited.
+	p2pCtrlQueueControl *p2pCtrlQueue
+	p2pCtrlQueueBulk    *p2pCtrlQueue
+
+	// The requests waiting for answers, by peer and message for getblockhashes, and by block
+	// hash for getblock
+	p2pRequests struct {
+		lock           WithMutex
+		hashes         map[*p2pConnection]*p2pRequest
+		blocks         map[string]*p2pRequest
+		lastChange     time.Time
+		searchedHeight int // The end of the last window of block hashes received
+	}
+	p2pBlockValidations struct {
+		queue   chan *p2pBlockValidation
+		pending sync.WaitGroup
+		done    int64 // Accessed atomically
+	}
+	// The last tip report
+	p2pTipState struct {
+		lock   WithMutex
+		report *p2pTipReport
+	}
+	p2pThrottle      p2pInboundThrottle
+	p2pBannedIPs     *StringSetWithExpiry // The IP addresses of the banned peers
+	p2pBannedPeerIDs *StringSetWithExpiry // The p2p IDs of the banned peers connected through relays
+
+	// The state of the relay, and of the sessions through the relays
+	p2pRelay struct {
+		lock     WithMutex
+		clients  map[int64]*p2pConnection    // The registered nodes, by their IDs
+		forwards map[p2pRelayKey]p2pRelayKey // The sessions forwarded by this relay, in both directions
+		conns    map[p2pRelayKey]*p2pRelayConn
+	}
+	// The public IP addresses peers have seen this node at, with the peers which have reported them
+	p2pObservedAddresses struct {
+		lock      WithMutex
+		reporters map[string]map[string]bool
+	}
+	p2pSessionRecorder     *p2pRecorder  // Nil if recording is not enabled
+	singlePortHTTPListener *connListener // The HTTP connections accepted on the p2p port
+}
+
+// Creates a node with the default state, to be configured with configInit() or
+// configInitChain()
+func newNode() *Node {
+	node := &Node{
+		chainParams:                 defaultChainParams,
+		blockchainVerificationState: "unknown",
+		mempool:                     &mempoolType{records: map[string]*mempoolRecord{}, removed: NewStringSetWithExpiry(mempoolRecordTTL)},
+		bootstrapPeers: peerStringMap{
+			"cosmos.ivoras.net:2017":  time.Now(),
+			"fielder.ivoras.net:2017": time.Now(),
+		},
+		p2pEphemeralID:         randInt63() & 0xffffffffffff,
+		p2pCtrlQueueControl:    &p2pCtrlQueue{name: "control", ch: make(chan p2pCtrlMessage, 16)},
+		p2pCtrlQueueBulk:       &p2pCtrlQueue{name: "bulk", ch: make(chan p2pCtrlMessage, 64), droppable: true},
+		p2pBannedIPs:           NewStringSetWithExpiry(p2pPenaltyBanTime),
+		p2pBannedPeerIDs:       NewStringSetWithExpiry(p2pPenaltyBanTime),
+		singlePortHTTPListener: newConnListener(),
+	}
+	node.blockDBs = &blockDBCache{node: node, capacity: blockDBCacheSize, byHash: map[string]*BlockDB{}, lru: list.New()}
+	node.keyOpProposals = &keyOpProposalPool{node: node, proposals: map[string]*keyOpProposal{}}
+	node.chainRefsVerified.refs = map[chainRef]bool{}
+	node.chainRefsNodes.checks = map[string]chainRefNodeCheck{}
+	node.nodeEvents.subscribers = map[*nodeEventSubscriber]bool{}
+	node.nodeMetrics.events = map[string]*int64{}
+	node.identityCache.entries = map[string]identityCacheEntry{}
+	node.mineJobs.jobs = map[string]*mineJob{}
+	node.mineWorks.works = map[*p2pConnection]*mineWork{}
+	node.p2pPeers = p2pPeersSet{node: node, peers: make(map[*p2pConnection]time.Time)}
+	node.p2pCoordinator = p2pCoordinatorType{
+		node:                    node,
+		recentlyRequestedBlocks: NewStringSetWithExpiry(5 * time.Second),
+		lastReconnectTime:       time.Now(),
+		lastConnectDbPeersTime:  time.Now(), // p2pClient() connects at startup
+		timeTicks:               make(chan int),
+		badPeers:                NewStringSetWithExpiry(15 * time.Minute),
+	}
+	node.p2pRequests.hashes = map[*p2pConnection]*p2pRequest{}
+	node.p2pRequests.blocks = map[string]*p2pRequest{}
+	node.p2pBlockValidations.queue = make(chan *p2pBlockValidation, p2pBlockValidationQueueSize)
+	node.p2pThrottle = p2pInboundThrottle{node: node, sources: map[string]*p2pTokenBucket{}}
+	node.p2pRelay.clients = map[int64]*p2pConnection{}
+	node.p2pRelay.forwards = map[p2pRelayKey]p2pRelayKey{}
+	node.p2pRelay.conns = map[p2pRelayKey]*p2pRelayConn{}
+	node.p2pObservedAddresses.reporters = map[string]map[string]bool{}
+	return node
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * Notarization of documents. Clients submit the SHA256 digest of a document, with optional
+ * metadata (e.g. the document's name), with POST /api/notary on the HTTP server or with the
+ * notarize command, and the node producing blocks (see blockproducer.go) puts the pending
+ * digests into the _notary table of its next block. The documents themselves never leave the
+ * clients.
+ *
+ * The creator of a block with a _notary table also signs the root of a Merkle tree over its
+ * rows, ordered by the digest, together with the previous block's hash, which ties the root to
+ * the block's place in the chain, and stores them as NotaryRoot and NotaryRootSignature in the
+ * block's _meta. The leaves are SHA256(0x00 || digest || metadata), and the inner nodes
+ * SHA256(0x01 || left || right), with the odd node at the end of a level promoted to the next
+ * level. GET /api/notary/<digest> (or the notaryproof command) then serves the inclusion
+ * proof of a digest: the path from its leaf to the root, the signed root and the block, which
+ * can be checked without the block file, with verifynotaryproof or any other implementation.
+ *
+ * The digests are kept in the notarizations table of the main database, both the pending ones
+ * and the ones included in the accepted blocks, from any node, for looking up the proofs. The
+ * digests put into a block which is waiting for signatures are pending again if the block is
+ * removed from the signed directory without being accepted, and a block takes no more digests
+ * than block_producer_max_size allows.
+ *
+ * Unless the HTTP server requires authentication, anyone can submit digests, so the
+ * submissions over HTTP can't have metadata (the first submission of a digest would decide its
+ * metadata for everyone), and each client IP address can have at most
+ * notaryMaxPendingPerClient digests waiting for a block.
+ */
+
+// The _meta keys of the signed Merkle root of the _notary table
+const (
+	blockMetaNotaryRoot          = "NotaryRoot"
+	blockMetaNotaryRootSignature = "NotaryRootSignature"
+)
+
+// The maximum size of a notarization's metadata
+const notaryMaxMetadataSize = 1024
+
+// The maximum number of notarizations waiting for a block
+const notaryMaxPending = 100000
+
+// The maximum number of notarizations waiting for a block, submitted by one client IP address
+// without authentication
+const notaryMaxPendingPerClient = 1000
+
+// The maximum number of notarizations in a block
+const notaryMaxPerBlock = 100000
+
+const notaryTableCreate = `
+CREATE TABLE _notary (
+	digest			VARCHAR NOT NULL PRIMARY KEY, -- hex-encoded SHA256
+	metadata		VARCHAR NOT NULL,
+	time_submitted		INTEGER NOT NULL
+);
+`
+
+const notarizationsTableCreate = `
+CREATE TABLE notarizations (
+	digest			VARCHAR NOT NULL PRIMARY KEY,
+	metadata		VARCHAR NOT NULL,
+	time_submitted		INTEGER NOT NULL,
+	block_hash		VARCHAR, -- NULL while pending
+	block_height		INTEGER -- NULL until the block is accepted
+);
+`
+
+// The IP address of the client which has submitted the notarization without authentication,
+// NULL for the others
+const notarizationsSubmitterColumn = "submitter VARCHAR"
+
+// notarization is a document digest submitted for notarization
+type notarization struct {
+	Digest        string `json:"digest"`
+	Metadata      string `json:"metadata"`
+	TimeSubmitted int64  `json:"time_submitted"`
+}
+
+// notaryProofStep is a sibling on the path from a leaf to the Merkle root
+type notaryProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // The sibling is on the left
+}
+
+// notaryProof is the proof that a digest is included in a block
+type notaryProof struct {
+	notarization
+	Height            int               `json:"height"`
+	BlockHash         string            `json:"block_hash"`
+	Creator           string            `json:"creator"`        // The public key hash of the block's creator
+	CreatorKey        string            `json:"creator_pubkey"` // Hex-encoded
+	PreviousBlockHash string            `json:"prev_hash"`
+	Root              string            `json:"root"`
+	RootSignature     string            `json:"root_signature"` // Of notaryRootSignedHash()
+	Path              []notaryProofStep `json:"path"`
+}
+
+// Checks the format of a notarization
+func (n *notarization) validate() error {
+	n.Digest = strings.ToLower(n.Digest)
+	if !blockHashRegexp.MatchString(n.Digest) {
+		return fmt.Errorf("the digest must be a hex-encoded SHA256 hash")
+	}
+	if len(n.Metadata) > notaryMaxMetadataSize {
+		return fmt.Errorf("the metadata is larger than %d bytes", notaryMaxMetadataSize)
+	}
+	return nil
+}
+
+// Returns the Merkle tree leaf of the notarization
+func (n *notarization) leaf() []byte {
+	digest, _ := hex.DecodeString(n.Digest)
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(digest)
+	h.Write([]byte(n.Metadata))
+	return h.Sum(nil)
+}
+
+func notaryHashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Returns the Merkle root of the leaves, and the path from the leaf at the index to it
+func notaryMerkleRoot(leaves [][]byte, index int) ([]byte, []notaryProofStep) {
+	var path []notaryProofStep
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, notaryHashNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		if sibling := index ^ 1; sibling < len(level) {
+			path = append(path, notaryProofStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < index})
+		}
+		index /= 2
+		level = next
+	}
+	return level[0], path
+}
+
+// Reads the _notary table of a block, ordered by the digest
+func notaryReadBlock(db dbRowsQueryer) ([]notarization, error) {
+	rows, err := db.Query("SELECT digest, metadata, time_submitted FROM _notary ORDER BY digest")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []notarization
+	for rows.Next() {
+		var n notarization
+		if err = rows.Scan(&n.Digest, &n.Metadata, &n.TimeSubmitted); err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, rows.Err()
+}
+
+// Returns the hex-encoded Merkle root of the notarizations, or "" if there are none
+func notaryRoot(notarizations []notarization) string {
+	if len(notarizations) == 0 {
+		return ""
+	}
+	leaves := make([][]byte, len(notarizations))
+	for i := range notarizations {
+		leaves[i] = notarizations[i].leaf()
+	}
+	root, _ := notaryMerkleRoot(leaves, 0)
+	return hex.EncodeToString(root)
+}
+
+// Returns the hex-encoded hash signed by the block's creator: the SHA256 hash of the Merkle root
+// and the previous block's hash
+func notaryRootSignedHash(root string, previousBlockHash string) string {
+	hash := sha256.Sum256([]byte(root + "\n" + previousBlockHash))
+	return hex.EncodeToString(hash[:])
+}
+
+// Validates the format of the _notary table in the given block database, if it has one
+func dbValidateBlockNotary(db *sql.DB) error {
+	if exists, err := dbTableExists(db, "_notary"); err != nil || !exists {
+		return err
+	}
+	notarizations, err := notaryReadBlock(db)
+	if err != nil {
+		return fmt.Errorf("block notary: cannot read the _notary table: %v", err)
+	}
+	if len(notarizations) > notaryMaxPerBlock {
+		return fmt.Errorf("block notary: more than %d rows", notaryMaxPerBlock)
+	}
+	for _, n := range notarizations {
+		if !blockHashRegexp.MatchString(n.Digest) {
+			return fmt.Errorf("block notary: %s is not a lowercase hex-encoded SHA256 hash", n.Digest)
+		}
+		if len(n.Metadata) > notaryMaxMetadataSize {
+			return fmt.Errorf("block notary: the metadata of %s is larger than %d bytes", n.Digest, notaryMaxMetadataSize)
+		}
+	}
+	return nil
+}
+
+// Signs the Merkle root of the _notary table of a block being signed, if it has one, into its
+// _meta
+func blockAddNotaryRoot(db *sql.DB, keypair *ecdsa.PrivateKey, previousBlockHash string) error {
+	if exists, err := dbTableExists(db, "_notary"); err != nil || !exists {
+		return err
+	}
+	notarizations, err := notaryReadBlock(db)
+	if err != nil || len(notarizations) == 0 {
+		return err
+	}
+	root := notaryRoot(notarizations)
+	signature, err := cryptoSignHex(keypair, notaryRootSignedHash(root, previousBlockHash))
+	if err != nil {
+		return err
+	}
+	if err = dbSetMetaString(db, blockMetaNotaryRoot, root); err != nil {
+		return err
+	}
+	return dbSetMetaString(db, blockMetaNotaryRootSignature, signature)
+}
+
+// Checks that the block's NotaryRoot is the root of its _notary table, signed by the creator
+func (b *Block) notaryVerifyRoot(creatorKey *ecdsa.PublicKey) error {
+	if exists, err := dbTableExists(b.db, "_notary"); err != nil || !exists {
+		return err
+	}
+	notarizations, err := notaryReadBlock(b.db)
+	if err != nil || len(notarizations) == 0 {
+		return err
+	}
+	root, err := b.dbGetMetaString(blockMetaNotaryRoot)
+	if err != nil {
+		return fmt.Errorf("the block has a _notary table but no %s", blockMetaNotaryRoot)
+	}
+	if expected := notaryRoot(notarizations); root != expected {
+		return fmt.Errorf("the block's %s is %s, but the root of its _notary table is %s", blockMetaNotaryRoot, root, expected)
+	}
+	signature, err := b.dbGetMetaString(blockMetaNotaryRootSignature)
+	if err != nil {
+		return fmt.Errorf("the block has no %s", blockMetaNotaryRootSignature)
+	}
+	if err = cryptoVerifyHex(creatorKey, notaryRootSignedHash(root, b.PreviousBlockHash), signature); err != nil {
+		return fmt.Errorf("the block's %s is not signed by its creator: %v", blockMetaNotaryRoot, err)
+	}
+	return nil
+}
+
+// Queues a notarization for the next block. The submitter is the IP address of the client
+// submitting it without authentication, or "". Returns false if the digest has already been
+// submitted.
+func (node *Node) dbInsertNotarization(n *notarization, submitter string) (bool, error) {
+	var pending int
+	if err := node.mainDb.QueryRow("SELECT COUNT(*) FROM notarizations WHERE block_hash IS NULL").Scan(&pending); err != nil {
+		return false, err
+	}
+	if pending >= notaryMaxPending {
+		return false, fmt.Errorf("there are already %d notarizations waiting for a block", pending)
+	}
+	var submitterValue interface{}
+	if submitter != "" {
+		if err := node.mainDb.QueryRow("SELECT COUNT(*) FROM notarizations WHERE block_hash IS NULL AND submitter=?", submitter).Scan(&pending); err != nil {
+			return false, err
+		}
+		if pending >= notaryMaxPendingPerClient {
+			return false, fmt.Errorf("there are already %d notarizations from %s waiting for a block", pending, submitter)
+		}
+		submitterValue = submitter
+	}
+	res, err := node.mainDb.Exec("INSERT INTO notarizations(digest, metadata, time_submitted, submitter) VALUES (?, ?, ?, ?) ON CONFLICT(digest) DO NOTHING",
+		n.Digest, n.Metadata, n.TimeSubmitted, submitterValue)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// Returns the notarizations waiting for a block, at most maxSize bytes of them if it isn't 0,
+// and the total size of their metadata
+func (node *Node) dbGetPendingNotarizations(maxSize int64) ([]notarization, int64, error) {
+	rows, err := node.mainDb.Query("SELECT digest, metadata, time_submitted FROM notarizations WHERE block_hash IS NULL ORDER BY time_submitted, digest LIMIT ?", notaryMaxPerBlock)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var result []notarization
+	var size int64
+	for rows.Next() {
+		var n notarization
+		if err = rows.Scan(&n.Digest, &n.Metadata, &n.TimeSubmitted); err != nil {
+			return nil, 0, err
+		}
+		nSize := int64(len(n.Digest) + len(n.Metadata))
+		if maxSize > 0 && size+nSize > maxSize && len(result) > 0 {
+			break
+		}
+		result = append(result, n)
+		size += nSize
+	}
+	return result, size, rows.Err()
+}
+
+// Marks the notarizations as included in the block which is waiting for signatures, so they
+// aren't put into another one. The accepted blocks are recorded by notaryIndexBlock().
+func (node *Node) dbSetNotarizationsBlock(notarizations []notarization, hash string) error {
+	for _, n := range notarizations {
+		if _, err := node.mainDb.Exec("UPDATE notarizations SET block_hash=? WHERE digest=? AND block_hash IS NULL", hash, n.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the hashes of the blocks the notarizations have been put into, which haven't been
+// accepted
+func (node *Node) dbGetUnacceptedNotarizationBlocks() ([]string, error) {
+	return dbQueryStrings(node.mainDb, "SELECT DISTINCT block_hash FROM notarizations WHERE block_hash IS NOT NULL AND block_height IS NULL")
+}
+
+// Makes the notarizations put into the block, which won't be accepted, pending again
+func (node *Node) dbResetNotarizationsBlock(hash string) error {
+	_, err := node.mainDb.Exec("UPDATE notarizations SET block_hash=NULL WHERE block_hash=? AND block_height IS NULL", hash)
+	return err
+}
+
+// Returns the notarization of the digest, and the hash and the height of the block it's in,
+// or an empty hash if it's pending
+func (node *Node) dbGetNotarization(digest string) (*notarization, string, int, error) {
+	var n notarization
+	var hash sql.NullString
+	var height sql.NullInt64
+	err := node.mainDb.QueryRow("SELECT digest, metadata, time_submitted, block_hash, block_height FROM notarizations WHERE digest=?", digest).Scan(
+		&n.Digest, &n.Metadata, &n.TimeSubmitted, &hash, &height)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if !height.Valid {
+		return &n, "", 0, nil
+	}
+	return &n, hash.String, int(height.Int64), nil
+}
+
+// Makes the notarizations of the blocks above the height pending again, after a rollback
+func (node *Node) dbNotarizationsRollback(height int) error {
+	_, err := node.mainDb.Exec("UPDATE notarizations SET block_hash=NULL, block_height=NULL WHERE block_height>?", height)
+	return err
+}
+
+// Creates the _notary table with the pending notarizations in a block being produced
+func blockCreateAddNotarizations(db *sql.DB, notarizations []notarization) error {
+	if len(notarizations) == 0 {
+		return nil
+	}
+	if _, err := db.Exec(notaryTableCreate); err != nil {
+		return err
+	}
+	for _, n := range notarizations {
+		if _, err := db.Exec("INSERT INTO _notary(digest, metadata, time_submitted) VALUES (?, ?, ?)", n.Digest, n.Metadata, n.TimeSubmitted); err != nil {
+			return err
+		}
+	}
+	chainLog.Info("Adding", len(notarizations), "notarizations")
+	return nil
+}
+
+// Records the notarizations in an accepted block, so the proofs can be served
+func (node *Node) notaryIndexBlock(blk *Block, height int) {
+	exists, err := dbTableExists(blk.db, "_notary")
+	if err != nil {
+		chainLog.Warn("Cannot read the notarizations of block", blk.Hash, err)
+		return
+	}
+	if !exists {
+		return
+	}
+	notarizations, err := notaryReadBlock(blk.db)
+	if err != nil {
+		chainLog.Warn("Cannot read the notarizations of block", blk.Hash, err)
+		return
+	}
+	for _, n := range notarizations {
+		// The first block including a digest proves it
+		_, err = node.mainDb.Exec(`INSERT INTO notarizations(digest, metadata, time_submitted, block_hash, block_height) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(digest) DO UPDATE SET metadata=excluded.metadata, block_hash=excluded.block_hash, block_height=excluded.block_height
+			WHERE notarizations.block_height IS NULL`, n.Digest, n.Metadata, n.TimeSubmitted, blk.Hash, height)
+		if err != nil {
+			chainLog.Warn("Cannot record the notarization", n.Digest, err)
+			return
+		}
+	}
+}
+
+// Returns the inclusion proof of the digest, or nil if it's pending
+func (node *Node) notaryGetProof(digest string) (*notaryProof, error) {
+	n, hash, height, err := node.dbGetNotarization(strings.ToLower(digest))
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		return nil, nil
+	}
+	bdb, err := node.blockDBs.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer node.blockDBs.Release(bdb)
+	notarizations, err := notaryReadBlock(bdb)
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	leaves := make([][]byte, len(notarizations))
+	for i := range notarizations {
+		leaves[i] = notarizations[i].leaf()
+		if notarizations[i].Digest == n.Digest {
+			index = i
+			*n = notarizations[i]
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("block %s doesn't contain the digest %s", hash, n.Digest)
+	}
+	root, path := notaryMerkleRoot(leaves, index)
+	proof := &notaryProof{notarization: *n, Height: height, BlockHash: hash, Root: hex.EncodeToString(root), Path: path}
+	if proof.Path == nil {
+		proof.Path = []notaryProofStep{}
+	}
+	for key, value := range map[string]*string{blockMetaNotaryRootSignature: &proof.RootSignature, "CreatorPublicKey": &proof.Creator,
+		"PreviousBlockHash": &proof.PreviousBlockHash} {
+		if err = bdb.QueryRow("SELECT value FROM _meta WHERE key=?", key).Scan(value); err != nil {
+			return nil, fmt.Errorf("cannot read %s of block %s: %v", key, hash, err)
+		}
+	}
+	dbpk, err := node.dbGetPublicKey(proof.Creator)
+	if err != nil {
+		return nil, err
+	}
+	proof.CreatorKey = hex.EncodeToString(dbpk.publicKeyBytes)
+	return proof, nil
+}
+
+// Verifies the inclusion proof: the path to the root, and the root's signature by the key in
+// the proof. The key and the block are checked by the caller.
+func (proof *notaryProof) verify() error {
+	if err := proof.notarization.validate(); err != nil {
+		return err
+	}
+	node := proof.notarization.leaf()
+	for _, step := range proof.Path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return fmt.Errorf("invalid hash in the proof path: %s", step.Hash)
+		}
+		if step.Left {
+			node = notaryHashNode(sibling, node)
+		} else {
+			node = notaryHashNode(node, sibling)
+		}
+	}
+	if root := hex.EncodeToString(node); root != proof.Root {
+		return fmt.Errorf("the proof path leads to %s, not to the root %s", root, proof.Root)
+	}
+	publicKeyBytes, err := hex.DecodeString(proof.CreatorKey)
+	if err != nil {
+		return fmt.Errorf("invalid creator public key: %v", err)
+	}
+	if getPubKeyHash(publicKeyBytes) != proof.Creator {
+		return fmt.Errorf("the creator public key doesn't match its hash %s", proof.Creator)
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(publicKeyBytes)
+	if err != nil {
+		return err
+	}
+	if err = cryptoVerifyHex(publicKey, notaryRootSignedHash(proof.Root, proof.PreviousBlockHash), proof.RootSignature); err != nil {
+		return fmt.Errorf("the root is not signed by the creator: %v", err)
+	}
+	return nil
+}
+
+// Handles the notary requests on the HTTP server: POST /api/notary submits a digest, and
+// GET /api/notary/<digest> returns its inclusion proof. If the server doesn't require
+// authentication, the submissions can't have metadata, and are limited per client IP address.
+func (node *Node) notaryServe(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		digest := mux.Vars(r)["digest"]
+		proof, err := node.notaryGetProof(digest)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown digest", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			chainLog.Error("Cannot get the notary proof of", digest, err)
+			http.Error(w, "Cannot get the proof", http.StatusInternalServerError)
+			return
+		}
+		if proof == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			controlSendJSON(w, StrIfMap{"digest": strings.ToLower(digest), "status": "pending"})
+			return
+		}
+		controlSendJSON(w, proof)
+	case http.MethodPost:
+		var n notarization
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*notaryMaxMetadataSize)).Decode(&n); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot parse the notarization: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := n.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		submitter := ""
+		if !node.blockWebAuthRequired() {
+			if n.Metadata != "" {
+				http.Error(w, "The metadata can only be set by authenticated clients", http.StatusForbidden)
+				return
+			}
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			submitter = host
+		}
+		n.TimeSubmitted = time.Now().Unix()
+		added, err := node.dbInsertNotarization(&n, submitter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !added {
+			http.Error(w, "The digest has already been submitted", http.StatusConflict)
+			return
+		}
+		chainLog.Info("Digest", n.Digest, "submitted for notarization by", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		controlSendJSON(w, StrIfMap{"digest": n.Digest, "status": "pending"})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Submits the digest of a file, or a hex-encoded digest, for notarization in the next block
+// produced by this node
+func (node *Node) actionNotarize(fileOrDigest string, metadata string) {
+	n := notarization{Digest: fileOrDigest, Metadata: metadata, TimeSubmitted: time.Now().Unix()}
+	if !blockHashRegexp.MatchString(strings.ToLower(fileOrDigest)) {
+		digest, err := hashFileToHexString(fileOrDigest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		n.Digest = digest
+	}
+	if err := n.validate(); err != nil {
+		log.Fatalln(err)
+	}
+	added, err := node.dbInsertNotarization(&n, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !added {
+		log.Fatalln("The digest", n.Digest, "has already been submitted")
+	}
+	fmt.Println(n.Digest)
+}
+
+// Prints the inclusion proof of the digest
+func (node *Node) actionNotaryProof(digest string) {
+	proof, err := node.notaryGetProof(digest)
+	if err == sql.ErrNoRows {
+		log.Fatalln("Unknown digest", digest)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if proof == nil {
+		log.Fatalln("The digest", digest, "is waiting for a block")
+	}
+	fmt.Println(jsonifyWhatever(proof))
+}
+
+// Checks an inclusion proof from a file, and that its block is in the local blockchain and
+// was created by a signatory
+func (node *Node) actionVerifyNotaryProof(fn string) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var proof notaryProof
+	if err = json.Unmarshal(data, &proof); err != nil {
+		log.Fatalln("Cannot parse the proof:", err)
+	}
+	if err = proof.verify(); err != nil {
+		log.Fatalln("Invalid proof:", err)
+	}
+	dbb, err := node.dbGetBlock(proof.BlockHash)
+	if err != nil {
+		log.Fatalln("The proof's block", proof.BlockHash, "isn't in the blockchain")
+	}
+	if dbb.Height != proof.Height || dbb.SignaturePublicKeyHash != proof.Creator || dbb.PreviousBlockHash != proof.PreviousBlockHash {
+		log.Fatalln("The proof's block", proof.BlockHash, "doesn't match the one in the blockchain")
+	}
+	fmt.Println("The digest", proof.Digest, "is included in block", proof.BlockHash, "at height", proof.Height)
+}
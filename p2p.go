@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
+	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -17,10 +19,12 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const p2pClientVersionString = "godaisy/0.2"
+const p2pClientVersionString = "godaisy/0.3"
 
 // Header for JSON messages we're sending
 type p2pMsgHeader struct {
@@ -34,11 +38,30 @@ const p2pMsgHello = "hello"
 
 type p2pMsgHelloStruct struct {
 	p2pMsgHeader
-	Version     string   `json:"version"`
-	ChainHeight int      `json:"chain_height"`
-	MyPeers     []string `json:"my_peers"`
+	Version      string          `json:"version"`
+	ChainHeight  int             `json:"chain_height"`
+	MyPeers      []string        `json:"my_peers"` // The connected peers, for the older nodes
+	Peers        []p2pSharedPeer `json:"peers,omitempty"`
+	YourAddress  string          `json:"your_address,omitempty"` // The address the peer is seen at
+	Network      string          `json:"network,omitempty"`      // Omitted on the main network
+	Mining       bool            `json:"mining,omitempty"`       // Accepts mining work, see p2pmining.go
+	Compression  []string        `json:"compression,omitempty"`  // Accepted compression methods, see p2pcompress.go
+	Capabilities []string        `json:"capabilities,omitempty"` // See p2pcaps.go
 }
 
+// A peer address shared with the other peers, with the time it was last seen
+type p2pSharedPeer struct {
+	Address  string `json:"address"`
+	LastSeen int64  `json:"last_seen"` // Unix timestamp
+}
+
+// The most peer addresses sent or accepted in a message
+const p2pMaxSharedPeers = 100
+
+// The peer addresses not seen for this long aren't shared, are dropped when received, and are
+// deleted from the peers table if the connections to them have failed since
+const p2pPeerMaxAge = 7 * 24 * time.Hour
+
 // The message asking for block hashes
 const p2pMsgGetBlockHashes = "getblockhashes"
 
@@ -51,6 +74,9 @@ type p2pMsgGetBlockHashesStruct struct {
 // The message reporting block hashes a node has
 const p2pMsgBlockHashes = "blockhashes"
 
+// The maximum number of block hashes sent in one message
+const p2pMaxBlockHashes = 5000
+
 type p2pMsgBlockHashesStruct struct {
 	p2pMsgHeader
 	Hashes map[int]string `json:"hashes"`
@@ -69,52 +95,86 @@ const p2pMsgBlock = "block"
 
 type p2pMsgBlockStruct struct {
 	p2pMsgHeader
-	Hash          string `json:"hash"`
-	HashSignature string `json:"hash_signature"`
-	Size          int64  `json:"size"`
-	Encoding      string `json:"encoding"`
-	Data          string `json:"data"`
+	Hash          string              `json:"hash"`
+	HashSignature string              `json:"hash_signature"`
+	Cosignatures  []p2pBlockSignature `json:"cosignatures,omitempty"`
+	Size          int64               `json:"size"`
+	Encoding      string              `json:"encoding"`
+	Data          string              `json:"data"`
 }
 
-// Map of peer addresses, for easy set-like behaviour
-type peerStringMap map[string]time.Time
+// A cosignature of the block hash, in the block message
+type p2pBlockSignature struct {
+	PublicKeyHash string `json:"pubkey_hash"`
+	Signature     string `json:"signature"`
+}
 
-var bootstrapPeers = peerStringMap{
-	"cosmos.ivoras.net:2017":  time.Now(),
-	"fielder.ivoras.net:2017": time.Now(),
+// The message reporting that a received block has been vetoed
+const p2pMsgBlockRejected = "blockrejected"
+
+type p2pMsgBlockRejectedStruct struct {
+	p2pMsgHeader
+	Hash    string `json:"hash"`
+	Stage   string `json:"stage"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
 }
 
-// The temporary ID of this node, using strong RNG
-var p2pEphemeralID = randInt63() & 0xffffffffffff
+// Map of peer addresses, for easy set-like behaviour
+type peerStringMap map[string]time.Time
 
 // Everything useful describing one p2p connection
 type p2pConnection struct {
 	conn              net.Conn
 	address           string // host:port
+	savedAddress      string // The address of the saved peer, for outgoing connections to saved peers
 	peer              *bufio.ReadWriter
 	peerID            int64
 	isConnectable     bool // using the default port
 	testedConnectable bool // using the default port
 	chainHeight       int
+	version           string   // as reported by the peer
+	network           string   // as reported by the peer
+	mining            bool     // accepts mining work
+	relay             bool     // relays the connections of other nodes, see p2prelay.go
+	capabilities      []string // as listed in the peer's hello, see p2pcaps.go
+	stalls            int32    // unanswered requests in a row, accessed atomically, see p2psync.go
+	penalty           int32    // penalty points, accessed atomically, see p2pmisbehavior.go
+	score             p2pPeerScore
+	tip               p2pPeerTip // see p2ptip.go
+	connectedTime     time.Time
 	refreshTime       time.Time
+	handshakeDone     func()           // For the inbound connections, see p2pthrottle.go
 	chanToPeer        chan interface{} // structs go out
 	chanFromPeer      chan StrIfMap    // StrIfMaps go in
+	ctx               context.Context  // Cancelled when the connection is torn down
+	cancel            context.CancelFunc
+	wg                sync.WaitGroup // Tracks all the goroutines belonging to this connection
+	compression       string         // The compression of the messages sent to the peer, see p2pcompress.go
+	compressor        p2pCompressor  // Used by writeLoop once the stream sent is compressed
+	decompressor      io.ReadCloser  // Used by readLoop once the stream received is compressed
+
+	// Traffic counters, updated atomically
+	bytesIn  uint64
+	bytesOut uint64
+	msgsIn   uint64
+	msgsOut  uint64
+	node     *Node
 }
 
 // A set of p2p connections
 type p2pPeersSet struct {
 	peers map[*p2pConnection]time.Time
 	lock  WithMutex // Warning: do not do any IO/network operations while holding this lock
+	node  *Node
 }
 
-// The global set of p2p connections. XXX: Singletons in Go?
-var p2pPeers = p2pPeersSet{peers: make(map[*p2pConnection]time.Time)}
-
 // Adds a p2p connections to the set of p2p connections
 func (p *p2pPeersSet) Add(c *p2pConnection) {
 	p.lock.With(func() {
 		p.peers[c] = time.Now()
 	})
+	p.node.nodeEvents.Publish(eventPeerConnected, StrIfMap{"address": c.address})
 }
 
 // Removes a p2p connection from the set of p2p connections
@@ -122,6 +182,21 @@ func (p *p2pPeersSet) Remove(c *p2pConnection) {
 	p.lock.With(func() {
 		delete(p.peers, c)
 	})
+	p.node.nodeEvents.Publish(eventPeerDisconnected, StrIfMap{"address": c.address})
+}
+
+// Returns the number of connected peers, and the highest chain height reported by them
+func (p *p2pPeersSet) Stats() (count int, maxChainHeight int) {
+	maxChainHeight = -1
+	p.lock.With(func() {
+		count = len(p.peers)
+		for peer := range p.peers {
+			if peer.chainHeight > maxChainHeight {
+				maxChainHeight = peer.chainHeight
+			}
+		}
+	})
+	return
 }
 
 func (p *p2pPeersSet) HasAddress(address string) bool {
@@ -150,6 +225,78 @@ func (p *p2pPeersSet) GetAddresses(onlyConnectable bool) []string {
 	return addresses
 }
 
+// Returns the peer addresses to share with the other peers, the most recently seen first: the
+// connectable connected peers, seen now, and the saved peers seen within p2pPeerMaxAge.
+func (node *Node) p2pSharedPeers() []p2pSharedPeer {
+	now := time.Now()
+	seen := map[string]int64{}
+	for _, address := range node.p2pPeers.GetAddresses(true) {
+		seen[address] = now.Unix()
+	}
+	saved, err := node.dbGetSavedPeerRecords()
+	if err != nil {
+		p2pLog.Warn("Cannot read the saved peers:", err)
+	}
+	for _, p := range saved {
+		lastSeen := p.lastSeen()
+		if now.Sub(lastSeen) > p2pPeerMaxAge || !p.bannedUntil.IsZero() && p.bannedUntil.After(now) {
+			continue
+		}
+		if lastSeen.Unix() > seen[p.address] {
+			seen[p.address] = lastSeen.Unix()
+		}
+	}
+	peers := make([]p2pSharedPeer, 0, len(seen))
+	for address, lastSeen := range seen {
+		peers = append(peers, p2pSharedPeer{Address: address, LastSeen: lastSeen})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].LastSeen != peers[j].LastSeen {
+			return peers[i].LastSeen > peers[j].LastSeen
+		}
+		return peers[i].Address < peers[j].Address
+	})
+	if len(peers) > p2pMaxSharedPeers {
+		peers = peers[:p2pMaxSharedPeers]
+	}
+	return peers
+}
+
+// Returns the peer addresses from a message, without the ones not seen within p2pPeerMaxAge
+// and at most p2pMaxSharedPeers of them. The older nodes only send the addresses of their
+// connected peers, in my_peers.
+func p2pReceivedPeers(msg StrIfMap) []string {
+	list, ok := msg["peers"].([]interface{})
+	if !ok {
+		addresses, _ := msg.GetStringList("my_peers")
+		if len(addresses) > p2pMaxSharedPeers {
+			addresses = addresses[:p2pMaxSharedPeers]
+		}
+		return addresses
+	}
+	minSeen := time.Now().Add(-p2pPeerMaxAge).Unix()
+	var addresses []string
+	for _, item := range list {
+		peer, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		address, err := StrIfMap(peer).GetString("address")
+		if err != nil {
+			continue
+		}
+		lastSeen, err := StrIfMap(peer).GetInt64("last_seen")
+		if err != nil || lastSeen < minSeen {
+			continue
+		}
+		addresses = append(addresses, address)
+		if len(addresses) == p2pMaxSharedPeers {
+			break
+		}
+	}
+	return addresses
+}
+
 func (p *p2pPeersSet) tryPeersConnectable() {
 	addressesToTry := map[string]string{}
 
@@ -162,12 +309,12 @@ func (p *p2pPeersSet) tryPeersConnectable() {
 			if err != nil {
 				continue
 			}
-			if port == DefaultP2PPort {
+			if port == p.node.networkP2PPort() {
 				// we're already connected to it
 				continue
 			}
 
-			address := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
+			address := fmt.Sprintf("%s:%d", host, p.node.networkP2PPort())
 			peer.testedConnectable = true
 
 			addressesToTry[peer.address] = address
@@ -189,13 +336,17 @@ func (p *p2pPeersSet) tryPeersConnectable() {
 
 		err = conn.Close()
 		if err != nil {
-			log.Println(err)
+			p2pLog.Warn(err)
 		}
 	}
 }
 
 func (p *p2pPeersSet) saveConnectablePeers() {
-	dbPeers := dbGetSavedPeers()
+	dbPeers, err := p.node.dbGetSavedPeers()
+	if err != nil {
+		p2pLog.Error("Cannot read the saved peers:", err)
+		return
+	}
 	localAddresses := getLocalAddresses()
 
 	p.lock.With(func() {
@@ -207,7 +358,7 @@ func (p *p2pPeersSet) saveConnectablePeers() {
 			if err != nil {
 				continue
 			}
-			canonicalAddress := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
+			canonicalAddress := fmt.Sprintf("%s:%d", host, p.node.networkP2PPort())
 			addr, err := net.ResolveTCPAddr("tcp", canonicalAddress)
 			if err != nil {
 				continue
@@ -220,49 +371,100 @@ func (p *p2pPeersSet) saveConnectablePeers() {
 				// Local interface
 				continue
 			}
-			log.Println("Detected canonical peer at", canonicalAddress)
-			dbSavePeer(canonicalAddress)
+			p2pLog.Info("Detected canonical peer at", canonicalAddress)
+			if err = p.node.dbSavePeer(canonicalAddress); err != nil {
+				p2pLog.Error("Cannot save peer", canonicalAddress, err)
+			}
 		}
 	})
 
 }
 
-func p2pServer() {
-	serverAddress := ":" + strconv.Itoa(cfg.P2pPort)
-	l, err := net.Listen("tcp", serverAddress)
+func (node *Node) p2pServer() {
+	addresses, err := node.p2pListenAddresses()
+	if err != nil {
+		p2pLog.Fatal(err)
+	}
+	listeners, err := listenAll(addresses)
 	if err != nil {
-		log.Println("Cannot listen on", serverAddress)
-		log.Fatal(err)
+		p2pLog.Fatal(err)
+	}
+	for _, l := range listeners {
+		p2pLog.Info("P2P listening on", l.Addr())
+		go node.p2pAccept(l)
 	}
+}
+
+// Accepts the p2p connections on the listener
+func (node *Node) p2pAccept(l net.Listener) {
 	defer func() {
-		err = l.Close()
+		err := l.Close()
 		if err != nil {
-			log.Fatalf("p2pServer l.Close: %v", err)
+			p2pLog.Fatalf("p2pServer l.Close: %v", err)
 		}
 	}()
-	log.Println("P2P listening on", serverAddress)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			log.Println("Error accepting socket:", err)
+			p2pLog.Error("Error accepting socket:", err)
 			sysEventChannel <- sysEventMessage{event: eventQuit}
 			return
 		}
-		if p2pCoordinator.badPeers.Has(conn.RemoteAddr().String()) {
-			log.Println("Ignoring bad peer", conn.RemoteAddr().String())
+		// See p2pthrottle.go
+		handshakeDone, reason := node.p2pThrottle.admit(conn)
+		if handshakeDone == nil {
+			p2pLog.Debug("Refusing", conn.RemoteAddr().String()+":", reason)
+			conn.Close()
 			continue
 		}
-		p2pc, err := p2pSetupPeer(conn.RemoteAddr().String(), conn)
-		if err != nil {
-			log.Println("Error setting up peer", conn.RemoteAddr().String(), err)
+		if node.cfg.SinglePort {
+			// The HTTP connections are passed to the HTTP server, see singleport.go
+			go func(conn net.Conn) {
+				if conn = node.singlePortSniff(conn); conn != nil {
+					node.p2pAcceptConn(conn, handshakeDone)
+				} else {
+					handshakeDone()
+				}
+			}(conn)
 			continue
 		}
-		go p2pc.handleConnection()
+		node.p2pAcceptConn(conn, handshakeDone)
 	}
 }
 
-func p2pClient() {
-	p2pCoordinator.connectDbPeers()
+// Starts handling an accepted p2p connection. handshakeDone is called when the connection's
+// prologue has been exchanged, or it's refused.
+func (node *Node) p2pAcceptConn(conn net.Conn, handshakeDone func()) {
+	if node.p2pIsBanned(conn.RemoteAddr().String()) {
+		p2pLog.Debug("Refusing banned peer", conn.RemoteAddr().String())
+		conn.Close()
+		handshakeDone()
+		return
+	}
+	if node.p2pCoordinator.badPeers.Has(conn.RemoteAddr().String()) {
+		p2pLog.Warn("Ignoring bad peer", conn.RemoteAddr().String())
+		conn.Close()
+		handshakeDone()
+		return
+	}
+	if !node.p2pPeers.makeRoom() {
+		p2pLog.Warn("Too many peers, refusing", conn.RemoteAddr().String())
+		conn.Close()
+		handshakeDone()
+		return
+	}
+	p2pc, err := node.p2pSetupPeer(conn.RemoteAddr().String(), conn)
+	if err != nil {
+		p2pLog.Warn("Error setting up peer", conn.RemoteAddr().String(), err)
+		handshakeDone()
+		return
+	}
+	p2pc.handshakeDone = handshakeDone
+	go p2pc.handleConnection()
+}
+
+func (node *Node) p2pClient() {
+	node.p2pCoordinator.connectDbPeers()
 }
 
 func (p2pc *p2pConnection) sendMsg(msg interface{}) error {
@@ -284,19 +486,46 @@ func (p2pc *p2pConnection) sendMsg(msg interface{}) error {
 	if n != 1 {
 		return errors.New("didn't write newline")
 	}
+	atomic.AddUint64(&p2pc.bytesOut, uint64(len(bmsg)+1))
+	atomic.AddUint64(&p2pc.msgsOut, 1)
 	//log.Println("... successfully wrote", string(bmsg))
-	return p2pc.peer.Flush()
+	if err = p2pc.peer.Flush(); err != nil {
+		return err
+	}
+	if p2pc.compressor != nil {
+		return p2pc.compressor.Flush()
+	}
+	return nil
+}
+
+// Queues a message to be sent to the peer. Returns false if the connection is being
+// torn down, in which case the message is dropped.
+func (p2pc *p2pConnection) send(msg interface{}) bool {
+	select {
+	case p2pc.chanToPeer <- msg:
+		return true
+	case <-p2pc.ctx.Done():
+		return false
+	}
 }
 
+// Handles the connection by starting the reader and the writer goroutines and processing
+// the incoming messages. When any of these finish, the connection's context is cancelled,
+// and all of the connection's goroutines are waited for before returning.
 func (p2pc *p2pConnection) handleConnection() {
 	defer func() {
-		log.Println("Cleaning up connection", p2pc.address)
-		p2pPeers.Remove(p2pc)
-		err := p2pc.conn.Close()
+		p2pLog.Debug("Cleaning up connection", p2pc.address)
+		p2pc.cancel()
+		p2pc.node.p2pPeers.Remove(p2pc)
+		p2pc.relayDisconnected()
+		p2pc.recordPeerDisconnect()
+		err := p2pc.conn.Close() // Unblocks the reader
 		if err != nil {
-			log.Printf("p2pc.conn.Close: %v", err)
+			p2pLog.Warnf("p2pc.conn.Close: %v", err)
 		}
-		log.Println("Finished cleaning up connection", p2pc.address)
+		p2pc.wg.Wait()
+		p2pc.closeCompression()
+		p2pLog.Debug("Finished cleaning up connection", p2pc.address)
 	}()
 
 	// Only store the IP address as the address.
@@ -307,189 +536,336 @@ func (p2pc *p2pConnection) handleConnection() {
 	}
 
 	p2pc.peer = bufio.NewReadWriter(bufio.NewReader(p2pc.conn), bufio.NewWriter(p2pc.conn))
+	err = p2pc.exchangePrologue()
+	if p2pc.handshakeDone != nil {
+		p2pc.handshakeDone()
+	}
+	if err != nil {
+		p2pLog.Warnf("Rejecting %v: %v", p2pc.address, err)
+		p2pc.node.p2pCoordinator.badPeers.Add(p2pc.address)
+		return
+	}
 
+	height, err := p2pc.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot read the blockchain height:", err)
+		return
+	}
 	// XXX: the state machine shouldn't start by the listener sending something
 	// (security best practices)
 	helloMsg := p2pMsgHelloStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
 			Msg:   p2pMsgHello,
 		},
 		Version:     p2pClientVersionString,
-		ChainHeight: dbGetBlockchainHeight(),
-		MyPeers:     p2pPeers.GetAddresses(true),
+		ChainHeight: height,
+		Peers:       p2pc.node.p2pSharedPeers(),
+	}
+	for _, peer := range helloMsg.Peers {
+		if p2pc.node.p2pPeers.HasAddress(peer.Address) && len(helloMsg.MyPeers) < p2pMaxSharedPeers {
+			helloMsg.MyPeers = append(helloMsg.MyPeers, peer.Address)
+		}
+	}
+	if p2pc.node.networkIsTest() {
+		helloMsg.Network = p2pc.node.networkName()
+	}
+	helloMsg.Mining = p2pc.node.cfg.MiningCooperate
+	helloMsg.Compression = p2pc.node.p2pAcceptedCompressions()
+	helloMsg.Capabilities = p2pc.node.p2pLocalCapabilities()
+	if ip := p2pc.remoteIP(); ip != nil {
+		helloMsg.YourAddress = ip.String()
 	}
 	err = p2pc.sendMsg(helloMsg)
 	if err != nil {
-		log.Println(err)
+		p2pLog.Warn(err)
 		return
 	}
-	log.Println("Handling connection", p2pc.address)
-	exit := false
+	p2pLog.Debug("Handling connection", p2pc.address)
 
-	go func() {
-		var line []byte
-		for {
-			line, err = p2pc.peer.ReadBytes('\n')
-			if err != nil {
-				log.Println("Error reading data from", p2pc.address, err)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Error reading data"}
-				break
-			}
-			var msg StrIfMap
-			err = json.Unmarshal(line, &msg)
-			if err != nil {
-				log.Println("Cannot parse JSON", strconv.QuoteToASCII(string(line)), "from", p2pc.address)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Cannot parse JSON"}
-				break
-			}
+	p2pc.wg.Add(2)
+	go p2pc.readLoop()
+	go p2pc.writeLoop()
 
-			var root string
-			if root, err = msg.GetString("root"); err != nil {
-				log.Printf("Problem with chain root from  %v: %v", p2pc.address, err)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Problem with chain root"}
-				break
-			}
-			if root != chainParams.GenesisBlockHash {
-				log.Printf("Received message from %v for a different chain than mine (%s vs %s). Ignoring.", p2pc.conn, root, chainParams.GenesisBlockHash)
-				continue
+	for {
+		select {
+		case <-p2pc.ctx.Done():
+			// The connection has been dismissed
+			return
+		case msg := <-p2pc.chanFromPeer:
+			// log.Printf("... chainFromPeer: %s: %s", p2pc.address, jsonifyWhatever(msg))
+			if err = p2pc.handleMsg(msg); err != nil {
+				p2pLog.Warnf("Error with msg from %v: %v", p2pc.address, err)
+				return
 			}
-			p2pc.chanFromPeer <- msg
 		}
-		log.Println("Shutting down receiver for", p2pc.address)
-		exit = true // In any case, if this goroutine exits, we want to shut down everything
-	}()
+	}
+}
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// Dispatches a message received from the peer to its handler. Problems with the message are
+// logged by the handlers, while the errors they return (e.g. from the database) drop the peer.
+func (p2pc *p2pConnection) handleMsg(msg StrIfMap) error {
+	cmd, err := msg.GetString("msg")
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case p2pMsgHello:
+		p2pc.handleMsgHello(msg)
+	case p2pMsgGetBlockHashes:
+		return p2pc.handleGetBlockHashes(msg)
+	case p2pMsgBlockHashes:
+		return p2pc.handleBlockHashes(msg)
+	case p2pMsgGetBlock:
+		return p2pc.handleGetBlock(msg)
+	case p2pMsgBlock:
+		return p2pc.handleBlock(msg)
+	case p2pMsgBlockRejected:
+		p2pc.handleBlockRejected(msg)
+	case p2pMsgMineWork:
+		p2pc.handleMineWork(msg)
+	case p2pMsgMineSolution:
+		p2pc.handleMineSolution(msg)
+	case p2pMsgMineCancel:
+		p2pc.handleMineCancel(msg)
+	case p2pMsgGetTip:
+		return p2pc.handleGetTip()
+	case p2pMsgTip:
+		p2pc.handleTip(msg)
+	case p2pMsgRecords:
+		p2pc.handleRecords(msg)
+	case p2pMsgKeyOp:
+		p2pc.handleKeyOp(msg)
+	case p2pMsgEquivocation:
+		p2pc.handleEquivocation(msg)
+	case p2pMsgRelayRegister:
+		p2pc.handleRelayRegister()
+	case p2pMsgRelayPeers:
+		p2pc.handleRelayPeers(msg)
+	case p2pMsgRelayOpen:
+		p2pc.handleRelayOpen(msg)
+	case p2pMsgRelayData:
+		p2pc.handleRelayData(msg)
+	case p2pMsgRelayClose:
+		p2pc.handleRelayClose(msg)
+	}
+	return nil
+}
 
-	for !exit {
-		select {
-		case msg := <-p2pc.chanFromPeer:
-			// log.Printf("... chainFromPeer: %s: %s", p2pc.address, jsonifyWhatever(msg))
-			var _error string
-			if _error, err = msg.GetString("_error"); err == nil {
-				log.Printf("Fatal error from %v: %v", p2pc.address, _error)
-				exit = true
+// Reads messages from the peer and passes them to the handler. If this goroutine exits,
+// the whole connection is shut down.
+func (p2pc *p2pConnection) readLoop() {
+	defer p2pc.wg.Done()
+	defer p2pc.cancel()
+	for {
+		maxSize := p2pc.node.p2pMaxMessageSize()
+		line, err := p2pReadLine(p2pc.peer.Reader, maxSize)
+		if err == errP2pMessageTooLarge {
+			p2pc.misbehaved(p2pPenaltyOversized, fmt.Sprintf("has sent a message larger than %d bytes", maxSize))
+			break
+		}
+		if err != nil {
+			p2pLog.Warn("Error reading data from", p2pc.address, err)
+			break
+		}
+		atomic.AddUint64(&p2pc.bytesIn, uint64(len(line)))
+		atomic.AddUint64(&p2pc.msgsIn, 1)
+		var msg StrIfMap
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			p2pLog.Warn("Cannot parse JSON", strconv.QuoteToASCII(string(line)), "from", p2pc.address)
+			p2pc.misbehaved(p2pPenaltyMalformed, "has sent a message which isn't JSON")
+			break
+		}
+		if p2pc.node.p2pSessionRecorder != nil {
+			p2pc.node.p2pSessionRecorder.recordMsg(p2pc.address, msg)
+		}
+
+		var root string
+		if root, err = msg.GetString("root"); err != nil {
+			p2pLog.Warnf("Problem with chain root from  %v: %v", p2pc.address, err)
+			p2pc.misbehaved(p2pPenaltyMalformed, "has sent a message without the chain root")
+			break
+		}
+		if root != p2pc.node.chainParams.GenesisBlockHash {
+			p2pLog.Warnf("Received message from %v for a different chain than mine (%s vs %s). Ignoring.", p2pc.conn, root, p2pc.node.chainParams.GenesisBlockHash)
+			if p2pc.misbehaved(p2pPenaltyWrongRoot, "has sent a message for a different chain") {
 				break
 			}
-			var cmd string
-			if cmd, err = msg.GetString("msg"); err != nil {
-				log.Printf("Error with msg from %v: %v", p2pc.address, err)
-				exit = true
+			continue
+		}
+		if cmd, _ := msg.GetString("msg"); cmd == p2pMsgCompress {
+			// The rest of the stream is compressed
+			if err = p2pc.decompressInput(msg); err != nil {
+				p2pLog.Warn("Cannot decompress the messages from", p2pc.address, err)
 				break
 			}
-			switch cmd {
-			case p2pMsgHello:
-				p2pc.handleMsgHello(msg)
-			case p2pMsgGetBlockHashes:
-				p2pc.handleGetBlockHashes(msg)
-			case p2pMsgBlockHashes:
-				p2pc.handleBlockHashes(msg)
-			case p2pMsgGetBlock:
-				p2pc.handleGetBlock(msg)
-			case p2pMsgBlock:
-				p2pc.handleBlock(msg)
-			}
+			continue
+		}
+		select {
+		case p2pc.chanFromPeer <- msg:
+		case <-p2pc.ctx.Done():
+			return
+		}
+	}
+	p2pLog.Debug("Shutting down receiver for", p2pc.address)
+}
+
+// Sends the queued messages to the peer. If this goroutine exits, the whole connection
+// is shut down.
+func (p2pc *p2pConnection) writeLoop() {
+	defer p2pc.wg.Done()
+	defer p2pc.cancel()
+	for {
+		select {
+		case <-p2pc.ctx.Done():
+			return
 		case msg := <-p2pc.chanToPeer:
-			err := p2pc.sendMsg(msg)
-			if err != nil {
-				log.Println("Error sending to peer:", err)
-				exit = true
+			if err := p2pc.sendMsg(msg); err != nil {
+				p2pLog.Warn("Error sending to peer:", err)
+				return
+			}
+			if cm, ok := msg.(p2pMsgCompressStruct); ok {
+				if err := p2pc.compressOutput(cm.Compression); err != nil {
+					p2pLog.Warn("Cannot compress the messages to", p2pc.address, err)
+					return
+				}
 			}
-		case <-ticker.C:
-			// so the exit variable gets tested
-			continue
 		}
 	}
-	// The connection has been dismissed
 }
 
 func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 	var ver string
 	var err error
 	if ver, err = msg.GetString("version"); err != nil {
-		log.Println(p2pc.conn, err)
+		p2pc.malformed(err)
 		return
 	}
 	if p2pc.chainHeight, err = msg.GetInt("chain_height"); err != nil {
-		log.Println(p2pc.conn, err)
+		p2pc.malformed(err)
 		return
 	}
 	if p2pc.peerID == 0 {
 		if p2pc.peerID, err = msg.GetInt64("p2p_id"); err != nil {
-			log.Println(p2pc.conn, err)
+			p2pc.malformed(err)
 			return
 		}
 	}
-	var remotePeers []string
-	if remotePeers, err = msg.GetStringList("my_peers"); err == nil {
-		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlConnectPeers, payload: remotePeers}
+	network, err := msg.GetString("network")
+	if err != nil {
+		network = networkMain
+	}
+	if network != p2pc.node.networkName() {
+		p2pLog.Warnf("%v is on the %s network instead of %s. Dropping it.", p2pc.address, network, p2pc.node.networkName())
+		p2pc.node.p2pCoordinator.badPeers.Add(p2pc.address)
+		if err = p2pc.conn.Close(); err != nil {
+			p2pLog.Warnf("p2pc.conn.Close: %v", err)
+		}
+		return
+	}
+	p2pc.network = network
+	p2pc.mining, _ = msg["mining"].(bool)
+	p2pc.capabilities, _ = msg.GetStringList("capabilities")
+	p2pc.relay = p2pc.hasCapability(p2pCapRelay)
+	if remotePeers := p2pReceivedPeers(msg); len(remotePeers) > 0 {
+		p2pc.node.p2pCoordinatorPost(p2pCtrlMessage{msgType: p2pCtrlConnectPeers, payload: remotePeers})
 	}
-	log.Printf("Hello from %v %s (%x) %d blocks", p2pc.address, ver, p2pc.peerID, p2pc.chainHeight)
+	if yourAddress, err := msg.GetString("your_address"); err == nil {
+		p2pc.node.p2pRecordObservedAddress(yourAddress, p2pc)
+	}
+	p2pc.version = ver
+	p2pLog.Infof("Hello from %v %s (%x) %d blocks", p2pc.address, ver, p2pc.peerID, p2pc.chainHeight)
 	// Check for duplicates
 	dup := false
-	p2pPeers.lock.With(func() {
-		for p := range p2pPeers.peers {
+	p2pc.node.p2pPeers.lock.With(func() {
+		for p := range p2pc.node.p2pPeers.peers {
 			if p.peerID == p2pc.peerID && p != p2pc {
-				log.Printf("%v looks like a duplicate of %v (%x), dropping it.", p2pc.address, p.address, p2pc.peerID)
+				p2pLog.Infof("%v looks like a duplicate of %v (%x), dropping it.", p2pc.address, p.address, p2pc.peerID)
 				dup = true
 				return
 			}
 		}
 	})
-	if p2pc.peerID == p2pEphemeralID {
-		log.Printf("%v is apparently myself (%x). Dropping it.", p2pc.conn, p2pc.peerID)
-		dup = true
+	myself := p2pc.peerID == p2pc.node.p2pEphemeralID
+	if myself {
+		p2pLog.Warnf("%v is apparently myself (%x). Dropping it.", p2pc.conn, p2pc.peerID)
+		// Only the connections to myself are banned, a duplicate can be a simultaneous dial, or
+		// a relayed and a direct connection to the same peer
+		p2pc.node.p2pCoordinator.badPeers.Add(p2pc.address)
+		if err = p2pc.node.dbBanPeer(p2pc.address, time.Now().Add(p2pPeerBackoffMax)); err != nil {
+			p2pLog.Warn("Cannot ban", p2pc.address, err)
+		}
 	}
-	if dup {
-		p2pCoordinator.badPeers.Add(p2pc.address)
+	if dup || myself {
 		err = p2pc.conn.Close()
 		if err != nil {
-			log.Printf("p2pc.conn.Close: %v", err)
+			p2pLog.Warnf("p2pc.conn.Close: %v", err)
 		}
 		return
 	}
 	p2pc.refreshTime = time.Now()
-	if p2pc.chainHeight > dbGetBlockchainHeight() {
-		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: p2pc}
+	p2pc.startCompression(msg)
+	if p2pc.relay && p2pc.node.cfg.UseRelays {
+		p2pc.wg.Add(1)
+		go p2pc.relayRegister()
+	}
+	if records, _ := p2pc.node.mempool.List(); len(records) > 0 {
+		go p2pc.sendRecords(records)
+	}
+	if proposals := p2pc.node.keyOpProposals.List(); len(proposals) > 0 {
+		go p2pc.sendKeyOps(proposals)
+	}
+	if height, err := p2pc.node.dbGetBlockchainHeight(); err != nil {
+		p2pLog.Error("Cannot read the blockchain height:", err)
+	} else if p2pc.chainHeight > height {
+		p2pc.node.p2pCoordinatorPost(p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: p2pc})
 	}
 }
 
 // Handle getblockhashes
-func (p2pc *p2pConnection) handleGetBlockHashes(msg StrIfMap) {
+func (p2pc *p2pConnection) handleGetBlockHashes(msg StrIfMap) error {
 	var minBlockHeight int
 	var maxBlockHeight int
 	var err error
 	if minBlockHeight, err = msg.GetInt("min_block_height"); err != nil {
-		log.Println(p2pc.conn, err)
-		return
+		p2pc.malformed(err)
+		return nil
 	}
 	if maxBlockHeight, err = msg.GetInt("max_block_height"); err != nil {
-		log.Println(p2pc.conn, err)
-		return
+		p2pc.malformed(err)
+		return nil
+	}
+	if maxBlockHeight-minBlockHeight >= p2pMaxBlockHashes {
+		maxBlockHeight = minBlockHeight + p2pMaxBlockHashes - 1
+	}
+	p2pLog.Debugf("*** Sending block hashes from %d to %d to %s", minBlockHeight, maxBlockHeight, p2pc.address)
+	hashes, err := p2pc.node.dbGetHeightHashes(minBlockHeight, maxBlockHeight)
+	if err != nil {
+		return err
 	}
-	log.Printf("*** Sending block hashes from %d to %d to %s", minBlockHeight, maxBlockHeight, p2pc.address)
 	respMsg := p2pMsgBlockHashesStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
 			Msg:   p2pMsgBlockHashes,
 		},
-		Hashes: dbGetHeightHashes(minBlockHeight, maxBlockHeight),
+		Hashes: hashes,
 	}
-	p2pc.chanToPeer <- respMsg
+	p2pc.send(respMsg)
+	return nil
 }
 
 // Handle receiving blockhashes
-func (p2pc *p2pConnection) handleBlockHashes(msg StrIfMap) {
+func (p2pc *p2pConnection) handleBlockHashes(msg StrIfMap) error {
 	var hashes map[int]string
 	var err error
 	if hashes, err = msg.GetIntStringMap("hashes"); err != nil {
-		log.Println(p2pc.conn, err)
-		return
+		p2pc.malformed(err)
+		return nil
 	}
+	req := p2pc.node.p2pBlockHashesReceived(p2pc)
 	heights := make([]int, len(hashes))
 	n := 0
 	for h := range hashes {
@@ -497,76 +873,94 @@ func (p2pc *p2pConnection) handleBlockHashes(msg StrIfMap) {
 		n++
 	}
 	sort.Ints(heights)
-	log.Println("handleBlockHashes: got", jsonifyWhatever(heights))
+	if req != nil {
+		p2pc.score.recordHeightClaim(n > 0 && heights[n-1] >= req.height)
+	}
+	p2pLog.Debug("handleBlockHashes: got", jsonifyWhatever(heights))
 	for _, h := range heights {
-		if dbBlockHeightExists(h) {
-			log.Println("handleBlockHashes: already have block:", h)
-			if dbGetBlockHashByHeight(h) != hashes[h] {
-				log.Println("ERROR: Blockchain desynced: received block hash at height", h, "to be", hashes[h], "instead of", dbGetBlockHashByHeight(h))
-				return
+		myHash, err := p2pc.node.dbGetBlockHashByHeight(h)
+		if err != nil {
+			return err
+		}
+		if myHash != "" {
+			p2pLog.Debug("handleBlockHashes: already have block:", h)
+			if myHash != hashes[h] {
+				p2pLog.Error("Blockchain desynced: received block hash at height", h, "to be", hashes[h], "instead of", myHash)
+				return nil
 			}
 			continue
 		}
-		if p2pCoordinator.recentlyRequestedBlocks.TestAndSet(hashes[h]) {
+		if p2pc.node.p2pCoordinator.recentlyRequestedBlocks.TestAndSet(hashes[h]) || p2pc.node.p2pBlockRequested(hashes[h]) {
 			continue
 		}
-		log.Println("Requesting block", hashes[h])
-		msg := p2pMsgGetBlockStruct{
-			p2pMsgHeader: p2pMsgHeader{
-				P2pID: p2pEphemeralID,
-				Root:  chainParams.GenesisBlockHash,
-				Msg:   p2pMsgGetBlock,
-			},
-			Hash: hashes[h],
+		p2pLog.Debug("Requesting block", hashes[h])
+		if !p2pc.requestBlock(hashes[h], h) {
+			return nil
 		}
-		p2pc.chanToPeer <- msg
 	}
+	if req != nil {
+		p2pc.continueSearch(req.height)
+	}
+	return nil
 }
 
 // getblock: a request to transfer a block
-func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
+func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) error {
 	hash, err := msg.GetString("hash")
 	if err != nil {
-		log.Println(p2pc.conn, err)
-		return
+		p2pc.malformed(err)
+		return nil
+	}
+	dbb, err := p2pc.node.dbGetBlock(hash)
+	evidence := false
+	if err == sql.ErrNoRows {
+		// The conflicting block of an equivocation proof isn't in the blockchain, so it can't
+		// be handed off to the HTTP server
+		dbb, err = p2pc.node.dbGetEquivocationBlock(hash)
+		evidence = err == nil
+	}
+	if err == sql.ErrNoRows {
+		p2pLog.Warn(p2pc.conn, "doesn't have block", hash)
+		return nil
 	}
-	dbb, err := dbGetBlock(hash)
 	if err != nil {
-		log.Println(p2pc.conn, err)
-		return
+		return err
 	}
-	fileName := blockchainGetFilename(dbb.Height)
+	fileName := p2pc.node.blockStore.Filename(dbb.Hash)
 	st, err := os.Stat(fileName)
 	if err != nil {
-		log.Println(err)
-		return
+		p2pLog.Warn(err)
+		return nil
 	}
 	fileSize := st.Size()
 
 	var msgBlockEncoding, msgBlockData string
 
-	if cfg.p2pBlockInline {
+	// Peers don't have the credentials for the HTTP server if it requires authentication, and
+	// the peers connected through relays can't check that the URL is this node's, see
+	// validateBlockURL()
+	if p2pc.node.cfg.P2pBlockInline || p2pc.node.blockWebAuthRequired() || evidence || p2pc.relayed() {
 		f, err := os.Open(fileName)
 		if err != nil {
-			log.Println(err)
-			return
+			p2pLog.Warn(err)
+			return nil
 		}
 		defer func() {
 			err = f.Close()
 			if err != nil {
-				log.Printf("handleGetBlock f.Close: %v", err)
+				p2pLog.Warnf("handleGetBlock f.Close: %v", err)
 			}
 		}()
 		var zbuf bytes.Buffer
 		w := zlib.NewWriter(&zbuf)
 		written, err := io.Copy(w, f)
 		if err != nil {
-			log.Println(err)
-			return
+			p2pLog.Warn(err)
+			return nil
 		}
 		if written != fileSize {
-			log.Println("Something broke when working with zlib:", written, "vs", fileSize)
-			return
+			p2pLog.Error("Something broke when working with zlib:", written, "vs", fileSize)
+			return nil
 		}
 		err = w.Close()
 		if err != nil {
@@ -576,204 +970,278 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 		msgBlockData = base64.StdEncoding.EncodeToString(zbuf.Bytes())
 	} else {
 		msgBlockEncoding = "http"
-		msgBlockData = fmt.Sprintf("http://%s:%d/block/%d", getLocalAddresses()[0], cfg.httpPort, dbb.Height)
-		log.Println("*** Instructing the peer to get a block from", msgBlockData)
+		msgBlockData = p2pc.node.blockHandOffURL(dbb.Height)
+		p2pLog.Debug("*** Instructing the peer to get a block from", msgBlockData)
 	}
 
 	respMsg := p2pMsgBlockStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
 			Msg:   p2pMsgBlock,
 		},
 		Hash:          hash,
 		HashSignature: hex.EncodeToString(dbb.HashSignature),
+		Cosignatures:  p2pEncodeCosignatures(dbb.Cosignatures),
 		Encoding:      msgBlockEncoding,
 		Data:          msgBlockData,
 		Size:          fileSize,
 	}
-	p2pc.chanToPeer <- respMsg
-	log.Println("*** Sent block", hash, "to", p2pc.address)
+	p2pc.send(respMsg)
+	p2pLog.Debug("*** Sent block", hash, "to", p2pc.address)
+	return nil
+}
+
+// Encodes the cosignatures for the block message
+func p2pEncodeCosignatures(sigs []BlockSignature) []p2pBlockSignature {
+	var result []p2pBlockSignature
+	for _, sig := range sigs {
+		result = append(result, p2pBlockSignature{PublicKeyHash: sig.PublicKeyHash, Signature: hex.EncodeToString(sig.Signature)})
+	}
+	return result
+}
+
+// Decodes the optional cosignatures field of a block message
+func p2pDecodeCosignatures(msg StrIfMap) ([]BlockSignature, error) {
+	raw, ok := msg["cosignatures"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	var msgSigs []p2pBlockSignature
+	if err := json.Unmarshal(jsonifyWhateverToBytes(raw), &msgSigs); err != nil {
+		return nil, err
+	}
+	var result []BlockSignature
+	for _, ms := range msgSigs {
+		signature, err := hex.DecodeString(ms.Signature)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, BlockSignature{PublicKeyHash: ms.PublicKeyHash, Signature: signature})
+	}
+	return result, nil
 }
 
 // block: A block is received
-func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
+func (p2pc *p2pConnection) handleBlock(msg StrIfMap) error {
 	hash, err := msg.GetString("hash")
 	if err != nil {
-		log.Println(err)
-		return
+		p2pc.malformed(err)
+		return nil
 	}
+	requestTime := p2pc.node.p2pBlockReceived(p2pc, hash)
 	hashSignature, err := msg.GetString("hash_signature")
 	if err != nil {
-		log.Println(err)
-		return
+		p2pc.malformed(err)
+		return nil
 	}
 	dataString, err := msg.GetString("data")
 	if err != nil {
-		log.Println(err)
-		return
+		p2pc.malformed(err)
+		return nil
 	}
-	if dbBlockHashExists(hash) {
-		log.Println("Replacing blocks not yet implemented")
-		return
+	exists, err := p2pc.node.dbBlockHashExists(hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		p2pLog.Warn("Replacing blocks not yet implemented")
+		return nil
 	}
 	fileSize, err := msg.GetInt64("size")
 	if err != nil {
-		log.Println(err)
+		p2pLog.Warn(err)
+	}
+	v := &p2pBlockValidation{p2pc: p2pc, hash: hash}
+	v.hashSignature, err = hex.DecodeString(hashSignature)
+	if err != nil {
+		p2pLog.Warn("Error decoding hash signature", p2pc.conn, err)
+		p2pc.misbehaved(p2pPenaltyInvalidBlock, "has sent a block with an invalid hash signature")
+		return nil
+	}
+	v.cosignatures, err = p2pDecodeCosignatures(msg)
+	if err != nil {
+		p2pLog.Warn("Error decoding cosignatures", p2pc.conn, err)
+		p2pc.misbehaved(p2pPenaltyInvalidBlock, "has sent a block with invalid cosignatures")
+		return nil
 	}
 	var blockFile *os.File
 	encoding, err := msg.GetString("encoding")
 	if err != nil {
-		log.Printf("encoding: %v", err)
-		return
+		p2pLog.Warnf("encoding: %v", err)
+		return nil
 	}
 	if encoding == "zlib-base64" {
 		zlibData, err := base64.StdEncoding.DecodeString(dataString)
 		if err != nil {
-			log.Println(err)
-			return
+			p2pLog.Warn(err)
+			return nil
 		}
 		blockFile, err = ioutil.TempFile("", "daisy")
 		if err != nil {
-			log.Println(err)
-			return
+			p2pLog.Warn(err)
+			return nil
 		}
-		defer func() {
-			err = blockFile.Close()
-			if err != nil {
-				log.Printf("handleBlock blockFile.Close: %v", err)
-			}
-			err = os.Remove(blockFile.Name())
-			if err != nil {
-				log.Printf("remove: %v", err)
-			}
-		}()
-		r, err := zlib.NewReader(bytes.NewReader(zlibData))
-		if err != nil {
-			log.Println(err)
-			return
+		written, err := p2pInflateBlock(blockFile, zlibData, fileSize+1)
+		if err2 := blockFile.Close(); err == nil {
+			err = err2
 		}
-		defer func() {
-			err = r.Close()
-			if err != nil {
-				log.Printf("handleBlock r.Close: %v", err)
-			}
-		}()
-		written, err := io.Copy(blockFile, r)
 		if err != nil {
-			log.Println(err)
-			return
+			p2pLog.Warn(err)
+			os.Remove(blockFile.Name())
+			return nil
 		}
 		if written != fileSize {
-			log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
-			return
+			p2pLog.Warn("Error decoding block: sizes don't match:", written, "vs", fileSize)
+			p2pc.misbehaved(p2pPenaltyInvalidBlock, "has sent a block of the wrong size")
+			os.Remove(blockFile.Name())
+			return nil
+		}
+		if !requestTime.IsZero() {
+			p2pc.score.recordTransfer(written, time.Since(requestTime))
 		}
 	} else if encoding == "http" {
-		log.Println("Getting block", hash, "from", dataString)
-		resp, err := http.Get(dataString)
+		if err = p2pc.validateBlockURL(dataString); err != nil {
+			p2pLog.Warn("Refusing to get block", hash, "from", dataString, err)
+			return nil
+		}
+		p2pLog.Info("Getting block", hash, "from", dataString)
+		req, err := http.NewRequest("GET", dataString, nil)
 		if err != nil {
-			log.Println("Error receiving block at", dataString, err)
-			return
+			p2pLog.Warn("Error receiving block at", dataString, err)
+			return nil
+		}
+		// The download is aborted if the connection is torn down
+		resp, body, err := httpGetCompressed(http.DefaultClient, req.WithContext(p2pc.ctx))
+		if err != nil {
+			p2pLog.Warn("Error receiving block at", dataString, err)
+			return nil
 		}
 		defer resp.Body.Close()
+		defer body.Close()
 		blockFile, err = ioutil.TempFile("", "daisy")
 		if err != nil {
-			log.Println("Error creating temp file", err)
-			return
+			p2pLog.Error("Error creating temp file", err)
+			return nil
 		}
-		written, err := io.Copy(blockFile, resp.Body)
+		// One byte more than announced is enough to tell the size is wrong
+		written, err := io.Copy(blockFile, io.LimitReader(body, fileSize+1))
 		if err != nil {
-			log.Println("Error saving block:", err)
+			p2pLog.Error("Error saving block:", err)
 			blockFile.Close()
 			os.Remove(blockFile.Name())
-			return
+			return nil
 		}
 		if written != fileSize {
-			log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
+			p2pLog.Warn("Error decoding block: sizes don't match:", written, "vs", fileSize)
+			p2pc.misbehaved(p2pPenaltyInvalidBlock, "has sent a block of the wrong size")
 			blockFile.Close()
 			os.Remove(blockFile.Name())
-			return
+			return nil
+		}
+		if !requestTime.IsZero() {
+			p2pc.score.recordTransfer(written, time.Since(requestTime))
 		}
 		err = blockFile.Close()
 		if err != nil {
-			log.Printf("handleBlock blockFile.Close: %v", err)
+			p2pLog.Warnf("handleBlock blockFile.Close: %v", err)
+		}
+		if p2pc.node.p2pSessionRecorder != nil {
+			p2pc.node.p2pSessionRecorder.recordBlockFile(hash, blockFile.Name())
 		}
-		defer func() {
-			err = os.Remove(blockFile.Name())
-			if err != nil {
-				log.Printf("remove: %v", err)
-			}
-		}()
 	} else {
-		log.Println("Unknown block encoding:", encoding)
-		return
+		p2pLog.Warn("Unknown block encoding:", encoding)
+		return nil
 	}
 
-	blk, err := OpenBlockFile(blockFile.Name())
-	if err != nil {
-		log.Println("Error opening block file", p2pc.conn, err)
-		return
-	}
-	blk.HashSignature, err = hex.DecodeString(hashSignature)
+	// The block is hashed, checked and inserted by the coordinator's validation worker, which
+	// also removes the file
+	v.fileName = blockFile.Name()
+	p2pc.node.p2pQueueBlockValidation(v)
+	return nil
+}
+
+// Decompresses an inline block into the file, at most max bytes of it, returning the number of
+// bytes written
+func p2pInflateBlock(w io.Writer, zlibData []byte, max int64) (int64, error) {
+	r, err := zlib.NewReader(bytes.NewReader(zlibData))
 	if err != nil {
-		log.Println("Error decoding hash signature", p2pc.conn, err)
-		return
+		return 0, err
 	}
-	height, err := checkAcceptBlock(blk)
-	if err != nil {
-		log.Println("Cannot import block:", err)
-		return
+	written, err := io.Copy(w, io.LimitReader(r, max))
+	if err2 := r.Close(); err == nil {
+		err = err2
 	}
-	blk.Height = height
-	blk.DbBlockchainBlock.TimeAccepted = time.Now()
-	err = blockchainCopyFile(blockFile.Name(), height)
-	if err != nil {
-		log.Println("Cannot copy block file:", err)
-		return
-	}
-	err = dbInsertBlock(blk.DbBlockchainBlock)
+	return written, err
+}
+
+// blockrejected: a peer reports it has vetoed a block we've sent it
+func (p2pc *p2pConnection) handleBlockRejected(msg StrIfMap) {
+	hash, err := msg.GetString("hash")
 	if err != nil {
-		log.Println("Cannot insert block:", err)
+		p2pc.malformed(err)
 		return
 	}
-	log.Println("Accepted block", blk.Hash, "at height", blk.Height)
-	blk.Close()
+	stage, _ := msg.GetString("stage")
+	reason, _ := msg.GetString("reason")
+	message, _ := msg.GetString("message")
+	p2pLog.Warnf("Peer %s has rejected block %s in stage %s (%s): %s", p2pc.address, hash, stage, reason, message)
+	p2pc.node.auditLog(auditBlockRejected, StrIfMap{"hash": hash, "peer": p2pc.address, "stage": stage, "reason": reason, "message": message})
 }
 
 // Connect to a peer. Does everything except starting the handler goroutine.
-// Checks if there already is a connection of this type.
-func p2pConnectPeer(address string) (*p2pConnection, error) {
-	addr, err := net.ResolveTCPAddr("tcp", address)
+// Checks if there already is a connection of this type. If the peer's host name resolves
+// to multiple addresses, they are tried as per RFC 8305.
+func (node *Node) p2pConnectPeer(address string) (*p2pConnection, error) {
+	ips, port, err := p2pResolveAddress(address)
 	if err != nil {
+		node.p2pRecordPeerFailure(address)
 		return nil, err
 	}
 
-	if p2pPeers.HasAddress(addr.String()) {
-		return nil, fmt.Errorf("Connection to %s already exists", addr.String())
-	}
-
 	localAddresses := getLocalAddresses()
-	if inStrings(addr.IP.String(), localAddresses) {
-		return nil, fmt.Errorf("Refusing to connect to myself at %s", addr.IP)
+	for _, ip := range ips {
+		resolvedAddress := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		if node.p2pPeers.HasAddress(resolvedAddress) {
+			return nil, fmt.Errorf("Connection to %s already exists", resolvedAddress)
+		}
+		if inStrings(ip.String(), localAddresses) {
+			return nil, fmt.Errorf("Refusing to connect to myself at %s", ip)
+		}
+		if node.p2pBannedIPs.Has(ip.String()) {
+			return nil, fmt.Errorf("%s is banned for misbehaving", ip)
+		}
 	}
 
-	conn, err := net.Dial("tcp", address)
+	start := time.Now()
+	conn, err := p2pDialHappyEyeballs(ips, port)
 	if err != nil {
-		log.Println("Error connecting to", address, err)
+		p2pLog.Warn("Error connecting to", address, err)
+		node.p2pRecordPeerFailure(address)
 		return nil, err
 	}
-	return p2pSetupPeer(address, conn)
+	if err = node.dbRecordPeerSuccess(address, time.Since(start)); err != nil {
+		p2pLog.Error("Cannot record the connection to", address, err)
+	}
+	p2pc, err := node.p2pSetupPeer(address, conn)
+	if err != nil {
+		return nil, err
+	}
+	p2pc.savedAddress = address
+	return p2pc, nil
 }
 
 // Creates the p2pConnection structure for the peer and adds it to the peer list.
 // Does not start the handler goroutine.
-func p2pSetupPeer(address string, conn net.Conn) (*p2pConnection, error) {
-	p2pc := p2pConnection{
-		conn:         conn,
-		address:      address,
-		chanToPeer:   make(chan interface{}, 5),
-		chanFromPeer: make(chan StrIfMap, 5),
-	}
-	p2pPeers.Add(&p2pc)
-	return &p2pc, nil
+func (node *Node) p2pSetupPeer(address string, conn net.Conn) (*p2pConnection, error) {
+	p2pc := &p2pConnection{node: node,
+		conn:          conn,
+		address:       address,
+		chanToPeer:    make(chan interface{}, 5),
+		chanFromPeer:  make(chan StrIfMap, 5),
+		connectedTime: time.Now(),
+	}
+	p2pc.ctx, p2pc.cancel = context.WithCancel(context.Background())
+	node.p2pPeers.Add(p2pc)
+	return p2pc, nil
 }
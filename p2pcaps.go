@@ -0,0 +1,52 @@
+package main
+
+/*
+ * Peer capabilities. The nodes list what they can do for their peers in the capabilities of
+ * their hello messages, so that the blocks are requested from the peers which have them, and the
+ * records are sent to the peers which produce blocks, instead of to everyone. The pruned peers
+ * only have the recent blocks, so they are only asked for blocks if no archival peer has them.
+ * The blocks are only downloaded over HTTP from the peers which say they serve them. The older
+ * nodes don't list any capabilities, and are assumed to be archival, to serve HTTP and to take
+ * records.
+ */
+
+const (
+	p2pCapServesHTTP         = "serves-http"         // Hands off the blocks to be downloaded from its HTTP server
+	p2pCapArchival           = "archival"            // Has all the blocks, from the genesis block
+	p2pCapPruned             = "pruned"              // Has only the recent blocks
+	p2pCapRelay              = "relay"               // Relays the connections of other nodes, see p2prelay.go
+	p2pCapAcceptsSubmissions = "accepts-submissions" // Produces blocks from the submitted records, see blockproducer.go
+)
+
+// Returns the capabilities of this node, for its hello messages. Nodes don't prune their
+// blocks, so they are all archival.
+func (node *Node) p2pLocalCapabilities() []string {
+	caps := []string{p2pCapArchival}
+	// The blocks are sent inline if the HTTP server requires authentication, see handleGetBlock
+	if !node.cfg.P2pBlockInline && !node.blockWebAuthRequired() {
+		caps = append(caps, p2pCapServesHTTP)
+	}
+	if node.cfg.Relay {
+		caps = append(caps, p2pCapRelay)
+	}
+	if node.cfg.BlockProducerDir != "" {
+		caps = append(caps, p2pCapAcceptsSubmissions)
+	}
+	return caps
+}
+
+// Returns true if the peer has listed the capability in its hello
+func (p2pc *p2pConnection) hasCapability(c string) bool {
+	return inStrings(c, p2pc.capabilities)
+}
+
+// Returns true if the peer has all the blocks up to its chain height
+func (p2pc *p2pConnection) hasAllBlocks() bool {
+	return !p2pc.hasCapability(p2pCapPruned) || p2pc.hasCapability(p2pCapArchival)
+}
+
+// Returns true if the records should be sent to the peer: it produces blocks, or it's an older
+// node which doesn't list its capabilities
+func (p2pc *p2pConnection) takesRecords() bool {
+	return len(p2pc.capabilities) == 0 || p2pc.hasCapability(p2pCapAcceptsSubmissions)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * The p2p protocol prologue. Before the hello message, both sides of a p2p connection send a
+ * single line with the protocol name and the chain ID, e.g. "daisy 1a2b3c4d", and read the
+ * peer's. The chain ID is derived from the genesis block hash and the network name, so nodes
+ * on different chains or networks reject each other at connect time with a clear error,
+ * instead of exchanging hello messages and then ignoring everything for its different root.
+ * Nodes predating the prologue start with the hello message, and are rejected as such.
+ */
+
+// The protocol name in the prologue
+const p2pPrologueName = "daisy"
+
+// How long to wait for the peer's prologue
+const p2pPrologueTimeout = 30 * time.Second
+
+// The longest prologue line read from the peer
+const p2pPrologueMaxLength = 128
+
+// Returns the short ID of the chain and network this node is on
+func (node *Node) p2pChainID() string {
+	hash := sha256.Sum256([]byte(node.chainParams.GenesisBlockHash + "\n" + node.networkName()))
+	return hex.EncodeToString(hash[:4])
+}
+
+// Sends my prologue to the peer and checks the peer's
+func (p2pc *p2pConnection) exchangePrologue() error {
+	if _, err := fmt.Fprintf(p2pc.peer, "%s %s\n", p2pPrologueName, p2pc.node.p2pChainID()); err != nil {
+		return err
+	}
+	if err := p2pc.peer.Flush(); err != nil {
+		return err
+	}
+	if err := p2pc.conn.SetReadDeadline(time.Now().Add(p2pPrologueTimeout)); err != nil {
+		return err
+	}
+	defer p2pc.conn.SetReadDeadline(time.Time{})
+	var line []byte
+	for {
+		b, err := p2pc.peer.ReadByte()
+		if err != nil {
+			return fmt.Errorf("cannot read the prologue: %v", err)
+		}
+		if b == '\n' {
+			break
+		}
+		if len(line) >= p2pPrologueMaxLength {
+			return fmt.Errorf("the prologue is too long")
+		}
+		line = append(line, b)
+	}
+	if strings.HasPrefix(string(line), "{") {
+		return fmt.Errorf("the peer doesn't send the chain ID, it's probably an older version")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 2 || fields[0] != p2pPrologueName {
+		return fmt.Errorf("invalid prologue %q", line)
+	}
+	if fields[1] != p2pc.node.p2pChainID() {
+		return fmt.Errorf("the peer is on a different chain or network (chain ID %s vs my %s)", fields[1], p2pc.node.p2pChainID())
+	}
+	return nil
+}
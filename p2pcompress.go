@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+ * Compression of the p2p streams. The nodes list the compression methods they accept in their
+ * hello messages (p2p_compression in the config, zstd and zlib by default, or "none"), and each
+ * side compresses everything it sends from then on with the first method in p2pCompressions
+ * which both accept, not just the block payloads: the block hashes and the peer lists compress
+ * well. The switch is marked by a compress message, sent uncompressed, after which the rest of
+ * the stream in that direction is compressed, so the two directions switch independently. The
+ * compressor is flushed after every message. The older nodes don't list any methods, and are
+ * sent uncompressed messages.
+ */
+
+// The message after which the stream is compressed
+const p2pMsgCompress = "compress"
+
+type p2pMsgCompressStruct struct {
+	p2pMsgHeader
+	Compression string `json:"compression"`
+}
+
+// The supported compression methods, the preferred first
+var p2pCompressions = []string{"zstd", "zlib"}
+
+// The p2p_compression value which disables the compression
+const p2pCompressionNone = "none"
+
+// A compressor of a p2p stream, flushed after each message
+type p2pCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Returns the compression methods this node accepts
+func (node *Node) p2pAcceptedCompressions() []string {
+	var result []string
+	for _, c := range node.cfg.P2pCompression {
+		if inStrings(c, p2pCompressions) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// Returns the compression method for the messages sent to a peer which accepts the given
+// methods, or "" if there's none both accept
+func (node *Node) p2pChooseCompression(accepted []string) string {
+	mine := node.p2pAcceptedCompressions()
+	for _, c := range p2pCompressions {
+		if inStrings(c, mine) && inStrings(c, accepted) {
+			return c
+		}
+	}
+	return ""
+}
+
+func p2pNewCompressor(method string, w io.Writer) (p2pCompressor, error) {
+	switch method {
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case "zlib":
+		return zlib.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", method)
+}
+
+func (node *Node) p2pNewDecompressor(method string, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case "zstd":
+		// The decoder's window and memory are bounded by the largest accepted message, so a
+		// peer can't make it allocate more than that with a crafted frame header.
+		maxSize := uint64(node.p2pMaxMessageSize())
+		window := maxSize
+		if window > zstd.MaxWindowSize {
+			window = zstd.MaxWindowSize
+		}
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(window), zstd.WithDecoderMaxMemory(maxSize))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "zlib":
+		return zlib.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported compression %s", method)
+}
+
+// Compresses the messages sent to the peer, if it accepts any of the methods this node
+// accepts. Called with the peer's hello.
+func (p2pc *p2pConnection) startCompression(msg StrIfMap) {
+	if p2pc.compression != "" {
+		return
+	}
+	accepted, err := msg.GetStringList("compression")
+	if err != nil {
+		return
+	}
+	if p2pc.compression = p2pc.node.p2pChooseCompression(accepted); p2pc.compression == "" {
+		return
+	}
+	p2pLog.Debug("Compressing the messages to", p2pc.address, "with", p2pc.compression)
+	p2pc.send(p2pMsgCompressStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgCompress,
+		},
+		Compression: p2pc.compression,
+	})
+}
+
+// Compresses the rest of the stream sent to the peer. Called by writeLoop after sending the
+// compress message.
+func (p2pc *p2pConnection) compressOutput(method string) (err error) {
+	if p2pc.compressor, err = p2pNewCompressor(method, p2pc.conn); err != nil {
+		return err
+	}
+	p2pc.peer.Writer = bufio.NewWriter(p2pc.compressor)
+	return nil
+}
+
+// Decompresses the rest of the stream read from the peer. Called by readLoop with the compress
+// message.
+func (p2pc *p2pConnection) decompressInput(msg StrIfMap) (err error) {
+	method, err := msg.GetString("compression")
+	if err != nil {
+		return err
+	}
+	if p2pc.decompressor != nil || !inStrings(method, p2pc.node.p2pAcceptedCompressions()) {
+		return fmt.Errorf("unexpected compression %s", method)
+	}
+	if p2pc.decompressor, err = p2pc.node.p2pNewDecompressor(method, p2pc.peer.Reader); err != nil {
+		return err
+	}
+	p2pc.peer.Reader = bufio.NewReader(p2pc.decompressor)
+	return nil
+}
+
+// Releases the compressor and the decompressor, after the connection's goroutines are done
+func (p2pc *p2pConnection) closeCompression() {
+	if p2pc.compressor != nil {
+		p2pc.compressor.Close()
+	}
+	if p2pc.decompressor != nil {
+		p2pc.decompressor.Close()
+	}
+}
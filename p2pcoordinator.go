@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,60 +20,151 @@ type p2pCtrlMessage struct {
 	payload interface{}
 }
 
-var p2pCtrlChannel = make(chan p2pCtrlMessage, 8)
+// p2pCtrlQueue is a bounded queue of messages to the p2p coordinator, with instrumentation.
+type p2pCtrlQueue struct {
+	name      string
+	ch        chan p2pCtrlMessage
+	droppable bool  // If true, messages are dropped when the queue is full, instead of blocking
+	enqueued  int64 // Accessed atomically
+	dropped   int64 // Accessed atomically
+	maxDepth  int64 // Accessed atomically
+}
+
+// Minimum time between handling two messages from the bulk queue
+const p2pBulkQueueInterval = 100 * time.Millisecond
+
+// Adds a message to the queue. Returns false if the message has been dropped.
+func (q *p2pCtrlQueue) post(msg p2pCtrlMessage) bool {
+	if q.droppable {
+		select {
+		case q.ch <- msg:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+			return false
+		}
+	} else {
+		q.ch <- msg
+	}
+	atomic.AddInt64(&q.enqueued, 1)
+	depth := int64(len(q.ch))
+	for {
+		max := atomic.LoadInt64(&q.maxDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&q.maxDepth, max, depth) {
+			break
+		}
+	}
+	return true
+}
+
+// Returns a short description of the queue's state
+func (q *p2pCtrlQueue) String() string {
+	return fmt.Sprintf("%s queue: depth %d/%d, max depth %d, enqueued %d, dropped %d", q.name, len(q.ch), cap(q.ch),
+		atomic.LoadInt64(&q.maxDepth), atomic.LoadInt64(&q.enqueued), atomic.LoadInt64(&q.dropped))
+}
+
+// Sends a message to the p2p coordinator, via the queue appropriate for its type
+func (node *Node) p2pCoordinatorPost(msg p2pCtrlMessage) bool {
+	switch msg.msgType {
+	case p2pCtrlConnectPeers:
+		return node.p2pCtrlQueueBulk.post(msg)
+	default:
+		return node.p2pCtrlQueueControl.post(msg)
+	}
+}
 
-// Data related to the (single instance of) the global p2p coordinator. This is also a
+// Data related to the (single instance per node of) the p2p coordinator. This is also a
 // single-threaded object, its fields and methods are only expected to be accessed from
 // the Run() goroutine.
 type p2pCoordinatorType struct {
 	timeTicks                chan int
 	lastTickBlockchainHeight int
+	lastNewBlockTime         time.Time
 	recentlyRequestedBlocks  *StringSetWithExpiry
 	lastReconnectTime        time.Time
+	lastConnectDbPeersTime   time.Time
 	badPeers                 *StringSetWithExpiry
-}
-
-// XXX: singletons in go?
-var p2pCoordinator = p2pCoordinatorType{
-	recentlyRequestedBlocks: NewStringSetWithExpiry(5 * time.Second),
-	lastReconnectTime:       time.Now(),
-	timeTicks:               make(chan int),
-	badPeers:                NewStringSetWithExpiry(15 * time.Minute),
+	lastBulkTime             time.Time
+	lastLoggedBulkDrops      int64
+	lastTipCheck             time.Time
+	resumeBlocks             map[int]string // Saved pending blocks, see syncstate.go
+	lastSyncState            string
+	lastVerifiedHeight       int
+	node                     *Node
 }
 
 func (co *p2pCoordinatorType) Run() {
-	co.lastTickBlockchainHeight = dbGetBlockchainHeight()
+	height, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Fatal("Cannot read the blockchain height:", err)
+	}
+	co.lastTickBlockchainHeight = height
+	co.loadSyncState()
+	go co.validateBlocks()
+	accepted := co.node.nodeEvents.Subscribe([]string{eventBlockAccepted}, true)
+	defer co.node.nodeEvents.Unsubscribe(accepted)
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 	for {
+		// Control messages are always handled first
 		select {
-		case msg := <-p2pCtrlChannel:
-			switch msg.msgType {
-			case p2pCtrlSearchForBlocks:
-				co.handleSearchForBlocks(msg.payload.(*p2pConnection))
-			case p2pCtrlConnectPeers:
-				co.handleConnectPeers(msg.payload.([]string))
-			}
+		case msg := <-co.node.p2pCtrlQueueControl.ch:
+			co.handleCtrlMessage(msg)
+			continue
+		default:
+		}
+		// The bulk queue is only listened to if enough time has passed since the last bulk message
+		var bulkCh chan p2pCtrlMessage
+		var bulkWait <-chan time.Time
+		if sinceBulk := time.Since(co.lastBulkTime); sinceBulk >= p2pBulkQueueInterval {
+			bulkCh = co.node.p2pCtrlQueueBulk.ch
+		} else {
+			bulkWait = time.After(p2pBulkQueueInterval - sinceBulk)
+		}
+		select {
+		case msg := <-co.node.p2pCtrlQueueControl.ch:
+			co.handleCtrlMessage(msg)
+		case msg := <-bulkCh:
+			co.lastBulkTime = time.Now()
+			co.handleCtrlMessage(msg)
+		case <-bulkWait:
+		case ev := <-accepted.events:
+			co.handleBlockAccepted(ev)
 		case <-ticker.C:
 			co.handleTimeTick()
 		}
 	}
 }
 
+func (co *p2pCoordinatorType) handleCtrlMessage(msg p2pCtrlMessage) {
+	switch msg.msgType {
+	case p2pCtrlSearchForBlocks:
+		// Sync from the best peer which has the blocks, not necessarily the one which has announced them
+		p2pc := msg.payload.(*p2pConnection)
+		if best := co.node.p2pPeers.BestPeer(p2pc.chainHeight, nil); best != nil {
+			p2pc = best
+		}
+		co.handleSearchForBlocks(p2pc)
+	case p2pCtrlConnectPeers:
+		co.handleConnectPeers(msg.payload.([]string))
+	}
+}
+
 // Retrieves block hashes from a node which apparently has more blocks than we do.
 // ToDo: This is a simplistic version. Make it better by introducing quorums.
 func (co *p2pCoordinatorType) handleSearchForBlocks(p2pcStart *p2pConnection) {
-	msg := p2pMsgGetBlockHashesStruct{
-		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
-			Msg:   p2pMsgGetBlockHashes,
-		},
-		MinBlockHeight: dbGetBlockchainHeight(),
-		MaxBlockHeight: p2pcStart.chainHeight,
+	// After a restart, the blocks which were being downloaded don't have to be searched for
+	minHeight, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot read the blockchain height:", err)
+		return
+	}
+	if h := co.resumeDownloads(p2pcStart); h > minHeight {
+		minHeight = h
+	}
+	if minHeight >= p2pcStart.chainHeight {
+		return
 	}
-	log.Printf("Searching for blocks from %d to %d", msg.MinBlockHeight, msg.MaxBlockHeight)
-	p2pcStart.chanToPeer <- msg
+	p2pcStart.requestBlockHashes(minHeight)
 }
 
 func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
@@ -84,15 +176,15 @@ func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
 			log.Println(address, err)
 			continue
 		}
-		canonicalAddress := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
-		if p2pPeers.HasAddress(canonicalAddress) || co.badPeers.Has(canonicalAddress) {
+		canonicalAddress := fmt.Sprintf("%s:%d", host, co.node.networkP2PPort())
+		if co.node.p2pPeers.HasAddress(canonicalAddress) || co.badPeers.Has(canonicalAddress) {
 			continue
 		}
 		addr, err := net.ResolveTCPAddr("tcp", canonicalAddress)
 		if err != nil {
 			continue
 		}
-		if inStrings(addr.IP.String(), localAddresses) {
+		if inStrings(addr.IP.String(), localAddresses) || co.node.p2pBannedIPs.Has(addr.IP.String()) {
 			continue
 		}
 		// Detect if there's a canonical peer on the other side, somewhat brute-forceish
@@ -100,61 +192,122 @@ func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
 		if err != nil {
 			return
 		}
-		p2pc, err := p2pSetupPeer(addr.String(), conn)
+		p2pc, err := co.node.p2pSetupPeer(addr.String(), conn)
 		if err != nil {
 			log.Println("handleConnectPeers:", err)
 			continue
 		}
 		go p2pc.handleConnection()
 		log.Println("Detected canonical peer at", canonicalAddress)
-		dbSavePeer(canonicalAddress)
+		if err = co.node.dbSavePeer(canonicalAddress); err != nil {
+			p2pLog.Error("Cannot save peer", canonicalAddress, err)
+		}
 	}
 }
 
-// Executed periodically to perform time-dependant actions. Do not rely on the
-// time period to be predictable or precise.
-func (co *p2pCoordinatorType) handleTimeTick() {
-	newHeight := dbGetBlockchainHeight()
+// Announces the blocks added since the last announcement to the peers. Returns the current
+// blockchain height.
+func (co *p2pCoordinatorType) announceNewBlocks() int {
+	newHeight, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot read the blockchain height:", err)
+		return co.lastTickBlockchainHeight
+	}
 	if newHeight > co.lastTickBlockchainHeight {
 		log.Println("New blocks detected. New max height:", newHeight)
 		co.floodPeersWithNewBlocks(co.lastTickBlockchainHeight, newHeight)
 		co.lastTickBlockchainHeight = newHeight
+		co.lastNewBlockTime = time.Now()
+	}
+	return newHeight
+}
+
+// A block has been accepted into the blockchain. Unless the node is still syncing, in which
+// case the blocks are announced in batches by the time tick, the block is announced to the
+// peers right away.
+func (co *p2pCoordinatorType) handleBlockAccepted(ev nodeEvent) {
+	if source, _ := ev.Data["source"].(string); source != "local" {
+		co.node.publishSyncProgress()
+	}
+	height, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot read the blockchain height:", err)
+		return
+	}
+	if _, bestPeerHeight := co.node.p2pPeers.Stats(); height >= bestPeerHeight {
+		co.announceNewBlocks()
+	}
+}
+
+// Executed periodically to perform time-dependant actions. Do not rely on the
+// time period to be predictable or precise.
+func (co *p2pCoordinatorType) handleTimeTick() {
+	// The blocks can also be added to the database by other processes, e.g. importblock
+	newHeight := co.announceNewBlocks()
+	if dropped := atomic.LoadInt64(&co.node.p2pCtrlQueueBulk.dropped); dropped > co.lastLoggedBulkDrops {
+		p2pLog.Warn("Coordinator is overloaded:", co.node.p2pCtrlQueueBulk)
+		co.lastLoggedBulkDrops = dropped
 	}
 	if time.Since(co.lastReconnectTime) >= 10*time.Minute {
+		p2pLog.Info("Coordinator", co.node.p2pCtrlQueueControl, ";", co.node.p2pCtrlQueueBulk, "; validation queue: depth", len(co.node.p2pBlockValidations.queue),
+			"validated", atomic.LoadInt64(&co.node.p2pBlockValidations.done))
 		co.lastReconnectTime = time.Now()
-		p2pPeers.saveConnectablePeers()
+		co.node.p2pPeers.saveConnectablePeers()
+	}
+	// The saved peers are retried when their backoff expires, see p2pdial.go
+	if time.Since(co.lastConnectDbPeersTime) >= p2pPeerBackoffMin {
+		co.lastConnectDbPeersTime = time.Now()
 		co.connectDbPeers()
 	}
-	p2pPeers.tryPeersConnectable()
+	co.node.p2pPeers.tryPeersConnectable()
+	co.checkStalledRequests()
+	co.reconcileTips()
+	co.saveSyncState()
+	if _, bestPeerHeight := co.node.p2pPeers.Stats(); bestPeerHeight <= newHeight && time.Since(co.lastNewBlockTime) >= dbMaintenanceIdleTime {
+		co.node.dbMaintenanceStartIfDue()
+	}
 }
 
 func (co *p2pCoordinatorType) floodPeersWithNewBlocks(minHeight, maxHeight int) {
-	blockHashes := dbGetHeightHashes(minHeight, maxHeight)
+	blockHashes, err := co.node.dbGetHeightHashes(minHeight, maxHeight)
+	if err != nil {
+		p2pLog.Error("Cannot announce new blocks:", err)
+		return
+	}
 	msg := p2pMsgBlockHashesStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
+			P2pID: co.node.p2pEphemeralID,
+			Root:  co.node.chainParams.GenesisBlockHash,
 			Msg:   p2pMsgBlockHashes,
 		},
 		Hashes: blockHashes,
 	}
-	p2pPeers.lock.With(func() {
-		for p2pc := range p2pPeers.peers {
-			p2pc.chanToPeer <- msg
+	co.node.p2pPeers.lock.With(func() {
+		for p2pc := range co.node.p2pPeers.peers {
+			p2pc.send(msg)
 		}
 	})
 }
 
 func (co *p2pCoordinatorType) connectDbPeers() {
-	peers := dbGetSavedPeers()
-	for peer := range peers {
-		if p2pPeers.HasAddress(peer) {
+	if n, err := co.node.dbDeleteStalePeers(time.Now().Add(-p2pPeerMaxAge)); err != nil {
+		p2pLog.Error("Cannot delete the stale peers:", err)
+	} else if n > 0 {
+		p2pLog.Info("Deleted", n, "saved peers not seen for", p2pPeerMaxAge)
+	}
+	peers, err := co.node.dbGetPeerCandidates()
+	if err != nil {
+		p2pLog.Error("Cannot read the saved peers:", err)
+		return
+	}
+	for _, peer := range peers {
+		if co.node.p2pPeers.HasAddress(peer.address) {
 			continue
 		}
-		if co.badPeers.Has(peer) {
+		if co.badPeers.Has(peer.address) {
 			continue
 		}
-		p2pc, err := p2pConnectPeer(peer)
+		p2pc, err := co.node.p2pConnectPeer(peer.address)
 		if err != nil {
 			continue
 		}
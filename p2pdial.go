@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The delay between starting connection attempts to successive addresses (RFC 8305, section 5)
+const p2pDialAttemptDelay = 250 * time.Millisecond
+
+// The overall time limit for connecting to a peer
+const p2pDialTimeout = 30 * time.Second
+
+// The time a saved peer isn't connected to after a failed connection, doubled with each
+// consecutive failure up to p2pPeerBackoffMax
+const p2pPeerBackoffMin = time.Minute
+const p2pPeerBackoffMax = 6 * time.Hour
+
+// A connection to a saved peer which is closed sooner than this counts as a failed one, so
+// that the peers which accept connections and then drop them are backed off from too
+const p2pPeerMinUptime = time.Minute
+
+// Returns the time to wait before connecting to a peer which has failed failCount times in a
+// row. It's a random time between half of the backoff and the whole of it, so that the peers
+// which have failed at the same time, e.g. when the network was down, aren't all retried at
+// the same time.
+func p2pPeerBackoff(failCount int) time.Duration {
+	d := p2pPeerBackoffMin
+	for i := 1; i < failCount && d < p2pPeerBackoffMax; i++ {
+		d *= 2
+	}
+	if d > p2pPeerBackoffMax {
+		d = p2pPeerBackoffMax
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Records a failed connection to a saved peer, backing off from it
+func (node *Node) p2pRecordPeerFailure(address string) {
+	if err := node.dbRecordPeerFailure(address); err != nil {
+		p2pLog.Error("Cannot record the failed connection to", address, err)
+	}
+}
+
+// Records the end of a connection to a saved peer: a connection which has lasted long enough
+// clears the peer's failures, and a shorter one counts as a failure
+func (p2pc *p2pConnection) recordPeerDisconnect() {
+	if p2pc.savedAddress == "" {
+		return
+	}
+	if time.Since(p2pc.connectedTime) < p2pPeerMinUptime {
+		p2pc.node.p2pRecordPeerFailure(p2pc.savedAddress)
+		return
+	}
+	if err := p2pc.node.dbClearPeerFailures(p2pc.savedAddress); err != nil {
+		p2pLog.Error("Cannot clear the failures of", p2pc.savedAddress, err)
+	}
+}
+
+// Orders the addresses as recommended by RFC 8305, section 4: interleaved by address family,
+// starting with IPv6.
+func p2pInterleaveAddresses(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	result := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			result = append(result, v6[i])
+		}
+		if i < len(v4) {
+			result = append(result, v4[i])
+		}
+	}
+	return result
+}
+
+// Connects to one of the given addresses, using the "happy eyeballs" algorithm from RFC 8305:
+// connection attempts are started one after the other, staggered by p2pDialAttemptDelay (or
+// sooner if the previous attempt fails), and the first one to succeed wins.
+func p2pDialHappyEyeballs(ips []net.IPAddr, port int) (net.Conn, error) {
+	ips = p2pInterleaveAddresses(ips)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No addresses to connect to")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p2pDialTimeout)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(ips))
+	var dialer net.Dialer
+	next := 0
+	pending := 0
+	startNext := func() {
+		address := net.JoinHostPort(ips[next].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	var lastErr error
+	startNext()
+	for pending > 0 {
+		var attemptDelay <-chan time.Time
+		if next < len(ips) {
+			attemptDelay = time.After(p2pDialAttemptDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections from the attempts which might still succeed
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if next < len(ips) {
+				startNext()
+			}
+		case <-attemptDelay:
+			startNext()
+		}
+	}
+	return nil, lastErr
+}
+
+// Resolves the host part of the address into all of its IP addresses
+func p2pResolveAddress(address string) ([]net.IPAddr, int, error) {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		p2pLog.Warn("No addresses found for", host)
+	}
+	return ips, port, nil
+}
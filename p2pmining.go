@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Distributed mining. A node with mining_cooperate announces in its hello message that it
+ * accepts mining work from its peers. A node with mining_distribute splits the nonces of the
+ * block it's mining between itself and the cooperating peers it's connected to, sending each
+ * of them the block and its range of nonces in a minework message. The peers answer with a
+ * minesolution message, with the nonce if they've found one, or without it when they've
+ * exhausted their range. Solutions are verified, and when one is found, the remaining peers
+ * are sent a minecancel message.
+ *
+ * The ranges of the peers which disconnect or send an invalid solution are mined locally, so
+ * all the nonces are still tried. A peer only accepts work for its own chain's target and
+ * PoW hash function, and works on one block per connection at a time.
+ */
+
+// The message with a block to mine and the range of nonces to try
+const p2pMsgMineWork = "minework"
+
+type p2pMsgMineWorkStruct struct {
+	p2pMsgHeader
+	JobID    string `json:"job_id"`
+	PoWHash  string `json:"pow_hash"` // The PoW hash function, see powhash.go
+	Target   string `json:"target"`   // Hex
+	Start    uint32 `json:"start"`
+	Count    uint64 `json:"count"`
+	Encoding string `json:"encoding"` // zlib-base64
+	Data     string `json:"data"`
+}
+
+// The message with the result of mining a range of nonces
+const p2pMsgMineSolution = "minesolution"
+
+type p2pMsgMineSolutionStruct struct {
+	p2pMsgHeader
+	JobID  string `json:"job_id"`
+	Found  bool   `json:"found"`
+	Nonce  uint32 `json:"nonce"`
+	Hash   string `json:"hash,omitempty"`
+	Hashes uint64 `json:"hashes"` // The number of hashes computed
+}
+
+// The message telling a peer to stop mining
+const p2pMsgMineCancel = "minecancel"
+
+type p2pMsgMineCancelStruct struct {
+	p2pMsgHeader
+	JobID string `json:"job_id"`
+}
+
+// The largest block accepted for mining from a peer
+const mineWorkMaxSize = 256 * 1024 * 1024
+
+// How often the coordinator checks for disconnected peers
+const mineCheckPeersInterval = time.Second
+
+// mineJob is a block being mined in cooperation with the peers
+type mineJob struct {
+	id       string
+	data     []byte
+	hashFunc powHashFunc
+	target   *big.Int
+	results  chan mineResult
+}
+
+// mineResult is a peer's result of mining its range of nonces
+type mineResult struct {
+	p2pc   *p2pConnection
+	found  bool
+	valid  bool
+	nonce  uint32
+	hash   []byte
+	hashes uint64
+}
+
+// mineWork is a range of nonces being mined for a peer
+type mineWork struct {
+	id     string
+	cancel context.CancelFunc
+}
+
+// Searches for a nonce giving the data a hash meeting the target, together with the
+// cooperating peers if mining_distribute is set. Stops when the context is cancelled.
+func (node *Node) mineFindNonce(ctx context.Context, data []byte, hashFunc powHashFunc, target *big.Int, hashes *uint64) (nonce uint32, hash []byte, found bool) {
+	var peers []*p2pConnection
+	if node.cfg.MiningDistribute {
+		peers = node.mineCooperatingPeers()
+	}
+	if len(peers) == 0 {
+		return mineNonce(ctx, data, hashFunc, target, runtime.NumCPU(), hashes)
+	}
+	return node.mineDistributed(ctx, data, hashFunc, target, peers, hashes)
+}
+
+// Returns the connected peers which accept mining work
+func (node *Node) mineCooperatingPeers() []*p2pConnection {
+	var result []*p2pConnection
+	node.p2pPeers.lock.With(func() {
+		for p2pc := range node.p2pPeers.peers {
+			if p2pc.mining {
+				result = append(result, p2pc)
+			}
+		}
+	})
+	return result
+}
+
+// Splits the nonces into n ranges, starting at start
+func mineSplitRanges(start uint32, n int) []mineRange {
+	ranges := make([]mineRange, n)
+	size := uint64(1<<32) / uint64(n)
+	for i := range ranges {
+		ranges[i] = mineRange{start + uint32(uint64(i)*size), size}
+	}
+	// The last range gets the remainder
+	ranges[n-1].count = 1<<32 - uint64(n-1)*size
+	return ranges
+}
+
+// Mines the data in cooperation with the peers, each of them getting its own range of nonces
+func (node *Node) mineDistributed(ctx context.Context, data []byte, hashFunc powHashFunc, target *big.Int, peers []*p2pConnection, hashes *uint64) (nonce uint32, hash []byte, found bool) {
+	var zbuf bytes.Buffer
+	w := zlib.NewWriter(&zbuf)
+	if _, err := w.Write(data); err != nil {
+		miningLog.Warn("Cannot compress the block, mining locally:", err)
+		return mineNonce(ctx, data, hashFunc, target, runtime.NumCPU(), hashes)
+	}
+	if err := w.Close(); err != nil {
+		miningLog.Warn("Cannot compress the block, mining locally:", err)
+		return mineNonce(ctx, data, hashFunc, target, runtime.NumCPU(), hashes)
+	}
+	encodedData := base64.StdEncoding.EncodeToString(zbuf.Bytes())
+
+	job := &mineJob{
+		id:       fmt.Sprintf("%x", randInt63()),
+		data:     data,
+		hashFunc: hashFunc,
+		target:   target,
+		results:  make(chan mineResult, len(peers)),
+	}
+	node.mineJobs.lock.With(func() {
+		node.mineJobs.jobs[job.id] = job
+	})
+	defer node.mineJobs.lock.With(func() {
+		delete(node.mineJobs.jobs, job.id)
+	})
+
+	// Cancelled when a nonce is found, to stop the local mining
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ranges := mineSplitRanges(uint32(time.Now().Unix()), len(peers)+1)
+	local := []mineRange{ranges[0]}
+	pending := map[*p2pConnection]mineRange{}
+	for i, p2pc := range peers {
+		r := ranges[i+1]
+		msg := p2pMsgMineWorkStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: node.p2pEphemeralID,
+				Root:  node.chainParams.GenesisBlockHash,
+				Msg:   p2pMsgMineWork,
+			},
+			JobID:    job.id,
+			PoWHash:  node.chainParams.powHashName(),
+			Target:   target.Text(16),
+			Start:    r.start,
+			Count:    r.count,
+			Encoding: "zlib-base64",
+			Data:     encodedData,
+		}
+		if p2pc.send(msg) {
+			pending[p2pc] = r
+		} else {
+			local = append(local, r)
+		}
+	}
+	miningLog.Infof("Mining job %s distributed to %d peers", job.id, len(pending))
+
+	type localResult struct {
+		nonce uint32
+		hash  []byte
+		found bool
+	}
+	localDone := make(chan localResult, 1)
+	localBusy := false
+	cancelled := false
+	ticker := time.NewTicker(mineCheckPeersInterval)
+	defer ticker.Stop()
+	for {
+		if !localBusy && len(local) > 0 {
+			r := local[0]
+			local = local[1:]
+			localBusy = true
+			go func() {
+				n, h, f := mineNonceRange(ctx, job.data, hashFunc, target, runtime.NumCPU(), r, hashes)
+				localDone <- localResult{n, h, f}
+			}()
+		}
+		if !localBusy && len(pending) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			cancelled = true
+		case lr := <-localDone:
+			localBusy = false
+			if lr.found {
+				nonce, hash, found = lr.nonce, lr.hash, true
+			}
+		case res := <-job.results:
+			r, ok := pending[res.p2pc]
+			if !ok {
+				continue
+			}
+			delete(pending, res.p2pc)
+			atomic.AddUint64(hashes, res.hashes)
+			if !res.valid {
+				miningLog.Warnf("Invalid solution for job %s from %s, mining its range locally", job.id, res.p2pc.address)
+				local = append(local, r)
+			} else if res.found {
+				miningLog.Infof("Peer %s has found the nonce for job %s", res.p2pc.address, job.id)
+				nonce, hash, found = res.nonce, res.hash, true
+			}
+		case <-ticker.C:
+			for p2pc, r := range pending {
+				if p2pc.ctx.Err() != nil {
+					miningLog.Warnf("Peer %s disconnected while mining job %s, mining its range locally", p2pc.address, job.id)
+					delete(pending, p2pc)
+					local = append(local, r)
+				}
+			}
+		}
+		if found || cancelled {
+			break
+		}
+	}
+	cancel()
+	if localBusy {
+		if lr := <-localDone; lr.found && !found {
+			nonce, hash, found = lr.nonce, lr.hash, true
+		}
+	}
+	for p2pc := range pending {
+		p2pc.send(p2pMsgMineCancelStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: node.p2pEphemeralID,
+				Root:  node.chainParams.GenesisBlockHash,
+				Msg:   p2pMsgMineCancel,
+			},
+			JobID: job.id,
+		})
+	}
+	return
+}
+
+// minework: a peer asks us to mine a range of nonces of a block
+func (p2pc *p2pConnection) handleMineWork(msg StrIfMap) {
+	if !p2pc.node.cfg.MiningCooperate {
+		p2pLog.Warn(p2pc.address, "has sent mining work, but mining_cooperate is disabled")
+		return
+	}
+	jobID, err := msg.GetString("job_id")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	targetHex, err := msg.GetString("target")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	start, err := msg.GetInt64("start")
+	if err != nil || start < 0 || start >= 1<<32 {
+		p2pLog.Warn(p2pc.conn, "invalid start nonce", err)
+		return
+	}
+	count, err := msg.GetInt64("count")
+	if err != nil || count < 1 || count > 1<<32 {
+		p2pLog.Warn(p2pc.conn, "invalid nonce count", err)
+		return
+	}
+	encoding, _ := msg.GetString("encoding")
+	if encoding != "zlib-base64" {
+		p2pLog.Warn(p2pc.conn, "unknown mining work encoding", encoding)
+		return
+	}
+	if !p2pc.node.chainParams.isPoW() {
+		p2pLog.Warn(p2pc.address, "has sent mining work, but the chain doesn't use PoW")
+		return
+	}
+	height, err := p2pc.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot read the blockchain height:", err)
+		return
+	}
+	chainTarget, err := p2pc.node.chainParamsAt(height + 1).powTarget()
+	if err != nil {
+		p2pLog.Warn(err)
+		return
+	}
+	target, ok := new(big.Int).SetString(targetHex, 16)
+	if !ok || target.Cmp(chainTarget) != 0 {
+		p2pLog.Warn(p2pc.address, "has sent mining work with a target different from the chain's")
+		return
+	}
+	if powHash, _ := msg.GetString("pow_hash"); powHash != p2pc.node.chainParams.powHashName() {
+		p2pLog.Warn(p2pc.address, "has sent mining work with a PoW hash function different from the chain's:", powHash)
+		return
+	}
+	hashFunc, err := p2pc.node.chainParams.powHashFunc()
+	if err != nil {
+		p2pLog.Warn(err)
+		return
+	}
+	dataString, err := msg.GetString("data")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	zlibData, err := base64.StdEncoding.DecodeString(dataString)
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	r, err := zlib.NewReader(bytes.NewReader(zlibData))
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, mineWorkMaxSize+1))
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	if len(data) > mineWorkMaxSize || len(data) < sqliteNonceOffset+4 {
+		p2pLog.Warn(p2pc.address, "has sent mining work of an invalid size:", len(data))
+		return
+	}
+
+	// Stopped when the connection is torn down
+	ctx, cancel := context.WithCancel(p2pc.ctx)
+	work := &mineWork{id: jobID, cancel: cancel}
+	p2pc.node.mineWorks.lock.With(func() {
+		// Only one block per connection
+		if old, ok := p2pc.node.mineWorks.works[p2pc]; ok {
+			old.cancel()
+		}
+		p2pc.node.mineWorks.works[p2pc] = work
+	})
+	miningLog.Infof("Mining job %s for %s: %d nonces from %d", jobID, p2pc.address, count, start)
+	p2pc.wg.Add(1)
+	go p2pc.mineWork(ctx, work, data, hashFunc, target, mineRange{uint32(start), uint64(count)})
+}
+
+// Mines a range of nonces for the peer and sends it the result
+func (p2pc *p2pConnection) mineWork(ctx context.Context, work *mineWork, data []byte, hashFunc powHashFunc, target *big.Int, r mineRange) {
+	defer p2pc.wg.Done()
+	defer work.cancel()
+	var hashes uint64
+	nonce, hash, found := mineNonceRange(ctx, data, hashFunc, target, runtime.NumCPU(), r, &hashes)
+	p2pc.node.mineWorks.lock.With(func() {
+		if p2pc.node.mineWorks.works[p2pc] == work {
+			delete(p2pc.node.mineWorks.works, p2pc)
+		}
+	})
+	if !found && ctx.Err() != nil {
+		miningLog.Info("Mining job", work.id, "cancelled")
+		return
+	}
+	miningLog.Infof("Mining job %s finished after %d hashes, found: %v", work.id, hashes, found)
+	msg := p2pMsgMineSolutionStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgMineSolution,
+		},
+		JobID:  work.id,
+		Found:  found,
+		Nonce:  nonce,
+		Hashes: hashes,
+	}
+	if found {
+		msg.Hash = hex.EncodeToString(hash)
+	}
+	p2pc.send(msg)
+}
+
+// minesolution: a peer reports the result of mining its range of nonces
+func (p2pc *p2pConnection) handleMineSolution(msg StrIfMap) {
+	jobID, err := msg.GetString("job_id")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	var job *mineJob
+	p2pc.node.mineJobs.lock.With(func() {
+		job = p2pc.node.mineJobs.jobs[jobID]
+	})
+	if job == nil {
+		// Already finished
+		return
+	}
+	res := mineResult{p2pc: p2pc, valid: true}
+	if hashes, err := msg.GetInt64("hashes"); err == nil && hashes > 0 {
+		res.hashes = uint64(hashes)
+	}
+	res.found, _ = msg["found"].(bool)
+	if res.found {
+		nonce, err := msg.GetInt64("nonce")
+		if err != nil || nonce < 0 || nonce >= 1<<32 {
+			res.valid = false
+		} else {
+			res.nonce = uint32(nonce)
+			res.hash = mineHashWithNonce(job.data, job.hashFunc, res.nonce)
+			res.valid = powHashMeetsTarget(res.hash, job.target)
+		}
+	}
+	select {
+	case job.results <- res:
+	default:
+		// Only one result per peer is expected
+	}
+}
+
+// minecancel: a peer tells us to stop mining its block
+func (p2pc *p2pConnection) handleMineCancel(msg StrIfMap) {
+	jobID, err := msg.GetString("job_id")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	p2pc.node.mineWorks.lock.With(func() {
+		if work, ok := p2pc.node.mineWorks.works[p2pc]; ok && work.id == jobID {
+			work.cancel()
+		}
+	})
+}
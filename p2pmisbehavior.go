@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Penalties for misbehaving peers. Besides lowering the peer's score (see p2pscore.go), each
+ * malformed message, message for another chain, invalid block or key op proposal, batch of
+ * records signed by unknown keys and oversized message adds penalty points to the
+ * connection, and a peer which reaches p2pPenaltyThreshold is disconnected, and its IP
+ * address is banned for p2pPenaltyBanTime: its connections are
+ * refused, and it isn't connected to, including as a saved peer. The peers connected through
+ * a relay (see p2prelay.go) don't have their own IP addresses, so their sessions are closed and
+ * their p2p IDs are banned instead, without banning the relay. A single message can't be parsed
+ * if it's too large, so the peer is dropped right away in that case.
+ */
+
+const (
+	p2pPenaltyMalformed     = 20  // A message which isn't JSON, or is missing its fields
+	p2pPenaltyWrongRoot     = 25  // A message for another chain
+	p2pPenaltyInvalidBlock  = 50  // A block which doesn't decode or isn't valid
+	p2pPenaltyInvalidKeyOp  = 20  // A key op proposal which isn't valid, see keyproposals.go
+	p2pPenaltyUnknownSigner = 20  // Records not signed by the chain's keys, see mempool.go
+	p2pPenaltyOversized     = 100 // A message larger than p2pMaxMessageSize()
+)
+
+// The penalty points at which the peer is dropped and banned
+const p2pPenaltyThreshold = 100
+
+// How long the misbehaving peers are banned
+const p2pPenaltyBanTime = 24 * time.Hour
+
+// The messages are at most the size of the base64-encoded blocks, with some room for the other
+// fields. The blocks are limited by the max_block_size of the next block, which can be changed
+// by the parameter updates, or else by the size of the mining work, which is the largest block
+// a node accepts from a peer.
+func (node *Node) p2pMaxMessageSize() int {
+	blockSize := int64(mineWorkMaxSize)
+	maxBlockSize := node.chainParams.MaxBlockSize
+	if height, err := node.dbGetBlockchainHeight(); err != nil {
+		p2pLog.Warn("Cannot read the blockchain height, using the chain's max_block_size:", err)
+	} else {
+		maxBlockSize = node.chainParamsAt(height + 1).MaxBlockSize
+	}
+	if maxBlockSize > 0 {
+		blockSize = maxBlockSize
+	}
+	return int(blockSize/3*4) + 1024*1024
+}
+
+var errP2pMessageTooLarge = errors.New("the message is too large")
+
+// Reads a message line from the peer, failing with errP2pMessageTooLarge if it's longer than
+// the maximum
+func p2pReadLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > max {
+			return nil, errP2pMessageTooLarge
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Adds the penalty points to the peer, and drops and bans it if they reach the threshold.
+// Returns true if the peer is dropped.
+func (p2pc *p2pConnection) misbehaved(points int, reason string) bool {
+	p2pc.score.recordError()
+	total := atomic.AddInt32(&p2pc.penalty, int32(points))
+	p2pLog.Warnf("%s %s (%d penalty points)", p2pc.address, reason, total)
+	if total < p2pPenaltyThreshold {
+		return false
+	}
+	if total-int32(points) >= p2pPenaltyThreshold {
+		// Already dropped
+		return true
+	}
+	p2pLog.Warnf("Dropping and banning %s for %v for misbehaving", p2pc.address, p2pPenaltyBanTime)
+	if p2pc.relayed() {
+		if p2pc.peerID != 0 {
+			p2pc.node.p2pBannedPeerIDs.Add(fmt.Sprintf("%x", p2pc.peerID))
+		}
+		p2pc.cancel()
+		return true
+	}
+	if ip := p2pc.remoteIP(); ip != nil {
+		p2pc.node.p2pBannedIPs.Add(ip.String())
+	}
+	p2pc.node.p2pCoordinator.badPeers.Add(p2pc.address)
+	for _, address := range []string{p2pc.address, p2pc.savedAddress} {
+		if address == "" {
+			continue
+		}
+		if err := p2pc.node.dbBanPeer(address, time.Now().Add(p2pPenaltyBanTime)); err != nil {
+			p2pLog.Warn("Cannot ban", address, err)
+		}
+	}
+	p2pc.cancel()
+	return true
+}
+
+// Penalizes the peer for a malformed message
+func (p2pc *p2pConnection) malformed(err error) {
+	p2pc.misbehaved(p2pPenaltyMalformed, fmt.Sprintf("has sent a malformed message: %v", err))
+}
+
+// Returns true if the host of the address is banned for misbehaving
+func (node *Node) p2pIsBanned(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return node.p2pBannedIPs.Has(host)
+}
+
+// Returns true if the peer with the p2p ID is banned for misbehaving through a relay
+func (node *Node) p2pIsBannedPeerID(peerID int64) bool {
+	return node.p2pBannedPeerIDs.Has(fmt.Sprintf("%x", peerID))
+}
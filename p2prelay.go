@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Relaying the p2p connections between the nodes which can't accept connections, e.g. home
+ * machines behind NAT. A publicly reachable node with "relay": true (or -relay) announces it in
+ * its hello, and the nodes with "use_relays": true register at the relays they're connected to,
+ * every p2pRelayRefreshInterval. The relay answers with the IDs of the other registered nodes,
+ * and the node opens a session through the relay to each of them it isn't connected to yet. A
+ * session carries an ordinary p2p connection (the prologue, the hello and everything after
+ * them) in relaydata messages, which the relay forwards between the two connections, so the
+ * relayed peers sync from each other like the directly connected ones. A session is closed with
+ * relayclose, or when either connection to the relay is closed. The sessions opened to a node
+ * are admitted like the inbound connections (see p2pthrottle.go), with the relay as their
+ * source, and each connection to a relay carries at most p2pRelayMaxSessions sessions, on the
+ * nodes and on the relay.
+ */
+
+// The message registering a node at a relay
+const p2pMsgRelayRegister = "relayregister"
+
+// The relay's answer to relayregister, with the other registered nodes
+const p2pMsgRelayPeers = "relaypeers"
+
+type p2pMsgRelayPeersStruct struct {
+	p2pMsgHeader
+	Peers []int64 `json:"peers"` // p2p IDs
+}
+
+// The message opening a session: from a node, to the peer with the ID, and from the relay, from
+// the peer with the ID
+const p2pMsgRelayOpen = "relayopen"
+
+type p2pMsgRelayOpenStruct struct {
+	p2pMsgHeader
+	Session int64 `json:"session"`
+	Peer    int64 `json:"peer"`
+}
+
+// The message carrying the data of a session
+const p2pMsgRelayData = "relaydata"
+
+type p2pMsgRelayDataStruct struct {
+	p2pMsgHeader
+	Session int64  `json:"session"`
+	Data    string `json:"data"` // base64
+}
+
+// The message closing a session
+const p2pMsgRelayClose = "relayclose"
+
+type p2pMsgRelayCloseStruct struct {
+	p2pMsgHeader
+	Session int64 `json:"session"`
+}
+
+// How often the nodes register at their relays, and look for the new peers
+const p2pRelayRefreshInterval = 5 * time.Minute
+
+// The most nodes registered at a relay
+const p2pRelayMaxClients = 256
+
+// The most sessions of a node through a relay
+const p2pRelayMaxSessions = 32
+
+// The largest data sent in one relaydata message
+const p2pRelayChunkSize = 16 * 1024
+
+// The data received in a session which hasn't been read yet, in chunks
+const p2pRelayQueueLength = 64
+
+// A session, identified by the connection to the relay (or, on the relay, to the node) and the
+// session ID chosen by the node which has opened it
+type p2pRelayKey struct {
+	p2pc    *p2pConnection
+	session int64
+}
+
+func (node *Node) p2pRelayHeader(msg string) p2pMsgHeader {
+	return p2pMsgHeader{P2pID: node.p2pEphemeralID, Root: node.chainParams.GenesisBlockHash, Msg: msg}
+}
+
+// p2pRelayConn is the net.Conn of a session through a relay
+type p2pRelayConn struct {
+	key       p2pRelayKey
+	in        chan []byte
+	pending   []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	lock      WithMutex
+	deadline  time.Time
+	node      *Node
+}
+
+// p2pRelayAddr is the address of a peer connected through a relay
+type p2pRelayAddr string
+
+func (a p2pRelayAddr) Network() string { return "relay" }
+func (a p2pRelayAddr) String() string  { return string(a) }
+
+// Returns true if the peer is connected through a relay
+func (p2pc *p2pConnection) relayed() bool {
+	_, ok := p2pc.conn.(*p2pRelayConn)
+	return ok
+}
+
+func (node *Node) newP2pRelayConn(key p2pRelayKey) *p2pRelayConn {
+	return &p2pRelayConn{node: node, key: key, in: make(chan []byte, p2pRelayQueueLength), done: make(chan struct{})}
+}
+
+func (c *p2pRelayConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+		var deadline time.Time
+		c.lock.With(func() {
+			deadline = c.deadline
+		})
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case c.pending = <-c.in:
+		case <-c.done:
+			// The data received before the session was closed is still read
+			select {
+			case c.pending = <-c.in:
+			default:
+				return 0, io.EOF
+			}
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *p2pRelayConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		select {
+		case <-c.done:
+			return written, net.ErrClosed
+		default:
+		}
+		n := len(b) - written
+		if n > p2pRelayChunkSize {
+			n = p2pRelayChunkSize
+		}
+		msg := p2pMsgRelayDataStruct{
+			p2pMsgHeader: c.node.p2pRelayHeader(p2pMsgRelayData),
+			Session:      c.key.session,
+			Data:         base64.StdEncoding.EncodeToString(b[written : written+n]),
+		}
+		if !c.key.p2pc.send(msg) {
+			return written, errors.New("the connection to the relay is closed")
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Closes the session, and tells the peer through the relay
+func (c *p2pRelayConn) Close() error {
+	if c.close() {
+		c.key.p2pc.send(p2pMsgRelayCloseStruct{p2pMsgHeader: c.node.p2pRelayHeader(p2pMsgRelayClose), Session: c.key.session})
+	}
+	return nil
+}
+
+// Closes the session, returning false if it was already closed
+func (c *p2pRelayConn) close() (closed bool) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.node.p2pRelay.lock.With(func() {
+			delete(c.node.p2pRelay.conns, c.key)
+		})
+		closed = true
+	})
+	return
+}
+
+// Passes the data received in the session to Read(). The connection to the relay carries the
+// other sessions too, so rather than waiting for a session which doesn't read its data, it's
+// closed when its queue is full.
+func (c *p2pRelayConn) feed(data []byte) {
+	select {
+	case c.in <- data:
+	case <-c.done:
+	default:
+		p2pLog.Warn("Closing the relayed session", c.RemoteAddr(), "which isn't reading its data")
+		c.Close()
+	}
+}
+
+func (c *p2pRelayConn) LocalAddr() net.Addr {
+	return c.key.p2pc.conn.LocalAddr()
+}
+
+func (c *p2pRelayConn) RemoteAddr() net.Addr {
+	return p2pRelayAddr(fmt.Sprintf("%s/%x", c.key.p2pc.address, c.key.session))
+}
+
+func (c *p2pRelayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *p2pRelayConn) SetReadDeadline(t time.Time) error {
+	c.lock.With(func() {
+		c.deadline = t
+	})
+	return nil
+}
+
+func (c *p2pRelayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Starts the p2p connection of a session. handshakeDone is called when the connection's prologue
+// has been exchanged, or it's refused.
+func (node *Node) p2pRelayStartConn(conn *p2pRelayConn, peerID int64, handshakeDone func()) {
+	p2pc, err := node.p2pSetupPeer(conn.RemoteAddr().String(), conn)
+	if err != nil {
+		p2pLog.Warn("Error setting up the relayed peer", conn.RemoteAddr(), err)
+		conn.Close()
+		handshakeDone()
+		return
+	}
+	p2pc.handshakeDone = handshakeDone
+	p2pLog.Infof("Connected to %x through the relay %s", peerID, conn.key.p2pc.address)
+	go p2pc.handleConnection()
+}
+
+// Returns the number of sessions through the connection to the relay, or forwarded for the
+// connection on the relay. Must be called with p2pRelay.lock held.
+func (p2pc *p2pConnection) relaySessions() int {
+	n := 0
+	for key := range p2pc.node.p2pRelay.conns {
+		if key.p2pc == p2pc {
+			n++
+		}
+	}
+	for key := range p2pc.node.p2pRelay.forwards {
+		if key.p2pc == p2pc {
+			n++
+		}
+	}
+	return n
+}
+
+// Checks if a session opened to this node through the relay can be accepted, like an inbound
+// connection. If it can, returns the function to call when its handshake is done, and otherwise
+// nil and the reason.
+func (p2pc *p2pConnection) relayAdmit(peerID int64) (func(), string) {
+	if p2pc.node.p2pIsBannedPeerID(peerID) {
+		return nil, fmt.Sprintf("%x is banned", peerID)
+	}
+	handshakeDone, reason := p2pc.node.p2pThrottle.admitFrom(p2pc.address)
+	if handshakeDone == nil {
+		return nil, reason
+	}
+	if !p2pc.node.p2pPeers.makeRoom() {
+		handshakeDone()
+		return nil, "too many peers"
+	}
+	return handshakeDone, ""
+}
+
+// Registers this node at the relay every p2pRelayRefreshInterval, until the connection is closed
+func (p2pc *p2pConnection) relayRegister() {
+	defer p2pc.wg.Done()
+	ticker := time.NewTicker(p2pRelayRefreshInterval)
+	defer ticker.Stop()
+	for {
+		if !p2pc.send(p2pc.node.p2pRelayHeader(p2pMsgRelayRegister)) {
+			return
+		}
+		select {
+		case <-p2pc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayregister: a node registers at this relay
+func (p2pc *p2pConnection) handleRelayRegister() {
+	if !p2pc.node.cfg.Relay {
+		p2pLog.Warn(p2pc.address, "wants to register, but this node isn't a relay")
+		return
+	}
+	var peers []int64
+	full := false
+	p2pc.node.p2pRelay.lock.With(func() {
+		if _, ok := p2pc.node.p2pRelay.clients[p2pc.peerID]; !ok && len(p2pc.node.p2pRelay.clients) >= p2pRelayMaxClients {
+			full = true
+			return
+		}
+		p2pc.node.p2pRelay.clients[p2pc.peerID] = p2pc
+		for id := range p2pc.node.p2pRelay.clients {
+			if id != p2pc.peerID && len(peers) < p2pMaxSharedPeers {
+				peers = append(peers, id)
+			}
+		}
+	})
+	if full {
+		p2pLog.Warn("Too many nodes registered at the relay, refusing", p2pc.address)
+		return
+	}
+	p2pc.send(p2pMsgRelayPeersStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayPeers), Peers: peers})
+}
+
+// relaypeers: opens the sessions to the peers registered at the relay which this node isn't
+// connected to
+func (p2pc *p2pConnection) handleRelayPeers(msg StrIfMap) {
+	if !p2pc.relay || !p2pc.node.cfg.UseRelays {
+		return
+	}
+	list, ok := msg["peers"].([]interface{})
+	if !ok {
+		p2pc.malformed(errors.New("no peers in relaypeers"))
+		return
+	}
+	connected := map[int64]bool{}
+	sessions := 0
+	p2pc.node.p2pPeers.lock.With(func() {
+		for p := range p2pc.node.p2pPeers.peers {
+			connected[p.peerID] = true
+		}
+	})
+	p2pc.node.p2pRelay.lock.With(func() {
+		sessions = p2pc.relaySessions()
+	})
+	for _, item := range list {
+		id, ok := item.(float64)
+		if !ok || connected[int64(id)] || int64(id) == p2pc.node.p2pEphemeralID {
+			continue
+		}
+		if sessions >= p2pRelayMaxSessions {
+			break
+		}
+		key := p2pRelayKey{p2pc: p2pc, session: randInt63()}
+		conn := p2pc.node.newP2pRelayConn(key)
+		p2pc.node.p2pRelay.lock.With(func() {
+			p2pc.node.p2pRelay.conns[key] = conn
+		})
+		if !p2pc.send(p2pMsgRelayOpenStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayOpen), Session: key.session, Peer: int64(id)}) {
+			conn.close()
+			return
+		}
+		sessions++
+		p2pc.node.p2pRelayStartConn(conn, int64(id), func() {})
+	}
+}
+
+// relayopen: on a relay, a node opens a session to another, and on a node, another node has
+// opened a session to it
+func (p2pc *p2pConnection) handleRelayOpen(msg StrIfMap) {
+	session, err := msg.GetInt64("session")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	peerID, err := msg.GetInt64("peer")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	key := p2pRelayKey{p2pc: p2pc, session: session}
+	refuse := func() {
+		p2pc.send(p2pMsgRelayCloseStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayClose), Session: session})
+	}
+	if p2pc.relay && p2pc.node.cfg.UseRelays {
+		handshakeDone, reason := p2pc.relayAdmit(peerID)
+		if handshakeDone == nil {
+			p2pLog.Debugf("Refusing the session from %x through %s: %s", peerID, p2pc.address, reason)
+			refuse()
+			return
+		}
+		conn := p2pc.node.newP2pRelayConn(key)
+		exists, full := false, false
+		p2pc.node.p2pRelay.lock.With(func() {
+			if _, exists = p2pc.node.p2pRelay.conns[key]; exists {
+				return
+			}
+			if full = p2pc.relaySessions() >= p2pRelayMaxSessions; !full {
+				p2pc.node.p2pRelay.conns[key] = conn
+			}
+		})
+		if exists {
+			handshakeDone()
+			p2pc.malformed(fmt.Errorf("session %x is already open", session))
+			return
+		}
+		if full {
+			handshakeDone()
+			p2pLog.Debugf("Refusing the session from %x through %s: too many sessions", peerID, p2pc.address)
+			refuse()
+			return
+		}
+		p2pc.node.p2pRelayStartConn(conn, peerID, handshakeDone)
+		return
+	}
+	if !p2pc.node.cfg.Relay {
+		return
+	}
+	var target *p2pConnection
+	p2pc.node.p2pRelay.lock.With(func() {
+		if p2pc.node.p2pRelay.clients[p2pc.peerID] != p2pc {
+			return
+		}
+		if target = p2pc.node.p2pRelay.clients[peerID]; target == nil {
+			return
+		}
+		if p2pc.relaySessions() >= p2pRelayMaxSessions || target.relaySessions() >= p2pRelayMaxSessions {
+			target = nil
+			return
+		}
+		targetKey := p2pRelayKey{p2pc: target, session: session}
+		_, exists := p2pc.node.p2pRelay.forwards[key]
+		_, targetExists := p2pc.node.p2pRelay.forwards[targetKey]
+		if exists || targetExists {
+			target = nil
+			return
+		}
+		p2pc.node.p2pRelay.forwards[key] = targetKey
+		p2pc.node.p2pRelay.forwards[targetKey] = key
+	})
+	if target == nil {
+		refuse()
+		return
+	}
+	target.send(p2pMsgRelayOpenStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayOpen), Session: session, Peer: p2pc.peerID})
+}
+
+// Returns the other end of a session forwarded by this relay, or the session's connection on a
+// node, or neither if there's no such session
+func (node *Node) p2pRelayLookup(key p2pRelayKey) (forward p2pRelayKey, conn *p2pRelayConn) {
+	node.p2pRelay.lock.With(func() {
+		forward = node.p2pRelay.forwards[key]
+		conn = node.p2pRelay.conns[key]
+	})
+	return
+}
+
+// relaydata: forwards the data to the other node, or passes it to the session's connection
+func (p2pc *p2pConnection) handleRelayData(msg StrIfMap) {
+	session, err := msg.GetInt64("session")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	forward, conn := p2pc.node.p2pRelayLookup(p2pRelayKey{p2pc: p2pc, session: session})
+	if forward.p2pc != nil {
+		data, err := msg.GetString("data")
+		if err != nil {
+			p2pc.malformed(err)
+			return
+		}
+		forward.p2pc.send(p2pMsgRelayDataStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayData), Session: session, Data: data})
+		return
+	}
+	if conn == nil {
+		// Closed in the meantime
+		return
+	}
+	dataString, err := msg.GetString("data")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(dataString)
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	conn.feed(data)
+}
+
+// relayclose: forwards the close to the other node, or closes the session's connection
+func (p2pc *p2pConnection) handleRelayClose(msg StrIfMap) {
+	session, err := msg.GetInt64("session")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	key := p2pRelayKey{p2pc: p2pc, session: session}
+	forward, conn := p2pc.node.p2pRelayLookup(key)
+	if forward.p2pc != nil {
+		p2pc.node.p2pRelay.lock.With(func() {
+			delete(p2pc.node.p2pRelay.forwards, key)
+			delete(p2pc.node.p2pRelay.forwards, forward)
+		})
+		forward.p2pc.send(p2pMsgRelayCloseStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayClose), Session: session})
+		return
+	}
+	if conn != nil {
+		conn.close()
+	}
+}
+
+// Unregisters a closed connection from the relay, and closes its sessions
+func (p2pc *p2pConnection) relayDisconnected() {
+	var forwards []p2pRelayKey
+	var conns []*p2pRelayConn
+	p2pc.node.p2pRelay.lock.With(func() {
+		if p2pc.node.p2pRelay.clients[p2pc.peerID] == p2pc {
+			delete(p2pc.node.p2pRelay.clients, p2pc.peerID)
+		}
+		for key, forward := range p2pc.node.p2pRelay.forwards {
+			if key.p2pc == p2pc {
+				forwards = append(forwards, forward)
+				delete(p2pc.node.p2pRelay.forwards, key)
+				delete(p2pc.node.p2pRelay.forwards, forward)
+			}
+		}
+		for key, conn := range p2pc.node.p2pRelay.conns {
+			if key.p2pc == p2pc {
+				conns = append(conns, conn)
+			}
+		}
+	})
+	for _, forward := range forwards {
+		forward.p2pc.send(p2pMsgRelayCloseStruct{p2pMsgHeader: p2pc.node.p2pRelayHeader(p2pMsgRelayClose), Session: forward.session})
+	}
+	for _, conn := range conns {
+		conn.close()
+	}
+}
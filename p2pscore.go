@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+/*
+ * Peer quality scoring. Each connection keeps track of how quickly the peer answers the
+ * requests (latency), how fast its blocks are downloaded (throughput), how many of its
+ * requests have stalled or its blocks were invalid (errors), and whether its block hashes
+ * have reached the chain height it has claimed. These are combined into a score from 0 to
+ * 100, which is used to choose the peer to sync from, and the peer to evict when p2p_max_peers
+ * is reached. Peers which haven't been measured yet get half of the penalties.
+ */
+
+// The weight of a new measurement in the moving averages
+const p2pScoreAlpha = 0.3
+
+// The throughput above which a peer isn't penalized, in bytes per second
+const p2pScoreGoodThroughput = 1024 * 1024
+
+// Newly connected peers are not evicted, so they have the time to prove themselves
+const p2pScoreEvictionGrace = time.Minute
+
+// p2pPeerScore holds the quality measurements of a peer
+type p2pPeerScore struct {
+	lock         WithMutex
+	latency      time.Duration // Moving average of the request round trips
+	throughput   float64       // Moving average of the block transfer rate, in bytes per second
+	errors       int           // Stalled requests, and invalid messages and blocks
+	heightClaims int           // Answers to block hash requests
+	heightMisses int           // Answers which haven't reached the claimed chain height
+}
+
+// Records the round trip time of a request
+func (s *p2pPeerScore) recordLatency(d time.Duration) {
+	s.lock.With(func() {
+		if s.latency == 0 {
+			s.latency = d
+		} else {
+			s.latency = time.Duration(p2pScoreAlpha*float64(d) + (1-p2pScoreAlpha)*float64(s.latency))
+		}
+	})
+}
+
+// Records the transfer of a block of the given size
+func (s *p2pPeerScore) recordTransfer(size int64, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	rate := float64(size) / d.Seconds()
+	s.lock.With(func() {
+		if s.throughput == 0 {
+			s.throughput = rate
+		} else {
+			s.throughput = p2pScoreAlpha*rate + (1-p2pScoreAlpha)*s.throughput
+		}
+	})
+}
+
+// Records a stalled request, or an invalid message or block
+func (s *p2pPeerScore) recordError() {
+	s.lock.With(func() {
+		s.errors++
+	})
+}
+
+// Records whether the block hashes sent by the peer have reached the height it has claimed
+func (s *p2pPeerScore) recordHeightClaim(accurate bool) {
+	s.lock.With(func() {
+		s.heightClaims++
+		if !accurate {
+			s.heightMisses++
+		}
+	})
+}
+
+// Returns the score, from 0 (worst) to 100 (best)
+func (s *p2pPeerScore) score() (score float64) {
+	s.lock.With(func() {
+		score = 100
+		// Up to 30 for latency, reached at 3 seconds
+		if s.latency == 0 {
+			score -= 15
+		} else {
+			score -= math.Min(30, s.latency.Seconds()*10)
+		}
+		// Up to 20 for throughput
+		if s.throughput == 0 {
+			score -= 10
+		} else if s.throughput < p2pScoreGoodThroughput {
+			score -= 20 * (1 - s.throughput/p2pScoreGoodThroughput)
+		}
+		// 10 for each error, up to 30
+		score -= math.Min(30, float64(s.errors)*10)
+		// Up to 20 for the claimed heights which weren't reached
+		if s.heightClaims == 0 {
+			score -= 10
+		} else {
+			score -= 20 * float64(s.heightMisses) / float64(s.heightClaims)
+		}
+	})
+	return
+}
+
+// Makes room for a new connection if p2p_max_peers has been reached, by evicting the peer
+// with the lowest score. Returns false if there's no room, because all the peers are new.
+func (p *p2pPeersSet) makeRoom() bool {
+	if p.node.cfg.P2pMaxPeers == 0 {
+		return true
+	}
+	var worst *p2pConnection
+	full := false
+	p.lock.With(func() {
+		if len(p.peers) < p.node.cfg.P2pMaxPeers {
+			return
+		}
+		full = true
+		worstScore := 0.0
+		for peer := range p.peers {
+			if time.Since(peer.connectedTime) < p2pScoreEvictionGrace {
+				continue
+			}
+			if s := peer.score.score(); worst == nil || s < worstScore {
+				worst, worstScore = peer, s
+			}
+		}
+	})
+	if !full {
+		return true
+	}
+	if worst == nil {
+		return false
+	}
+	p2pLog.Infof("Evicting %s (score %.0f) to make room for a new peer", worst.address, worst.score.score())
+	worst.cancel()
+	if err := worst.conn.Close(); err != nil {
+		p2pLog.Warnf("p2pc.conn.Close: %v", err)
+	}
+	return true
+}
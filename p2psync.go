@@ -0,0 +1,288 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The block hashes are requested in windows of sync_batch_size heights. As soon as a window's
+ * hashes arrive and its blocks are requested, the next window is requested from the same
+ * peer, unless there are already two windows' worth of blocks in flight, in which case the
+ * coordinator continues the search when the downloads catch up.
+ *
+ * Stalled sync detection. The getblockhashes and getblock requests sent to the peers are
+ * tracked with deadlines. The coordinator periodically checks them, and the requests which
+ * haven't been answered in time, or whose peer has disconnected, are sent again to another
+ * peer which has the blocks. A peer which doesn't answer in time has a connection failure
+ * recorded, and is dropped after p2pMaxStalls unanswered requests.
+ *
+ * If the node is behind its peers but has no requests in flight, e.g. because the answers
+ * have been lost, the coordinator starts searching for blocks again.
+ */
+
+const (
+	p2pGetBlockHashesTimeout = 30 * time.Second
+	p2pGetBlockTimeout       = 2 * time.Minute
+)
+
+// The number of unanswered requests after which a peer is dropped
+const p2pMaxStalls = 3
+
+// p2pRequest is a request sent to a peer, waiting for the answer
+type p2pRequest struct {
+	msg      string // p2pMsgGetBlockHashes or p2pMsgGetBlock
+	hash     string // The requested block, for getblock
+	height   int    // The height of the requested block, or the max height for getblockhashes
+	p2pc     *p2pConnection
+	sent     time.Time
+	deadline time.Time
+}
+
+// Records that block hashes up to the given height have been requested from the peer
+func (node *Node) p2pTrackGetBlockHashes(p2pc *p2pConnection, maxHeight int) {
+	node.p2pRequests.lock.With(func() {
+		now := time.Now()
+		node.p2pRequests.hashes[p2pc] = &p2pRequest{msg: p2pMsgGetBlockHashes, height: maxHeight, p2pc: p2pc, sent: now, deadline: now.Add(p2pGetBlockHashesTimeout)}
+		node.p2pRequests.lastChange = time.Now()
+	})
+}
+
+// Records that the block at the given height has been requested from the peer
+func (node *Node) p2pTrackGetBlock(p2pc *p2pConnection, hash string, height int) {
+	node.p2pRequests.lock.With(func() {
+		now := time.Now()
+		node.p2pRequests.blocks[hash] = &p2pRequest{msg: p2pMsgGetBlock, hash: hash, height: height, p2pc: p2pc, sent: now, deadline: now.Add(p2pGetBlockTimeout)}
+		node.p2pRequests.lastChange = time.Now()
+	})
+}
+
+// Records that the peer has answered a getblockhashes request. Returns the request, or nil if
+// there was none.
+func (node *Node) p2pBlockHashesReceived(p2pc *p2pConnection) (req *p2pRequest) {
+	node.p2pRequests.lock.With(func() {
+		if req = node.p2pRequests.hashes[p2pc]; req != nil {
+			delete(node.p2pRequests.hashes, p2pc)
+			node.p2pRequests.lastChange = time.Now()
+			node.p2pRequests.searchedHeight = req.height
+		}
+	})
+	atomic.StoreInt32(&p2pc.stalls, 0)
+	if req != nil {
+		p2pc.score.recordLatency(time.Since(req.sent))
+	}
+	return
+}
+
+// Records that a block has been received, from any peer. Returns the time the block has been
+// requested from this peer, or the zero time if it hasn't been.
+func (node *Node) p2pBlockReceived(p2pc *p2pConnection, hash string) (sent time.Time) {
+	node.p2pRequests.lock.With(func() {
+		if req, ok := node.p2pRequests.blocks[hash]; ok {
+			delete(node.p2pRequests.blocks, hash)
+			node.p2pRequests.lastChange = time.Now()
+			if req.p2pc == p2pc {
+				sent = req.sent
+			}
+		}
+	})
+	atomic.StoreInt32(&p2pc.stalls, 0)
+	return
+}
+
+// Returns the numbers of the getblockhashes and getblock requests in flight, and the end of the
+// last window of block hashes received
+func (node *Node) p2pRequestsInFlight() (hashes, blocks, searchedHeight int) {
+	node.p2pRequests.lock.With(func() {
+		hashes, blocks, searchedHeight = len(node.p2pRequests.hashes), len(node.p2pRequests.blocks), node.p2pRequests.searchedHeight
+	})
+	return
+}
+
+// Returns true if a request for the block is in flight
+func (node *Node) p2pBlockRequested(hash string) (requested bool) {
+	node.p2pRequests.lock.With(func() {
+		_, requested = node.p2pRequests.blocks[hash]
+	})
+	return
+}
+
+// Removes and returns the requests which have passed their deadlines or whose peers have
+// disconnected, and the number of the requests still in flight
+func (node *Node) p2pTakeStalledRequests(now time.Time) (stalled []*p2pRequest, inFlight int) {
+	node.p2pRequests.lock.With(func() {
+		for p2pc, req := range node.p2pRequests.hashes {
+			if now.After(req.deadline) || p2pc.ctx.Err() != nil {
+				stalled = append(stalled, req)
+				delete(node.p2pRequests.hashes, p2pc)
+			}
+		}
+		for hash, req := range node.p2pRequests.blocks {
+			if now.After(req.deadline) || req.p2pc.ctx.Err() != nil {
+				stalled = append(stalled, req)
+				delete(node.p2pRequests.blocks, hash)
+			}
+		}
+		inFlight = len(node.p2pRequests.hashes) + len(node.p2pRequests.blocks)
+	})
+	return
+}
+
+// Returns the connected peer with the best score among those with a chain height of at least
+// minHeight, other than the excluded one, or nil if there is none. Of the peers with the same
+// score, the one with the highest chain is chosen. The pruned peers are only chosen if there's
+// no archival one, see p2pcaps.go.
+func (p *p2pPeersSet) BestPeer(minHeight int, exclude *p2pConnection) (best *p2pConnection) {
+	bestScore := 0.0
+	p.lock.With(func() {
+		for peer := range p.peers {
+			if peer == exclude || peer.chainHeight < minHeight || peer.ctx.Err() != nil {
+				continue
+			}
+			score := peer.score.score()
+			if !peer.hasAllBlocks() {
+				// Below the score of any archival peer, as the scores are from 0 to 100
+				score -= 100
+			}
+			if best == nil || score > bestScore || (score == bestScore && peer.chainHeight > best.chainHeight) {
+				best, bestScore = peer, score
+			}
+		}
+	})
+	return
+}
+
+// Penalizes the peer for not answering a request in time
+func (p2pc *p2pConnection) stalled(req *p2pRequest) {
+	stalls := atomic.AddInt32(&p2pc.stalls, 1)
+	p2pLog.Warnf("%s hasn't answered %s for %s in time (%d stalls)", p2pc.address, req.msg, req.describe(), stalls)
+	p2pc.node.p2pRecordPeerFailure(p2pc.address)
+	p2pc.score.recordError()
+	if stalls >= p2pMaxStalls {
+		p2pLog.Warn("Dropping stalled peer", p2pc.address)
+		p2pc.node.p2pCoordinator.badPeers.Add(p2pc.address)
+		p2pc.cancel()
+		if err := p2pc.conn.Close(); err != nil {
+			p2pLog.Warnf("p2pc.conn.Close: %v", err)
+		}
+	}
+}
+
+// Returns a description of the request for the logs
+func (req *p2pRequest) describe() string {
+	if req.msg == p2pMsgGetBlock {
+		return "block " + req.hash
+	}
+	return "blocks up to " + strconv.Itoa(req.height)
+}
+
+// Checks the requests in flight, sending the stalled ones to other peers. Called from the
+// coordinator.
+func (co *p2pCoordinatorType) checkStalledRequests() {
+	stalled, inFlight := co.node.p2pTakeStalledRequests(time.Now())
+	for _, req := range stalled {
+		if req.p2pc.ctx.Err() == nil {
+			req.p2pc.stalled(req)
+		}
+		switch req.msg {
+		case p2pMsgGetBlockHashes:
+			if height, err := co.node.dbGetBlockchainHeight(); err != nil {
+				p2pLog.Error(err)
+			} else if peer := co.node.p2pPeers.BestPeer(height+1, req.p2pc); peer != nil {
+				co.handleSearchForBlocks(peer)
+			}
+		case p2pMsgGetBlock:
+			exists, err := co.node.dbBlockHashExists(req.hash)
+			if err != nil {
+				p2pLog.Error(err)
+				continue
+			}
+			if exists {
+				continue
+			}
+			if peer := co.node.p2pPeers.BestPeer(req.height, req.p2pc); peer != nil {
+				p2pLog.Info("Requesting block", req.hash, "from", peer.address, "instead")
+				peer.requestBlock(req.hash, req.height)
+			}
+		}
+	}
+	if len(stalled) > 0 {
+		return
+	}
+	// Continue the search if it has been held back while the blocks were downloading
+	hashesInFlight, blocksInFlight, searchedHeight := co.node.p2pRequestsInFlight()
+	if hashesInFlight == 0 && blocksInFlight > 0 && blocksInFlight < co.node.cfg.SyncBatchSize {
+		if peer := co.node.p2pPeers.BestPeer(searchedHeight+1, nil); peer != nil {
+			peer.requestBlockHashes(searchedHeight + 1)
+		}
+		return
+	}
+	if inFlight > 0 {
+		return
+	}
+	// Nothing in flight: if the node is behind, the sync has been lost
+	height, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error(err)
+		return
+	}
+	var idle time.Duration
+	co.node.p2pRequests.lock.With(func() {
+		idle = time.Since(co.node.p2pRequests.lastChange)
+	})
+	if idle < p2pGetBlockHashesTimeout {
+		return
+	}
+	if peer := co.node.p2pPeers.BestPeer(height+1, nil); peer != nil {
+		p2pLog.Info("Behind", peer.address, "with no requests in flight, searching for blocks again")
+		co.handleSearchForBlocks(peer)
+	}
+}
+
+// Sends a getblockhashes request to the peer for the window of heights starting at minHeight,
+// and tracks it
+func (p2pc *p2pConnection) requestBlockHashes(minHeight int) bool {
+	maxHeight := p2pc.chainHeight
+	if maxHeight-minHeight >= p2pc.node.cfg.SyncBatchSize {
+		maxHeight = minHeight + p2pc.node.cfg.SyncBatchSize - 1
+	}
+	msg := p2pMsgGetBlockHashesStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetBlockHashes,
+		},
+		MinBlockHeight: minHeight,
+		MaxBlockHeight: maxHeight,
+	}
+	p2pLog.Infof("Searching for blocks from %d to %d at %s", minHeight, maxHeight, p2pc.address)
+	p2pc.node.p2pTrackGetBlockHashes(p2pc, maxHeight)
+	return p2pc.send(msg)
+}
+
+// Requests the next window of block hashes after the one ending at height, if the peer has
+// more blocks and there aren't too many blocks in flight
+func (p2pc *p2pConnection) continueSearch(height int) {
+	if height >= p2pc.chainHeight {
+		return
+	}
+	if _, blocksInFlight, _ := p2pc.node.p2pRequestsInFlight(); blocksInFlight >= 2*p2pc.node.cfg.SyncBatchSize {
+		return
+	}
+	p2pc.requestBlockHashes(height + 1)
+}
+
+// Sends a getblock request to the peer and tracks it
+func (p2pc *p2pConnection) requestBlock(hash string, height int) bool {
+	msg := p2pMsgGetBlockStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetBlock,
+		},
+		Hash: hash,
+	}
+	p2pc.node.p2pTrackGetBlock(p2pc, hash, height)
+	return p2pc.send(msg)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Throttling of the inbound p2p connections, so that a connection flood can't exhaust the file
+ * descriptors and the goroutines. The rate of the new connections is limited with token buckets,
+ * one for each source IP address (p2p_inbound_per_ip a minute) and one for all of them
+ * (p2p_inbound_total a minute), and at most p2p_inbound_handshakes accepted connections can be
+ * in the handshake (the prologue, see p2pchainid.go) at a time. The connections over the limits
+ * are closed right after they are accepted, before anything is read from them or a goroutine is
+ * started for them. The local connections are not limited.
+ */
+
+// The defaults of the limits
+const (
+	p2pDefaultInboundPerIP      = 10
+	p2pDefaultInboundTotal      = 120
+	p2pDefaultInboundHandshakes = 32
+)
+
+// How long an idle source's bucket is kept
+const p2pThrottleIdleTime = 10 * time.Minute
+
+// A token bucket refilled at a rate per minute, up to the rate
+type p2pTokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Takes a token from the bucket, returning false if it's empty
+func (b *p2pTokenBucket) take(perMinute int, now time.Time) bool {
+	b.tokens += now.Sub(b.lastSeen).Minutes() * float64(perMinute)
+	if b.tokens > float64(perMinute) {
+		b.tokens = float64(perMinute)
+	}
+	b.lastSeen = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type p2pInboundThrottle struct {
+	lock        WithMutex
+	sources     map[string]*p2pTokenBucket
+	total       p2pTokenBucket
+	handshakes  int
+	lastCleanup time.Time
+	node        *Node
+}
+
+func (node *Node) p2pInboundPerIP() int {
+	if node.cfg.P2pInboundPerIP > 0 {
+		return node.cfg.P2pInboundPerIP
+	}
+	return p2pDefaultInboundPerIP
+}
+
+func (node *Node) p2pInboundTotal() int {
+	if node.cfg.P2pInboundTotal > 0 {
+		return node.cfg.P2pInboundTotal
+	}
+	return p2pDefaultInboundTotal
+}
+
+func (node *Node) p2pInboundHandshakes() int {
+	if node.cfg.P2pInboundHandshakes > 0 {
+		return node.cfg.P2pInboundHandshakes
+	}
+	return p2pDefaultInboundHandshakes
+}
+
+// Checks the limits for a new inbound connection. If it's allowed, returns the function to call
+// when its handshake is done (or it's closed), and otherwise nil and the reason.
+func (t *p2pInboundThrottle) admit(conn net.Conn) (done func(), reason string) {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return func() {}, ""
+	}
+	return t.admitFrom(host)
+}
+
+// Checks the limits for a new inbound connection from the source, which is the IP address, or
+// the relay for the sessions through relays, see p2prelay.go
+func (t *p2pInboundThrottle) admitFrom(host string) (done func(), reason string) {
+	now := time.Now()
+	t.lock.With(func() {
+		if now.Sub(t.lastCleanup) > p2pThrottleIdleTime {
+			for k, b := range t.sources {
+				if now.Sub(b.lastSeen) > p2pThrottleIdleTime {
+					delete(t.sources, k)
+				}
+			}
+			t.lastCleanup = now
+		}
+		if t.handshakes >= t.node.p2pInboundHandshakes() {
+			reason = "too many connections in the handshake"
+			return
+		}
+		b, ok := t.sources[host]
+		if !ok {
+			b = &p2pTokenBucket{tokens: float64(t.node.p2pInboundPerIP()), lastSeen: now}
+			t.sources[host] = b
+		}
+		if !b.take(t.node.p2pInboundPerIP(), now) {
+			reason = "too many connections from " + host
+			return
+		}
+		if t.total.lastSeen.IsZero() {
+			t.total = p2pTokenBucket{tokens: float64(t.node.p2pInboundTotal()), lastSeen: now}
+		}
+		if !t.total.take(t.node.p2pInboundTotal(), now) {
+			reason = "too many new connections"
+			return
+		}
+		t.handshakes++
+	})
+	if reason != "" {
+		return nil, reason
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.lock.With(func() {
+				t.handshakes--
+			})
+		})
+	}, ""
+}
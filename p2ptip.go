@@ -0,0 +1,187 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+ * Tip reconciliation. Every p2pTipCheckInterval, the coordinator asks all the connected peers
+ * for their chain tips with gettip, and on the next round compares the tips they've answered
+ * with to the local chain. A peer agrees if its tip is in the local chain, disagrees if the
+ * local chain has a different block at its tip's height, and is ahead if its chain is longer,
+ * which is left to the sync. If a majority of the peers which could be compared disagree with
+ * the local chain, the node is probably on a fork: the desync is logged as an error, written
+ * to the audit log, published as the chain_desync event and shown by the status command,
+ * until the peers agree again.
+ */
+
+// How often the tips are compared
+const p2pTipCheckInterval = time.Minute
+
+// The message asking for the peer's chain tip
+const p2pMsgGetTip = "gettip"
+
+type p2pMsgGetTipStruct struct {
+	p2pMsgHeader
+}
+
+// The message reporting the chain tip
+const p2pMsgTip = "tip"
+
+type p2pMsgTipStruct struct {
+	p2pMsgHeader
+	Height int    `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// p2pPeerTip is the chain tip last reported by a peer
+type p2pPeerTip struct {
+	lock   WithMutex
+	height int
+	hash   string
+	time   time.Time
+}
+
+// p2pTipReport is the result of comparing the peers' tips to the local chain
+type p2pTipReport struct {
+	Time       time.Time `json:"time"`
+	Height     int       `json:"height"` // The local height at the time of the check
+	Agree      int       `json:"agree"`
+	Disagree   int       `json:"disagree"`
+	Ahead      int       `json:"ahead"`
+	Desynced   bool      `json:"desynced"`
+	Dissenters []string  `json:"dissenters,omitempty"` // The addresses of the peers which disagree
+}
+
+// Returns the last tip report, or nil if the tips haven't been compared yet
+func (node *Node) p2pGetTipReport() (report *p2pTipReport) {
+	node.p2pTipState.lock.With(func() {
+		report = node.p2pTipState.report
+	})
+	return
+}
+
+// gettip: the peer asks for our chain tip
+func (p2pc *p2pConnection) handleGetTip() error {
+	height, err := p2pc.node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	hash, err := p2pc.node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		return err
+	}
+	p2pc.send(p2pMsgTipStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pc.node.p2pEphemeralID,
+			Root:  p2pc.node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgTip,
+		},
+		Height: height,
+		Hash:   hash,
+	})
+	return nil
+}
+
+// tip: the peer reports its chain tip
+func (p2pc *p2pConnection) handleTip(msg StrIfMap) {
+	height, err := msg.GetInt("height")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	hash, err := msg.GetString("hash")
+	if err != nil {
+		p2pc.malformed(err)
+		return
+	}
+	p2pc.tip.lock.With(func() {
+		p2pc.tip.height = height
+		p2pc.tip.hash = hash
+		p2pc.tip.time = time.Now()
+	})
+}
+
+// Compares the tips received since the last check to the local chain, and asks the peers for
+// their tips again. Called from the coordinator's time tick.
+func (co *p2pCoordinatorType) reconcileTips() {
+	if time.Since(co.lastTipCheck) < p2pTipCheckInterval {
+		return
+	}
+	type peerTip struct {
+		address string
+		height  int
+		hash    string
+	}
+	var tips []peerTip
+	co.node.p2pPeers.lock.With(func() {
+		for p2pc := range co.node.p2pPeers.peers {
+			p2pc.tip.lock.With(func() {
+				if p2pc.tip.time.After(co.lastTipCheck) {
+					tips = append(tips, peerTip{p2pc.address, p2pc.tip.height, p2pc.tip.hash})
+				}
+			})
+		}
+	})
+	if len(tips) > 0 && !co.lastTipCheck.IsZero() {
+		height, err := co.node.dbGetBlockchainHeight()
+		if err != nil {
+			p2pLog.Error("Cannot compare tips:", err)
+			return
+		}
+		report := &p2pTipReport{Time: time.Now(), Height: height}
+		for _, t := range tips {
+			if t.height > report.Height {
+				report.Ahead++
+				continue
+			}
+			myHash, err := co.node.dbGetBlockHashByHeight(t.height)
+			if err != nil {
+				p2pLog.Error("Cannot compare tips:", err)
+				return
+			}
+			if myHash == t.hash {
+				report.Agree++
+			} else {
+				report.Disagree++
+				report.Dissenters = append(report.Dissenters, t.address)
+			}
+		}
+		report.Desynced = report.Disagree > report.Agree
+		co.setTipReport(report)
+	}
+	co.lastTipCheck = time.Now()
+	msg := p2pMsgGetTipStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: co.node.p2pEphemeralID,
+			Root:  co.node.chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetTip,
+		},
+	}
+	co.node.p2pPeers.lock.With(func() {
+		for p2pc := range co.node.p2pPeers.peers {
+			p2pc.send(msg)
+		}
+	})
+}
+
+// Records the tip report, raising or clearing the desync alert
+func (co *p2pCoordinatorType) setTipReport(report *p2pTipReport) {
+	var wasDesynced bool
+	co.node.p2pTipState.lock.With(func() {
+		wasDesynced = co.node.p2pTipState.report != nil && co.node.p2pTipState.report.Desynced
+		co.node.p2pTipState.report = report
+	})
+	fields := StrIfMap{"height": report.Height, "agree": report.Agree, "disagree": report.Disagree, "ahead": report.Ahead,
+		"dissenters": report.Dissenters}
+	if report.Desynced && !wasDesynced {
+		p2pLog.Errorf("Blockchain desynced: %d peers disagree with the local chain at height %d, %d agree: %v",
+			report.Disagree, report.Height, report.Agree, report.Dissenters)
+		co.node.auditLog(auditChainDesync, fields)
+		co.node.nodeEvents.Publish(eventChainDesync, fields)
+	} else if !report.Desynced && wasDesynced {
+		p2pLog.Info("The peers agree with the local chain again")
+		co.node.auditLog(auditChainResynced, fields)
+		co.node.nodeEvents.Publish(eventChainResynced, fields)
+	}
+}
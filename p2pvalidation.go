@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+/*
+ * Block validation. The blocks received from the peers are only downloaded and decoded by
+ * the connection goroutines, and then queued to the coordinator's validation worker, which
+ * hashes, checks and inserts them one at a time. This way, validating a large block doesn't
+ * stop the connection from reading further messages from the peer, and the blocks are
+ * inserted in the order they have been received, instead of racing each other. A connection
+ * waits while the queue is full.
+ */
+
+// The number of received blocks which can wait for validation
+const p2pBlockValidationQueueSize = 16
+
+// p2pBlockValidation is a received block waiting for validation. The worker owns the block
+// file and removes it when done.
+type p2pBlockValidation struct {
+	p2pc          *p2pConnection
+	hash          string
+	fileName      string
+	hashSignature []byte
+	cosignatures  []BlockSignature
+}
+
+// Queues the block for validation, waiting while the queue is full. Returns false, and
+// removes the block file, if the connection is torn down in the meantime.
+func (node *Node) p2pQueueBlockValidation(v *p2pBlockValidation) bool {
+	node.p2pBlockValidations.pending.Add(1)
+	select {
+	case node.p2pBlockValidations.queue <- v:
+		return true
+	case <-v.p2pc.ctx.Done():
+		node.p2pBlockValidations.pending.Done()
+		v.removeFile()
+		return false
+	}
+}
+
+// Waits until the queued blocks have been validated. Used by the replay, which needs the
+// blocks to be in the blockchain before feeding it the next message.
+func (node *Node) p2pWaitBlockValidations() {
+	node.p2pBlockValidations.pending.Wait()
+}
+
+// The validation worker, started by the coordinator
+func (co *p2pCoordinatorType) validateBlocks() {
+	for v := range co.node.p2pBlockValidations.queue {
+		v.validate()
+		atomic.AddInt64(&co.node.p2pBlockValidations.done, 1)
+		co.node.p2pBlockValidations.pending.Done()
+	}
+}
+
+// Removes the block file
+func (v *p2pBlockValidation) removeFile() {
+	if err := os.Remove(v.fileName); err != nil {
+		p2pLog.Warnf("remove: %v", err)
+	}
+}
+
+// Checks the block and accepts it into the blockchain, reporting a veto back to the peer
+func (v *p2pBlockValidation) validate() {
+	defer v.removeFile()
+	// The same block can have been queued by more than one peer
+	exists, err := v.p2pc.node.dbBlockHashExists(v.hash)
+	if err != nil {
+		p2pLog.Error(err)
+		return
+	}
+	if exists {
+		return
+	}
+	blk, err := OpenBlockFile(v.fileName)
+	if err != nil {
+		p2pLog.Error("Error opening block file", v.p2pc.conn, err)
+		return
+	}
+	defer blk.Close()
+	blk.HashSignature = v.hashSignature
+	blk.Cosignatures = v.cosignatures
+	if conflicting, err := v.p2pc.node.equivocationCheckBlock(blk, v.fileName, v.hashSignature); err != nil {
+		p2pLog.Error("Cannot check the block for an equivocation:", err)
+	} else if conflicting {
+		return
+	}
+	err = v.p2pc.node.blockchainAcceptBlock(&blockAcceptanceRequest{blk: blk, fileName: v.fileName, source: v.p2pc.address})
+	if err != nil {
+		p2pLog.Error("Cannot import block:", err)
+		if veto, ok := err.(*BlockVetoError); ok {
+			// Only the consensus violations are the peer's fault: the blocks which don't
+			// extend the local chain, or are refused by the local policy, can be valid
+			if veto.Reason == BlockVetoInvalid {
+				v.p2pc.misbehaved(p2pPenaltyInvalidBlock, "has sent an invalid block")
+			}
+			v.p2pc.send(p2pMsgBlockRejectedStruct{
+				p2pMsgHeader: p2pMsgHeader{
+					P2pID: v.p2pc.node.p2pEphemeralID,
+					Root:  v.p2pc.node.chainParams.GenesisBlockHash,
+					Msg:   p2pMsgBlockRejected,
+				},
+				Hash:    blk.Hash,
+				Stage:   veto.Stage,
+				Reason:  string(veto.Reason),
+				Message: veto.Message,
+			})
+		}
+		return
+	}
+	p2pLog.Info("Accepted block", blk.Hash, "at height", blk.Height)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+ * On-chain chain parameter updates. A governance block carries the new values of some of the
+ * chain params in its _params table, one row per parameter and signatory. Each row's
+ * signature is of the SHA256 hash of "param", the chain's genesis block hash, the parameter
+ * name, its JSON value and the height of the last block which can include the update,
+ * separated by newlines, and the signatures of each parameter need the same weight as the
+ * key ops (see KeyOpThreshold). The signatures can't be used on another chain or after they
+ * expire, and an update which has already been applied can't be included again, so the
+ * signatures of an old update can't be replayed to reverse a later one. The parameters which
+ * can be updated are:
+ *
+ *   key_op_quorum, key_op_weight_threshold, max_block_size, pow_difficulty_bits, pow_target
+ *
+ * The new values apply from the block after the governance block on. The updates accepted so
+ * far are kept in the config table of the main database, and chainParamsAt() returns the
+ * chain params in effect at a height, so that the old blocks are still verified with the
+ * params they were made with. The setparam and signparam commands make the governance blocks,
+ * like addkey and signkeyop do for the key ops.
+ */
+
+const paramsTableCreate = `
+CREATE TABLE _params (
+    name            VARCHAR NOT NULL,
+    value           VARCHAR NOT NULL, -- JSON
+    sigkey_hash     VARCHAR NOT NULL,
+    signature       VARCHAR NOT NULL,
+    expires         INTEGER NOT NULL, -- The last block height which can include the update
+    PRIMARY KEY (name, sigkey_hash)
+);
+`
+
+// The chain params which can be updated by governance blocks
+var chainParamsUpdatable = map[string]bool{
+	"key_op_quorum":           true,
+	"key_op_weight_threshold": true,
+	"max_block_size":          true,
+	"pow_difficulty_bits":     true,
+	"pow_target":              true,
+}
+
+// The number of blocks after which the signatures of a chain param update expire
+const paramUpdateSignatureTTL = 1000
+
+// The config table key of the accepted updates
+const chainParamsUpdatesKey = "chainparams_updates"
+
+// chainParamsUpdate is a chain param update accepted in the block at the given height
+type chainParamsUpdate struct {
+	Height  int    `json:"height"`
+	Name    string `json:"name"`
+	Value   string `json:"value"` // JSON
+	Expires int    `json:"expires"`
+}
+
+// BlockParamOp is a row of a block's _params table
+type BlockParamOp struct {
+	name             string
+	value            string
+	signatureKeyHash string
+	signature        []byte
+	expires          int
+}
+
+// paramSignature is a signature of a chain param update by one signatory, exchanged as a
+// JSON file
+type paramSignature struct {
+	Name          string `json:"name"`
+	Value         string `json:"value"`
+	Expires       int    `json:"expires"`
+	SignerKeyHash string `json:"sigkey_hash"`
+	Signature     string `json:"signature"`
+}
+
+// Returns the hash signed in the chain param updates
+func (node *Node) cryptoChainParamHash(name string, value string, expires int) []byte {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("param\n%s\n%s\n%s\n%d", node.chainParams.GenesisBlockHash, name, value, expires)))
+	return hash[:]
+}
+
+// Returns the height of the block which has applied the same update, with the same
+// signatures, below the given height, or 0
+func (node *Node) chainParamsAppliedUpdate(height int, name string, value string, expires int) int {
+	applied := 0
+	node.chainParamsUpdates.lock.With(func() {
+		for _, u := range node.chainParamsUpdates.updates {
+			if u.Height < height && u.Name == name && u.Value == value && u.Expires == expires {
+				applied = u.Height
+				return
+			}
+		}
+	})
+	return applied
+}
+
+// Sets the chain param to the JSON value
+func (cp *ChainParams) applyUpdate(name string, value string) error {
+	data, err := json.Marshal(map[string]json.RawMessage{name: json.RawMessage(value)})
+	if err != nil {
+		return err
+	}
+	if name == "key_op_quorum" {
+		// Don't decode into the policy shared with the other copies
+		cp.KeyOpQuorum = nil
+	}
+	return json.Unmarshal(data, cp)
+}
+
+// Checks that the chain param can be updated to the JSON value
+func (node *Node) validateChainParamUpdate(name string, value string) error {
+	if !chainParamsUpdatable[name] {
+		return fmt.Errorf("the chain param %s can't be updated", name)
+	}
+	cp := node.chainParams
+	if err := cp.applyUpdate(name, value); err != nil {
+		return fmt.Errorf("invalid value of %s: %v", name, err)
+	}
+	if err := cp.quorumPolicy().validate(); err != nil {
+		return err
+	}
+	if cp.KeyOpWeightThreshold < 0 || cp.KeyOpWeightThreshold > 1 {
+		return fmt.Errorf("key_op_weight_threshold must be between 0 and 1")
+	}
+	if cp.MaxBlockSize < 0 {
+		return fmt.Errorf("max_block_size must not be negative")
+	}
+	if _, err := cp.powTarget(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the chain params in effect for the block at the given height
+func (node *Node) chainParamsAt(height int) *ChainParams {
+	cp := node.chainParams
+	node.chainParamsUpdates.lock.With(func() {
+		for _, u := range node.chainParamsUpdates.updates {
+			if u.Height >= height {
+				break
+			}
+			if err := cp.applyUpdate(u.Name, u.Value); err != nil {
+				chainLog.Error("Cannot apply the update of", u.Name, "from block", u.Height, err)
+			}
+		}
+	})
+	return &cp
+}
+
+// Loads the accepted chain param updates from the main database
+func (node *Node) chainParamsLoadUpdates() error {
+	value, err := node.dbGetConfigValue(chainParamsUpdatesKey)
+	if err != nil || value == "" {
+		return err
+	}
+	var updates []chainParamsUpdate
+	if err = json.Unmarshal([]byte(value), &updates); err != nil {
+		return err
+	}
+	node.chainParamsUpdates.lock.With(func() {
+		node.chainParamsUpdates.updates = updates
+	})
+	return nil
+}
+
+// Keeps the updates from the blocks below the given height, adds the given ones, and saves
+// the list in the main database, or the transaction on it. If the transaction is rolled back,
+// the list must be loaded again with chainParamsLoadUpdates().
+func (node *Node) chainParamsSaveUpdates(db dbQueryer, height int, updates []chainParamsUpdate) error {
+	var all []chainParamsUpdate
+	node.chainParamsUpdates.lock.With(func() {
+		for _, u := range node.chainParamsUpdates.updates {
+			if u.Height < height {
+				all = append(all, u)
+			}
+		}
+		all = append(all, updates...)
+	})
+	_, err := db.Exec("INSERT INTO config(key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value", chainParamsUpdatesKey, jsonifyWhatever(all))
+	if err != nil {
+		return err
+	}
+	node.chainParamsUpdates.lock.With(func() {
+		node.chainParamsUpdates.updates = all
+	})
+	return nil
+}
+
+// Removes the updates from the blocks above the given height, after a rollback
+func (node *Node) chainParamsRollbackUpdates(height int) error {
+	if err := node.chainParamsLoadUpdates(); err != nil {
+		return err
+	}
+	return node.chainParamsSaveUpdates(node.mainDb, height+1, nil)
+}
+
+// Checks the block file against the chain's size limit at the given height
+func (node *Node) checkBlockSize(fileName string, height int) error {
+	maxSize := node.chainParamsAt(height).MaxBlockSize
+	if maxSize == 0 {
+		return nil
+	}
+	st, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if st.Size() > maxSize {
+		return fmt.Errorf("the block is %d bytes, more than the chain's max_block_size of %d", st.Size(), maxSize)
+	}
+	return nil
+}
+
+// Returns the chain param updates in the block, by parameter name
+func (b *Block) dbGetParamOps() (map[string][]BlockParamOp, error) {
+	paramOps := map[string][]BlockParamOp{}
+	if exists, err := dbTableExists(b.db, "_params"); err != nil || !exists {
+		return paramOps, err
+	}
+	rows, err := b.query("SELECT name, value, sigkey_hash, signature, expires FROM _params")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var op BlockParamOp
+		var signatureHex string
+		if err = rows.Scan(&op.name, &op.value, &op.signatureKeyHash, &signatureHex, &op.expires); err != nil {
+			return nil, err
+		}
+		if op.signature, err = hex.DecodeString(signatureHex); err != nil {
+			return nil, err
+		}
+		paramOps[op.name] = append(paramOps[op.name], op)
+	}
+	return paramOps, rows.Err()
+}
+
+// Verifies the chain param updates in the block at the given height. signer returns the
+// public key and the metadata of a signatory, or an error if it can't sign the updates.
+func (node *Node) blockchainVerifyParamOps(height int, paramOps map[string][]BlockParamOp, threshold int, signer func(publicKeyHash string) (*ecdsa.PublicKey, map[string]string, error)) error {
+	if height == 0 && len(paramOps) > 0 {
+		return fmt.Errorf("the genesis block can't update the chain params")
+	}
+	for name, ops := range paramOps {
+		if err := node.validateChainParamUpdate(name, ops[0].value); err != nil {
+			return err
+		}
+		if height > ops[0].expires {
+			return fmt.Errorf("the update of %s has expired at height %d", name, ops[0].expires)
+		}
+		if applied := node.chainParamsAppliedUpdate(height, name, ops[0].value, ops[0].expires); applied != 0 {
+			return fmt.Errorf("the update of %s has already been applied in block %d", name, applied)
+		}
+		weight := 0
+		signers := map[string]bool{}
+		for _, op := range ops {
+			if op.value != ops[0].value || op.expires != ops[0].expires {
+				return fmt.Errorf("the updates of %s have different values or expiry heights", name)
+			}
+			publicKey, metadata, err := signer(op.signatureKeyHash)
+			if err != nil {
+				return fmt.Errorf("update of %s signed by %s: %v", name, op.signatureKeyHash, err)
+			}
+			if !keyCanSignKeyOps(metadata) {
+				return fmt.Errorf("update of %s signed by %s, whose role doesn't allow it", name, op.signatureKeyHash)
+			}
+			if err = cryptoVerifyBytes(publicKey, node.cryptoChainParamHash(name, op.value, op.expires), op.signature); err != nil {
+				return fmt.Errorf("update of %s has an invalid signature by %s: %v", name, op.signatureKeyHash, err)
+			}
+			if !signers[op.signatureKeyHash] {
+				signers[op.signatureKeyHash] = true
+				weight += keyWeight(metadata)
+			}
+		}
+		if weight < threshold {
+			return fmt.Errorf("the update of %s doesn't have quorum: weight %d vs Q=%d", name, weight, threshold)
+		}
+	}
+	return nil
+}
+
+// Records the chain param updates of an accepted block, which must have been verified by
+// checkAcceptBlock(), in the transaction on the main database which inserts the block
+func (node *Node) blockchainApplyParamOps(tx *dbTx, blk *Block, height int) error {
+	paramOps, err := blk.dbGetParamOps()
+	if err != nil || len(paramOps) == 0 {
+		return err
+	}
+	var updates []chainParamsUpdate
+	for name, ops := range paramOps {
+		updates = append(updates, chainParamsUpdate{Height: height, Name: name, Value: ops[0].value, Expires: ops[0].expires})
+		chainLog.Info("Block", blk.Hash, "updates the chain param", name, "to", ops[0].value)
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Name < updates[j].Name })
+	return node.chainParamsSaveUpdates(tx, height, updates)
+}
+
+// Signs a chain param update with one of my keys, selected with -key, and prints the
+// signature as JSON for the signatory running setparam. The signature expires
+// paramUpdateSignatureTTL blocks after the current height.
+func (node *Node) actionSignParam(name string, value string) {
+	if err := node.validateChainParamUpdate(name, value); err != nil {
+		log.Fatalln(err)
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	expires := height + paramUpdateSignatureTTL
+	keypair, signerKeyHash, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	signature, err := cryptoSignBytes(keypair, node.cryptoChainParamHash(name, value, expires))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(jsonifyWhatever(paramSignature{Name: name, Value: value, Expires: expires, SignerKeyHash: signerKeyHash, Signature: hex.EncodeToString(signature)}))
+}
+
+// Creates, signs and imports a governance block updating the chain param, signed by my keys
+// and the co-signatures from signparam. My signatures expire with the co-signatures, or
+// paramUpdateSignatureTTL blocks after the current height if there are none.
+func (node *Node) actionSetParam(name string, value string, cosignatureFiles []string) {
+	if err := node.validateChainParamUpdate(name, value); err != nil {
+		log.Fatalln(err)
+	}
+	chainHeight, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	height := chainHeight + 1
+	totalWeight, err := node.dbGetKeyOpWeight(height)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	threshold := node.KeyOpThreshold(height, totalWeight)
+	signatures := map[string][]byte{}
+	weight := 0
+
+	cosignatures := make([]paramSignature, len(cosignatureFiles))
+	for i, fn := range cosignatureFiles {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err = json.Unmarshal(data, &cosignatures[i]); err != nil {
+			log.Fatalln("Cannot parse", fn, err)
+		}
+	}
+	expires := chainHeight + paramUpdateSignatureTTL
+	if len(cosignatures) > 0 {
+		expires = cosignatures[0].Expires
+	}
+	if height > expires {
+		log.Fatalln("The signatures of the update have expired at height", expires)
+	}
+	hash := node.cryptoChainParamHash(name, value, expires)
+
+	// My keys which are valid signatories
+	myKeyHashes, err := node.dbGetMyPublicKeyHashes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, myKeyHash := range myKeyHashes {
+		if weight >= threshold {
+			break
+		}
+		dbpk, err := node.dbGetPublicKey(myKeyHash)
+		if err != nil || dbpk.isRevoked || !keyCanSignKeyOps(dbpk.metadata) || keyCheckActive(dbpk.addBlockHeight, dbpk.metadata, height) != nil {
+			continue
+		}
+		keypair, err := node.cryptoGetPrivateKey(myKeyHash)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if signatures[myKeyHash], err = cryptoSignBytes(keypair, hash); err != nil {
+			log.Fatalln(err)
+		}
+		weight += keyWeight(dbpk.metadata)
+	}
+
+	// Co-signatures by other signatories
+	for i, fn := range cosignatureFiles {
+		if weight >= threshold {
+			break
+		}
+		ps := cosignatures[i]
+		if ps.Name != name || ps.Value != value || ps.Expires != expires {
+			log.Fatalln(fn, "is a signature for a different update:", ps.Name, ps.Value, "expiring at", ps.Expires)
+		}
+		if _, ok := signatures[ps.SignerKeyHash]; ok {
+			continue
+		}
+		signer, err := node.dbGetPublicKey(ps.SignerKeyHash)
+		if err != nil || signer.isRevoked || !keyCanSignKeyOps(signer.metadata) || keyCheckActive(signer.addBlockHeight, signer.metadata, height) != nil {
+			log.Fatalln(fn, "is not signed by a valid signatory which can sign the update:", ps.SignerKeyHash)
+		}
+		signerKey, err := cryptoDecodePublicKeyBytes(signer.publicKeyBytes)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		signature, err := hex.DecodeString(ps.Signature)
+		if err != nil {
+			log.Fatalln(fn, err)
+		}
+		if err = cryptoVerifyBytes(signerKey, hash, signature); err != nil {
+			log.Fatalln(fn, "has an invalid signature:", err)
+		}
+		signatures[ps.SignerKeyHash] = signature
+		weight += keyWeight(signer.metadata)
+	}
+
+	if weight < threshold {
+		log.Fatalf("The update needs signatures with the weight of %d, only %d is available. Other signatories can sign it with: daisy signparam %s '%s' > signature.json",
+			threshold, weight, name, value)
+	}
+
+	fn := fmt.Sprintf("%s/params-%d.db", node.cfg.DataDir, time.Now().Unix())
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dbEnsureBlockchainTables(db)
+	if _, err = db.Exec(paramsTableCreate); err != nil {
+		log.Fatalln(err)
+	}
+	for signerKeyHash, signature := range signatures {
+		_, err = db.Exec("INSERT INTO _params(name, value, sigkey_hash, signature, expires) VALUES (?, ?, ?, ?, ?)",
+			name, value, signerKeyHash, hex.EncodeToString(signature), expires)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		log.Fatalln(err)
+	}
+
+	sigs := node.blockSignFile(fn)
+	if q := node.SignatureQuorumForHeight(height); q > 1 {
+		if err = sigs.write(fn); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("The governance block needs", q-1, "more signatures: use cosignblock on", fn, "and then importblock")
+		return
+	}
+	node.blockImportFile(fn, sigs)
+	if err = os.Remove(fn); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// p2pPeerInfo describes a live p2p connection, for the peers command and the /peers URL
+type p2pPeerInfo struct {
+	Address       string   `json:"address"`
+	PeerID        string   `json:"peer_id"`
+	Version       string   `json:"version"`
+	Network       string   `json:"network"`
+	ChainHeight   int      `json:"chain_height"`
+	IsConnectable bool     `json:"connectable"`
+	Mining        bool     `json:"mining"`       // Accepts mining work
+	Capabilities  []string `json:"capabilities"` // See p2pcaps.go
+	Score         int      `json:"score"`        // See p2pscore.go
+	BytesIn       uint64   `json:"bytes_in"`
+	BytesOut      uint64   `json:"bytes_out"`
+	MsgsIn        uint64   `json:"msgs_in"`
+	MsgsOut       uint64   `json:"msgs_out"`
+	ConnectedTime int64    `json:"connected_time"` // Unix timestamp
+}
+
+// Returns information about all the live connections, sorted by address
+func (p *p2pPeersSet) Info() []p2pPeerInfo {
+	result := []p2pPeerInfo{}
+	p.lock.With(func() {
+		for peer := range p.peers {
+			result = append(result, p2pPeerInfo{
+				Address:       peer.address,
+				PeerID:        fmt.Sprintf("%x", peer.peerID),
+				Network:       peer.network,
+				Version:       peer.version,
+				ChainHeight:   peer.chainHeight,
+				IsConnectable: peer.isConnectable,
+				Mining:        peer.mining,
+				Capabilities:  peer.capabilities,
+				Score:         int(peer.score.score()),
+				BytesIn:       atomic.LoadUint64(&peer.bytesIn),
+				BytesOut:      atomic.LoadUint64(&peer.bytesOut),
+				MsgsIn:        atomic.LoadUint64(&peer.msgsIn),
+				MsgsOut:       atomic.LoadUint64(&peer.msgsOut),
+				ConnectedTime: peer.connectedTime.Unix(),
+			})
+		}
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Address < result[j].Address })
+	return result
+}
+
+// Checks if the HTTP request comes from the local host, for URLs which are only available
+// to the node's operator.
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Sends the list of live connections as JSON. Only available to local clients.
+func (node *Node) blockWebSendPeers(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(jsonifyWhateverToBytes(node.p2pPeers.Info())); err != nil {
+		log.Println(err)
+	}
+}
+
+// savedPeerInfo describes a saved peer, for the peers command
+type savedPeerInfo struct {
+	Address     string     `json:"address"`
+	LastSeen    time.Time  `json:"last_seen"`
+	Permanent   bool       `json:"permanent"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	FailCount   int        `json:"fail_count"`
+	LatencyMs   int64      `json:"latency_ms,omitempty"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+}
+
+// Returns a pointer to t, or nil if it's the zero time
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Returns the saved peers
+func (node *Node) getSavedPeerInfo() ([]savedPeerInfo, error) {
+	records, err := node.dbGetSavedPeerRecords()
+	if err != nil {
+		return nil, err
+	}
+	result := []savedPeerInfo{}
+	for _, p := range records {
+		result = append(result, savedPeerInfo{
+			Address:     p.address,
+			LastSeen:    p.timeAdded,
+			Permanent:   p.permanent,
+			LastSuccess: timeOrNil(p.lastSuccess),
+			LastFailure: timeOrNil(p.lastFailure),
+			FailCount:   p.failCount,
+			LatencyMs:   p.latency.Milliseconds(),
+			BannedUntil: timeOrNil(p.bannedUntil),
+		})
+	}
+	return result, nil
+}
+
+// Lists the peers connected to the running node, and the saved peers which aren't connected.
+// The peers are fetched from the running node over the control socket; if it isn't running,
+// the saved peers are read from the database.
+func (node *Node) actionPeersList() {
+	var live []p2pPeerInfo
+	var saved []savedPeerInfo
+	err := node.controlRequest(http.MethodGet, "/peers", &live)
+	if err == nil {
+		err = node.controlRequest(http.MethodGet, "/peers/saved", &saved)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	connected := map[string]bool{}
+	if err != nil {
+		fmt.Println("Cannot get the connected peers from the running node:", err)
+		node.dbInit()
+		if saved, err = node.getSavedPeerInfo(); err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		fmt.Fprintln(w, "ADDRESS\tPEER ID\tVERSION\tHEIGHT\tCONNECTABLE\tSCORE\tIN\tOUT\tAGE")
+		for _, p := range live {
+			connected[p.Address] = true
+			age := time.Since(time.Unix(p.ConnectedTime, 0)).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%v\t%d\t%s / %d msgs\t%s / %d msgs\t%s\n", p.Address, p.PeerID, p.Version, p.ChainHeight,
+				p.IsConnectable, p.Score, formatByteSize(int64(p.BytesIn)), p.MsgsIn, formatByteSize(int64(p.BytesOut)), p.MsgsOut, age)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+
+	fmt.Fprintln(w, "SAVED PEER\tLAST SEEN\tPERMANENT\tFAILURES\tLATENCY\tBANNED UNTIL")
+	for _, p := range saved {
+		if connected[p.Address] {
+			continue
+		}
+		latency, banned := "-", "-"
+		if p.LatencyMs > 0 {
+			latency = fmt.Sprintf("%d ms", p.LatencyMs)
+		}
+		if p.BannedUntil != nil && p.BannedUntil.After(time.Now()) {
+			banned = p.BannedUntil.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%d\t%s\t%s\n", p.Address, p.LastSeen.Format(time.RFC3339), p.Permanent, p.FailCount, latency, banned)
+	}
+	w.Flush()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+/*
+ * A peers snapshot is a JSON file listing known-good peer addresses, signed by one of the
+ * node's keys. It's used to seed the peers table of nodes which can't reach the bootstrap
+ * peers, e.g. in restricted networks. The snapshot is only imported if it's signed by a
+ * valid key of the same blockchain.
+ */
+
+const peersSnapshotVersion = 1
+
+// peersSnapshotPeer is one peer in the snapshot
+type peersSnapshotPeer struct {
+	Address   string `json:"address"`
+	LastSeen  string `json:"last_seen"` // RFC3339
+	Permanent bool   `json:"permanent,omitempty"`
+}
+
+// peersSnapshot is the content of a peers snapshot file
+type peersSnapshot struct {
+	Version       int                 `json:"version"`
+	GenesisHash   string              `json:"genesis_hash"`
+	Created       string              `json:"created"` // RFC3339
+	PublicKeyHash string              `json:"pubkey_hash"`
+	Peers         []peersSnapshotPeer `json:"peers"`
+	Signature     string              `json:"signature,omitempty"`
+}
+
+// Returns the hash of the snapshot content, excluding the signature
+func (ps *peersSnapshot) hash() []byte {
+	unsigned := *ps
+	unsigned.Signature = ""
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		log.Panicln(err)
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// Writes the saved peers into a signed snapshot file
+func (node *Node) actionPeersExport(fileName string) {
+	keys, publicKeyHash, err := node.cryptoGetSigningKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ps := peersSnapshot{
+		Version:       peersSnapshotVersion,
+		GenesisHash:   node.chainParams.GenesisBlockHash,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		PublicKeyHash: publicKeyHash,
+		Peers:         []peersSnapshotPeer{},
+	}
+	records, err := node.dbGetSavedPeerRecords()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, p := range records {
+		ps.Peers = append(ps.Peers, peersSnapshotPeer{Address: p.address, LastSeen: p.timeAdded.Format(time.RFC3339), Permanent: p.permanent})
+	}
+	signature, err := cryptoSignBytes(keys, ps.hash())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ps.Signature = hex.EncodeToString(signature)
+	data, err := json.MarshalIndent(ps, "", "\t")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = ioutil.WriteFile(fileName, append(data, '\n'), 0644); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Exported", len(ps.Peers), "peers to", fileName, "signed by", publicKeyHash)
+}
+
+// Verifies a signed snapshot file and adds its peers to the peers table
+func (node *Node) actionPeersImport(fileName string) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var ps peersSnapshot
+	if err = json.Unmarshal(data, &ps); err != nil {
+		log.Fatalln("Cannot parse peers snapshot:", err)
+	}
+	if err = ps.verify(node); err != nil {
+		log.Fatalln("Invalid peers snapshot:", err)
+	}
+	n := 0
+	for _, sp := range ps.Peers {
+		if _, _, err = splitAddress(sp.Address); err != nil {
+			log.Println("Skipping invalid peer address", sp.Address, err)
+			continue
+		}
+		lastSeen, err := time.Parse(time.RFC3339, sp.LastSeen)
+		if err != nil {
+			log.Println("Skipping peer", sp.Address, "with invalid time:", err)
+			continue
+		}
+		if err = node.dbSavePeerRecord(dbPeer{address: sp.Address, timeAdded: lastSeen, permanent: sp.Permanent}); err != nil {
+			log.Fatalln(err)
+		}
+		n++
+	}
+	log.Println("Imported", n, "peers from a snapshot created at", ps.Created, "by", ps.PublicKeyHash)
+}
+
+// Checks that the snapshot belongs to this blockchain and is signed by a valid key
+func (ps *peersSnapshot) verify(node *Node) error {
+	if ps.Version != peersSnapshotVersion {
+		return fmt.Errorf("unsupported version %d", ps.Version)
+	}
+	if ps.GenesisHash != node.chainParams.GenesisBlockHash {
+		return fmt.Errorf("the snapshot is for a different blockchain: %s", ps.GenesisHash)
+	}
+	dbpk, err := node.dbGetPublicKey(ps.PublicKeyHash)
+	if err != nil {
+		return fmt.Errorf("unknown signing key %s", ps.PublicKeyHash)
+	}
+	if dbpk.isRevoked {
+		return fmt.Errorf("the signing key %s is revoked", ps.PublicKeyHash)
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(ps.Signature)
+	if err != nil {
+		return fmt.Errorf("cannot decode the signature: %v", err)
+	}
+	return cryptoVerifyBytes(publicKey, ps.hash(), signature)
+}
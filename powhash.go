@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/sha3"
+)
+
+/*
+ * The hash function of the proof of work, selected by pow_hash in chainparams.json. With
+ * "sha256" (the default), the PoW hash is the block hash itself. With "sha3-256", it's the
+ * SHA3-256 hash of the block file. With "argon2id", it's the memory-hard Argon2id hash of the
+ * block's SHA256 hash, with the genesis block hash as the salt and the pow_argon2_time,
+ * pow_argon2_memory (in KiB) and pow_argon2_threads parameters, so that each nonce tried
+ * needs its own Argon2id computation, which is expensive to do on ASICs.
+ *
+ * The blocks of PoW chains record the function in the PoWHash _meta key, and blocks which
+ * record a different function than the chain's are rejected. Blocks without the key are only
+ * accepted on chains using SHA256, which have existed before the key.
+ */
+
+const (
+	powHashSHA256   = "sha256"
+	powHashSHA3     = "sha3-256"
+	powHashArgon2id = "argon2id"
+)
+
+// The defaults of the Argon2id parameters
+const (
+	powArgon2DefaultTime    = 1
+	powArgon2DefaultMemory  = 64 * 1024 // KiB
+	powArgon2DefaultThreads = 1
+)
+
+// A PoW hash function, hashing a whole block file
+type powHashFunc func(data []byte) [32]byte
+
+// Returns the name of the chain's PoW hash function
+func (cp *ChainParams) powHashName() string {
+	if cp.PoWHash == "" {
+		return powHashSHA256
+	}
+	return cp.PoWHash
+}
+
+// Returns the chain's PoW hash function
+func (cp *ChainParams) powHashFunc() (powHashFunc, error) {
+	switch cp.powHashName() {
+	case powHashSHA256:
+		return sha256.Sum256, nil
+	case powHashSHA3:
+		return sha3.Sum256, nil
+	case powHashArgon2id:
+		t, memory, threads := cp.PoWArgon2Time, cp.PoWArgon2Memory, cp.PoWArgon2Threads
+		if t == 0 {
+			t = powArgon2DefaultTime
+		}
+		if memory == 0 {
+			memory = powArgon2DefaultMemory
+		}
+		if threads == 0 {
+			threads = powArgon2DefaultThreads
+		}
+		salt := []byte(cp.GenesisBlockHash)
+		return func(data []byte) (result [32]byte) {
+			blockHash := sha256.Sum256(data)
+			copy(result[:], argon2.IDKey(blockHash[:], salt, t, memory, threads, 32))
+			return
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown pow_hash %q, expecting %s, %s or %s", cp.PoWHash, powHashSHA256, powHashSHA3, powHashArgon2id)
+}
+
+// Returns the PoW hash of a block file, with the chain's hash function
+func (node *Node) powHashFile(fileName string) ([]byte, error) {
+	hashFunc, err := node.chainParams.powHashFunc()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashFunc(data)
+	return hash[:], nil
+}
+
+// Checks that the PoW hash function recorded in a block is the chain's
+func (node *Node) powCheckHashName(name string) error {
+	if name == "" {
+		if node.chainParams.powHashName() != powHashSHA256 {
+			return fmt.Errorf("the block doesn't record its PoW hash function, expecting %s", node.chainParams.powHashName())
+		}
+		return nil
+	}
+	if name != node.chainParams.powHashName() {
+		return fmt.Errorf("the block's PoW hash function is %s instead of the chain's %s", name, node.chainParams.powHashName())
+	}
+	return nil
+}
+
+// Returns the PoW hash function recorded in the block, or an empty string if there is none
+func (b *Block) dbGetPoWHashName() (string, error) {
+	name, err := b.dbGetMetaString("PoWHash")
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+/*
+ * When blocks are handed off over HTTP, the peer is given a URL on this node's HTTP server.
+ * The host in the URL is the configured public address, or with HTTPS the name the server's
+ * certificate is for, so the peers can verify it, or the address peers report seeing this node
+ * connect from (in the hello message), or finally a local interface address.
+ */
+
+// Records the address a peer reports seeing this node at, if it's a public address. Each peer
+// is counted once per address, by its IP address, or by its p2p ID if it's connected through a
+// relay, so a peer reconnecting over and over can't outvote the others.
+func (node *Node) p2pRecordObservedAddress(address string, p2pc *p2pConnection) {
+	ip := net.ParseIP(address)
+	if ip == nil || !isPublicIP(ip) {
+		return
+	}
+	reporter := fmt.Sprintf("%x", p2pc.peerID)
+	if peerIP := p2pc.remoteIP(); peerIP != nil {
+		reporter = peerIP.String()
+	}
+	node.p2pObservedAddresses.lock.With(func() {
+		reporters := node.p2pObservedAddresses.reporters[ip.String()]
+		if reporters == nil {
+			reporters = map[string]bool{}
+			node.p2pObservedAddresses.reporters[ip.String()] = reporters
+		}
+		reporters[reporter] = true
+	})
+}
+
+// Returns the public address reported by the most peers, or "" if none
+func (node *Node) p2pMostObservedAddress() (address string) {
+	node.p2pObservedAddresses.lock.With(func() {
+		best := 0
+		for a, reporters := range node.p2pObservedAddresses.reporters {
+			if n := len(reporters); n > best || n == best && a < address {
+				address, best = a, n
+			}
+		}
+	})
+	return
+}
+
+// Checks if the IP address is routable on the Internet
+func isPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsLoopback() {
+		return false
+	}
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the host and port this node's HTTP server is reachable at by peers
+func (node *Node) getAdvertisedHTTPAddress() string {
+	if node.cfg.PublicAddress != "" {
+		if _, _, err := net.SplitHostPort(node.cfg.PublicAddress); err == nil {
+			return node.cfg.PublicAddress
+		}
+		return net.JoinHostPort(node.cfg.PublicAddress, fmt.Sprint(node.httpListenPort()))
+	}
+	if host := node.blockWebTLSHost(); host != "" {
+		return net.JoinHostPort(host, fmt.Sprint(node.httpListenPort()))
+	}
+	host := node.p2pMostObservedAddress()
+	if host == "" {
+		if local := getLocalAddresses(); len(local) > 0 {
+			host = local[0]
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, fmt.Sprint(node.httpListenPort()))
+}
+
+// Returns the host name the HTTPS server has its certificate for: the first ACME domain, or the
+// first name in the certificate file which isn't a wildcard. Returns "" without TLS, or if
+// there's no such name.
+func (node *Node) blockWebTLSHost() string {
+	if len(node.cfg.HTTPACMEDomains) > 0 {
+		return node.cfg.HTTPACMEDomains[0]
+	}
+	if node.cfg.HTTPTLSCertFile == "" {
+		return ""
+	}
+	cert, err := tls.LoadX509KeyPair(node.cfg.HTTPTLSCertFile, node.cfg.HTTPTLSKeyFile)
+	if err != nil {
+		return ""
+	}
+	leaf, err := configParseLeaf(cert)
+	if err != nil {
+		return ""
+	}
+	for _, name := range leaf.DNSNames {
+		if !strings.HasPrefix(name, "*") {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the URL peers can download the block at the given height from
+func (node *Node) blockHandOffURL(height int) string {
+	scheme := "http"
+	if node.blockWebTLSEnabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/block/%d", scheme, node.getAdvertisedHTTPAddress(), height)
+}
+
+// Returns the IP address of the peer's end of the connection, or nil for the peers connected
+// through relays, whose addresses are the relays'
+func (p2pc *p2pConnection) remoteIP() net.IP {
+	if p2pc.relayed() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(p2pc.conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Checks that a block hand-off URL points to the peer which has sent it, so that peers can't
+// make this node download from arbitrary hosts.
+func (p2pc *p2pConnection) validateBlockURL(blockURL string) error {
+	u, err := url.Parse(blockURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %s", u.Scheme)
+	}
+	// The older nodes don't list their capabilities, see p2pcaps.go
+	if len(p2pc.capabilities) > 0 && !p2pc.hasCapability(p2pCapServesHTTP) {
+		return fmt.Errorf("the peer hasn't said it serves the blocks over HTTP")
+	}
+	peerIP := p2pc.remoteIP()
+	if peerIP == nil {
+		return fmt.Errorf("cannot find the peer's address")
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if ip.Equal(peerIP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the URL host %s doesn't match the peer's address %s", u.Hostname(), peerIP)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// The maximum number of blocks a query over HTTP can combine
+const queryAPIMaxBlocks = 1000
+
+// The content types of the query output formats
+var queryContentTypes = map[string]string{
+	"jsonl": "application/x-ndjson",
+	"csv":   "text/csv",
+	"table": "text/plain",
+}
+
+// queryFlushWriter flushes the HTTP response after every write, so the results are streamed
+type queryFlushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw queryFlushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// Handles POST /api/query: runs a read-only query with bound parameters over a range of blocks,
+// and streams the results, by default as JSON lines. The request is a JSON object:
+//
+//	{"sql": "SELECT * FROM t WHERE a = ?", "params": [42], "from": 1, "to": 100, "limit": 10}
+//
+// Queries can use a lot of a node's resources, so they're only served to the authenticated
+// clients (see blockWebAuth), and refused if the HTTP server doesn't require authentication.
+func (node *Node) blockWebQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !node.blockWebAuthRequired() {
+		http.Error(w, "Queries need http_auth_token or http_auth_user to be configured", http.StatusForbidden)
+		return
+	}
+	var qr queryRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.UseNumber()
+	if err := dec.Decode(&qr); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot parse the query request: %v", err), http.StatusBadRequest)
+		return
+	}
+	for i, p := range qr.Params {
+		qr.Params[i] = blockCreateJSONValue(p)
+	}
+	if err := qr.normalize(node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if qr.To-qr.From+1 > queryAPIMaxBlocks {
+		http.Error(w, fmt.Sprintf("The query can combine at most %d blocks, use from and to to select them", queryAPIMaxBlocks), http.StatusBadRequest)
+		return
+	}
+	log.Println("HTTP query from", r.RemoteAddr, "over blocks", qr.From, "to", qr.To)
+	// The query is also cancelled if the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), qr.timeout(node))
+	defer cancel()
+	qdb, rows, err := qr.run(node, ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer qdb.Close()
+	defer rows.Close()
+	w.Header().Set("Content-Type", queryContentTypes[qr.Format])
+	if err = node.writeQueryRows(queryFlushWriter{w}, rows, qr.Format, qr.Limit); err != nil {
+		// The status has already been sent, the error can only be reported in the output
+		log.Println("HTTP query:", err)
+		fmt.Fprintln(w, jsonifyWhatever(StrIfMap{"error": err.Error()}))
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// The output formats of the query command
+var queryOutputFormats = []string{"jsonl", "csv", "table"}
+
+// The formats of the -output files, by the file name extension
+var queryOutputFileFormats = map[string]string{
+	".db":      "db",
+	".sqlite":  "db",
+	".sqlite3": "db",
+	".csv":     "csv",
+	".jsonl":   "jsonl",
+	".ndjson":  "jsonl",
+}
+
+// The name of the table with the results in a .db -output file
+const queryOutputTable = "results"
+
+// Converts a value scanned from SQLite into a value suitable for output: SQLite drivers
+// return TEXT as []byte.
+func queryValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// Converts a value scanned from SQLite into a string, for the text output formats.
+// NULL becomes an empty string.
+func queryValueString(v interface{}) string {
+	switch v := queryValue(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// The size of the buffer the rows are written through
+const queryOutputBufferSize = 32 * 1024
+
+// The table format is aligned in chunks of this many rows, so it doesn't keep all of them
+const queryTableChunkRows = 1000
+
+// queryLimitWriter fails the writes after the limit of bytes has been written
+type queryLimitWriter struct {
+	w         io.Writer
+	remaining int64
+	node      *Node
+}
+
+func (lw *queryLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, fmt.Errorf("the result is larger than %d MB, the maximum set by query_max_result_size", lw.node.queryMaxResultSize()>>20)
+	}
+	lw.remaining -= int64(len(p))
+	return lw.w.Write(p)
+}
+
+// Writes at most limit rows (or all of them if limit <= 0) in the given format, as they are read,
+// so the memory used doesn't depend on the size of the result. The output is cut off at
+// query_max_rows or query_max_result_size, with an error if there are more rows.
+func (node *Node) writeQueryRows(w io.Writer, rows *sql.Rows, format string, limit int) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	maxRows := node.queryMaxRows()
+	capped := limit <= 0 || limit > maxRows
+	if capped {
+		limit = maxRows
+	}
+	bw := bufio.NewWriterSize(&queryLimitWriter{node: node, w: w, remaining: node.queryMaxResultSize()}, queryOutputBufferSize)
+	var csvw *csv.Writer
+	var tabw *tabwriter.Writer
+	// The JSON object keys are encoded once, as `{"col1":` and `,"col2":`
+	var jsonKeys [][]byte
+	switch format {
+	case "jsonl":
+		for i, col := range cols {
+			key := []byte{','}
+			if i == 0 {
+				key[0] = '{'
+			}
+			key = append(appendQueryJSONString(key, col), ':')
+			jsonKeys = append(jsonKeys, key)
+		}
+	case "csv":
+		csvw = csv.NewWriter(bw)
+		if err = csvw.Write(cols); err != nil {
+			return err
+		}
+	case "table":
+		tabw = tabwriter.NewWriter(bw, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tabw, strings.Join(cols, "\t"))
+	default:
+		return fmt.Errorf("unknown output format %s, must be one of: %s", format, strings.Join(queryOutputFormats, ", "))
+	}
+
+	values := make([]interface{}, len(cols))
+	valuePointers := make([]interface{}, len(cols))
+	for i := range values {
+		valuePointers[i] = &values[i]
+	}
+	record := make([]string, len(cols))
+	// Tabs and newlines would break the table layout
+	tableReplacer := strings.NewReplacer("\t", " ", "\n", " ")
+	var line []byte
+	n := 0
+	for ; n < limit && rows.Next(); n++ {
+		if err = rows.Scan(valuePointers...); err != nil {
+			return err
+		}
+		switch format {
+		case "jsonl":
+			line = line[:0]
+			for i, key := range jsonKeys {
+				line = appendQueryJSONValue(append(line, key...), values[i])
+			}
+			if len(cols) == 0 {
+				line = append(line, '{')
+			}
+			line = append(line, '}', '\n')
+			if _, err = bw.Write(line); err != nil {
+				return err
+			}
+		case "csv":
+			for i := range values {
+				record[i] = queryValueString(values[i])
+			}
+			if err = csvw.Write(record); err != nil {
+				return err
+			}
+		case "table":
+			for i := range values {
+				record[i] = tableReplacer.Replace(queryValueString(values[i]))
+			}
+			fmt.Fprintln(tabw, strings.Join(record, "\t"))
+			if (n+1)%queryTableChunkRows == 0 {
+				if err = tabw.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if csvw != nil {
+		csvw.Flush()
+		if err = csvw.Error(); err != nil {
+			return err
+		}
+	}
+	if tabw != nil {
+		if err = tabw.Flush(); err != nil {
+			return err
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if capped && n == maxRows && rows.Next() {
+		return fmt.Errorf("the result is cut off at %d rows, the maximum set by query_max_rows", maxRows)
+	}
+	return nil
+}
+
+// Appends the JSON encoding of a value scanned from SQLite
+func appendQueryJSONValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return append(buf, "null"...)
+		}
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case []byte:
+		return appendQueryJSONString(buf, string(v))
+	case string:
+		return appendQueryJSONString(buf, v)
+	case time.Time:
+		return appendQueryJSONString(buf, v.Format(time.RFC3339Nano))
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return appendQueryJSONString(buf, fmt.Sprint(v))
+		}
+		return append(buf, b...)
+	}
+}
+
+// Appends a JSON string, escaped like encoding/json does
+func appendQueryJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				buf = append(buf, '\\', c)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(append(buf, s[start:i]...), "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(append(buf, s[start:i]...), '\\', 'u', '2', '0', '2', hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	return append(append(buf, s[start:]...), '"')
+}
+
+// Checks the -output file name, before running the query. The SQLite databases must be new.
+func checkQueryOutputFile(fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	format, ok := queryOutputFileFormats[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		return fmt.Errorf("The output file %s must be a .db, .csv or .jsonl file", fileName)
+	}
+	if format == "db" {
+		if _, err := os.Stat(fileName); err == nil {
+			return fmt.Errorf("The output database %s already exists", fileName)
+		}
+	}
+	return nil
+}
+
+// Writes the query results to stdout, or to the file, in the format given by its extension. The
+// results are written to a temporary file first, which replaces the file when they're complete.
+func (node *Node) writeQueryOutput(fileName string, rows *sql.Rows, format string, limit int) error {
+	if fileName == "" {
+		return node.writeQueryRows(os.Stdout, rows, format, limit)
+	}
+	if err := checkQueryOutputFile(fileName); err != nil {
+		return err
+	}
+	format = queryOutputFileFormats[strings.ToLower(filepath.Ext(fileName))]
+	f, err := ioutil.TempFile(filepath.Dir(fileName), "daisy-output-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if format == "db" {
+		f.Close()
+		err = node.writeQueryRowsToDb(f.Name(), rows, limit)
+	} else {
+		err = node.writeQueryRows(f, rows, format, limit)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
+
+// Returns the size of a value in the results database, counting the numbers as 8 bytes
+func queryValueSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case []byte:
+		return int64(len(v))
+	case string:
+		return int64(len(v))
+	default:
+		return 8
+	}
+}
+
+// Writes at most limit rows (or all of them if limit <= 0) into the results table of a new
+// SQLite database. The output is cut off at query_max_rows or query_max_result_size, with an
+// error if there are more rows. The columns with the same name, e.g. from a join, are renamed
+// like SQLite does it for CREATE TABLE ... AS SELECT, to id, id:1 and so on.
+func (node *Node) writeQueryRowsToDb(fileName string, rows *sql.Rows, limit int) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	maxRows := node.queryMaxRows()
+	capped := limit <= 0 || limit > maxRows
+	if capped {
+		limit = maxRows
+	}
+	db, err := dbOpen(fileName, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	defs := make([]string, len(cols))
+	quoted := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	blobs := make([]bool, len(cols))
+	used := map[string]bool{}
+	for i, c := range cols {
+		// SQLite's column names are case-insensitive
+		name := c
+		for n := 1; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s:%d", c, n)
+		}
+		used[strings.ToLower(name)] = true
+		quoted[i] = dbQuoteIdentifier(name)
+		// The columns of expressions have no declared type
+		defs[i] = strings.TrimSpace(quoted[i] + " " + colTypes[i].DatabaseTypeName())
+		placeholders[i] = "?"
+		blobs[i] = strings.EqualFold(colTypes[i].DatabaseTypeName(), "BLOB")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", queryOutputTable, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", queryOutputTable, strings.Join(quoted, ", "), strings.Join(placeholders, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	values := make([]interface{}, len(cols))
+	valuePointers := make([]interface{}, len(cols))
+	for i := range values {
+		valuePointers[i] = &values[i]
+	}
+	remaining := node.queryMaxResultSize()
+	n := 0
+	for ; n < limit && rows.Next(); n++ {
+		if err = rows.Scan(valuePointers...); err != nil {
+			return err
+		}
+		for i := range values {
+			if !blobs[i] {
+				values[i] = queryValue(values[i])
+			}
+			remaining -= queryValueSize(values[i])
+		}
+		if remaining < 0 {
+			return fmt.Errorf("the result is larger than %d MB, the maximum set by query_max_result_size", node.queryMaxResultSize()>>20)
+		}
+		if _, err = stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if capped && n == maxRows && rows.Next() {
+		return fmt.Errorf("the result is cut off at %d rows, the maximum set by query_max_rows", maxRows)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * The sandbox of the queries over the blockchain, from the query command and POST /api/query.
+ * The combined database is a scratch copy of the blocks, but the queries mustn't be able to do
+ * anything except read it: a query must be a single statement of at most queryMaxSQLLength
+ * bytes, and it runs on a connection with PRAGMA query_only and an SQLite authorizer which
+ * only allows reading tables and calling functions (see dbSetQueryAuthorizer() in the driver
+ * files), so writes, DDL, ATTACH, PRAGMA and transactions are rejected when the statement is
+ * prepared.
+ *
+ * The resources a query can use are limited too, from the CLI and HTTP alike: it's cancelled
+ * after query_block_timeout seconds per block it combines, or query_timeout seconds in total,
+ * by cancelling its context, which go-sqlite3 turns into sqlite3_interrupt() (it doesn't expose
+ * the progress handlers, but the interrupt is checked at the same points of the execution). Its
+ * connection's page cache is limited to query_max_memory MB, with the temporary tables and
+ * sorts spilled to files, and no string or blob it makes can be larger than that. The results
+ * are cut off at query_max_rows rows or query_max_result_size MB of output.
+ */
+
+// The maximum length of a query's SQL
+const queryMaxSQLLength = 64 * 1024
+
+// The maximum number of rows returned by a query, if query_max_rows isn't configured
+const queryDefaultMaxRows = 100000
+
+// The time a query can take per block it combines, if query_block_timeout isn't configured
+const queryDefaultBlockTimeout = 10 * time.Second
+
+// The time a query can take in total, if query_timeout isn't configured
+const queryDefaultTimeout = 10 * time.Minute
+
+// The memory in MB a query's connection can use, if query_max_memory isn't configured
+const queryDefaultMaxMemory = 256
+
+// The size in MB of a query's output, if query_max_result_size isn't configured
+const queryDefaultMaxResultSize = 1024
+
+// Checks that the SQL is a single statement, i.e. that there's nothing but whitespace, comments
+// and semicolons after the first semicolon outside of literals, identifiers and comments
+func queryCheckStatement(query string) error {
+	if len(query) > queryMaxSQLLength {
+		return fmt.Errorf("The query is longer than %d bytes", queryMaxSQLLength)
+	}
+	end := -1
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			// A doubled quote inside a literal is skipped as two adjacent literals
+			j := strings.IndexByte(query[i+1:], closing)
+			if j < 0 {
+				return nil // Unterminated, SQLite will reject it
+			}
+			i += j + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				i = len(query)
+			} else {
+				i += j
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				i = len(query)
+			} else {
+				i += j + 3
+			}
+		case c == ';':
+			if end < 0 {
+				end = i
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			if end >= 0 {
+				return fmt.Errorf("The query must be a single SQL statement")
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the maximum number of rows a query returns
+func (node *Node) queryMaxRows() int {
+	if node.cfg.QueryMaxRows > 0 {
+		return node.cfg.QueryMaxRows
+	}
+	return queryDefaultMaxRows
+}
+
+// Returns the maximum size of a query's output in bytes
+func (node *Node) queryMaxResultSize() int64 {
+	if node.cfg.QueryMaxResultSize > 0 {
+		return int64(node.cfg.QueryMaxResultSize) << 20
+	}
+	return queryDefaultMaxResultSize << 20
+}
+
+// Returns the time the query can take, for combining the blocks and running it
+func (qr *queryRequest) timeout(node *Node) time.Duration {
+	perBlock := queryDefaultBlockTimeout
+	if node.cfg.QueryBlockTimeout > 0 {
+		perBlock = time.Duration(node.cfg.QueryBlockTimeout) * time.Second
+	}
+	total := queryDefaultTimeout
+	if node.cfg.QueryTimeout > 0 {
+		total = time.Duration(node.cfg.QueryTimeout) * time.Second
+	}
+	if t := time.Duration(qr.To-qr.From+1) * perBlock; t < total {
+		return t
+	}
+	return total
+}
+
+// Returns a connection to the database which can only read it
+func (node *Node) querySandboxConn(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	maxMemory := queryDefaultMaxMemory
+	if node.cfg.QueryMaxMemory > 0 {
+		maxMemory = node.cfg.QueryMaxMemory
+	}
+	pragmas := []string{"PRAGMA query_only=ON", "PRAGMA temp_store=FILE", fmt.Sprintf("PRAGMA cache_size=%d", -maxMemory*1024)}
+	for _, pragma := range pragmas {
+		if _, err = conn.ExecContext(ctx, pragma); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	err = conn.Raw(func(driverConn interface{}) error {
+		return dbSetQueryLengthLimit(driverConn, maxMemory<<20)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = conn.Raw(dbSetQueryAuthorizer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
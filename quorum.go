@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+ * The key op quorum policy of a chain, set with key_op_quorum in chainparams.json. It
+ * declares how the number of signatures the key ops need (see QuorumForHeight) grows with the
+ * block height:
+ *
+ *   {"type": "fixed", "quorum": 3}
+ *   {"type": "linear", "start": 100, "factor": 0.01}   - 1 + (H - start) * factor
+ *   {"type": "log", "start": 149, "factor": 2}         - log(H) * factor
+ *   {"type": "table", "table": [{"height": 0, "quorum": 1}, {"height": 1000, "quorum": 3}]}
+ *
+ * The quorum is 1 below the start height of the linear and log policies, and below the
+ * first height in the table. "max" caps the linear and log policies. Chains without a policy
+ * use the log policy with the start height of 149 and the factor of 2.
+ */
+
+const (
+	quorumPolicyFixed  = "fixed"
+	quorumPolicyLinear = "linear"
+	quorumPolicyLog    = "log"
+	quorumPolicyTable  = "table"
+)
+
+// QuorumPolicy declares the key op quorum as a function of the block height
+type QuorumPolicy struct {
+	Type   string              `json:"type"`
+	Quorum int                 `json:"quorum,omitempty"` // For the fixed policy
+	Start  int                 `json:"start,omitempty"`  // For the linear and log policies
+	Factor float64             `json:"factor,omitempty"` // For the linear and log policies
+	Max    int                 `json:"max,omitempty"`    // For the linear and log policies, 0 for no cap
+	Table  []QuorumPolicyEntry `json:"table,omitempty"`  // For the table policy, by increasing height
+}
+
+// QuorumPolicyEntry is the quorum from the given block height on
+type QuorumPolicyEntry struct {
+	Height int `json:"height"`
+	Quorum int `json:"quorum"`
+}
+
+// The policy of the chains which don't declare one
+var defaultQuorumPolicy = QuorumPolicy{Type: quorumPolicyLog, Start: 149, Factor: 2}
+
+// Returns the key op quorum policy of the chain
+func (cp *ChainParams) quorumPolicy() *QuorumPolicy {
+	if cp.KeyOpQuorum != nil {
+		return cp.KeyOpQuorum
+	}
+	return &defaultQuorumPolicy
+}
+
+// Checks the policy, returning an error describing the first problem
+func (qp *QuorumPolicy) validate() error {
+	switch qp.Type {
+	case quorumPolicyFixed:
+		if qp.Quorum < 1 {
+			return fmt.Errorf("key_op_quorum: the fixed quorum must be at least 1")
+		}
+	case quorumPolicyLinear, quorumPolicyLog:
+		if qp.Start < 0 || qp.Factor <= 0 || qp.Max < 0 {
+			return fmt.Errorf("key_op_quorum: the %s policy needs a non-negative start and max, and a positive factor", qp.Type)
+		}
+	case quorumPolicyTable:
+		if len(qp.Table) == 0 {
+			return fmt.Errorf("key_op_quorum: the table is empty")
+		}
+		if !sort.SliceIsSorted(qp.Table, func(i, j int) bool { return qp.Table[i].Height < qp.Table[j].Height }) {
+			return fmt.Errorf("key_op_quorum: the table must be sorted by height")
+		}
+		for _, e := range qp.Table {
+			if e.Height < 0 || e.Quorum < 1 {
+				return fmt.Errorf("key_op_quorum: invalid table entry %d: %d", e.Height, e.Quorum)
+			}
+		}
+	default:
+		return fmt.Errorf("key_op_quorum: unknown policy type %q", qp.Type)
+	}
+	return nil
+}
+
+// Returns the key op quorum for the block at the given height
+func (qp *QuorumPolicy) quorum(h int) int {
+	q := 1
+	switch qp.Type {
+	case quorumPolicyFixed:
+		return qp.Quorum
+	case quorumPolicyLinear:
+		if h >= qp.Start {
+			q = 1 + int(float64(h-qp.Start)*qp.Factor)
+		}
+	case quorumPolicyLog:
+		if h >= qp.Start && h > 0 {
+			q = int(math.Log(float64(h)) * qp.Factor)
+		}
+	case quorumPolicyTable:
+		for _, e := range qp.Table {
+			if e.Height > h {
+				break
+			}
+			q = e.Quorum
+		}
+		return q
+	}
+	if qp.Max > 0 && q > qp.Max {
+		q = qp.Max
+	}
+	if q < 1 {
+		q = 1
+	}
+	return q
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Per-IP limits for the HTTP server: the request rate is limited with a token bucket for each
+ * client IP address, and the number of concurrent block downloads is limited separately.
+ * Requests over the limits get 429 Too Many Requests. Local clients are not limited.
+ */
+
+// How long an idle client's state is kept
+const httpLimiterIdleTime = 10 * time.Minute
+
+// httpClientState tracks the requests of one client IP address
+type httpClientState struct {
+	tokens    float64
+	lastSeen  time.Time
+	downloads int
+}
+
+type httpLimiter struct {
+	lock         WithMutex
+	rate         float64 // Requests per second, 0 for no limit
+	burst        float64
+	maxDownloads int // Concurrent downloads, 0 for no limit
+	clients      map[string]*httpClientState
+	lastCleanup  time.Time
+}
+
+// Creates the limiter from the configuration
+func (node *Node) newHTTPLimiter() *httpLimiter {
+	burst := float64(node.cfg.HTTPRateBurst)
+	if burst < 1 {
+		burst = node.cfg.HTTPRateLimit
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &httpLimiter{
+		rate:         node.cfg.HTTPRateLimit,
+		burst:        burst,
+		maxDownloads: node.cfg.HTTPMaxDownloadsPerIP,
+		clients:      map[string]*httpClientState{},
+		lastCleanup:  time.Now(),
+	}
+}
+
+// Returns the client's state, creating it if needed. Must be called with the lock held.
+func (l *httpLimiter) client(ip string, now time.Time) *httpClientState {
+	if now.Sub(l.lastCleanup) > httpLimiterIdleTime {
+		for k, c := range l.clients {
+			if c.downloads == 0 && now.Sub(c.lastSeen) > httpLimiterIdleTime {
+				delete(l.clients, k)
+			}
+		}
+		l.lastCleanup = now
+	}
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &httpClientState{tokens: l.burst, lastSeen: now}
+		l.clients[ip] = c
+	}
+	return c
+}
+
+// Takes a token from the client's bucket, returning false if the client is over the rate limit
+func (l *httpLimiter) allow(ip string) (ok bool) {
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.lock.With(func() {
+		c := l.client(ip, now)
+		c.tokens += now.Sub(c.lastSeen).Seconds() * l.rate
+		if c.tokens > l.burst {
+			c.tokens = l.burst
+		}
+		c.lastSeen = now
+		if c.tokens >= 1 {
+			c.tokens--
+			ok = true
+		}
+	})
+	return
+}
+
+// Registers a download by the client, returning false if it has too many already
+func (l *httpLimiter) startDownload(ip string) (ok bool) {
+	if l.maxDownloads <= 0 {
+		return true
+	}
+	l.lock.With(func() {
+		c := l.client(ip, time.Now())
+		if c.downloads < l.maxDownloads {
+			c.downloads++
+			ok = true
+		}
+	})
+	return
+}
+
+// Unregisters a download started with startDownload
+func (l *httpLimiter) endDownload(ip string) {
+	if l.maxDownloads <= 0 {
+		return
+	}
+	l.lock.With(func() {
+		if c, ok := l.clients[ip]; ok && c.downloads > 0 {
+			c.downloads--
+		}
+	})
+}
+
+// Returns true if the request downloads blocks
+func isBlockDownloadRequest(r *http.Request) bool {
+	return r.URL.Path == "/blocks" || strings.HasPrefix(r.URL.Path, "/block/")
+}
+
+// Applies the limits to the requests
+func (l *httpLimiter) Handler(next http.Handler) http.Handler {
+	if l.rate <= 0 && l.maxDownloads <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLoopbackRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if !l.allow(ip) {
+			log.Println("HTTP rate limit exceeded by", ip)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if isBlockDownloadRequest(r) {
+			if !l.startDownload(ip) {
+				log.Println("HTTP concurrent download limit exceeded by", ip)
+				w.Header().Set("Retry-After", "5")
+				http.Error(w, "Too many concurrent downloads", http.StatusTooManyRequests)
+				return
+			}
+			defer l.endDownload(ip)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+ * A session recording consists of a directory containing the session.log file, with one
+ * JSON-encoded p2pSessionEntry per line, and a blocks subdirectory with the block files which
+ * were downloaded over HTTP during the session. The replay command feeds the recorded messages
+ * through the p2p message handlers, in order, so that sync problems can be reproduced offline.
+ * The replay should be done against a scratch copy of the data directory, taken at the time
+ * the recording started.
+ */
+
+const p2pSessionLogFileName = "session.log"
+const p2pSessionBlocksSubdirectory = "blocks"
+
+// Session log entry types
+const (
+	p2pSessionEntryStart     = "start"
+	p2pSessionEntryMsg       = "msg"
+	p2pSessionEntryBlockFile = "blockfile"
+)
+
+// p2pSessionEntry is one entry in the session log
+type p2pSessionEntry struct {
+	Type   string   `json:"type"`
+	Time   int64    `json:"time"` // Unix timestamp in nanoseconds
+	Peer   string   `json:"peer,omitempty"`
+	Msg    StrIfMap `json:"msg,omitempty"`
+	Hash   string   `json:"hash,omitempty"`
+	Root   string   `json:"root,omitempty"`
+	Height int      `json:"height,omitempty"`
+}
+
+// p2pRecorder records the inbound p2p messages and block files into a session directory
+type p2pRecorder struct {
+	dir  string
+	f    *os.File
+	lock WithMutex
+}
+
+// Starts recording a session into the given directory
+func (node *Node) p2pRecorderInit(dir string) {
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s", dir, p2pSessionBlocksSubdirectory), 0700); err != nil {
+		log.Fatalln("Cannot create session directory", dir, err)
+	}
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", dir, p2pSessionLogFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalln("Cannot create session log", err)
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	r := &p2pRecorder{dir: dir, f: f}
+	r.write(p2pSessionEntry{Type: p2pSessionEntryStart, Root: node.chainParams.GenesisBlockHash, Height: height})
+	node.p2pSessionRecorder = r
+	log.Println("Recording the p2p session into", dir)
+}
+
+// Appends an entry to the session log
+func (r *p2pRecorder) write(e p2pSessionEntry) {
+	e.Time = time.Now().UnixNano()
+	line := append(jsonifyWhateverToBytes(e), '\n')
+	r.lock.With(func() {
+		if _, err := r.f.Write(line); err != nil {
+			log.Println("Error writing session log:", err)
+		}
+	})
+}
+
+// Records a message received from a peer
+func (r *p2pRecorder) recordMsg(peer string, msg StrIfMap) {
+	r.write(p2pSessionEntry{Type: p2pSessionEntryMsg, Peer: peer, Msg: msg})
+}
+
+// Records a copy of a block file received from a peer out of band
+func (r *p2pRecorder) recordBlockFile(hash string, fileName string) {
+	if err := copyFile(fileName, r.blockFileName(hash)); err != nil {
+		log.Println("Error recording block file:", err)
+		return
+	}
+	r.write(p2pSessionEntry{Type: p2pSessionEntryBlockFile, Hash: hash})
+}
+
+func (r *p2pRecorder) blockFileName(hash string) string {
+	return fmt.Sprintf("%s/%s/%s.db", r.dir, p2pSessionBlocksSubdirectory, hash)
+}
+
+// Creates a connection which isn't backed by the network, for replaying messages from the
+// given peer address. Messages sent to it are logged and discarded.
+func (node *Node) p2pNewReplayConnection(address string) *p2pConnection {
+	conn, other := net.Pipe()
+	other.Close()
+	p2pc := &p2pConnection{node: node,
+		conn:         conn,
+		address:      address,
+		chanToPeer:   make(chan interface{}, 5),
+		chanFromPeer: make(chan StrIfMap, 5),
+	}
+	p2pc.ctx, p2pc.cancel = context.WithCancel(context.Background())
+	go func() {
+		for {
+			select {
+			case msg := <-p2pc.chanToPeer:
+				log.Printf("replay: -> %s: %s", address, jsonifyWhatever(msg))
+			case <-p2pc.ctx.Done():
+				return
+			}
+		}
+	}()
+	return p2pc
+}
+
+// Replays a recorded session against the current data directory. If maxEntries is greater
+// than 0, only that many messages are replayed, which is useful for bisecting.
+func (node *Node) actionReplay(dir string, maxEntries int) {
+	f, err := os.Open(fmt.Sprintf("%s/%s", dir, p2pSessionLogFileName))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	recorder := p2pRecorder{dir: dir}
+
+	// The coordinator isn't running, so drain its queues
+	go func() {
+		for {
+			select {
+			case msg := <-node.p2pCtrlQueueControl.ch:
+				log.Printf("replay: control message %d to the coordinator", msg.msgType)
+			case msg := <-node.p2pCtrlQueueBulk.ch:
+				log.Printf("replay: bulk message %d to the coordinator", msg.msgType)
+			}
+		}
+	}()
+
+	go node.p2pCoordinator.validateBlocks()
+
+	peers := map[string]*p2pConnection{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 256*1024*1024) // Inline blocks can make for very long lines
+	nMsgs := 0
+	for scanner.Scan() {
+		var e p2pSessionEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Fatalln("Cannot parse session log:", err)
+		}
+		switch e.Type {
+		case p2pSessionEntryStart:
+			if e.Root != node.chainParams.GenesisBlockHash {
+				log.Fatalln("The session was recorded on a different blockchain:", e.Root)
+			}
+			h, err := node.dbGetBlockchainHeight()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if h != e.Height {
+				log.Println("Warning: the session was recorded at height", e.Height, "but the blockchain is at height", h)
+			}
+		case p2pSessionEntryMsg:
+			if maxEntries > 0 && nMsgs >= maxEntries {
+				log.Println("Stopping replay after", nMsgs, "messages")
+				return
+			}
+			nMsgs++
+			p2pc, ok := peers[e.Peer]
+			if !ok {
+				p2pc = node.p2pNewReplayConnection(e.Peer)
+				peers[e.Peer] = p2pc
+			}
+			if err = replayInlineBlock(&recorder, e.Msg); err != nil {
+				log.Fatalln("Cannot replay message", nMsgs, err)
+			}
+			log.Printf("replay: <- %s #%d: %v", e.Peer, nMsgs, e.Msg["msg"])
+			if err = p2pc.handleMsg(e.Msg); err != nil {
+				log.Println("replay:", err)
+			}
+			node.p2pWaitBlockValidations()
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Replayed", nMsgs, "messages, blockchain height is now", height)
+}
+
+// Block messages which have referred to block files over HTTP are converted to carry the
+// recorded block file inline, so the replay doesn't depend on the network.
+func replayInlineBlock(recorder *p2pRecorder, msg StrIfMap) error {
+	if cmd, _ := msg.GetString("msg"); cmd != p2pMsgBlock {
+		return nil
+	}
+	if encoding, _ := msg.GetString("encoding"); encoding != "http" {
+		return nil
+	}
+	hash, err := msg.GetString("hash")
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(recorder.blockFileName(hash))
+	if err != nil {
+		return fmt.Errorf("block %s was not recorded: %v", hash, err)
+	}
+	var zbuf bytes.Buffer
+	w := zlib.NewWriter(&zbuf)
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	msg["encoding"] = "zlib-base64"
+	msg["data"] = base64.StdEncoding.EncodeToString(zbuf.Bytes())
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Saved queries and scheduled reports. Named queries are registered with the savequery command
+ * in the config table of the main database, with a schedule, which is either "block" (run the
+ * query after every accepted block) or an interval like "1h", and an output, which is a file
+ * (replaced on every run) or an http(s) URL the results are POSTed to. The running node checks
+ * the schedules once a minute, and runs the due reports one at a time, with the limits of the
+ * query command. The result of the last run of each report is kept in the config table too.
+ */
+
+// The config table key of the saved queries
+const savedQueriesKey = "saved_queries"
+
+// The prefix of the config table keys of the reports' last runs
+const savedQueryRunKeyPrefix = "saved_query_run:"
+
+// How often the node checks the reports' schedules
+const reportsCheckInterval = time.Minute
+
+// The schedule of the reports run after every accepted block
+const reportScheduleBlock = "block"
+
+var savedQueryNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// savedQuery is a named query with its schedule and output
+type savedQuery struct {
+	Name     string       `json:"name"`
+	Query    queryRequest `json:"query"`
+	Schedule string       `json:"schedule"` // "block" or an interval
+	Output   string       `json:"output"`   // A file name or an http(s) URL
+}
+
+// savedQueryRun is the result of the last run of a saved query
+type savedQueryRun struct {
+	Time   time.Time `json:"time"`
+	Height int       `json:"height"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (sq *savedQuery) validate() error {
+	if !savedQueryNameRegexp.MatchString(sq.Name) {
+		return fmt.Errorf("invalid query name %s, it can have up to 64 letters, digits, _ and -", sq.Name)
+	}
+	if sq.Schedule != reportScheduleBlock {
+		interval, err := time.ParseDuration(sq.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule %s, must be %s or an interval like 1h", sq.Schedule, reportScheduleBlock)
+		}
+		if interval < reportsCheckInterval {
+			return fmt.Errorf("the schedule interval must be at least %v", reportsCheckInterval)
+		}
+	}
+	if sq.Output == "" {
+		return fmt.Errorf("the report needs an output file or URL")
+	}
+	if err := queryCheckStatement(sq.Query.SQL); err != nil {
+		return err
+	}
+	if sq.Query.Format != "" && !inStrings(sq.Query.Format, queryOutputFormats) {
+		return fmt.Errorf("Unknown output format %s - must be one of: %s", sq.Query.Format, strings.Join(queryOutputFormats, ", "))
+	}
+	return nil
+}
+
+// Returns true if the output is a URL rather than a file
+func (sq *savedQuery) outputIsURL() bool {
+	return strings.HasPrefix(sq.Output, "http://") || strings.HasPrefix(sq.Output, "https://")
+}
+
+// Returns true if the report is due to run, on its interval
+func (sq *savedQuery) due(last savedQueryRun, now time.Time) bool {
+	interval, err := time.ParseDuration(sq.Schedule)
+	if err != nil {
+		return false
+	}
+	return now.Sub(last.Time) >= interval
+}
+
+// Returns the saved queries, ordered by name
+func (node *Node) dbGetSavedQueries() ([]savedQuery, error) {
+	value, err := node.dbGetConfigValue(savedQueriesKey)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var queries []savedQuery
+	err = json.Unmarshal([]byte(value), &queries)
+	return queries, err
+}
+
+func (node *Node) dbSetSavedQueries(queries []savedQuery) error {
+	return node.dbSetConfigValue(savedQueriesKey, jsonifyWhatever(queries))
+}
+
+// Returns the last run of the saved query, with a zero Time if it hasn't run yet
+func (node *Node) dbGetSavedQueryRun(name string) (run savedQueryRun, err error) {
+	value, err := node.dbGetConfigValue(savedQueryRunKeyPrefix + name)
+	if err != nil || value == "" {
+		return run, err
+	}
+	err = json.Unmarshal([]byte(value), &run)
+	return run, err
+}
+
+func (node *Node) dbSetSavedQueryRun(name string, run savedQueryRun) error {
+	return node.dbSetConfigValue(savedQueryRunKeyPrefix+name, jsonifyWhatever(run))
+}
+
+// Runs the saved query, writes its results to the output, and records the run
+func (sq *savedQuery) run(node *Node) error {
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	node.reportsLock.With(func() {
+		err = sq.write(node)
+	})
+	run := savedQueryRun{Time: time.Now().UTC(), Height: height}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if err2 := node.dbSetSavedQueryRun(sq.Name, run); err2 != nil {
+		chainLog.Error("Cannot record the run of the report", sq.Name, err2)
+	}
+	return err
+}
+
+// Runs the query into a temporary file next to the output file, or in the temporary directory
+// for the URLs, and moves the file into place or POSTs it
+func (sq *savedQuery) write(node *Node) error {
+	qr := sq.Query
+	if err := qr.normalize(node); err != nil {
+		return err
+	}
+	dir := ""
+	if !sq.outputIsURL() {
+		dir = filepath.Dir(sq.Output)
+	}
+	f, err := ioutil.TempFile(dir, "daisy-report-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), qr.timeout(node))
+	defer cancel()
+	qdb, rows, err := qr.run(node, ctx)
+	if err != nil {
+		return err
+	}
+	err = node.writeQueryRows(f, rows, qr.Format, qr.Limit)
+	rows.Close()
+	qdb.Close()
+	if err != nil {
+		return err
+	}
+	if !sq.outputIsURL() {
+		if err = f.Chmod(0644); err != nil {
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), sq.Output)
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sq.Output, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", queryContentTypes[qr.Format])
+	req.Header.Set("X-Daisy-Report", sq.Name)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// Runs the saved queries with the given schedule, or the ones due on their interval if it's ""
+func (node *Node) reportsRun(schedule string) {
+	queries, err := node.dbGetSavedQueries()
+	if err != nil {
+		chainLog.Error("Cannot load the saved queries:", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, sq := range queries {
+		if schedule == "" {
+			if sq.Schedule == reportScheduleBlock {
+				continue
+			}
+			last, err := node.dbGetSavedQueryRun(sq.Name)
+			if err != nil {
+				chainLog.Error("Cannot read the last run of the report", sq.Name, err)
+				continue
+			}
+			if !sq.due(last, now) {
+				continue
+			}
+		} else if sq.Schedule != schedule {
+			continue
+		}
+		if err = sq.run(node); err != nil {
+			chainLog.Error("Report", sq.Name, "failed:", err)
+		}
+	}
+}
+
+// Starts running the saved queries on their schedules
+func (node *Node) reportsStart() {
+	node.nodeEvents.Handle("reports", []string{eventBlockAccepted}, func(ev nodeEvent) {
+		node.reportsRun(reportScheduleBlock)
+	})
+	go func() {
+		for range time.Tick(reportsCheckInterval) {
+			node.reportsRun("")
+		}
+	}()
+}
+
+// Saves the query under the name, replacing the one with the same name
+func (node *Node) actionSaveQuery(name, schedule, output, q string) {
+	sq := savedQuery{
+		Name:     name,
+		Query:    queryRequest{SQL: q, From: node.cfg.queryFrom, To: node.cfg.queryTo, Reverse: node.cfg.queryReverse, Limit: node.cfg.queryLimit, Format: node.cfg.queryFormat},
+		Schedule: schedule,
+		Output:   output,
+	}
+	if !sq.outputIsURL() {
+		abs, err := filepath.Abs(output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sq.Output = abs
+	}
+	if err := sq.validate(); err != nil {
+		log.Fatalln(err)
+	}
+	queries, err := node.dbGetSavedQueries()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var saved []savedQuery
+	for _, q := range queries {
+		if q.Name != name {
+			saved = append(saved, q)
+		}
+	}
+	saved = append(saved, sq)
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	if err = node.dbSetSavedQueries(saved); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Deletes the saved query
+func (node *Node) actionDeleteQuery(name string) {
+	queries, err := node.dbGetSavedQueries()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var saved []savedQuery
+	for _, q := range queries {
+		if q.Name != name {
+			saved = append(saved, q)
+		}
+	}
+	if len(saved) == len(queries) {
+		log.Fatalln("No saved query named", name)
+	}
+	if err = node.dbSetSavedQueries(saved); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Prints the saved queries, with their last runs
+func (node *Node) actionSavedQueries() {
+	queries, err := node.dbGetSavedQueries()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(queries) == 0 {
+		fmt.Println("There are no saved queries")
+		return
+	}
+	for _, sq := range queries {
+		last := "never run"
+		run, err := node.dbGetSavedQueryRun(sq.Name)
+		if err != nil {
+			last = err.Error()
+		} else if !run.Time.IsZero() {
+			last = fmt.Sprintf("last run at %s, block %d", run.Time.Format(time.RFC3339), run.Height)
+			if run.Error != "" {
+				last += ", failed: " + run.Error
+			}
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", sq.Name, sq.Schedule, sq.Output, sq.Query.SQL, last)
+	}
+}
+
+// Runs the saved query now, writing to its output
+func (node *Node) actionRunQuery(name string) {
+	queries, err := node.dbGetSavedQueries()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, sq := range queries {
+		if sq.Name == name {
+			if err = sq.run(node); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+	}
+	log.Fatalln("No saved query named", name)
+}
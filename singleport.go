@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Sharing the p2p port with the HTTP server, for operators who can only open one port. With
+ * single_port (or -single-port), the p2p listeners also accept the HTTP and HTTPS connections,
+ * which are told apart by their first bytes: the p2p peers start with the prologue line (see
+ * p2pchainid.go), the HTTP clients with a request method like "GET ", and the HTTPS clients
+ * with a TLS handshake record. The HTTP connections are passed to the HTTP server, which still
+ * listens on its own addresses too, and the peers are told to download the blocks from the
+ * p2p port.
+ */
+
+// How long to wait for the first bytes of a connection
+const singlePortSniffTimeout = 10 * time.Second
+
+// How many bytes are read to tell the protocols apart, enough for the longest method and a space
+const singlePortSniffLength = 8
+
+// The first byte of a TLS handshake record
+const singlePortTLSHandshake = 0x16
+
+var singlePortHTTPMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+// sniffedConn is a connection whose first bytes have been read into a buffer
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a net.Listener for the connections accepted by another listener
+type connListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("the listener is closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Passes the connection to the Accept() of the listener, or closes it if the listener is closed
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Reads the first bytes of a connection accepted on the p2p port, and passes it to the HTTP
+// server if it's an HTTP(S) connection. Returns the connection if it's a p2p one, or nil.
+func (node *Node) singlePortSniff(conn net.Conn) net.Conn {
+	if err := conn.SetReadDeadline(time.Now().Add(singlePortSniffTimeout)); err != nil {
+		conn.Close()
+		return nil
+	}
+	sc := &sniffedConn{Conn: conn, r: bufio.NewReader(conn)}
+	b, err := sc.r.Peek(singlePortSniffLength)
+	conn.SetReadDeadline(time.Time{})
+	if len(b) == 0 {
+		p2pLog.Debug("Nothing received from", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil
+	}
+	if singlePortIsHTTP(b) {
+		node.singlePortHTTPListener.push(sc)
+		return nil
+	}
+	return sc
+}
+
+// Returns true if the first bytes of a connection are an HTTP request or a TLS handshake
+func singlePortIsHTTP(b []byte) bool {
+	if b[0] == singlePortTLSHandshake {
+		return true
+	}
+	i := bytes.IndexByte(b, ' ')
+	return i > 0 && inStrings(string(b[:i]), singlePortHTTPMethods)
+}
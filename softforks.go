@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+ * Soft fork signaling with version bits. The low byte of a block's Version is the format of
+ * the block metadata (CurrentBlockVersion), and the bits above it signal the support for the
+ * upcoming rule changes, so that the network can switch to new consensus rules once enough
+ * signatories run the nodes which implement them, instead of on a flag day.
+ *
+ * A chain declares the rule changes as soft_forks in its chainparams.json, each with its
+ * name, the bit (0 to 23) which signals it, and the heights at which the signaling starts and
+ * times out. The blocks are evaluated in windows of soft_fork_window blocks (100 by default),
+ * and the state of each soft fork changes at the end of a window:
+ *
+ *   defined   -> started    when the next window is at or above the start height
+ *   started   -> locked_in  when at least the threshold (75% by default) of the window's
+ *                           blocks signal the bit
+ *   started   -> failed     when the next window is at or above the timeout height
+ *   locked_in -> active     after one more window, giving the nodes time to upgrade
+ *
+ * The nodes sign blocks with the bits of the started and locked-in soft forks they implement
+ * (listed in softForksImplemented). The states are kept in the softforks table of the main
+ * database, and the new rules check softForkActive() for the height of the block they apply
+ * to. A node warns when a soft fork it doesn't implement is locked in, as it should be
+ * upgraded before it becomes active.
+ */
+
+// Soft fork states
+const (
+	softForkDefined  = "defined"
+	softForkStarted  = "started"
+	softForkLockedIn = "locked_in"
+	softForkActive   = "active"
+	softForkFailed   = "failed"
+)
+
+// The bits of the block Version which are the block metadata format
+const blockVersionFormatMask = 0xff
+
+// The number of signaling bits above the block metadata format
+const softForkMaxBit = 23
+
+// The defaults for the chains which don't set them
+const (
+	softForkDefaultWindow    = 100
+	softForkDefaultThreshold = 0.75
+)
+
+// The config table key of the height up to which the soft fork states have been evaluated
+const softForksEvaluatedHeightKey = "softforks_evaluated_height"
+
+// The names of the soft forks whose rules this version of the node implements
+var softForksImplemented = map[string]bool{}
+
+// SoftForkDeployment is a rule change declared in the chain params
+type SoftForkDeployment struct {
+	Name          string  `json:"name"`
+	Bit           uint    `json:"bit"`
+	StartHeight   int     `json:"start_height"`
+	TimeoutHeight int     `json:"timeout_height"`
+	Threshold     float64 `json:"threshold,omitempty"` // The fraction of the window's blocks, 0.75 by default
+}
+
+// The state of a soft fork, as stored in the main database
+type softForkState struct {
+	Name   string `json:"name"`
+	Bit    uint   `json:"bit"`
+	State  string `json:"state"`
+	Height int    `json:"height"` // The height from which the state applies
+}
+
+const softForksTableCreate = `
+CREATE TABLE softforks (
+	name			VARCHAR NOT NULL PRIMARY KEY,
+	state			VARCHAR NOT NULL,
+	height			INTEGER NOT NULL
+);
+`
+
+// Returns the block metadata format of the block Version
+func blockVersionFormat(version int) int {
+	return version & blockVersionFormatMask
+}
+
+// Returns the block Version bit which signals the soft fork
+func (d *SoftForkDeployment) versionBit() int {
+	return 1 << (8 + d.Bit)
+}
+
+// Returns the size of the soft fork evaluation window
+func (cp *ChainParams) softForkWindow() int {
+	if cp.SoftForkWindow > 0 {
+		return cp.SoftForkWindow
+	}
+	return softForkDefaultWindow
+}
+
+// Checks the soft fork deployments of the chain params
+func (cp *ChainParams) validateSoftForks() error {
+	names := map[string]bool{}
+	bits := map[uint]bool{}
+	for _, d := range cp.SoftForks {
+		if d.Name == "" || names[d.Name] {
+			return fmt.Errorf("soft_forks: missing or duplicate name %q", d.Name)
+		}
+		if d.Bit > softForkMaxBit || bits[d.Bit] {
+			return fmt.Errorf("soft_forks: %s: invalid or duplicate bit %d", d.Name, d.Bit)
+		}
+		if d.StartHeight < 0 || d.TimeoutHeight <= d.StartHeight {
+			return fmt.Errorf("soft_forks: %s: the timeout height must be above the start height", d.Name)
+		}
+		if d.Threshold < 0 || d.Threshold > 1 {
+			return fmt.Errorf("soft_forks: %s: the threshold must be between 0 and 1", d.Name)
+		}
+		names[d.Name] = true
+		bits[d.Bit] = true
+	}
+	return nil
+}
+
+// Returns the states of the chain's soft forks
+func (node *Node) dbGetSoftForkStates() (map[string]softForkState, error) {
+	rows, err := node.mainDb.Query("SELECT name, state, height FROM softforks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := map[string]softForkState{}
+	for rows.Next() {
+		var st softForkState
+		if err = rows.Scan(&st.Name, &st.State, &st.Height); err != nil {
+			return nil, err
+		}
+		states[st.Name] = st
+	}
+	return states, rows.Err()
+}
+
+// Records the state of a soft fork
+func (node *Node) dbSetSoftForkState(st softForkState) error {
+	_, err := node.mainDb.Exec("INSERT INTO softforks(name, state, height) VALUES (?, ?, ?) ON CONFLICT(name) DO UPDATE SET state=excluded.state, height=excluded.height",
+		st.Name, st.State, st.Height)
+	return err
+}
+
+// Counts the blocks in the height range which signal the version bit
+func (node *Node) dbCountSignalingBlocks(minHeight, maxHeight int, bit int) (int, error) {
+	var count int
+	err := node.mainDb.QueryRow("SELECT COUNT(*) FROM blockchain WHERE height BETWEEN ? AND ? AND (version & ?) != 0", minHeight, maxHeight, bit).Scan(&count)
+	return count, err
+}
+
+// Returns the state of each of the chain's soft forks, defined if it hasn't been evaluated yet
+func (node *Node) softForkStates() ([]softForkState, error) {
+	stored, err := node.dbGetSoftForkStates()
+	if err != nil {
+		return nil, err
+	}
+	var states []softForkState
+	for _, d := range node.chainParams.SoftForks {
+		st, ok := stored[d.Name]
+		if !ok {
+			st = softForkState{Name: d.Name, State: softForkDefined}
+		}
+		st.Bit = d.Bit
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// Returns true if the rules of the soft fork apply to the block at the given height
+func (node *Node) softForkIsActive(name string, height int) bool {
+	states, err := node.dbGetSoftForkStates()
+	if err != nil {
+		chainLog.Error("Cannot read the soft fork states:", err)
+		return false
+	}
+	st, ok := states[name]
+	return ok && st.State == softForkActive && height >= st.Height
+}
+
+// Returns the Version of the next block signed by this node, signaling the soft forks which
+// are started or locked in, and which this node implements
+func (node *Node) softForksBlockVersion() int {
+	version := CurrentBlockVersion
+	states, err := node.softForkStates()
+	if err != nil {
+		chainLog.Error("Cannot read the soft fork states:", err)
+		return version
+	}
+	for i, st := range states {
+		if (st.State == softForkStarted || st.State == softForkLockedIn) && softForksImplemented[st.Name] {
+			version |= node.chainParams.SoftForks[i].versionBit()
+		}
+	}
+	return version
+}
+
+// Evaluates the soft fork states for the windows completed since the last evaluation. After
+// a rollback below the evaluated height, the states are evaluated again from the start.
+func (node *Node) softForksUpdate() error {
+	if len(node.chainParams.SoftForks) == 0 {
+		return nil
+	}
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		return err
+	}
+	evaluated := -1
+	value, err := node.dbGetConfigValue(softForksEvaluatedHeightKey)
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		if evaluated, err = strconv.Atoi(value); err != nil {
+			return err
+		}
+	}
+	if evaluated > height {
+		if _, err = node.mainDb.Exec("DELETE FROM softforks"); err != nil {
+			return err
+		}
+		evaluated = -1
+	}
+	window := node.chainParams.softForkWindow()
+	for end := evaluated + window; end <= height; end += window {
+		if err = node.softForksEvaluateWindow(end-window+1, end); err != nil {
+			return err
+		}
+		if err = node.dbSetConfigValue(softForksEvaluatedHeightKey, strconv.Itoa(end)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the soft forks to their next states at the end of the window of the given heights
+func (node *Node) softForksEvaluateWindow(minHeight, maxHeight int) error {
+	states, err := node.softForkStates()
+	if err != nil {
+		return err
+	}
+	next := maxHeight + 1
+	for i, st := range states {
+		d := &node.chainParams.SoftForks[i]
+		newState := st.State
+		switch st.State {
+		case softForkDefined:
+			if next >= d.TimeoutHeight {
+				newState = softForkFailed
+			} else if next >= d.StartHeight {
+				newState = softForkStarted
+			}
+		case softForkStarted:
+			count, err := node.dbCountSignalingBlocks(minHeight, maxHeight, d.versionBit())
+			if err != nil {
+				return err
+			}
+			threshold := d.Threshold
+			if threshold == 0 {
+				threshold = softForkDefaultThreshold
+			}
+			if float64(count) >= threshold*float64(maxHeight-minHeight+1) {
+				newState = softForkLockedIn
+			} else if next >= d.TimeoutHeight {
+				newState = softForkFailed
+			}
+		case softForkLockedIn:
+			newState = softForkActive
+		}
+		if newState == st.State {
+			continue
+		}
+		st.State = newState
+		st.Height = next
+		if err = node.dbSetSoftForkState(st); err != nil {
+			return err
+		}
+		chainLog.Info("Soft fork", st.Name, "is", st.State, "from block", next)
+		if st.State == softForkLockedIn && !softForksImplemented[st.Name] {
+			chainLog.Warn("Soft fork", st.Name, "is locked in, but this node doesn't implement it: upgrade it before block", next+node.chainParams.softForkWindow())
+		}
+		node.nodeEvents.Publish(eventSoftFork, StrIfMap{"name": st.Name, "state": st.State, "height": next})
+	}
+	return nil
+}
+
+// Starts updating the soft fork states as the blocks are accepted
+func (node *Node) softForksStart() {
+	node.nodeEvents.Handle("softforks", []string{eventBlockAccepted}, func(ev nodeEvent) {
+		if err := node.softForksUpdate(); err != nil {
+			chainLog.Error("Cannot update the soft fork states:", err)
+		}
+	})
+}
+
+// Prints the states of the chain's soft forks
+func (node *Node) actionSoftForks() {
+	states, err := node.softForkStates()
+	if err != nil {
+		chainLog.Fatal(err)
+	}
+	if len(states) == 0 {
+		fmt.Println("The chain has no soft forks")
+		return
+	}
+	for _, st := range states {
+		implemented := ""
+		if !softForksImplemented[st.Name] {
+			implemented = " (not implemented by this node)"
+		}
+		if st.State == softForkDefined {
+			fmt.Printf("%s\tbit %d\t%s%s\n", st.Name, st.Bit, st.State, implemented)
+		} else {
+			fmt.Printf("%s\tbit %d\t%s since block %d%s\n", st.Name, st.Bit, st.State, st.Height, implemented)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !sqlcipher
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// This build uses the plain SQLite driver, which can't encrypt the databases
+const dbEncryptionSupported = false
+
+// Returns the DSN parameters which open a SQLite database with the given passphrase
+func dbEncryptionDSNParams(passphrase string) string {
+	return ""
+}
+
+// Copies the database on the src driver connection into the one on dest, with SQLite's
+// online backup API
+func dbBackupConns(dest, src interface{}) error {
+	destConn, ok1 := dest.(*sqlite3.SQLiteConn)
+	srcConn, ok2 := src.(*sqlite3.SQLiteConn)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("the backup needs SQLite connections")
+	}
+	b, err := destConn.Backup("main", srcConn, "main")
+	if err != nil {
+		return err
+	}
+	if _, err = b.Step(-1); err != nil {
+		b.Close()
+		return err
+	}
+	return b.Finish()
+}
+
+// Limits the size of the strings and blobs on the driver connection, for the query sandbox
+func dbSetQueryLengthLimit(conn interface{}, maxLength int) error {
+	c, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return fmt.Errorf("the query sandbox needs a SQLite connection")
+	}
+	c.SetLimit(sqlite3.SQLITE_LIMIT_LENGTH, maxLength)
+	return nil
+}
+
+// Sets an authorizer on the driver connection which only allows the statements reading the
+// database, for the query sandbox
+func dbSetQueryAuthorizer(conn interface{}) error {
+	c, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return fmt.Errorf("the query sandbox needs a SQLite connection")
+	}
+	c.RegisterAuthorizer(func(action int, arg1, arg2, arg3 string) int {
+		switch action {
+		case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, sqlite3.SQLITE_RECURSIVE:
+			return sqlite3.SQLITE_OK
+		}
+		return sqlite3.SQLITE_DENY
+	})
+	return nil
+}
@@ -0,0 +1,69 @@
+//go:build sqlcipher
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+// This build uses SQLCipher, which encrypts the databases opened with a passphrase and reads
+// the plain ones (such as the blocks) as usual
+const dbEncryptionSupported = true
+
+// Returns the DSN parameters which open a SQLite database with the given passphrase. The
+// driver puts the key into a PRAGMA as it is, so the passphrase is given as a SQL string,
+// from which SQLCipher derives the key.
+func dbEncryptionDSNParams(passphrase string) string {
+	key := "'" + strings.Replace(passphrase, "'", "''", -1) + "'"
+	return "_pragma_key=" + url.QueryEscape(key) + "&_pragma_cipher_page_size=4096"
+}
+
+// Copies the database on the src driver connection into the one on dest, with SQLite's
+// online backup API. Both databases must use the same passphrase.
+func dbBackupConns(dest, src interface{}) error {
+	destConn, ok1 := dest.(*sqlite3.SQLiteConn)
+	srcConn, ok2 := src.(*sqlite3.SQLiteConn)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("the backup needs SQLite connections")
+	}
+	b, err := destConn.Backup("main", srcConn, "main")
+	if err != nil {
+		return err
+	}
+	if _, err = b.Step(-1); err != nil {
+		b.Close()
+		return err
+	}
+	return b.Finish()
+}
+
+// Limits the size of the strings and blobs on the driver connection, for the query sandbox
+func dbSetQueryLengthLimit(conn interface{}, maxLength int) error {
+	c, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return fmt.Errorf("the query sandbox needs a SQLite connection")
+	}
+	c.SetLimit(sqlite3.SQLITE_LIMIT_LENGTH, maxLength)
+	return nil
+}
+
+// Sets an authorizer on the driver connection which only allows the statements reading the
+// database, for the query sandbox
+func dbSetQueryAuthorizer(conn interface{}) error {
+	c, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return fmt.Errorf("the query sandbox needs a SQLite connection")
+	}
+	c.RegisterAuthorizer(func(action int, arg1, arg2, arg3 string) int {
+		switch action {
+		case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, sqlite3.SQLITE_RECURSIVE:
+			return sqlite3.SQLITE_OK
+		}
+		return sqlite3.SQLITE_DENY
+	})
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The time the node has started, for reporting the uptime
+var nodeStartTime = time.Now()
+
+// nodeStatus is the health overview reported by the status command and the /status URL
+type nodeStatus struct {
+	Daemon         bool    `json:"daemon"` // true if reported by a running node
+	Version        string  `json:"version"`
+	Network        string  `json:"network"`
+	Uptime         string  `json:"uptime,omitempty"`
+	Height         int     `json:"height"`
+	TipHash        string  `json:"tip_hash"`
+	Verification   string  `json:"verification"`
+	Peers          int     `json:"peers"`
+	BestPeerHeight int     `json:"best_peer_height"`
+	SyncProgress   float64 `json:"sync_progress"` // percent
+	DataDir        string  `json:"data_dir"`
+	DataDirSize    int64   `json:"data_dir_size"`
+	MyKeys         int     `json:"my_keys"`
+	Signatories    int     `json:"signatories"`
+
+	Maintenance *dbMaintenanceReport `json:"maintenance,omitempty"` // The last database maintenance run
+	Mining      *mineProgress        `json:"mining,omitempty"`      // The current or the last mining
+	Tips        *p2pTipReport        `json:"tips,omitempty"`        // The last comparison of the peers' tips
+}
+
+// Collects the status of this node
+func (node *Node) getNodeStatus(daemon bool) nodeStatus {
+	height, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Println(err)
+	}
+	tipHash, err := node.dbGetBlockHashByHeight(height)
+	if err != nil {
+		log.Println(err)
+	}
+	st := nodeStatus{
+		Daemon:       daemon,
+		Version:      p2pClientVersionString,
+		Network:      node.networkName(),
+		Height:       height,
+		TipHash:      tipHash,
+		Verification: node.blockchainVerificationState,
+		DataDir:      node.cfg.DataDir,
+		DataDirSize:  dirSize(node.cfg.DataDir),
+		MyKeys:       node.dbNumPrivateKeys(),
+		Signatories:  node.dbNumValidPublicKeys(),
+		SyncProgress: 100,
+	}
+	if daemon {
+		st.Uptime = time.Since(nodeStartTime).Round(time.Second).String()
+		st.Peers, st.BestPeerHeight = node.p2pPeers.Stats()
+		st.Maintenance = node.dbGetMaintenanceReport()
+		st.Mining = node.mineGetStatus()
+		st.Tips = node.p2pGetTipReport()
+		if st.BestPeerHeight > height && st.BestPeerHeight > 0 {
+			st.SyncProgress = float64(height) * 100 / float64(st.BestPeerHeight)
+		}
+	}
+	return st
+}
+
+// Returns the total size of the files in the directory tree
+func dirSize(dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return size
+}
+
+// Sends the node status as JSON. Only available to local clients.
+func (node *Node) blockWebSendStatus(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(jsonifyWhateverToBytes(node.getNodeStatus(true))); err != nil {
+		log.Println(err)
+	}
+}
+
+// Prints the node status, asking the running node for it over the control socket if possible,
+// or reading it from the databases directly.
+func (node *Node) actionStatus() {
+	var st nodeStatus
+	if err := node.controlRequest(http.MethodGet, "/status", &st); err != nil {
+		log.Println("Cannot get the status from the running node, reading the databases:", err)
+		node.dbInit()
+		st = node.getNodeStatus(false)
+	}
+
+	if st.Daemon {
+		fmt.Println("Node:             running, version", st.Version, "up", st.Uptime)
+	} else {
+		fmt.Println("Node:             not running")
+	}
+	if st.Network != "" && st.Network != networkMain {
+		fmt.Println("Network:         ", st.Network)
+	}
+	fmt.Println("Height:          ", st.Height)
+	fmt.Println("Tip hash:        ", st.TipHash)
+	fmt.Println("Verification:    ", st.Verification)
+	if st.Daemon {
+		fmt.Println("Connected peers: ", st.Peers)
+		if st.BestPeerHeight >= 0 {
+			fmt.Printf("Sync progress:    %.1f%% (best peer height %d)\n", st.SyncProgress, st.BestPeerHeight)
+		}
+	}
+	fmt.Println("Data directory:  ", st.DataDir, "-", formatByteSize(st.DataDirSize))
+	fmt.Println("My keys:         ", st.MyKeys)
+	fmt.Println("Signatory keys:  ", st.Signatories)
+	if st.Maintenance != nil {
+		result := "ok"
+		if !st.Maintenance.OK() {
+			result = "PROBLEMS FOUND: " + jsonifyWhatever(st.Maintenance.Results)
+		}
+		fmt.Println("DB maintenance:  ", st.Maintenance.Time.Local().Format(time.RFC3339), "-", result)
+	}
+	if m := st.Mining; m != nil {
+		if m.Done {
+			fmt.Printf("Mining:           %s finished, %d hashes in %s (%.0f H/s)\n", m.File, m.Hashes, m.Elapsed, m.Hashrate)
+		} else {
+			fmt.Printf("Mining:           %s, %d hashes in %s (%.0f H/s), expected time to solution %s\n", m.File, m.Hashes, m.Elapsed, m.Hashrate, m.ExpectedTime)
+		}
+	}
+	if t := st.Tips; t != nil {
+		fmt.Printf("Peer tips:        %d agree, %d disagree, %d ahead at %s\n", t.Agree, t.Disagree, t.Ahead, t.Time.Local().Format(time.RFC3339))
+		if t.Desynced {
+			fmt.Println("                  DESYNCED: the local chain differs from", strings.Join(t.Dissenters, ", "))
+		}
+	}
+}
+
+// Formats the size in bytes into a human-readable string
+func formatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
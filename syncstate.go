@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+/*
+ * The sync state, kept in the config table so that a node restarted in the middle of a sync
+ * resumes where it has left off. The coordinator periodically saves the blocks it's waiting
+ * for and the height it's syncing to, and on restart requests the saved blocks directly from
+ * the first peer which has them, searching only for the block hashes above them.
+ *
+ * The verified height is the height up to which the blocks have been verified, either by the
+ * startup verification or when they were accepted. On startup, only the blocks above it are
+ * verified again, while the blocks below it only have their key ops replayed. The verify
+ * command still verifies all the blocks.
+ */
+
+// The config table keys
+const (
+	syncStateTargetHeightKey   = "sync_target_height"
+	syncStatePendingBlocksKey  = "sync_pending_blocks"
+	syncStateVerifiedHeightKey = "sync_verified_height"
+)
+
+// syncState is the saved state of the sync
+type syncState struct {
+	TargetHeight  int            // The best peer height at the time of saving
+	PendingBlocks map[int]string // The blocks being downloaded, by height
+}
+
+// Loads the saved sync state
+func (node *Node) dbLoadSyncState() (st syncState, err error) {
+	value, err := node.dbGetConfigValue(syncStateTargetHeightKey)
+	if err != nil || value == "" {
+		return
+	}
+	if st.TargetHeight, err = strconv.Atoi(value); err != nil {
+		return
+	}
+	if value, err = node.dbGetConfigValue(syncStatePendingBlocksKey); err != nil || value == "" {
+		return
+	}
+	err = json.Unmarshal([]byte(value), &st.PendingBlocks)
+	return
+}
+
+// Saves the sync state
+func (node *Node) dbSaveSyncState(st syncState) error {
+	if err := node.dbSetConfigValue(syncStateTargetHeightKey, strconv.Itoa(st.TargetHeight)); err != nil {
+		return err
+	}
+	return node.dbSetConfigValue(syncStatePendingBlocksKey, jsonifyWhatever(st.PendingBlocks))
+}
+
+// Returns the height up to which the blocks have been verified, or -1 if there is none
+func (node *Node) dbGetVerifiedHeight() (int, error) {
+	value, err := node.dbGetConfigValue(syncStateVerifiedHeightKey)
+	if err != nil || value == "" {
+		return -1, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Records the height up to which the blocks have been verified
+func (node *Node) dbSetVerifiedHeight(height int) error {
+	return node.dbSetConfigValue(syncStateVerifiedHeightKey, strconv.Itoa(height))
+}
+
+// Returns the blocks being downloaded, by height
+func (node *Node) p2pPendingBlocks() map[int]string {
+	result := map[int]string{}
+	node.p2pRequests.lock.With(func() {
+		for hash, req := range node.p2pRequests.blocks {
+			result[req.height] = hash
+		}
+	})
+	return result
+}
+
+// Loads the saved sync state into the coordinator. Called when the coordinator starts.
+func (co *p2pCoordinatorType) loadSyncState() {
+	st, err := co.node.dbLoadSyncState()
+	if err != nil {
+		p2pLog.Error("Cannot load the sync state:", err)
+		return
+	}
+	height, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot load the sync state:", err)
+		return
+	}
+	co.resumeBlocks = map[int]string{}
+	for h, hash := range st.PendingBlocks {
+		if h > height {
+			co.resumeBlocks[h] = hash
+		}
+	}
+	if st.TargetHeight > height {
+		p2pLog.Info("Resuming the sync to height", st.TargetHeight, "with", len(co.resumeBlocks), "blocks pending")
+	}
+	co.lastSyncState = jsonifyWhatever(st)
+	if co.lastVerifiedHeight, err = co.node.dbGetVerifiedHeight(); err != nil {
+		p2pLog.Error("Cannot load the verified height:", err)
+	}
+}
+
+// Saves the sync state, if it has changed. Called from the coordinator's time tick.
+func (co *p2pCoordinatorType) saveSyncState() {
+	height, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot save the sync state:", err)
+		return
+	}
+	_, bestPeerHeight := co.node.p2pPeers.Stats()
+	st := syncState{TargetHeight: bestPeerHeight, PendingBlocks: co.node.p2pPendingBlocks()}
+	// The blocks which haven't been requested again since the restart are still pending
+	for h, hash := range co.resumeBlocks {
+		if h > height {
+			st.PendingBlocks[h] = hash
+		}
+	}
+	if st.TargetHeight < height {
+		st.TargetHeight = height
+	}
+	if state := jsonifyWhatever(st); state != co.lastSyncState {
+		if err := co.node.dbSaveSyncState(st); err != nil {
+			p2pLog.Error("Cannot save the sync state:", err)
+			return
+		}
+		co.lastSyncState = state
+	}
+	// The blocks in the blockchain have been verified when they were accepted
+	if height != co.lastVerifiedHeight {
+		if err := co.node.dbSetVerifiedHeight(height); err != nil {
+			p2pLog.Error("Cannot save the verified height:", err)
+			return
+		}
+		co.lastVerifiedHeight = height
+	}
+}
+
+// Requests the saved pending blocks which the peer has, in the order of their heights. Returns
+// the height up to which all the blocks have been requested, or -1 if there are gaps between
+// the blockchain and the requested blocks, which the hashes have to be searched for.
+func (co *p2pCoordinatorType) resumeDownloads(p2pc *p2pConnection) int {
+	maxHeight := -1
+	height, err := co.node.dbGetBlockchainHeight()
+	if err != nil {
+		p2pLog.Error("Cannot resume the downloads:", err)
+		return maxHeight
+	}
+	next := height + 1
+	contiguous := true
+	heights := make([]int, 0, len(co.resumeBlocks))
+	for h := range co.resumeBlocks {
+		heights = append(heights, h)
+	}
+	sort.Ints(heights)
+	for _, h := range heights {
+		hash := co.resumeBlocks[h]
+		if h <= height {
+			delete(co.resumeBlocks, h)
+			continue
+		}
+		if h > p2pc.chainHeight {
+			continue
+		}
+		delete(co.resumeBlocks, h)
+		if h != next {
+			contiguous = false
+		}
+		next = h + 1
+		if !co.node.p2pBlockRequested(hash) && !p2pc.requestBlock(hash, h) {
+			return -1
+		}
+		maxHeight = h
+	}
+	if maxHeight < 0 {
+		return -1
+	}
+	p2pLog.Info("Resumed downloading blocks up to", maxHeight, "from", p2pc.address)
+	if !contiguous {
+		return -1
+	}
+	return maxHeight
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha256" // The hash functions of the TSA signatures
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+/*
+ * RFC 3161 timestamp attestation. With tsa_url in the configuration, the node asks the Time
+ * Stamping Authority for a timestamp token of the previous block's hash whenever it signs a
+ * block, and stores the token (base64-encoded DER) as PreviousBlockTimestampToken in the new
+ * block's _meta. The token can't be stored in the block it attests, as the block hash covers
+ * _meta, but this way each block's time is proven by the token in the next block, which is in
+ * turn covered by that block's signed hash. If the TSA can't be reached, the block is signed
+ * without the token.
+ *
+ * The tokens are verified with the blocks: the token must be for the previous block's hash,
+ * signed by the certificate it contains, and not dated after the block containing it. With
+ * tsa_roots, the TSA's certificate must also chain to one of the roots in that PEM file, which
+ * is checked by the policy stage of the block acceptance, not with the consensus rules, as the
+ * nodes can trust different TSAs. The
+ * blocktimestamp command prints a block's token, which third parties can decode and check with
+ * e.g. "openssl ts -verify -digest <block hash> -in token.der -token_in -CAfile tsa-roots.pem".
+ *
+ * Only the parts of the CMS SignedData structure which the TSAs use are supported.
+ */
+
+// The _meta key of the timestamp token of the previous block's hash
+const blockMetaTimestampToken = "PreviousBlockTimestampToken"
+
+// The maximum size of the base64-encoded token in _meta
+const tsaMaxTokenSize = 16384
+
+// How long to wait for the TSA
+const tsaTimeout = 30 * time.Second
+
+var (
+	oidSHA256         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSignedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidMessageDigest  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+)
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// TimeStampReq
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+// TimeStampResp
+type tsaResponse struct {
+	Status         tsaStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tsaStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// The TSA status values for a granted token
+const (
+	tsaStatusGranted         = 0
+	tsaStatusGrantedWithMods = 1
+)
+
+// The CMS ContentInfo of the token
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type tsaTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       tsaAccuracy   `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type tsaAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// tsaTimestamp is a verified timestamp token
+type tsaTimestamp struct {
+	Time   time.Time
+	TSA    string // The subject of the TSA's certificate
+	Serial string
+	Token  string              // Base64-encoded DER
+	certs  []*x509.Certificate // The TSA's certificate first
+}
+
+// Returns the hash function with the given OID
+func tsaHashFunc(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash algorithm %v", oid)
+}
+
+// Returns the signature algorithm of the certificate's key with the hash function
+func tsaSignatureAlgorithm(cert *x509.Certificate, h crypto.Hash) x509.SignatureAlgorithm {
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		return map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA256: x509.SHA256WithRSA, crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA}[h]
+	case x509.ECDSA:
+		return map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA256: x509.ECDSAWithSHA256, crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512}[h]
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// Asks the configured TSA for a timestamp token of the hex-encoded block hash, and returns it
+// base64-encoded
+func (node *Node) tsaRequestToken(hexHash string) (string, error) {
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return "", err
+	}
+	req, err := asn1.Marshal(tsaRequest{
+		Version:        1,
+		MessageImprint: tsaMessageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, HashedMessage: hash},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return "", err
+	}
+	client := http.Client{Timeout: tsaTimeout}
+	resp, err := client.Post(node.cfg.TSAURL, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the TSA has responded with %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, tsaMaxTokenSize))
+	if err != nil {
+		return "", err
+	}
+	var tr tsaResponse
+	if _, err = asn1.Unmarshal(data, &tr); err != nil {
+		return "", fmt.Errorf("cannot parse the TSA response: %v", err)
+	}
+	if tr.Status.Status != tsaStatusGranted && tr.Status.Status != tsaStatusGrantedWithMods {
+		return "", fmt.Errorf("the TSA has refused the request with status %d: %v", tr.Status.Status, tr.Status.StatusString)
+	}
+	info, _, err := tsaParseToken(tr.TimeStampToken.FullBytes)
+	if err != nil {
+		return "", err
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return "", fmt.Errorf("the TSA response doesn't have the nonce of the request")
+	}
+	token := base64.StdEncoding.EncodeToString(tr.TimeStampToken.FullBytes)
+	if len(token) > tsaMaxTokenSize {
+		return "", fmt.Errorf("the timestamp token is %d bytes, more than the maximum of %d", len(token), tsaMaxTokenSize)
+	}
+	ts, err := tsaVerifyToken(token, hexHash)
+	if err != nil {
+		return "", err
+	}
+	if err = ts.checkRoots(node); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Parses the token and verifies its signature, returning the timestamp info and the TSA's
+// certificate, with the other certificates in the token
+func tsaParseToken(der []byte) (*tsaTSTInfo, []*x509.Certificate, error) {
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the timestamp token: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, fmt.Errorf("the timestamp token isn't CMS signed data")
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the timestamp token's signed data: %v", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) || len(sd.SignerInfos) != 1 {
+		return nil, nil, fmt.Errorf("the timestamp token doesn't contain one signed timestamp")
+	}
+	var info tsaTSTInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the timestamp info: %v", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil || len(certs) == 0 {
+		return nil, nil, fmt.Errorf("the timestamp token doesn't contain the TSA's certificate")
+	}
+
+	// The signed attributes must contain the digest of the timestamp info, and are signed as
+	// a SET instead of the implicit [0] tag
+	si := sd.SignerInfos[0]
+	h, err := tsaHashFunc(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(si.SignedAttrs.FullBytes) == 0 {
+		return nil, nil, fmt.Errorf("the timestamp token has no signed attributes")
+	}
+	signedAttrs := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	var attrs []cmsAttribute
+	if _, err = asn1.UnmarshalWithParams(signedAttrs, &attrs, "set"); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the signed attributes: %v", err)
+	}
+	digester := h.New()
+	digester.Write(sd.EncapContentInfo.EContent)
+	var digest []byte
+	for _, attr := range attrs {
+		if attr.Type.Equal(oidMessageDigest) {
+			if _, err = asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+				return nil, nil, err
+			}
+		} else if attr.Type.Equal(oidAttContentType) {
+			var contentType asn1.ObjectIdentifier
+			if _, err = asn1.Unmarshal(attr.Values.Bytes, &contentType); err != nil || !contentType.Equal(oidTSTInfo) {
+				return nil, nil, fmt.Errorf("the signed content type isn't the timestamp info")
+			}
+		}
+	}
+	if !bytes.Equal(digest, digester.Sum(nil)) {
+		return nil, nil, fmt.Errorf("the timestamp info doesn't match the signed digest")
+	}
+	for i, cert := range certs {
+		if cert.CheckSignature(tsaSignatureAlgorithm(cert, h), signedAttrs, si.Signature) == nil {
+			certs[0], certs[i] = certs[i], certs[0]
+			return &info, certs, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("the timestamp token isn't signed by any of its certificates")
+}
+
+// Verifies the base64-encoded timestamp token of the hex-encoded block hash. The TSA's
+// certificate isn't checked against tsa_roots, see checkRoots().
+func tsaVerifyToken(token string, hexHash string) (*tsaTimestamp, error) {
+	der, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	info, certs, err := tsaParseToken(der)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil {
+		return nil, err
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, hash) {
+		return nil, fmt.Errorf("the timestamp token isn't for the hash %s", hexHash)
+	}
+	return &tsaTimestamp{Time: info.GenTime, TSA: certs[0].Subject.String(), Serial: info.SerialNumber.String(), Token: token, certs: certs}, nil
+}
+
+// Checks that the TSA's certificate chains to one of the roots in tsa_roots, if it's set
+func (ts *tsaTimestamp) checkRoots(node *Node) error {
+	if node.cfg.TSARoots == "" {
+		return nil
+	}
+	roots, err := node.tsaRoots()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range ts.certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = ts.certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   ts.Time,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return fmt.Errorf("the TSA's certificate %q isn't trusted: %v", ts.TSA, err)
+	}
+	return nil
+}
+
+// Returns the roots of the TSA certificates, from tsa_roots
+func (node *Node) tsaRoots() (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(node.cfg.TSARoots)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", node.cfg.TSARoots)
+	}
+	return pool, nil
+}
+
+// Returns the verified timestamp of the previous block from the block, or nil if it has none
+func (b *Block) tsaPreviousBlockTimestamp() (*tsaTimestamp, error) {
+	var count int
+	if err := b.queryRow("SELECT COUNT(*) FROM _meta WHERE key=?", blockMetaTimestampToken).Scan(&count); err != nil || count == 0 {
+		return nil, err
+	}
+	token, err := b.dbGetMetaString(blockMetaTimestampToken)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := tsaVerifyToken(token, b.PreviousBlockHash)
+	if err != nil {
+		return nil, fmt.Errorf("the timestamp token of the previous block is invalid: %v", err)
+	}
+	return ts, nil
+}
+
+// Verifies the timestamp token of the previous block in the block, if it has one. The token
+// must not be dated after the block itself. This is a consensus rule, so the TSA's certificate
+// isn't checked against the local tsa_roots, see tsaCheckPreviousBlockRoots().
+func (b *Block) tsaVerifyPreviousBlock() error {
+	ts, err := b.tsaPreviousBlockTimestamp()
+	if err != nil || ts == nil {
+		return err
+	}
+	if blockTime, err := b.dbGetMetaTime("Timestamp"); err == nil && ts.Time.After(blockTime.Add(blockMaxFutureDrift)) {
+		return fmt.Errorf("the timestamp token of the previous block is dated %v, after the block itself", ts.Time)
+	}
+	return nil
+}
+
+// Checks that the timestamp token of the previous block in the block, if it has one, is signed
+// by a TSA trusted with tsa_roots. This is a local policy, see blockStagePolicy().
+func (b *Block) tsaCheckPreviousBlockRoots(node *Node) error {
+	ts, err := b.tsaPreviousBlockTimestamp()
+	if err != nil || ts == nil {
+		return err
+	}
+	return ts.checkRoots(node)
+}
+
+// Prints the verified timestamp of the block at the given height, from the next block
+func (node *Node) actionBlockTimestamp(height int) {
+	dbb, err := node.dbGetBlockByHeight(height)
+	if err != nil {
+		log.Fatalln("Cannot get block", height, err)
+	}
+	next, err := node.OpenBlockByHeight(height + 1)
+	if err != nil {
+		log.Fatalln("The timestamp of a block is in the next block, and there's no block", height+1)
+	}
+	defer next.Close()
+	token, err := next.dbGetMetaString(blockMetaTimestampToken)
+	if err != nil {
+		log.Fatalln("Block", height, "has no timestamp token")
+	}
+	ts, err := tsaVerifyToken(token, dbb.Hash)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = ts.checkRoots(node); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(jsonifyWhatever(StrIfMap{"height": height, "hash": dbb.Hash, "time": ts.Time, "tsa": ts.TSA, "serial": ts.Serial, "token": ts.Token}))
+}
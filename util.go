@@ -390,21 +390,3 @@ func copyFile(src, dst string) error {
 	}
 	return out.Close()
 }
-
-func countStartZeroBits(b []byte) int {
-	nBits := 0
-	for i := 0; i < len(b); i++ {
-		if b[i] == 0 {
-			nBits += 8
-		} else {
-			for z := uint(7); z >= 0; z-- {
-				if b[i]&(1<<z) == 0 {
-					nBits++
-				} else {
-					break
-				}
-			}
-		}
-	}
-	return nBits
-}
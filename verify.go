@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// verifyReport is the result of the verify command, written as JSON with -report
+type verifyReport struct {
+	Time         time.Time          `json:"time"`
+	FromHeight   int                `json:"from_height"`
+	ToHeight     int                `json:"to_height"`
+	ChainHeight  int                `json:"chain_height"`
+	BlocksTested int                `json:"blocks_tested"`
+	Duration     string             `json:"duration"`
+	OK           bool               `json:"ok"`
+	Errors       []blockVerifyError `json:"errors"`
+}
+
+// Verifies the blocks selected with -from and -to, without starting the node, and exits with
+// a non-zero status if there are errors. With -report, the result is also written as JSON.
+func (node *Node) actionVerify() {
+	node.dbInit()
+	node.blockchainLoad(false)
+	chainHeight, err := node.dbGetBlockchainHeight()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if chainHeight < 0 {
+		log.Fatalln("There is no blockchain in", node.cfg.DataDir)
+	}
+	from, to := node.cfg.queryFrom, node.cfg.queryTo
+	if from < 0 {
+		from = 0
+	}
+	if to <= 0 || to > chainHeight {
+		to = chainHeight
+	}
+	if from > to {
+		log.Fatalln("No blocks between the heights", from, "and", to)
+	}
+
+	log.Println("Verifying the blocks from", from, "to", to)
+	start := time.Now()
+	errs := node.blockchainVerifyBlocks(from, to)
+	report := verifyReport{
+		Time:         start.UTC(),
+		FromHeight:   from,
+		ToHeight:     to,
+		ChainHeight:  chainHeight,
+		BlocksTested: to - from + 1,
+		Duration:     time.Since(start).Round(time.Millisecond).String(),
+		OK:           len(errs) == 0,
+		Errors:       errs,
+	}
+	if report.Errors == nil {
+		report.Errors = []blockVerifyError{}
+	}
+	for _, e := range errs {
+		log.Printf("block %d: %s", e.Height, e.Error)
+	}
+	if node.cfg.verifyReport != "" {
+		if err := ioutil.WriteFile(node.cfg.verifyReport, jsonifyWhateverToBytes(report), 0644); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if !report.OK {
+		log.Println("Verification failed with", len(errs), "errors")
+		os.Exit(1)
+	}
+	log.Println("Verified", report.BlocksTested, "blocks in", report.Duration, "- no errors found")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+ * Webhooks. The node POSTs the events selected with webhook_events (or all of them) as JSON,
+ * in the same format as on the /ws WebSocket, to each of the URLs listed in webhooks. The
+ * events are delivered in order, one at a time, and a failed delivery is logged and not
+ * retried. The webhooks are outside the node, so like the remote WebSocket clients they don't
+ * get the events revealing the node's peers.
+ */
+
+const webhookTimeout = 10 * time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Subscribes the configured webhooks to the event bus
+func (node *Node) webhooksStart() {
+	for _, url := range node.cfg.Webhooks {
+		url := url
+		node.nodeEvents.HandleRemote("webhook "+url, node.cfg.WebhookEvents, func(ev nodeEvent) {
+			if err := webhookPost(url, ev); err != nil {
+				chainLog.Warn("Cannot deliver", ev.Event, "to webhook", url, err)
+			}
+		})
+	}
+}
+
+// Posts the event to the webhook
+func webhookPost(url string, ev nodeEvent) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(jsonifyWhateverToBytes(ev)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * A minimal server side implementation of the WebSocket protocol (RFC 6455), sufficient for
+ * pushing events to clients: text messages are sent, and the messages received from the
+ * client are read only to answer pings and notice the connection closing.
+ */
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	websocketOpText  = 0x1
+	websocketOpClose = 0x8
+	websocketOpPing  = 0x9
+	websocketOpPong  = 0xa
+)
+
+// The largest control or client message accepted
+const websocketMaxReadSize = 4096
+
+// How often pings are sent to keep the connection alive
+const websocketPingInterval = 30 * time.Second
+
+// websocketConn is an upgraded WebSocket connection
+type websocketConn struct {
+	conn      net.Conn
+	rw        *bufio.ReadWriter
+	writeLock WithMutex
+}
+
+// Performs the WebSocket handshake and takes over the HTTP connection
+func websocketUpgrade(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a WebSocket request")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported WebSocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cannot upgrade the connection", http.StatusInternalServerError)
+		return nil, fmt.Errorf("the connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, rw: rw}, nil
+}
+
+// Sends a single unfragmented frame. Server frames are not masked.
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) (err error) {
+	ws.writeLock.With(func() {
+		header := []byte{0x80 | opcode, 0}
+		switch n := len(payload); {
+		case n < 126:
+			header[1] = byte(n)
+		case n <= 0xffff:
+			header[1] = 126
+			header = append(header, 0, 0)
+			binary.BigEndian.PutUint16(header[2:], uint16(n))
+		default:
+			header[1] = 127
+			header = append(header, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(header[2:], uint64(n))
+		}
+		ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err = ws.rw.Write(header); err != nil {
+			return
+		}
+		if _, err = ws.rw.Write(payload); err != nil {
+			return
+		}
+		err = ws.rw.Flush()
+	})
+	return
+}
+
+// Sends a text message
+func (ws *websocketConn) WriteText(data []byte) error {
+	return ws.writeFrame(websocketOpText, data)
+}
+
+// Reads and discards client messages, answering pings, until the connection is closed
+func (ws *websocketConn) readLoop() {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(ws.rw, header); err != nil {
+			return
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(ws.rw, ext); err != nil {
+				return
+			}
+			size = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(ws.rw, ext); err != nil {
+				return
+			}
+			size = binary.BigEndian.Uint64(ext)
+		}
+		if size > websocketMaxReadSize {
+			ws.writeFrame(websocketOpClose, []byte{0x03, 0xf1}) // 1009: message too big
+			return
+		}
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+				return
+			}
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(ws.rw, payload); err != nil {
+			return
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case websocketOpClose:
+			ws.writeFrame(websocketOpClose, payload)
+			return
+		case websocketOpPing:
+			if err := ws.writeFrame(websocketOpPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Closes the connection
+func (ws *websocketConn) Close() error {
+	return ws.conn.Close()
+}
+
+// Handles the /ws URL: pushes node events as JSON text messages. The events can be selected
+// with the events query parameter, e.g. /ws?events=block_accepted,block_rejected
+func (node *Node) blockWebEvents(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocketUpgrade(w, r)
+	if err != nil {
+		log.Println("WebSocket:", err)
+		return
+	}
+	defer ws.Close()
+	var events []string
+	if e := r.URL.Query().Get("events"); e != "" {
+		events = strings.Split(e, ",")
+	}
+	sub := node.nodeEvents.Subscribe(events, isLoopbackRequest(r))
+	defer node.nodeEvents.Unsubscribe(sub)
+	log.Println("WebSocket event subscriber connected from", r.RemoteAddr)
+
+	closed := make(chan struct{})
+	go func() {
+		ws.readLoop()
+		close(closed)
+	}()
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-sub.events:
+			if err = ws.WriteText(jsonifyWhateverToBytes(ev)); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err = ws.writeFrame(websocketOpPing, nil); err != nil {
+				return
+			}
+		case <-closed:
+			log.Println("WebSocket event subscriber disconnected from", r.RemoteAddr)
+			return
+		}
+	}
+}